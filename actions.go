@@ -0,0 +1,127 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+)
+
+// the things a logged in user can actually do, as opposed to the pages that just show stuff
+// every one of these is a form POST that redirects back to a page afterwards
+
+// wraps a user action, handling login and turning errors into a 400
+func userAction(w http.ResponseWriter, r *http.Request, redirect string, action func(user *User) error) {
+	user := getUser(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to do that", http.StatusForbidden)
+		return
+	}
+	err := action(user)
+	if err != nil {
+		requestLogger(r, httpLog).Info("User action failed", "user", user.UserID, "path", r.URL.Path, "err", err)
+		http.Error(w, "Unable to do that. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func formInt(r *http.Request, field string) (int, error) {
+	return strconv.Atoi(r.FormValue(field))
+}
+
+func handleDeposit(w http.ResponseWriter, r *http.Request) {
+	listingIdStr := r.URL.Query().Get(":listing")
+	userAction(w, r, "/trade/"+listingIdStr, func(user *User) error {
+		listing_id, err := strconv.ParseInt(listingIdStr, 10, 64)
+		if err != nil {
+			return err
+		}
+		listing := getListingById(listing_id)
+		if listing == nil {
+			return ErrNoRows
+		}
+		deposit_id, err := createPendingDeposit(r.Context(), user.UserID, listing_id)
+		if err != nil {
+			return err
+		}
+		message := "To deposit a shulker of `" + listing.ItemName + "` on `" + listing.Server + "`, rename it to `" + depositIDToName(uint32(deposit_id)) + "` in an anvil, then throw it to one of our bots.\n"
+		message += "This deposit expires in " + strconv.FormatInt(config.DepositTimeoutSeconds/60, 10) + " minutes."
+		go user.DM(message)
+		return nil
+	})
+}
+
+func handleBuy(w http.ResponseWriter, r *http.Request) {
+	listingIdStr := r.URL.Query().Get(":listing")
+	userAction(w, r, "/trade/"+listingIdStr, func(user *User) error {
+		listing_id, err := strconv.ParseInt(listingIdStr, 10, 64)
+		if err != nil {
+			return err
+		}
+		price, err := formInt(r, "price")
+		if err != nil {
+			return err
+		}
+		quantity, err := formInt(r, "quantity")
+		if err != nil {
+			return err
+		}
+		return RunSQLContext(r.Context(), func(sql *sql.Tx) error {
+			return createBuyOrder(sql, user.UserID, listing_id, price, quantity)
+		})
+	})
+}
+
+func handleSell(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, "/dashboard", func(user *User) error {
+		slot_index, err := strconv.Atoi(r.URL.Query().Get(":slot"))
+		if err != nil {
+			return err
+		}
+		price, err := formInt(r, "price")
+		if err != nil {
+			return err
+		}
+		return RunSQLContext(r.Context(), func(sql *sql.Tx) error {
+			return createSellOrder(sql, user.UserID, slot_index, price)
+		})
+	})
+}
+
+func handleCancelSell(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, "/dashboard", func(user *User) error {
+		slot_index, err := strconv.Atoi(r.URL.Query().Get(":slot"))
+		if err != nil {
+			return err
+		}
+		return cancelSell(r.Context(), user.UserID, slot_index)
+	})
+}
+
+func handleWithdraw(w http.ResponseWriter, r *http.Request) {
+	userAction(w, r, "/dashboard", func(user *User) error {
+		slot_index, err := strconv.Atoi(r.URL.Query().Get(":slot"))
+		if err != nil {
+			return err
+		}
+		code, err := createWithdrawal(r.Context(), user.UserID, slot_index)
+		if err != nil {
+			return err
+		}
+		message := "Your withdrawal code for slot `#" + strconv.Itoa(slot_index) + "` is `" + formatWithdrawalCode(code) + "`.\n"
+		message += "Go stand near the bot, then confirm it on the site, and it'll drop your item. It expires in " + strconv.FormatInt(config.WithdrawalTimeoutSeconds/60, 10) + " minutes."
+		go user.DM(message)
+		return nil
+	})
+}
+
+// anyone with the code can confirm it, same as whispering it to the bot
+func handleConfirmWithdrawal(w http.ResponseWriter, r *http.Request) {
+	code, err := parseWithdrawalCode(r.FormValue("code"))
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusBadRequest)
+		return
+	}
+	botReceivesWithdrawalCode(code)
+	http.Redirect(w, r, "/dashboard", http.StatusFound)
+}
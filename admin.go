@@ -0,0 +1,179 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the people who run the exchange get DMed about anything that needs a human to look at it
+// their discord ids are admin_discord_ids in the config
+
+func DMadmins(message string) {
+	ids := config.AdminDiscordIDs
+	if len(ids) == 0 {
+		adminLog.Warn("No admins configured to receive the message", "message", message)
+		return
+	}
+	for _, id := range ids {
+		err := DMuser(id, message)
+		if err != nil {
+			adminLog.Warn("Unable to DM admin", "admin", id, "err", err)
+		}
+	}
+}
+
+func isAdmin(user_id int64) bool {
+	for _, id := range config.AdminDiscordIDs {
+		if id == user_id {
+			return true
+		}
+	}
+	return false
+}
+
+// like getUser, but returns nil unless the logged in user is an admin
+func getAdmin(req *http.Request) *User {
+	user := getUser(req)
+	if user == nil || !isAdmin(user.UserID) {
+		return nil
+	}
+	return user
+}
+
+// every admin action below does its thing and writes to admin_audit_log in the same transaction
+// so either both happen or neither does
+
+func writeAdminLog(sql *sql.Tx, admin_id int64, action string, user_id int64, detail string, reason string) error {
+	if strings.TrimSpace(reason) == "" {
+		return errors.New("You must give a reason")
+	}
+	var target interface{} // NULL if it isn't about one user
+	if user_id != 0 {
+		target = user_id
+	}
+	adminLog.Info("Admin action", "admin", admin_id, "action", action, "user", user_id, "detail", detail, "reason", reason)
+	_, err := sql.Exec("INSERT INTO admin_audit_log (admin_id, action, user_id, detail, reason) VALUES (?, ?, ?, ?, ?)", admin_id, action, target, detail, reason)
+	return err
+}
+
+func adminAdjustBalance(ctx context.Context, admin_id int64, user_id int64, amount int64, reason string) error {
+	if amount == 0 {
+		return errors.New("Adjusting a balance by 0 doesn't do anything")
+	}
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		res, err := sql.Exec("UPDATE users SET balance = balance + ? WHERE user_id = ?", amount, user_id) // the CHECK on balance stops this from going negative
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.New("No such user")
+		}
+		return writeAdminLog(sql, admin_id, "adjust_balance", user_id, "balance adjusted by "+strconv.FormatInt(amount, 10)+Currency, reason)
+	})
+	if err != nil {
+		return err
+	}
+	go DMuser(user_id, "An admin adjusted your balance by "+strconv.FormatInt(amount, 10)+Currency+". Reason: "+reason)
+	return nil
+}
+
+func adminCancelBuy(ctx context.Context, admin_id int64, user_id int64, listing_id int64, price int, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		// cancelBuy is happy to cancel nothing, but the audit log shouldn't say an admin did something they didn't
+		var orders int
+		err := sql.QueryRow("SELECT COUNT(*) FROM listing_buy_orders WHERE user_id = ? AND listing_id = ? AND price = ?", user_id, listing_id, price).Scan(&orders)
+		if err != nil {
+			return err
+		}
+		if orders == 0 {
+			return errors.New("No such order")
+		}
+		err = cancelBuy(sql, user_id, listing_id, price)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "cancel_buy", user_id, "cancelled buy order in listing "+strconv.FormatInt(listing_id, 10)+" at "+strconv.Itoa(price)+Currency+" each", reason)
+	})
+}
+
+func adminCancelSell(ctx context.Context, admin_id int64, user_id int64, slot_index int, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var orders int
+		err := sql.QueryRow("SELECT COUNT(*) FROM slots WHERE user_id = ? AND slot_index = ? AND sale_price IS NOT NULL", user_id, slot_index).Scan(&orders)
+		if err != nil {
+			return err
+		}
+		if orders == 0 {
+			return errors.New("No such order")
+		}
+		err = cancelSale(sql, user_id, slot_index)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "cancel_sell", user_id, "cancelled sell order of slot #"+strconv.Itoa(slot_index), reason)
+	})
+}
+
+// unlock a slot that's locked for force selling or stuck in a withdrawal, and give it a fresh day before it expires again
+func adminReleaseSlot(ctx context.Context, admin_id int64, user_id int64, slot_index int, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var locked int
+		var withdrawal_code int64
+		err := sql.QueryRow("SELECT locked, COALESCE(withdrawal_code, 0) FROM slots WHERE user_id = ? AND slot_index = ?", user_id, slot_index).Scan(&locked, &withdrawal_code)
+		if err != nil {
+			return err
+		}
+		if locked == 0 {
+			return errors.New("That slot isn't locked")
+		}
+		if locked == 2 {
+			err = expireWithdrawal(sql, withdrawal_code)
+			if err != nil {
+				return err
+			}
+		}
+		_, err = sql.Exec("UPDATE slots SET locked = 0, sale_price = NULL, for_sale_since = NULL, expiry_time = ? WHERE user_id = ? AND slot_index = ?", unixNow()+config.SlotLifetimeSeconds, user_id, slot_index)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "release_slot", user_id, "released slot #"+strconv.Itoa(slot_index)+" from lock "+strconv.Itoa(locked), reason)
+	})
+}
+
+func adminExpireDeposit(ctx context.Context, admin_id int64, deposit_id int64, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var user_id int64
+		err := sql.QueryRow("SELECT user_id FROM pending_deposits WHERE deposit_id = ?", deposit_id).Scan(&user_id)
+		if err != nil {
+			return err
+		}
+		_, err = sql.Exec("DELETE FROM pending_deposits WHERE deposit_id = ?", deposit_id)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "expire_deposit", user_id, "expired pending deposit "+strconv.FormatInt(deposit_id, 10), reason)
+	})
+}
+
+func adminExpireWithdrawal(ctx context.Context, admin_id int64, withdrawal_code int64, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var user_id int64
+		err := sql.QueryRow("SELECT user_id FROM slots WHERE withdrawal_code = ?", withdrawal_code).Scan(&user_id)
+		if err != nil {
+			return err
+		}
+		err = expireWithdrawal(sql, withdrawal_code)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "expire_withdrawal", user_id, "expired pending withdrawal "+strconv.FormatInt(withdrawal_code, 10), reason)
+	})
+}
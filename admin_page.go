@@ -0,0 +1,530 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strconv"
+	"time"
+
+	"github.com/gorilla/pat"
+)
+
+type AdminUser struct {
+	UserID     int64
+	Balance    int64
+	MaxSlots   int
+	UsedSlots  int
+	CreatedAt  int64
+	Suspension *Suspension // nil if they aren't suspended
+}
+
+type AdminSlot struct {
+	SlotIndex      int
+	ListingID      int64
+	ItemName       string
+	ExpiryTime     int64
+	Renewals       int
+	SalePrice      int64 // -1 if not for sale
+	Locked         int
+	WithdrawalCode int64 // 0 if not being withdrawn
+}
+
+type AdminBuyOrder struct {
+	ListingID int64
+	ItemName  string
+	Quantity  int
+	Price     int
+}
+
+type AdminDeposit struct {
+	DepositID  int64
+	ListingID  int64
+	ItemName   string
+	ExpiryTime int64
+	PickedUpAt int64 // 0 if never picked up
+}
+
+type AdminLogEntry struct {
+	AdminID   int64
+	Action    string
+	UserID    int64 // 0 if it wasn't about one user
+	Detail    string
+	Reason    string
+	CreatedAt int64
+}
+
+type ListingFreeze struct {
+	ListingID int64
+	ItemName  string
+	BotUUID   string
+	Reason    string
+	FrozenAt  int64
+}
+
+type AdminListing struct {
+	Listing
+	Retired   bool
+	Frozen    bool
+	Held      int    // how many slots have this
+	Stored    int    // how many are in our echests
+	BuyOrders int    // how many are wanted by open buy orders
+	Template  string // ShulkerTemplate JSON, empty if it's an exact item_key listing
+}
+
+type AdminListingsPageTemplate struct {
+	Profile  *User
+	Servers  []Server
+	Listings []AdminListing
+}
+
+type AdminPageTemplate struct {
+	Profile     *User
+	Query       string
+	Users       []AdminUser
+	BotStatuses []BotStatus
+	BotAlerts   []BotAlert
+	Freezes     []ListingFreeze
+	Suspended   []SuspendedUser
+	Log         []AdminLogEntry
+	Database    AdminDatabaseStats
+	LogLevels   []ComponentLevel
+	LevelNames  []string
+}
+
+type AdminDatabaseStats struct {
+	QueueDepth    int64
+	RunningCaller string // "" if the writer is idle
+	RunningFor    time.Duration
+	Buckets       []string
+	Latencies     []QueryLatency
+}
+
+type AdminUserPageTemplate struct {
+	Profile   *User
+	User      AdminUser
+	Slots     []AdminSlot
+	BuyOrders []AdminBuyOrder
+	Deposits  []AdminDeposit
+	Sessions  []Session
+	Log       []AdminLogEntry
+}
+
+func setupAdmin(p *pat.Router) {
+	// pat matches by prefix, so the longer routes have to come first
+	p.Get("/admin/health", rateLimited(RateClassAdmin, handleAdminHealth))
+	p.Get("/admin/user/{user}", rateLimited(RateClassAdmin, handleAdminUserPage))
+	p.Post("/admin/bot/{uuid}/safety", rateLimited(RateClassAdmin, handleAdminSetSafetyRules))
+	p.Get("/admin/bot/{uuid}", rateLimited(RateClassAdmin, handleAdminBotPage))
+	p.Post("/admin/user/{user}/balance", rateLimited(RateClassAdmin, handleAdminAdjustBalance))
+	p.Post("/admin/user/{user}/cancelbuy", rateLimited(RateClassAdmin, handleAdminCancelBuy))
+	p.Post("/admin/user/{user}/cancelsell", rateLimited(RateClassAdmin, handleAdminCancelSell))
+	p.Post("/admin/user/{user}/release", rateLimited(RateClassAdmin, handleAdminReleaseSlot))
+	p.Post("/admin/user/{user}/sessions/revoke", rateLimited(RateClassAdmin, handleAdminRevokeSessions))
+	p.Post("/admin/user/{user}/suspend", rateLimited(RateClassAdmin, handleAdminSuspendUser))
+	p.Post("/admin/user/{user}/unsuspend", rateLimited(RateClassAdmin, handleAdminUnsuspendUser))
+	p.Post("/admin/deposit/{deposit}/expire", rateLimited(RateClassAdmin, handleAdminExpireDeposit))
+	p.Post("/admin/withdrawal/{withdrawal}/expire", rateLimited(RateClassAdmin, handleAdminExpireWithdrawal))
+	p.Post("/admin/listings/{listing}/edit", rateLimited(RateClassAdmin, handleAdminEditListing))
+	p.Post("/admin/listings/{listing}/retire", rateLimited(RateClassAdmin, handleAdminRetireListing))
+	p.Post("/admin/listings/{listing}/unfreeze", rateLimited(RateClassAdmin, handleAdminUnfreezeListing))
+	p.Post("/admin/listings", rateLimited(RateClassAdmin, handleAdminCreateListing))
+	p.Post("/admin/servers/{server}/enable", rateLimited(RateClassAdmin, handleAdminEnableServer))
+	p.Post("/admin/servers", rateLimited(RateClassAdmin, handleAdminCreateServer))
+	p.Get("/admin/listings", rateLimited(RateClassAdmin, handleAdminListingsPage))
+	p.Post("/admin/jobs/run", rateLimited(RateClassAdmin, handleAdminRunJob))
+	p.Post("/admin/loglevel", rateLimited(RateClassAdmin, handleAdminSetLogLevel))
+	p.Get("/admin/jobs", rateLimited(RateClassAdmin, handleAdminJobsPage))
+	p.Get("/admin", rateLimited(RateClassAdmin, handleAdminPage))
+}
+
+func searchUsers(sql *sql.Tx, query string) ([]AdminUser, error) {
+	// users are only identified by discord id, so searching is by the start of that
+	rows, err := sql.Query(`SELECT users.user_id, users.balance, users.max_slots, users.created_at, COUNT(slots.user_id) FROM users
+		LEFT OUTER JOIN slots ON slots.user_id = users.user_id
+		WHERE CAST(users.user_id AS TEXT) LIKE ? || '%'
+		GROUP BY users.user_id ORDER BY users.created_at DESC LIMIT 50`, query)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]AdminUser, 0)
+	for rows.Next() {
+		var user AdminUser
+		err = rows.Scan(&user.UserID, &user.Balance, &user.MaxSlots, &user.CreatedAt, &user.UsedSlots)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, user)
+	}
+	return result, rows.Err()
+}
+
+// user_id of 0 means everyone
+func getAdminLog(sql *sql.Tx, user_id int64) ([]AdminLogEntry, error) {
+	rows, err := sql.Query("SELECT admin_id, action, COALESCE(user_id, 0), detail, reason, created_at FROM admin_audit_log WHERE ? = 0 OR user_id = ? ORDER BY log_id DESC LIMIT 100", user_id, user_id)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]AdminLogEntry, 0)
+	for rows.Next() {
+		var entry AdminLogEntry
+		err = rows.Scan(&entry.AdminID, &entry.Action, &entry.UserID, &entry.Detail, &entry.Reason, &entry.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, entry)
+	}
+	return result, rows.Err()
+}
+
+func getListingFreezes(sql *sql.Tx) ([]ListingFreeze, error) {
+	rows, err := sql.Query("SELECT listing_freezes.listing_id, listings.item_name, listing_freezes.bot_uuid, listing_freezes.reason, listing_freezes.frozen_at FROM listing_freezes INNER JOIN listings ON listings.listing_id = listing_freezes.listing_id ORDER BY listing_freezes.frozen_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]ListingFreeze, 0)
+	for rows.Next() {
+		var freeze ListingFreeze
+		err = rows.Scan(&freeze.ListingID, &freeze.ItemName, &freeze.BotUUID, &freeze.Reason, &freeze.FrozenAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, freeze)
+	}
+	return result, rows.Err()
+}
+
+func handleAdminPage(w http.ResponseWriter, r *http.Request) {
+	admin := getAdmin(r)
+	if admin == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	data := &AdminPageTemplate{
+		Profile:     admin,
+		Query:       r.URL.Query().Get("q"),
+		BotStatuses: GetBotStatuses(),
+		LogLevels:   getLogLevels(),
+		LevelNames:  levelNames,
+	}
+	data.Database.QueueDepth = getWriteQueueDepth()
+	data.Database.RunningCaller, data.Database.RunningFor = getRunningQuery()
+	data.Database.Buckets = queryWaitBucketNames()
+	data.Database.Latencies = getQueryLatencies()
+	err := RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
+		var err error
+		data.Users, err = searchUsers(sql, data.Query)
+		if err != nil {
+			return err
+		}
+		data.Freezes, err = getListingFreezes(sql)
+		if err != nil {
+			return err
+		}
+		data.Suspended, err = getSuspendedUsers(sql)
+		if err != nil {
+			return err
+		}
+		data.BotAlerts, err = getBotAlerts(sql, "", time.Now().Unix()-24*60*60)
+		if err != nil {
+			return err
+		}
+		data.Log, err = getAdminLog(sql, 0)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Unable to load admin page. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = templates.ExecuteTemplate(w, "admin.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the admin page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleAdminUserPage(w http.ResponseWriter, r *http.Request) {
+	admin := getAdmin(r)
+	if admin == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	user_id, err := strconv.ParseInt(r.URL.Query().Get(":user"), 10, 64)
+	if err != nil {
+		http.Error(w, "Invalid user "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	data := &AdminUserPageTemplate{
+		Profile: admin,
+	}
+	err = RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
+		err := sql.QueryRow("SELECT user_id, balance, max_slots, created_at FROM users WHERE user_id = ?", user_id).Scan(&data.User.UserID, &data.User.Balance, &data.User.MaxSlots, &data.User.CreatedAt)
+		if err != nil {
+			return err
+		}
+
+		rows, err := sql.Query("SELECT slots.slot_index, slots.listing_id, listings.item_name, slots.expiry_time, slots.renewals, COALESCE(slots.sale_price, -1), slots.locked, COALESCE(slots.withdrawal_code, 0) FROM slots INNER JOIN listings ON listings.listing_id = slots.listing_id WHERE slots.user_id = ? ORDER BY slots.slot_index", user_id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var slot AdminSlot
+			err = rows.Scan(&slot.SlotIndex, &slot.ListingID, &slot.ItemName, &slot.ExpiryTime, &slot.Renewals, &slot.SalePrice, &slot.Locked, &slot.WithdrawalCode)
+			if err != nil {
+				return err
+			}
+			data.Slots = append(data.Slots, slot)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+		data.User.UsedSlots = len(data.Slots)
+
+		data.User.Suspension, err = getSuspension(sql, user_id)
+		if err != nil {
+			return err
+		}
+
+		rows, err = sql.Query("SELECT listing_buy_orders.listing_id, listings.item_name, listing_buy_orders.quantity, listing_buy_orders.price FROM listing_buy_orders INNER JOIN listings ON listings.listing_id = listing_buy_orders.listing_id WHERE listing_buy_orders.user_id = ? ORDER BY listing_buy_orders.created_at", user_id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var order AdminBuyOrder
+			err = rows.Scan(&order.ListingID, &order.ItemName, &order.Quantity, &order.Price)
+			if err != nil {
+				return err
+			}
+			data.BuyOrders = append(data.BuyOrders, order)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		rows, err = sql.Query("SELECT pending_deposits.deposit_id, pending_deposits.listing_id, listings.item_name, pending_deposits.expiry_time, COALESCE(pending_deposits.picked_up_at, 0) FROM pending_deposits INNER JOIN listings ON listings.listing_id = pending_deposits.listing_id WHERE pending_deposits.user_id = ? ORDER BY pending_deposits.expiry_time", user_id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var deposit AdminDeposit
+			err = rows.Scan(&deposit.DepositID, &deposit.ListingID, &deposit.ItemName, &deposit.ExpiryTime, &deposit.PickedUpAt)
+			if err != nil {
+				return err
+			}
+			data.Deposits = append(data.Deposits, deposit)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		data.Sessions, err = getSessions(sql, user_id)
+		if err != nil {
+			return err
+		}
+
+		data.Log, err = getAdminLog(sql, user_id)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Unable to load user. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = templates.ExecuteTemplate(w, "admin_user.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the admin user page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// the admin POST handlers all look the same: check they're an admin, parse the form, do the thing, go back to the user's page
+func adminAction(w http.ResponseWriter, r *http.Request, action func(admin *User, user_id int64, reason string) error) {
+	user_id, _ := strconv.ParseInt(r.URL.Query().Get(":user"), 10, 64) // 0 for the routes that aren't about one user
+	redirect := "/admin"
+	if user_id != 0 {
+		redirect = "/admin/user/" + strconv.FormatInt(user_id, 10)
+	}
+	adminActionThen(w, r, redirect, func(admin *User, reason string) error {
+		return action(admin, user_id, reason)
+	})
+}
+
+func adminActionThen(w http.ResponseWriter, r *http.Request, redirect string, action func(admin *User, reason string) error) {
+	admin := getAdmin(r)
+	if admin == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	err := action(admin, r.FormValue("reason"))
+	if err != nil {
+		requestLogger(r, adminLog).Warn("Admin action failed", "admin", admin.UserID, "path", r.URL.Path, "err", err)
+		http.Error(w, "Unable to do that. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	http.Redirect(w, r, redirect, http.StatusFound)
+}
+
+func handleAdminAdjustBalance(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		amount, err := strconv.ParseInt(r.FormValue("amount"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return adminAdjustBalance(r.Context(), admin.UserID, user_id, amount, reason)
+	})
+}
+
+func handleAdminCancelBuy(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		listing_id, err := strconv.ParseInt(r.FormValue("listing"), 10, 64)
+		if err != nil {
+			return err
+		}
+		price, err := strconv.Atoi(r.FormValue("price"))
+		if err != nil {
+			return err
+		}
+		return adminCancelBuy(r.Context(), admin.UserID, user_id, listing_id, price, reason)
+	})
+}
+
+func handleAdminCancelSell(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		slot_index, err := strconv.Atoi(r.FormValue("slot"))
+		if err != nil {
+			return err
+		}
+		return adminCancelSell(r.Context(), admin.UserID, user_id, slot_index, reason)
+	})
+}
+
+func handleAdminReleaseSlot(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		slot_index, err := strconv.Atoi(r.FormValue("slot"))
+		if err != nil {
+			return err
+		}
+		return adminReleaseSlot(r.Context(), admin.UserID, user_id, slot_index, reason)
+	})
+}
+
+func handleAdminExpireDeposit(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, _ int64, reason string) error {
+		deposit_id, err := strconv.ParseInt(r.URL.Query().Get(":deposit"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return adminExpireDeposit(r.Context(), admin.UserID, deposit_id, reason)
+	})
+}
+
+func handleAdminExpireWithdrawal(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, _ int64, reason string) error {
+		withdrawal_code, err := strconv.ParseInt(r.URL.Query().Get(":withdrawal"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return adminExpireWithdrawal(r.Context(), admin.UserID, withdrawal_code, reason)
+	})
+}
+
+func handleAdminListingsPage(w http.ResponseWriter, r *http.Request) {
+	admin := getAdmin(r)
+	if admin == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	data := &AdminListingsPageTemplate{
+		Profile: admin,
+	}
+	err := RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
+		var err error
+		data.Servers, err = getServers(sql)
+		if err != nil {
+			return err
+		}
+		rows, err := sql.Query(`SELECT listings.listing_id, listings.server, listings.item_key, listings.item_name, listings.item_photo,
+				EXISTS(SELECT 1 FROM listing_retirements WHERE listing_retirements.listing_id = listings.listing_id),
+				EXISTS(SELECT 1 FROM listing_freezes WHERE listing_freezes.listing_id = listings.listing_id),
+				(SELECT COUNT(*) FROM slots WHERE slots.listing_id = listings.listing_id),
+				(SELECT COUNT(*) FROM inventory WHERE inventory.listing_id = listings.listing_id),
+				(SELECT COALESCE(SUM(quantity), 0) FROM listing_buy_orders WHERE listing_buy_orders.listing_id = listings.listing_id),
+				COALESCE((SELECT template FROM listing_templates WHERE listing_templates.listing_id = listings.listing_id), '')
+			FROM listings ORDER BY listings.server, listings.listing_id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var listing AdminListing
+			err = rows.Scan(&listing.ListingID, &listing.Server, &listing.ItemKey, &listing.ItemName, &listing.ItemPhoto, &listing.Retired, &listing.Frozen, &listing.Held, &listing.Stored, &listing.BuyOrders, &listing.Template)
+			if err != nil {
+				return err
+			}
+			data.Listings = append(data.Listings, listing)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		http.Error(w, "Unable to load listings. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = templates.ExecuteTemplate(w, "admin_listings.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the admin listings page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleAdminCreateListing(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin/listings", func(admin *User, reason string) error {
+		_, err := createListing(r.Context(), admin.UserID, r.FormValue("server"), r.FormValue("item_key"), r.FormValue("item_name"), r.FormValue("item_photo"), r.FormValue("template"), reason)
+		return err
+	})
+}
+
+func handleAdminEditListing(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin/listings", func(admin *User, reason string) error {
+		listing_id, err := strconv.ParseInt(r.URL.Query().Get(":listing"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return editListing(r.Context(), admin.UserID, listing_id, r.FormValue("item_name"), r.FormValue("item_photo"), reason)
+	})
+}
+
+func handleAdminRetireListing(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin/listings", func(admin *User, reason string) error {
+		listing_id, err := strconv.ParseInt(r.URL.Query().Get(":listing"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return retireListing(r.Context(), admin.UserID, listing_id, reason)
+	})
+}
+
+func handleAdminUnfreezeListing(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin", func(admin *User, reason string) error {
+		listing_id, err := strconv.ParseInt(r.URL.Query().Get(":listing"), 10, 64)
+		if err != nil {
+			return err
+		}
+		return adminUnfreezeListing(r.Context(), admin.UserID, listing_id, reason)
+	})
+}
+
+func handleAdminCreateServer(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin/listings", func(admin *User, reason string) error {
+		return createServer(r.Context(), admin.UserID, r.FormValue("server"), r.FormValue("display_name"), reason)
+	})
+}
+
+func handleAdminEnableServer(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin/listings", func(admin *User, reason string) error {
+		return setServerEnabled(r.Context(), admin.UserID, r.URL.Query().Get(":server"), r.FormValue("enabled") == "1", reason)
+	})
+}
@@ -0,0 +1,180 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestAdminActionsAreAudited(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := adminAdjustBalance(ctx, 42, 1, 50, "")
+		if err == nil {
+			t.Errorf("Was able to adjust a balance without a reason")
+		}
+		err = adminAdjustBalance(ctx, 42, 1, -1000, "too much")
+		if err == nil {
+			t.Errorf("Was able to make a balance negative")
+		}
+		err = adminAdjustBalance(ctx, 42, 1, 50, "refund for stuck deposit")
+		if err != nil {
+			t.Error(err)
+		}
+		err = adminCancelSell(ctx, 42, 1, 2, "suspicious price")
+		if err != nil {
+			t.Error(err)
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			var balance int64
+			err := sql.QueryRow("SELECT balance FROM users WHERE user_id = 1").Scan(&balance)
+			if err != nil {
+				return err
+			}
+			if balance != 150 {
+				t.Errorf("Balance wasn't adjusted, it's %d", balance)
+			}
+			var forSale int
+			err = sql.QueryRow("SELECT COUNT(*) FROM slots WHERE sale_price IS NOT NULL").Scan(&forSale)
+			if err != nil {
+				return err
+			}
+			if forSale != 0 {
+				t.Errorf("Sell order wasn't cancelled")
+			}
+			entries, err := getAdminLog(sql, 1)
+			if err != nil {
+				return err
+			}
+			if len(entries) != 2 || entries[0].Action != "cancel_sell" || entries[1].Action != "adjust_balance" || entries[1].Reason != "refund for stuck deposit" || entries[1].AdminID != 42 {
+				t.Errorf("Wrong audit log %v", entries)
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAdminCancelNothing(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		if err := adminCancelSell(ctx, 42, 2, 3, "suspicious price"); err == nil || err.Error() != "No such order" {
+			t.Error("Slot that isn't for sale has no sell order to cancel", err)
+		}
+		if err := adminCancelBuy(ctx, 42, 1, 2, 10, "suspicious price"); err == nil || err.Error() != "No such order" {
+			t.Error("There's no buy order to cancel", err)
+		}
+		err := RunSQL(func(sql *sql.Tx) error {
+			return createBuyOrder(sql, 1, 2, 10, 3)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if err = adminCancelBuy(ctx, 42, 1, 2, 11, "suspicious price"); err == nil {
+			t.Error("Buy order is at 10, not 11")
+		}
+		if err = adminCancelBuy(ctx, 42, 1, 2, 10, "suspicious price"); err != nil {
+			t.Error(err)
+		}
+		if balanceOf(t, 1) != 100 || countRows(t, "SELECT COUNT(*) FROM admin_audit_log") != 1 {
+			t.Error("Only the real cancel should be refunded and audited")
+		}
+	})
+}
+
+func TestAdminReleaseSlot(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := adminReleaseSlot(ctx, 42, 2, 3, "not even locked")
+		if err == nil {
+			t.Errorf("Was able to release a slot that isn't locked")
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (?, ?, ?)", 99, 7, 1)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("UPDATE slots SET locked = 2, withdrawal_code = 99 WHERE user_id = 2 AND slot_index = 3")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = adminReleaseSlot(ctx, 42, 2, 3, "withdrawal bot died")
+		if err != nil {
+			t.Error(err)
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			var locked int
+			err := sql.QueryRow("SELECT locked FROM slots WHERE user_id = 2 AND slot_index = 3").Scan(&locked)
+			if err != nil {
+				return err
+			}
+			if locked != 0 {
+				t.Errorf("Slot is still locked")
+			}
+			var pending int
+			err = sql.QueryRow("SELECT COUNT(*) FROM pending_withdrawals").Scan(&pending)
+			if err != nil {
+				return err
+			}
+			if pending != 0 {
+				t.Errorf("Pending withdrawal wasn't removed")
+			}
+			return verifyStorage(sql)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAdminTemplatesRender(t *testing.T) {
+	admin := &User{UserID: 42, Name: "admin"}
+	err := templates.ExecuteTemplate(ioutil.Discard, "admin.html", &AdminPageTemplate{
+		Profile:     admin,
+		Users:       []AdminUser{{UserID: 1}},
+		BotStatuses: []BotStatus{{BotUUID: testBotUUID}},
+		Freezes:     []ListingFreeze{{ListingID: 1}},
+		Suspended:   []SuspendedUser{{UserID: 1, Suspension: Suspension{Source: SuspensionDiscord, Reason: ReasonBanned}}},
+		Log:         []AdminLogEntry{{AdminID: 42, UserID: 1}},
+		LogLevels:   getLogLevels(),
+		LevelNames:  levelNames,
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	err = templates.ExecuteTemplate(ioutil.Discard, "admin_user.html", &AdminUserPageTemplate{
+		Profile:   admin,
+		User:      AdminUser{UserID: 1},
+		Slots:     []AdminSlot{{SlotIndex: 0, SalePrice: 5}, {SlotIndex: 1, SalePrice: -1, Locked: 2, WithdrawalCode: 99}},
+		BuyOrders: []AdminBuyOrder{{ListingID: 1, Quantity: 1, Price: 1}},
+		Deposits:  []AdminDeposit{{DepositID: 1}},
+		Sessions:  []Session{{SessionID: 1, UserAgent: "Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:65.0) Gecko/20100101 Firefox/65.0"}},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, suspension := range []*Suspension{{Source: SuspensionDiscord}, {Source: SuspensionAdmin}} {
+		err = templates.ExecuteTemplate(ioutil.Discard, "admin_user.html", &AdminUserPageTemplate{
+			Profile: admin,
+			User:    AdminUser{UserID: 1, Suspension: suspension},
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = templates.ExecuteTemplate(ioutil.Discard, "admin_jobs.html", &AdminJobsPageTemplate{
+		Profile: admin,
+		Jobs: []JobStatus{
+			{Name: "slot expiries", Interval: 10 * time.Second, History: []JobRun{{Skipped: true}, {Rows: 3, Err: "nope"}}},
+			{Name: "bot watchdog", Interval: 5 * time.Second, Running: true},
+		},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
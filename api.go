@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"encoding/json"
-	"log"
 	"net/http"
 
 	"github.com/bdwilliams/go-jsonify/jsonify"
@@ -16,9 +16,9 @@ func handleCategories(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "", http.StatusInternalServerError)
 		return
 	} else {
-		outJSON, err := getJSON("SELECT * FROM listings")
+		outJSON, err := getJSON(r.Context(), "SELECT * FROM listings WHERE listing_id NOT IN (SELECT listing_id FROM listing_retirements)")
 		if err != nil {
-			log.Println("wtf lol i couldn't get categories")
+			requestLogger(r, httpLog).Error("Unable to get categories", "err", err)
 		}
 		w.Write([]byte(outJSON))
 	}
@@ -26,23 +26,21 @@ func handleCategories(w http.ResponseWriter, r *http.Request) {
 
 func handlemarket(w http.ResponseWriter, r *http.Request) {
 	targetlistings := r.URL.Query().Get("category")
-	err := RunSQL(func(sql *sql.Tx) error {
+	err := RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
 		rows, err := sql.Query("SELECT listings.listing_id, listings.server, listings.item_name, listings.item_photo, listings.item_key, COALESCE(MAX(listing_buy_orders.price), -1) AS buy_order_max, COALESCE(MIN(slots.sale_price), -1) AS sell_order_min FROM listings LEFT OUTER JOIN listing_buy_orders ON listings.listing_id = listing_buy_orders.listing_id LEFT OUTER JOIN (SELECT * FROM slots WHERE sale_price IS NOT NULL) slots ON listings.listing_id = slots.listing_id GROUP BY listings.listing_id HAVING listings.item_key = ? AND sell_order_min != -1;", targetlistings)
 		if err != nil {
-			log.Println(err)
 			return err
 		}
 		defer rows.Close()
 		marshalled, err := json.Marshal(jsonify.Jsonify(rows))
 		if err != nil {
-			log.Println(err)
 			return err
 		}
 		w.Write([]byte(marshalled))
 		return err
 	})
 	if err != nil {
-		log.Println(err)
+		requestLogger(r, httpLog).Error("Unable to get market", "category", targetlistings, "err", err)
 		return
 	}
 	return
@@ -55,7 +53,7 @@ func handleorders(w http.ResponseWriter, r *http.Request) {
 		return
 	} else {
 		w.Header().Set("Content-Type", "application/json")
-		outjson, err := getJSON("SELECT listings.listing_id, listings.server, listings.item_name, listings.item_photo, completed_listing_trades.price, completed_listing_trades.timestamp FROM completed_listing_trades INNER JOIN listings ON completed_listing_trades.listing_id=listings.listing_id ORDER BY completed_listing_trades.timestamp DESC LIMIT 5")
+		outjson, err := getJSON(r.Context(), "SELECT listings.listing_id, listings.server, listings.item_name, listings.item_photo, completed_listing_trades.price, completed_listing_trades.timestamp FROM completed_listing_trades INNER JOIN listings ON completed_listing_trades.listing_id=listings.listing_id ORDER BY completed_listing_trades.timestamp DESC LIMIT 5")
 		w.Write([]byte(outjson))
 		if err != nil {
 			return
@@ -65,9 +63,9 @@ func handleorders(w http.ResponseWriter, r *http.Request) {
 
 // WARNING BIG BRAINS CODE FROM STACKOVERFLOW BELOW!!! DO NOT TOUCH!
 
-func getJSON(sqlString string) (string, error) {
+func getJSON(ctx context.Context, sqlString string) (string, error) {
 	tableData := make([]map[string]interface{}, 0)
-	err := RunSQL(func(sql *sql.Tx) error {
+	err := RunReadSQLContext(ctx, func(sql *sql.Tx) error {
 		rows, err := sql.Query(sqlString)
 		if err != nil {
 			return err
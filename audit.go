@@ -0,0 +1,291 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"strconv"
+	"strings"
+	"time"
+)
+
+const EchestAuditInterval = 10 * time.Minute
+
+// chat control that makes a bot open its ender chest and send back a full echest packet (type 6) with all 27 slots
+const EchestAuditCommand = "audit ender_chest"
+
+var ErrListingFrozen = errors.New("This listing is frozen while an admin looks into an ender chest discrepancy")
+
+type AuditItem struct {
+	ItemID       uint32 // deposit id aka anvil name, 0 if the item didn't even have a name we recognize
+	ListingID    int64  // 0 if we couldn't tell what listing it is
+	Slot         int    // where it actually is in the echest, -1 if it isn't there at all
+	ExpectedSlot int    // where the inventory table says it should be, -1 if the inventory table doesn't know about it
+	Raw          string // exactly what the bot reported in that slot
+}
+
+type EchestAuditReport struct {
+	BotUUID    string
+	Server     string
+	Missing    []AuditItem // in the inventory table, but not anywhere in the echest
+	Unexpected []AuditItem // in the echest, but the inventory table doesn't know about it
+	Misplaced  []AuditItem // in both, but in a different slot than the inventory table says
+}
+
+func (report EchestAuditReport) Clean() bool {
+	return len(report.Missing) == 0 && len(report.Unexpected) == 0 && len(report.Misplaced) == 0
+}
+
+// every listing that this report says something is wrong with
+func (report EchestAuditReport) AffectedListings() []int64 {
+	seen := make(map[int64]bool)
+	result := make([]int64, 0)
+	for _, items := range [][]AuditItem{report.Missing, report.Unexpected, report.Misplaced} {
+		for _, item := range items {
+			if item.ListingID == 0 || seen[item.ListingID] {
+				continue
+			}
+			seen[item.ListingID] = true
+			result = append(result, item.ListingID)
+		}
+	}
+	return result
+}
+
+func (report EchestAuditReport) String() string {
+	str := "Ender chest audit of bot `" + report.BotUUID + "` on `" + report.Server + "`"
+	if report.Clean() {
+		return str + " is clean.\n"
+	}
+	str += " found problems!\n"
+	for _, item := range report.Missing {
+		str += "MISSING: item `" + depositIDToName(item.ItemID) + "` of listing " + strconv.FormatInt(item.ListingID, 10) + " should be in slot " + strconv.Itoa(item.ExpectedSlot) + " but isn't in the echest at all\n"
+	}
+	for _, item := range report.Unexpected {
+		str += "UNEXPECTED: slot " + strconv.Itoa(item.Slot) + " has `" + item.Raw + "` which isn't in inventory\n"
+	}
+	for _, item := range report.Misplaced {
+		str += "MISPLACED: item `" + depositIDToName(item.ItemID) + "` of listing " + strconv.FormatInt(item.ListingID, 10) + " is in slot " + strconv.Itoa(item.Slot) + " but should be in slot " + strconv.Itoa(item.ExpectedSlot) + "\n"
+	}
+	affected := report.AffectedListings()
+	if len(affected) > 0 {
+		ids := make([]string, len(affected))
+		for i, id := range affected {
+			ids[i] = strconv.FormatInt(id, 10)
+		}
+		str += "Listings " + strings.Join(ids, ", ") + " are frozen until a clean audit of this bot.\n"
+	}
+	return str
+}
+
+// the ender chest audit job: ask every bot that's online and healthy to send us its whole echest
+// the audit itself happens when the echest packet comes back, in readFullEchestPacket. returns how many bots were asked
+// the bots are picked with botsLock held but asked after it's let go, so one stuck connection can't hold up every other bot's status
+func requestEchestAudits() (int64, error) {
+	botsLock.Lock()
+	healthy := make([]*Bot, 0, len(bots))
+	for _, bot := range bots {
+		if bot.hasReceivedStatusUpdateInTheLastFiveSeconds() {
+			bot.logger().Debug("Requesting ender chest audit")
+			healthy = append(healthy, bot)
+		}
+	}
+	botsLock.Unlock()
+	for _, bot := range healthy {
+		bot.sendChatControl(EchestAuditCommand)
+	}
+	return int64(len(healthy)), nil
+}
+
+func (bot *Bot) readFullEchestPacket() {
+	contents := bot.readManyStrings(27)
+	if bot.latestStatus == nil {
+		bot.logger().Warn("Got a full echest from a bot that hasn't told us who it is yet, ignoring it")
+		return
+	}
+	report, err := auditEchest(bot.latestStatus.BotUUID, bot.latestStatus.ServerIP, contents)
+	if err != nil {
+		bot.logger().Error("Unable to audit ender chest", "err", err)
+		return
+	}
+	if report.Clean() {
+		bot.logger().Debug("Ender chest audit is clean")
+	} else {
+		bot.logger().Warn("Ender chest audit found problems", "report", report.String())
+		go DMadmins(report.String())
+	}
+}
+
+// compare the full contents of a bot's ender chest against what the inventory table says it should have
+// freezes every listing that doesn't add up, and unfreezes everything this bot froze if it all adds up now
+func auditEchest(botUUID string, server string, contents []string) (*EchestAuditReport, error) {
+	if len(contents) != 27 {
+		return nil, errors.New("An ender chest has 27 slots, got " + strconv.Itoa(len(contents)))
+	}
+	report := &EchestAuditReport{
+		BotUUID: botUUID,
+		Server:  server,
+	}
+
+	// parse everything first, since parseItem does its own RunSQL and we can't nest those
+	type parsedSlot struct {
+		listing *Listing
+		id      uint32
+	}
+	parsed := make([]parsedSlot, 27)
+	for slot, item := range contents {
+		listing, id := parseItem(item, server)
+		parsed[slot] = parsedSlot{listing, id}
+	}
+
+	err := RunSQL(func(sql *sql.Tx) error {
+		expected := make(map[uint32]AuditItem) // item id -> where the inventory table says it is
+		rows, err := sql.Query("SELECT inventory.item_id, inventory.listing_id, inventory.slot_number FROM inventory INNER JOIN listings ON listings.listing_id = inventory.listing_id WHERE inventory.bot_uuid = ? AND listings.server = ?", botUUID, server)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var item AuditItem
+			err = rows.Scan(&item.ItemID, &item.ListingID, &item.ExpectedSlot)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			item.Slot = -1
+			expected[item.ItemID] = item
+		}
+		rows.Close()
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		found := make(map[uint32]bool)
+		dropping := make(map[uint32]bool) // confirmed withdrawals that the bot hasn't gotten around to dropping yet
+		for slot, item := range contents {
+			if item == "empty" {
+				continue
+			}
+			p := parsed[slot]
+			entry := AuditItem{ItemID: p.id, Slot: slot, ExpectedSlot: -1, Raw: item}
+			if p.listing != nil {
+				entry.ListingID = p.listing.ListingID
+			}
+			inv, ok := expected[p.id]
+			if p.listing == nil || !ok || inv.ListingID != entry.ListingID {
+				if p.listing != nil {
+					// a deposit that's been picked up but not confirmed yet is allowed to be in here
+					var pending int
+					err = sql.QueryRow("SELECT COUNT(*) FROM pending_deposits WHERE deposit_id = ? AND listing_id = ? AND picked_up_at IS NOT NULL", p.id, entry.ListingID).Scan(&pending)
+					if err != nil {
+						return err
+					}
+					if pending > 0 {
+						continue
+					}
+					err = sql.QueryRow("SELECT COUNT(*) FROM withdrawal_drops WHERE item_id = ? AND listing_id = ? AND bot_uuid = ?", p.id, entry.ListingID, botUUID).Scan(&pending)
+					if err != nil {
+						return err
+					}
+					if pending > 0 {
+						dropping[p.id] = true
+						continue
+					}
+				}
+				report.Unexpected = append(report.Unexpected, entry)
+				continue
+			}
+			found[p.id] = true
+			if inv.ExpectedSlot != slot {
+				entry.ExpectedSlot = inv.ExpectedSlot
+				report.Misplaced = append(report.Misplaced, entry)
+			}
+		}
+		for id, inv := range expected {
+			if !found[id] {
+				report.Missing = append(report.Missing, inv)
+			}
+		}
+
+		// anything of this bot's that was being dropped and isn't in here anymore has been dropped
+		rows, err = sql.Query("SELECT item_id FROM withdrawal_drops WHERE bot_uuid = ?", botUUID)
+		if err != nil {
+			return err
+		}
+		dropped := make([]uint32, 0)
+		for rows.Next() {
+			var item_id uint32
+			err = rows.Scan(&item_id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			if !dropping[item_id] {
+				dropped = append(dropped, item_id)
+			}
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, item_id := range dropped {
+			_, err = sql.Exec("DELETE FROM withdrawal_drops WHERE item_id = ?", item_id)
+			if err != nil {
+				return err
+			}
+		}
+
+		return applyAuditFreezes(sql, report)
+	})
+	if err != nil {
+		return nil, err
+	}
+	return report, nil
+}
+
+func applyAuditFreezes(sql *sql.Tx, report *EchestAuditReport) error {
+	// whatever this bot froze last time is superseded by this audit
+	_, err := sql.Exec("DELETE FROM listing_freezes WHERE bot_uuid = ?", report.BotUUID)
+	if err != nil {
+		return err
+	}
+	for _, listing_id := range report.AffectedListings() {
+		_, err = sql.Exec("INSERT INTO listing_freezes (listing_id, bot_uuid, reason) VALUES (?, ?, ?)", listing_id, report.BotUUID, report.String())
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// can only be called within the context of a sql transaction, just like createSellOrder
+func checkNotFrozen(sql *sql.Tx, listing_id int64) error {
+	var freezes int
+	err := sql.QueryRow("SELECT COUNT(*) FROM listing_freezes WHERE listing_id = ?", listing_id).Scan(&freezes)
+	if err != nil {
+		return err
+	}
+	if freezes > 0 {
+		return ErrListingFrozen
+	}
+	return nil
+}
+
+// for when an admin has looked into it and the audit was wrong, or it's been sorted out by hand
+// this lifts every bot's freeze on the listing, but the next audit that still finds a problem will freeze it again
+func adminUnfreezeListing(ctx context.Context, admin_id int64, listing_id int64, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		result, err := sql.Exec("DELETE FROM listing_freezes WHERE listing_id = ?", listing_id)
+		if err != nil {
+			return err
+		}
+		lifted, err := result.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if lifted == 0 {
+			return errors.New("That listing isn't frozen")
+		}
+		return writeAdminLog(sql, admin_id, "unfreeze_listing", 0, "lifted "+strconv.FormatInt(lifted, 10)+" freezes on listing "+strconv.FormatInt(listing_id, 10), reason)
+	})
+}
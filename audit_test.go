@@ -0,0 +1,254 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"strings"
+	"testing"
+	"time"
+)
+
+const testBotUUID = "51dcd870-d33b-40e9-9fc1-aecdcff96081"
+
+// what a bot would report for a named shulker with these contents
+func testShulker(id uint32, contents string) string {
+	return depositIDToName(id) + "$tile.shulkerBox;0;1;," + contents
+}
+
+// totems don't stack
+func fullTotemShulker() string {
+	return strings.TrimSuffix(strings.Repeat("item.totem;0;1;,", 27), ",")
+}
+
+func emptyEchest() []string {
+	contents := make([]string, 27)
+	for i := range contents {
+		contents[i] = "empty"
+	}
+	return contents
+}
+
+func TestEchestAudit(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		err := RunSQL(func(sql *sql.Tx) error {
+			// listing 1 is gapples, listing 2 is totems
+			_, err := sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (?, ?, ?, ?)", 10, 1, testBotUUID, 0)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (?, ?, ?, ?)", 11, 1, testBotUUID, 1)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (?, ?, ?, ?)", 12, 2, testBotUUID, 2)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		contents := emptyEchest()
+		contents[0] = testShulker(10, createShulkerFull("item.appleGold;1"))
+		contents[1] = testShulker(11, createShulkerFull("item.appleGold;1"))
+		contents[2] = testShulker(12, fullTotemShulker())
+		report, err := auditEchest(testBotUUID, "2b2t.org", contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Clean() {
+			t.Errorf("Audit of a correct echest wasn't clean: %s", report)
+		}
+
+		contents = emptyEchest()
+		contents[5] = testShulker(10, createShulkerFull("item.appleGold;1"))   // misplaced
+		contents[2] = testShulker(12, fullTotemShulker())                      // fine
+		contents[3] = testShulker(99, createShulkerFull("item.end_crystal;0")) // unexpected
+		report, err = auditEchest(testBotUUID, "2b2t.org", contents)           // and 11 is missing
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Missing) != 1 || report.Missing[0].ItemID != 11 || report.Missing[0].ExpectedSlot != 1 {
+			t.Errorf("Wrong missing items %v", report.Missing)
+		}
+		if len(report.Misplaced) != 1 || report.Misplaced[0].ItemID != 10 || report.Misplaced[0].Slot != 5 || report.Misplaced[0].ExpectedSlot != 0 {
+			t.Errorf("Wrong misplaced items %v", report.Misplaced)
+		}
+		if len(report.Unexpected) != 1 || report.Unexpected[0].ItemID != 99 || report.Unexpected[0].ListingID != 3 {
+			t.Errorf("Wrong unexpected items %v", report.Unexpected)
+		}
+
+		err = RunSQL(func(sql *sql.Tx) error {
+			if checkNotFrozen(sql, 1) != ErrListingFrozen {
+				t.Errorf("Listing with missing item wasn't frozen")
+			}
+			if checkNotFrozen(sql, 3) != ErrListingFrozen {
+				t.Errorf("Listing with unexpected item wasn't frozen")
+			}
+			if checkNotFrozen(sql, 2) != nil {
+				t.Errorf("Listing that was fine got frozen")
+			}
+			_, err := sql.Exec("INSERT INTO users (user_id, balance) VALUES (1, 100)")
+			if err != nil {
+				return err
+			}
+			if createBuyOrder(sql, 1, 1, 5, 1) != ErrListingFrozen {
+				t.Errorf("Was able to place a buy order in a frozen listing")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+
+		contents = emptyEchest()
+		contents[0] = testShulker(10, createShulkerFull("item.appleGold;1"))
+		contents[1] = testShulker(11, createShulkerFull("item.appleGold;1"))
+		contents[2] = testShulker(12, fullTotemShulker())
+		report, err = auditEchest(testBotUUID, "2b2t.org", contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			if checkNotFrozen(sql, 1) != nil || checkNotFrozen(sql, 3) != nil {
+				t.Errorf("Clean audit didn't unfreeze listings")
+			}
+			return nil
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestAuditIgnoresItemsBeingDropped(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO users (user_id, balance) VALUES (1, 100)")
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (12, 2, ?, 2)", testBotUUID)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (99, 12, ?)", unixNow()+60)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id, locked, withdrawal_code) VALUES (1, 0, 2, 2, 99)")
+			if err != nil {
+				return err
+			}
+			return verifyStorage(sql)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		botReceivesWithdrawalCode(99)
+		site.discord.waitForDM(t, 1, "confirmed")
+
+		// confirmed, but the bot hasn't dropped it yet
+		contents := emptyEchest()
+		contents[2] = testShulker(12, fullTotemShulker())
+		report, err := auditEchest(testBotUUID, "2b2t.org", contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !report.Clean() {
+			t.Errorf("Item that's about to be dropped was reported: %s", report)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM withdrawal_drops") != 1 {
+			t.Error("Should still be waiting for the drop")
+		}
+
+		// it's somewhere it shouldn't be, so that's not the drop
+		contents = emptyEchest()
+		contents[2] = testShulker(12, createShulkerFull("item.appleGold;1"))
+		report, err = auditEchest(testBotUUID, "2b2t.org", contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(report.Unexpected) != 1 {
+			t.Errorf("Item in the wrong listing should be unexpected %v", report.Unexpected)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM withdrawal_drops") != 0 {
+			t.Error("Once it's gone from the ender chest it's been dropped")
+		}
+		report, err = auditEchest(testBotUUID, "2b2t.org", emptyEchest())
+		if err != nil || !report.Clean() {
+			t.Error("Empty ender chest should be clean now", report, err)
+		}
+	})
+}
+
+func TestAdminUnfreezeListing(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		contents := emptyEchest()
+		contents[3] = testShulker(99, createShulkerFull("item.end_crystal;0"))
+		_, err := auditEchest(testBotUUID, "2b2t.org", contents)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if adminUnfreezeListing(ctx, 42, 3, "") == nil {
+			t.Error("Unfreezing needs a reason")
+		}
+		if adminUnfreezeListing(ctx, 42, 1, "checked it") == nil {
+			t.Error("Listing 1 was never frozen")
+		}
+		err = adminUnfreezeListing(ctx, 42, 3, "crystals were mine, moved them out")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			return checkNotFrozen(sql, 3)
+		})
+		if err != nil {
+			t.Error("Listing should be unfrozen", err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM admin_audit_log WHERE action = 'unfreeze_listing'") != 1 {
+			t.Error("Unfreezing should be audited once")
+		}
+	})
+}
+
+func TestStuckBotDoesntHoldUpAudits(t *testing.T) {
+	savedTimeout := BotWriteTimeout
+	BotWriteTimeout = 200 * time.Millisecond
+	ours, theirs := net.Pipe() // nobody ever reads theirs, so writing to ours blocks
+	defer theirs.Close()
+	stuck := &Bot{conn: ours, latestStatus: &BotStatus{BotUUID: "stuck", timeReceivedUnixNano: time.Now().UnixNano()}}
+	botsLock.Lock()
+	bots = []*Bot{stuck}
+	botsLock.Unlock()
+	defer func() {
+		botsLock.Lock()
+		bots = nil
+		botsLock.Unlock()
+		BotWriteTimeout = savedTimeout
+	}()
+
+	done := make(chan int64)
+	go func() {
+		asked, _ := requestEchestAudits()
+		done <- asked
+	}()
+	time.Sleep(50 * time.Millisecond) // it's stuck in the write by now
+	start := time.Now()
+	stuck.status()
+	if time.Since(start) > 100*time.Millisecond {
+		t.Error("Reading a status had to wait for the stuck write", time.Since(start))
+	}
+	select {
+	case asked := <-done:
+		if asked != 1 {
+			t.Error("Should have asked the one bot", asked)
+		}
+	case <-time.After(5 * time.Second):
+		t.Fatal("Writing to a stuck bot never timed out")
+	}
+	if _, err := ours.Write([]byte{0}); err == nil {
+		t.Error("Stuck bot should have been disconnected")
+	}
+}
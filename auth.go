@@ -1,11 +1,10 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"encoding/gob"
 	"errors"
 	"fmt"
-	"log"
 	"net/http"
 	"os"
 	"strconv"
@@ -18,38 +17,30 @@ import (
 )
 
 type User struct { // someone's information, as received from discord oauth
-	UserID    int64
-	Name      string
-	AvatarURL string
+	UserID     int64
+	Name       string
+	AvatarURL  string
+	Suspension string // why they can't trade or withdraw, "" if they can. see suspensions.go
 }
 
-const OurCookieName = "2b2tq"
-const HttpOnly = true             // change this to false in production with https support
-const ProfileDataSection = "user" // we store our user info in a section of the session called "user"
-const CurrentDomainName = "http://localhost:3000"
-const CallbackURL = CurrentDomainName + "/auth/discord/callback" // this must equal the callback serve down below, but with discord replaced with {provider}
-const HomeURL = "/home"                                          // where a logged in user goes
+const OurCookieName = "2b2tq"                 // holds the session token, see sessions.go
+const CallbackPath = "/auth/discord/callback" // this must equal the callback serve down below, but with discord replaced with {provider}
+const HomeURL = "/home"                       // where a logged in user goes
 
-const discordID2b2tq = "510930252676071439"
-
-var sessionStore sessions.Store
-
-// weird shit dont touch its radioactive
-func init() {
-	gob.Register(User{}) // this allows it to be saved in the session
-}
-
-// weird shit dont touch its radioactive
+// tests swap this out, since they can't go through discord's oauth page
+var completeUserAuth = gothic.CompleteUserAuth
 
+// our own sessions are in the database, but gothic keeps the oauth state in a signed cookie of its own ("_gothic_session") while you're off on discord's page
 func setupSession() {
-	sessionSecret := os.Getenv("SESSION_SECRET") // note that gothic uses the same session secret, the SESSION_SECRET env variable
-	// this is fine since we use a diffreent cookie name, "2b2tq", instead of "_gothic_user"
+	sessionSecret := os.Getenv("SESSION_SECRET")
 	if sessionSecret == "" {
 		panic("Must set environment variable SESSION_SECRET")
 	}
 	store := sessions.NewCookieStore([]byte(sessionSecret))
-	store.Options.HttpOnly = HttpOnly
-	sessionStore = store
+	store.Options.HttpOnly = config.CookieHTTPOnly
+	store.Options.Secure = config.CookieSecure
+	store.MaxAge(5 * 60) // only has to last as long as the trip to discord and back
+	gothic.Store = store
 }
 
 func getDiscordSecrets() (string, string) {
@@ -63,63 +54,56 @@ func getDiscordSecrets() (string, string) {
 
 func setupDiscord() {
 	key, secret := getDiscordSecrets()
-	goth.UseProviders(gothDiscord.New(key, secret, CallbackURL, gothDiscord.ScopeIdentify))
+	goth.UseProviders(gothDiscord.New(key, secret, config.DomainName+CallbackPath, gothDiscord.ScopeIdentify))
 }
 
 func setupAuth(p *pat.Router) {
 	setupSession()
 	setupDiscord()
 
-	p.Get("/logout", func(res http.ResponseWriter, req *http.Request) {
-		session, _ := sessionStore.Get(req, OurCookieName)
-		session.Options.MaxAge = -1 // apparently this is how you're supposed to delete a session
-		session.Save(req, res)
-		http.Redirect(res, req, "/", http.StatusFound)
-	})
+	p.Get("/logout", handleLogout)
+	setupSessions(p) // your sessions page, calls sessions.go
 
-	p.Get("/auth/{provider}/callback", func(res http.ResponseWriter, req *http.Request) {
-		gothUser, err := gothic.CompleteUserAuth(res, req)
+	p.Get("/auth/{provider}/callback", rateLimited(RateClassLogin, func(res http.ResponseWriter, req *http.Request) {
+		gothUser, err := completeUserAuth(res, req)
 		if err != nil {
 			fmt.Fprintln(res, err)
 			return
 		}
 		// goth library has gotten us their verified discord information
-		// now to save it in the session cookie...
+		// now to start a session for them...
 
-		user, err := initUser(gothUser)
+		user, err := initUser(req.Context(), gothUser)
 		if err != nil {
 			// discord gave invalid data...?
 			fmt.Fprintln(res, err)
 			return
 		}
 
-		session, _ := sessionStore.Get(req, OurCookieName)
-		session.Values[ProfileDataSection] = *user // save as a User not a *User, we know it's not nil since we checked the error above
-		session.Save(req, res)
+		err = createSession(req.Context(), res, req, user)
+		if err != nil {
+			http.Error(res, "Unable to start your session. "+err.Error(), http.StatusInternalServerError)
+			return
+		}
 		http.Redirect(res, req, HomeURL, http.StatusFound)
-	})
+	}))
 
-	p.Get("/auth/{provider}", func(res http.ResponseWriter, req *http.Request) {
+	p.Get("/auth/{provider}", rateLimited(RateClassLogin, func(res http.ResponseWriter, req *http.Request) {
 		if getUser(req) != nil {
 			// already logged in
 			http.Redirect(res, req, HomeURL, http.StatusFound)
 			return
 		}
 		gothic.BeginAuthHandler(res, req)
-	})
+	}))
 }
 
 func getUser(req *http.Request) *User {
-	session, _ := sessionStore.Get(req, OurCookieName)
-	// ignore error since .Get is guaranteed to return a session, just an empty one if the cookie is invalid
-	user, ok := session.Values[ProfileDataSection].(User)
-	if !ok || user.UserID == 0 {
-		return nil
-	}
-	return &user
+	_, user := getSession(req)
+	return user
 }
 
-func initUser(gothUser goth.User) (*User, error) { // take the information we got from discord about their user, and convert it into the format we want
+func initUser(ctx context.Context, gothUser goth.User) (*User, error) { // take the information we got from discord about their user, and convert it into the format we want
 	UserIDstr := gothUser.UserID
 
 	UserID, err := strconv.ParseInt(UserIDstr, 10, 64) // base 10, 64 bits
@@ -128,16 +112,25 @@ func initUser(gothUser goth.User) (*User, error) { // take the information we go
 		return nil, err
 	}
 
-	membership, err := discord.GuildMember(discordID2b2tq, UserIDstr)
-	if err != nil || membership == nil {
+	if discord == nil {
+		return nil, errors.New("Discord not connected!")
+	}
+	reason, err := verifyMembership(UserID)
+	if err != nil || reason != "" {
+		httpLog.Info("Rejecting login from someone who isn't allowed in", "user", UserID, "reason", reason, "err", err)
+		if reason == ReasonMissingRole {
+			return nil, errors.New("You must have one of the roles needed to trade in the 2b2tq discord server")
+		}
 		return nil, errors.New("You must be a member of the 2b2tq discord server")
 	}
-	log.Println(*membership)
 
-	err = RunSQL(func(sql *sql.Tx) error {
+	err = RunSQLContext(ctx, func(sql *sql.Tx) error {
 		_, err := sql.Exec("INSERT OR IGNORE INTO users (user_id) VALUES (?)", UserID)
 		return err
 	})
+	if err == nil {
+		err = applyMembership(ctx, UserID, "") // they just passed, so a discord suspension can go
+	}
 	if err != nil {
 		// there is literally no reason why that could ever fail.
 		// but shrug. maybe..... the disk is full and it can't save even just one more row to disk. lol
@@ -0,0 +1,339 @@
+package main
+
+import (
+	"crypto/sha256"
+	"database/sql"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+
+	sqlite3 "github.com/mattn/go-sqlite3"
+)
+
+// scheduled online backups of the whole database, and restoring from one
+// a backup is exchange.db.<unix time>.backup with a sha256sum style exchange.db.<unix time>.backup.sha256 next to it
+// they're taken with sqlite's backup api through databaseLoop, so they're always a consistent snapshot between two transactions
+
+const BackupSuffix = ".backup"
+const ChecksumSuffix = ".sha256"
+
+type DatabaseBackup struct {
+	Path    string
+	TakenAt int64 // unix seconds
+}
+
+// the database backup job, only scheduled when backup_interval_minutes isn't 0
+func databaseBackups() (int64, error) {
+	path, err := takeBackup(config.BackupDir)
+	if err != nil {
+		go DMadmins("Scheduled database backup failed: " + err.Error())
+		return 0, err
+	}
+	dbLog.Info("Backed up database", "path", path)
+	err = rotateBackups(config.BackupDir, int(config.BackupKeep))
+	if err != nil {
+		return 1, fmt.Errorf("backed up to %s but unable to delete old backups: %v", path, err)
+	}
+	return 1, nil
+}
+
+// takes a backup right now, returns where it went
+func takeBackup(backupDir string) (string, error) {
+	err := os.MkdirAll(backupDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(backupDir, filepath.Base(config.DatabaseFile)+"."+strconv.FormatInt(unixNow(), 10)+BackupSuffix)
+	partial := path + ".partial" // so a crash halfway through never leaves something that looks like a real backup
+	os.Remove(partial)
+	err = RunOnDatabase(func(db *sql.DB) error {
+		return backupInto(db, partial)
+	})
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	// the checksum doesn't need the database, so it's done after databaseLoop has moved on
+	sum, err := fileChecksum(partial)
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	err = ioutil.WriteFile(path+ChecksumSuffix, []byte(sum+"  "+filepath.Base(path)+"\n"), 0600)
+	if err != nil {
+		os.Remove(partial)
+		return "", err
+	}
+	return path, os.Rename(partial, path)
+}
+
+// copies every page of db into a new database file at dest
+func backupInto(db *sql.DB, dest string) error {
+	destDB, err := sql.Open("sqlite3", "file:"+dest)
+	if err != nil {
+		return err
+	}
+	defer destDB.Close()
+	destConn, err := destDB.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer destConn.Close()
+	srcConn, err := db.Conn(ctx)
+	if err != nil {
+		return err
+	}
+	defer srcConn.Close()
+	return destConn.Raw(func(destRaw interface{}) error {
+		return srcConn.Raw(func(srcRaw interface{}) error {
+			backup, err := destRaw.(*sqlite3.SQLiteConn).Backup("main", srcRaw.(*sqlite3.SQLiteConn), "main")
+			if err != nil {
+				return err
+			}
+			done, err := backup.Step(-1) // -1 means every page in one go
+			finishErr := backup.Finish()
+			if err != nil {
+				return err
+			}
+			if !done {
+				return errors.New("backup didn't copy every page, the database was busy")
+			}
+			return finishErr
+		})
+	})
+}
+
+func fileChecksum(path string) (string, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer f.Close()
+	h := sha256.New()
+	_, err = io.Copy(h, f)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(h.Sum(nil)), nil
+}
+
+// checks a backup against the .sha256 file next to it
+func verifyBackupChecksum(path string) error {
+	data, err := ioutil.ReadFile(path + ChecksumSuffix)
+	if err != nil {
+		return err
+	}
+	fields := strings.Fields(string(data))
+	if len(fields) == 0 {
+		return errors.New(path + ChecksumSuffix + " is empty")
+	}
+	sum, err := fileChecksum(path)
+	if err != nil {
+		return err
+	}
+	if sum != fields[0] {
+		return fmt.Errorf("%s doesn't match its checksum, it's been changed or corrupted since it was taken", path)
+	}
+	return nil
+}
+
+// every scheduled backup in backupDir, oldest first
+func listBackups(backupDir string) ([]DatabaseBackup, error) {
+	files, err := ioutil.ReadDir(backupDir)
+	if err != nil {
+		if os.IsNotExist(err) {
+			return nil, nil
+		}
+		return nil, err
+	}
+	prefix := filepath.Base(config.DatabaseFile) + "."
+	backups := make([]DatabaseBackup, 0)
+	for _, f := range files {
+		name := f.Name()
+		if !strings.HasPrefix(name, prefix) || !strings.HasSuffix(name, BackupSuffix) {
+			continue
+		}
+		takenAt, err := strconv.ParseInt(strings.TrimSuffix(strings.TrimPrefix(name, prefix), BackupSuffix), 10, 64)
+		if err != nil {
+			continue // not one of ours
+		}
+		backups = append(backups, DatabaseBackup{filepath.Join(backupDir, name), takenAt})
+	}
+	sort.Slice(backups, func(i, j int) bool {
+		return backups[i].TakenAt < backups[j].TakenAt
+	})
+	return backups, nil
+}
+
+// deletes the oldest backups until there are only keep left
+func rotateBackups(backupDir string, keep int) error {
+	backups, err := listBackups(backupDir)
+	if err != nil {
+		return err
+	}
+	for len(backups) > keep {
+		err = os.Remove(backups[0].Path)
+		if err != nil {
+			return err
+		}
+		os.Remove(backups[0].Path + ChecksumSuffix)
+		backups = backups[1:]
+	}
+	return nil
+}
+
+// the newest backup taken at or before the given time, for restoring to a point in time
+func backupAsOf(backupDir string, t time.Time) (*DatabaseBackup, error) {
+	backups, err := listBackups(backupDir)
+	if err != nil {
+		return nil, err
+	}
+	for i := len(backups) - 1; i >= 0; i-- {
+		if backups[i].TakenAt <= t.Unix() {
+			return &backups[i], nil
+		}
+	}
+	return nil, fmt.Errorf("there are no backups in %s from before %s", backupDir, t.Format(time.RFC3339))
+}
+
+// replaces databaseFile with the backup at path, but only if the backup is intact and everything in it adds up
+// the exchange must not be running while this happens
+// the database being replaced gets backed up into backupDir first, so a restore can itself be undone
+func restoreDatabase(path string, databaseFile string, backupDir string) error {
+	held, err := lockDatabaseFile(databaseFile)
+	if err != nil {
+		return fmt.Errorf("refusing to restore: %v", err)
+	}
+	defer held.Close()
+
+	err = verifyBackupChecksum(path)
+	if err != nil {
+		return err
+	}
+
+	// work on a copy, so the backup stays untouched and the real database isn't touched until the copy is known good
+	candidate := databaseFile + ".restoring"
+	os.Remove(candidate)
+	defer os.Remove(candidate)
+	err = copyFile(path, candidate)
+	if err != nil {
+		return err
+	}
+	err = checkRestoreCandidate(candidate)
+	if err != nil {
+		return fmt.Errorf("refusing to restore %s: %v", path, err)
+	}
+
+	// keep what's there now, through sqlite so that a half finished transaction in a journal gets rolled back rather than copied
+	_, err = os.Stat(databaseFile)
+	if err == nil {
+		current, err := sql.Open("sqlite3", "file:"+databaseFile)
+		if err != nil {
+			return err
+		}
+		saved := filepath.Join(backupDir, filepath.Base(databaseFile)+".before-restore."+strconv.FormatInt(unixNow(), 10)+".bak")
+		err = os.MkdirAll(backupDir, 0700)
+		if err == nil {
+			err = backupInto(current, saved)
+		}
+		current.Close()
+		if err != nil {
+			return fmt.Errorf("unable to save the current database before restoring over it: %v", err)
+		}
+		dbLog.Info("Saved the database being replaced", "path", saved)
+	}
+	// sqlite would apply a leftover journal from the old database to the new one, which would wreck it
+	for _, suffix := range []string{"-journal", "-wal", "-shm"} {
+		err = os.Remove(databaseFile + suffix)
+		if err != nil && !os.IsNotExist(err) {
+			return err
+		}
+	}
+	return os.Rename(candidate, databaseFile)
+}
+
+// opens the copy of a backup, brings it up to the latest schema, and checks it over
+func checkRestoreCandidate(candidate string) error {
+	db, err := sql.Open("sqlite3", "file:"+candidate+"?_foreign_keys=1")
+	if err != nil {
+		return err
+	}
+	defer db.Close()
+	var integrity string
+	err = db.QueryRow("PRAGMA integrity_check").Scan(&integrity)
+	if err != nil {
+		return err
+	}
+	if integrity != "ok" {
+		return errors.New("integrity check failed: " + integrity)
+	}
+	_, err = migrate(db, false, candidate, "") // it's a copy, no need to back it up again
+	if err != nil {
+		return err
+	}
+	tx, err := db.BeginTx(ctx, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+	err = checkForeignKeys(tx)
+	if err != nil {
+		return err
+	}
+	return verifyStorage(tx)
+}
+
+// never overwrites dst, so a backup taken in the same second as another one fails instead of replacing it
+// and never leaves half a copy behind looking like a whole one
+func copyFile(src string, dst string) error {
+	in, err := os.Open(src)
+	if err != nil {
+		return err
+	}
+	defer in.Close()
+	out, err := os.OpenFile(dst, os.O_WRONLY|os.O_CREATE|os.O_EXCL, 0600)
+	if err != nil {
+		return err
+	}
+	_, err = io.Copy(out, in)
+	if err == nil {
+		err = out.Sync()
+	}
+	if closeErr := out.Close(); err == nil {
+		err = closeErr
+	}
+	if err != nil {
+		os.Remove(dst)
+	}
+	return err
+}
+
+// for -restore and -restore-to. exactly one of path and to should be set
+func restoreFromCommandLine(path string, to string) error {
+	if to != "" {
+		t, err := time.Parse(time.RFC3339, to)
+		if err != nil {
+			return fmt.Errorf("-restore-to must be a time like 2019-02-01T15:04:05Z: %v", err)
+		}
+		backup, err := backupAsOf(config.BackupDir, t)
+		if err != nil {
+			return err
+		}
+		path = backup.Path
+	}
+	dbLog.Info("Restoring database", "file", config.DatabaseFile, "from", path)
+	err := restoreDatabase(path, config.DatabaseFile, config.BackupDir)
+	if err != nil {
+		return err
+	}
+	dbLog.Info("Restored database", "file", config.DatabaseFile, "from", path)
+	return nil
+}
@@ -0,0 +1,226 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestBackupRotation(t *testing.T) {
+	WithTestingDatabase(func() {
+		withFakeClock(func(c *fakeClock) {
+			dir, err := ioutil.TempDir("", "exchange-backups")
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer os.RemoveAll(dir)
+			createSomeExampleUsers(t)
+
+			paths := make([]string, 0)
+			for i := 0; i < 3; i++ {
+				path, err := takeBackup(dir)
+				if err != nil {
+					t.Fatal(err)
+				}
+				err = verifyBackupChecksum(path)
+				if err != nil {
+					t.Error(err)
+				}
+				paths = append(paths, path)
+				c.Advance(time.Hour)
+			}
+
+			// a backup is a complete database on its own
+			db, err := sql.Open("sqlite3", "file:"+paths[0])
+			if err != nil {
+				t.Fatal(err)
+			}
+			if n := countRowsIn(t, db, "SELECT COUNT(*) FROM users"); n != 2 {
+				t.Error("Backup should have both users in it, has", n)
+			}
+			db.Close()
+
+			err = rotateBackups(dir, 2)
+			if err != nil {
+				t.Fatal(err)
+			}
+			backups, err := listBackups(dir)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if len(backups) != 2 || backups[0].Path != paths[1] || backups[1].Path != paths[2] {
+				t.Error("Rotation should have deleted only the oldest backup", backups)
+			}
+			if _, err := os.Stat(paths[0] + ChecksumSuffix); !os.IsNotExist(err) {
+				t.Error("Rotation should delete the checksum along with the backup")
+			}
+
+			backup, err := backupAsOf(dir, c.Now().Add(-90*time.Minute))
+			if err != nil || backup.Path != paths[1] {
+				t.Error("Expected the backup from two hours ago", backup, err)
+			}
+			_, err = backupAsOf(dir, c.Now().Add(-10*time.Hour))
+			if err == nil {
+				t.Error("There's no backup that old")
+			}
+		})
+	})
+}
+
+func TestRestore(t *testing.T) {
+	WithTestingDatabase(func() {
+		dir, err := ioutil.TempDir("", "exchange-restore")
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer os.RemoveAll(dir)
+		backupDir := filepath.Join(dir, "backups")
+		databaseFile := filepath.Join(dir, "exchange.db")
+		err = ioutil.WriteFile(databaseFile, []byte("the database that's about to be replaced"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		createSomeExampleUsers(t)
+		good, err := takeBackup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		// nothing happens while something else has the database open
+		held, err := lockDatabaseFile(databaseFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = restoreDatabase(good, databaseFile, backupDir)
+		if err == nil || !strings.Contains(err.Error(), "in use by another process (pid "+strconv.Itoa(os.Getpid())+")") {
+			t.Error("Restore should refuse while the database is in use", err)
+		}
+		held.Close()
+
+		// a backup that's been tampered with is refused
+		tampered := filepath.Join(dir, "tampered.backup")
+		copyFile(good, tampered)
+		copyFile(good+ChecksumSuffix, tampered+ChecksumSuffix)
+		f, _ := os.OpenFile(tampered, os.O_WRONLY|os.O_APPEND, 0600)
+		f.Write([]byte("extra"))
+		f.Close()
+		err = restoreDatabase(tampered, databaseFile, backupDir)
+		if err == nil || !strings.Contains(err.Error(), "checksum") {
+			t.Error("Restore should check the checksum", err)
+		}
+
+		// so is one where the slots and the echests don't add up
+		err = RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id) VALUES (1, 0, 1)")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := &fakeClock{now: time.Now().Add(time.Hour)} // so it doesn't land on the same second as the good one
+		clock = c
+		broken, err := takeBackup(backupDir)
+		clock = realClock{}
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = restoreDatabase(broken, databaseFile, backupDir)
+		if err == nil || !strings.Contains(err.Error(), "Storage invariants violated") {
+			t.Error("Restore should refuse a backup that fails verifyStorage", err)
+		}
+		data, _ := ioutil.ReadFile(databaseFile)
+		if string(data) != "the database that's about to be replaced" {
+			t.Fatal("Failed restores shouldn't touch the database")
+		}
+	})
+}
+
+func TestRestoreGoodBackup(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exchange-restore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	backupDir := filepath.Join(dir, "backups")
+	databaseFile := filepath.Join(dir, "exchange.db")
+	var good string
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		good, err = takeBackup(backupDir)
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+	// something to be replaced, from the old days before schema_version
+	err = copyFile(filepath.Join("bak", "exchange.db"), databaseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	err = restoreDatabase(good, databaseFile, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+databaseFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+	if n := countRowsIn(t, db, "SELECT COUNT(*) FROM users WHERE user_id IN (1, 2)"); n != 2 {
+		t.Error("Restored database doesn't have the backed up users")
+	}
+	if schemaVersion(t, db) != latestSchemaVersion() {
+		t.Error("Restored database should be at the latest schema version")
+	}
+	files, _ := filepath.Glob(filepath.Join(backupDir, "exchange.db.before-restore.*"))
+	if len(files) != 1 {
+		t.Fatal("The replaced database should have been saved first", files)
+	}
+	saved, err := sql.Open("sqlite3", "file:"+files[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer saved.Close()
+	if n := countRowsIn(t, saved, "SELECT COUNT(*) FROM users WHERE user_id = 379769819844575242"); n != 1 {
+		t.Error("Saved copy isn't the database that was replaced")
+	}
+}
+
+func TestMigrationBackupNeverOverwrites(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exchange-backup")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	databaseFile := filepath.Join(dir, "exchange.db")
+	err = ioutil.WriteFile(databaseFile, []byte("version 1"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	clock = &fakeClock{now: time.Now()}
+	defer func() {
+		clock = realClock{}
+	}()
+	first, err := backupDatabaseFile(databaseFile, dir, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = ioutil.WriteFile(databaseFile, []byte("version 2"), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = backupDatabaseFile(databaseFile, dir, 1)
+	if !os.IsExist(err) {
+		t.Error("Second backup in the same second should fail", err)
+	}
+	data, _ := ioutil.ReadFile(first)
+	if string(data) != "version 1" {
+		t.Error("First backup was overwritten or deleted:", string(data))
+	}
+}
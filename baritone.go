@@ -1,7 +1,8 @@
 package main
 
 import (
-	"log"
+	"context"
+	"fmt"
 	"net"
 	"sync"
 	"time"
@@ -9,6 +10,7 @@ import (
 
 var bots []*Bot
 var botsLock sync.Mutex
+var botConnections sync.WaitGroup // one for each bot whose handleMessages is still running
 
 type BotStatus struct {
 	timeReceivedUnixNano    int64
@@ -43,8 +45,12 @@ type BotStatus struct {
 }
 
 type Bot struct {
-	latestStatus *BotStatus
-	conn         net.Conn
+	latestStatus        *BotStatus
+	conn                net.Conn
+	writeLock           sync.Mutex       // held while a whole packet is written, see send in io.go
+	lastSampledUnixNano int64            // when we last saved this bot's status into bot_status_history
+	staleAlerted        bool             // whether we already told the admins this bot went quiet
+	safetyLastFired     map[string]int64 // when each safety rule last fired for this bot, so we don't spam it
 }
 
 func (bs BotStatus) AgeMillis() int64 { // how many milliseconds ago was this bot status received
@@ -63,19 +69,32 @@ func GetBotStatuses() []BotStatus { // get statuses of all currently active bots
 	return statuses
 }
 
-func baritoneListen() { // listen for connections from baritone bots
-	l, err := net.Listen("tcp", ":5021")
+func baritoneListen(ctx context.Context) { // listen for connections from baritone bots until we shut down
+	l, err := net.Listen("tcp", config.BotAddr)
 	if err != nil {
 		panic(err)
 	}
+	acceptBots(ctx, l)
+	disconnectAllBots()
+}
+
+func acceptBots(ctx context.Context, l net.Listener) { // split out so tests can listen on any port
 	defer l.Close()
-	log.Println("Listening for baritowones")
+	go func() {
+		<-ctx.Done()
+		l.Close() // this is what makes Accept return
+	}()
+	botLog.Info("Listening for bots", "addr", l.Addr().String())
 	for {
 		conn, err := l.Accept()
 		if err != nil {
+			if ctx.Err() != nil {
+				botLog.Info("Stopped listening for bots")
+				return
+			}
 			panic(err)
 		}
-		go handleNewBot(conn)
+		handleNewBot(conn)
 	}
 }
 
@@ -87,33 +106,64 @@ func handleNewBot(conn net.Conn) { // handle a new incoming connection that was
 		conn:         conn,
 	}
 	bots = append(bots, bot)
+	botConnections.Add(1)
 	go bot.handleMessages()
 }
 
+// hangs up on every bot and waits for their packet loops to finish whatever they were in the middle of
+func disconnectAllBots() {
+	botsLock.Lock()
+	botLog.Info("Disconnecting bots", "count", len(bots))
+	for _, bot := range bots {
+		bot.conn.Close()
+	}
+	botsLock.Unlock()
+	botConnections.Wait()
+}
+
 func (bot *Bot) handleMessages() { // handle incoming messages coming from a given bot
+	defer bot.disconnected()
 	for {
 		msgType := bot.readByte()
 		switch msgType {
 		case 0:
-			log.Println("status packet uwu")
+			bot.logger().Debug("Status packet")
 			bot.readStatusPacket()
-			log.Println()
 		case 4:
-			log.Println("echest packet uwu")
+			bot.logger().Debug("Ender chest slot packet")
 			bot.readEchestPacket()
-			log.Println()
+		case 6:
+			bot.logger().Debug("Full ender chest packet")
+			bot.readFullEchestPacket()
 		default:
-			log.Println("oh noes! unknown packet type", msgType, "what do :S")
+			bot.logger().Warn("Unknown packet type, disconnecting", "type", msgType)
 			bot.conn.Close() // just destroy everything xdx xdd
 		}
 	}
 }
 
+// the read functions in io.go panic when the connection dies, this is where that ends up
+func (bot *Bot) disconnected() {
+	defer botConnections.Done()
+	if r := recover(); r != nil {
+		bot.logger().Info("Lost connection to bot", "reason", fmt.Sprint(r))
+	}
+	bot.conn.Close()
+	botsLock.Lock()
+	defer botsLock.Unlock()
+	for i, b := range bots {
+		if b == bot {
+			bots = append(bots[:i], bots[i+1:]...)
+			break
+		}
+	}
+}
+
 func (bot *Bot) readStatusPacket() { // read a bot's status
 	status := &BotStatus{
 		timeReceivedUnixNano:    time.Now().UnixNano(),
 		BotUUID:                 bot.readUTF(),
-		ServerIP:                bot.readUTF(),
+		ServerIP:                normalizeServerIP(bot.readUTF()),
 		X:                       bot.readDouble(),
 		Y:                       bot.readDouble(),
 		Z:                       bot.readDouble(),
@@ -141,48 +191,97 @@ func (bot *Bot) readStatusPacket() { // read a bot's status
 		WindowId:                bot.readInt(),
 		EChestOpenNow:           bot.readBoolean(),
 	}
+	if ok, _ := allowRate(RateClassBots, status.BotUUID, time.Now()); !ok {
+		// it's all been read, so skipping the rest keeps us in sync with the stream
+		bot.logger().Debug("Too many status packets, ignoring this one")
+		return
+	}
+	previous := bot.latestStatus
+	botsLock.Lock() // other goroutines read latestStatus under botsLock
 	bot.latestStatus = status
+	wasStale := bot.staleAlerted
+	bot.staleAlerted = false
+	botsLock.Unlock()
+	bot.recordTelemetry(previous, status, wasStale)
+	bot.superviseSafety(status)
 	bot.onBotInventoryUpdate()
-	log.Println("INvy", bot.latestStatus.MainInventory)
+	bot.logger().Debug("Inventory", "inventory", bot.latestStatus.MainInventory)
 }
 
 func (bot *Bot) readEchestPacket() {
 	slot := bot.readInt()
 	item := bot.readUTF()
-	log.Println("They have", item, "in slot", slot)
-	shouldDrop := botHasItemInEchest(slot, item, bot.latestStatus.BotUUID, "2b2t.org")
+	bot.logger().Debug("Ender chest slot", "slot", slot, "item", item)
+	if bot.latestStatus == nil {
+		bot.logger().Warn("Got an echest slot from a bot that hasn't told us who it is yet, ignoring it")
+		return
+	}
+	// an item on a server we don't know won't parse to any listing, so it won't be dropped
+	shouldDrop := botHasItemInEchest(slot, item, bot.latestStatus.BotUUID, bot.latestStatus.ServerIP)
 	if !shouldDrop {
 		return
 	}
+	logger := bot.logger().With("slot", slot, "item", item)
 	go func() {
 		time.Sleep(125 * time.Millisecond)
-		log.Println("DrOpPiNg")
-		if bot.latestStatus.EChestOpenNow {
-			log.Println("okay this dude is open")
-			// bot.latestStatus.WindowId is therefore guaranteed to refer to the echest
-			bot.sendWindowClick(bot.latestStatus.WindowId, slot, 1, THROW)
+		status := bot.status()
+		if status.EChestOpenNow {
+			logger.Info("Dropping item from ender chest")
+			// status.WindowId is therefore guaranteed to refer to the echest
+			bot.sendWindowClick(status.WindowId, slot, 1, THROW)
 		}
 	}()
 }
 
-func (bot *Bot) hasReceivedStatusUpdateInTheLastFiveSeconds() bool {
+// only call this with botsLock held, or from the bot's own handleMessages goroutine
+// tags lines with which bot it is, or just its address if it hasn't sent a status yet
+func (bot *Bot) logger() *Logger {
 	if bot.latestStatus == nil {
+		return botLog.With("addr", bot.conn.RemoteAddr().String())
+	}
+	return botLog.With("bot", bot.latestStatus.BotUUID, "server", bot.latestStatus.ServerIP)
+}
+
+// only call this with botsLock held, or from the bot's own handleMessages goroutine
+func (bot *Bot) hasReceivedStatusUpdateInTheLastFiveSeconds() bool {
+	return bot.latestStatus.isFresh()
+}
+
+func (status *BotStatus) isFresh() bool {
+	if status == nil {
 		return false
 	}
-	return time.Now().UnixNano()-bot.latestStatus.timeReceivedUnixNano < int64(5*time.Second)
+	return time.Now().UnixNano()-status.timeReceivedUnixNano < int64(5*time.Second)
 }
 
-func goToEnderChest() {
-	// lol
+// for reading a bot's status from any goroutine other than its own handleMessages. can be nil
+func (bot *Bot) status() *BotStatus {
 	botsLock.Lock()
 	defer botsLock.Unlock()
-	bots[0].sendChatControl("goto ender_chest") // lol
+	return bot.latestStatus
+}
+
+func goToEnderChest() { // sends every bot to its ender chest
+	botsLock.Lock()
+	all := append([]*Bot(nil), bots...) // not sent with botsLock held, same as requestEchestAudits
+	botsLock.Unlock()
+	for _, bot := range all {
+		bot.goToEnderChest()
+	}
+}
+
+func (bot *Bot) goToEnderChest() {
+	bot.sendChatControl("goto ender_chest")
 }
 
 func (bot *Bot) onBotInventoryUpdate() {
-	log.Println("Reported server ip", bot.latestStatus.ServerIP)
+	if !isServerEnabled(bot.latestStatus.ServerIP) {
+		// don't throw out everything the bot is carrying just because it's somewhere we don't run the exchange
+		bot.logger().Debug("Bot isn't on an enabled server, ignoring its inventory")
+		return
+	}
 	for i, str := range bot.latestStatus.MainInventory {
-		keep := botHasItemInInventory(i, str, bot.latestStatus.BotUUID, "2b2t.org")
+		keep := botHasItemInInventory(i, str, bot.latestStatus.BotUUID, bot.latestStatus.ServerIP)
 		if str != "empty" {
 			slot := i
 			if bot.latestStatus.EChestOpenNow {
@@ -202,7 +301,7 @@ func (bot *Bot) onBotInventoryUpdate() {
 					bot.sendWindowClick(bot.latestStatus.WindowId, slot, 0, QUICK_MOVE)
 					break // only do one at a time
 				} else {
-					goToEnderChest()
+					bot.goToEnderChest()
 				}
 			} else {
 				bot.sendWindowClick(bot.latestStatus.WindowId, slot, 1, THROW)
@@ -0,0 +1,441 @@
+// Package botsim is a fake Baritone bot that speaks the same protocol as the real one,
+// so the controller can be tested without a Minecraft client.
+//
+// It keeps a pretend inventory and ender chest, and acts on window clicks and chat controls
+// the way the real bot would: QUICK_MOVE stashes into the ender chest, THROW drops the item on the ground.
+package botsim
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+const Empty = "empty"
+
+// window click types, in the same order as the controller's ClickType
+const (
+	PICKUP = iota
+	QUICK_MOVE
+	SWAP
+	CLONE
+	THROW
+	QUICK_CRAFT
+	PICKUP_ALL
+)
+
+const EchestWindowID = 1 // the player's own inventory is always window 0
+
+type WindowClick struct {
+	WindowID    int
+	Slot        int
+	MouseButton int
+	ClickType   int
+}
+
+type Bot struct {
+	UUID           string
+	ServerIP       string
+	X              float64
+	Y              float64
+	Z              float64
+	Health         float32
+	Saturation     float32
+	FoodLevel      int
+	Dimension      int
+	CurrentGoal    string
+	CurrentProcess string
+
+	Inventory  [36]string // 0-8 is the hotbar, just like minecraft
+	Echest     [27]string
+	EchestOpen bool
+
+	Dropped      []string      // everything this bot threw on the ground, in order
+	ChatControls []string      // every chat control it was sent, in order
+	Clicks       []WindowClick // every window click it was sent, in order
+
+	// called for every chat control, after the built in ones are handled. can be nil
+	OnChatControl func(bot *Bot, command string)
+
+	conn      net.Conn
+	lock      sync.Mutex // protects everything above
+	writeLock sync.Mutex // so packets don't interleave
+	done      chan struct{}
+	err       error // why the connection ended
+}
+
+// a shulker named with the given anvil name, holding contents in the controller's slot format
+func Shulker(name string, contents string) string {
+	return name + "$tile.shulkerBox;0;1;," + contents
+}
+
+func New(uuid string, server string) *Bot {
+	bot := &Bot{
+		UUID:      uuid,
+		ServerIP:  server,
+		Health:    20,
+		FoodLevel: 20,
+		done:      make(chan struct{}),
+	}
+	for i := range bot.Inventory {
+		bot.Inventory[i] = Empty
+	}
+	for i := range bot.Echest {
+		bot.Echest[i] = Empty
+	}
+	return bot
+}
+
+// connects to the controller at addr (normally ":5021") and sends a first status
+func (bot *Bot) Connect(addr string) error {
+	conn, err := net.Dial("tcp", addr)
+	if err != nil {
+		return err
+	}
+	bot.conn = conn
+	go bot.readLoop()
+	return bot.SendStatus()
+}
+
+func (bot *Bot) Close() error {
+	return bot.conn.Close()
+}
+
+// closed once the controller hangs up or Close is called
+func (bot *Bot) Done() <-chan struct{} {
+	return bot.done
+}
+
+// lets a test look at (or change) the bot's state without racing the read loop
+func (bot *Bot) Do(fn func(bot *Bot)) {
+	bot.lock.Lock()
+	defer bot.lock.Unlock()
+	fn(bot)
+}
+
+// polls until cond is true, returns false if it wasn't by the timeout
+func (bot *Bot) WaitFor(timeout time.Duration, cond func(bot *Bot) bool) bool {
+	deadline := time.Now().Add(timeout)
+	for time.Now().Before(deadline) {
+		bot.lock.Lock()
+		ok := cond(bot)
+		bot.lock.Unlock()
+		if ok {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+// puts an item in the first free inventory slot, like walking over it
+func (bot *Bot) PickUp(item string) error {
+	bot.lock.Lock()
+	slot := firstEmpty(bot.Inventory[:])
+	if slot >= 0 {
+		bot.Inventory[slot] = item
+	}
+	bot.lock.Unlock()
+	if slot < 0 {
+		return errors.New("inventory is full")
+	}
+	return bot.SendStatus()
+}
+
+// opens the ender chest and reports every slot in it, like the real bot does when it arrives
+func (bot *Bot) OpenEchest() error {
+	bot.lock.Lock()
+	bot.EchestOpen = true
+	bot.lock.Unlock()
+	err := bot.SendStatus()
+	if err != nil {
+		return err
+	}
+	for slot := 0; slot < 27; slot++ {
+		bot.lock.Lock()
+		item := bot.Echest[slot]
+		bot.lock.Unlock()
+		if item == Empty {
+			continue
+		}
+		err = bot.SendEchestSlot(slot)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (bot *Bot) CloseEchest() error {
+	bot.lock.Lock()
+	bot.EchestOpen = false
+	bot.lock.Unlock()
+	return bot.SendStatus()
+}
+
+// packet 0
+func (bot *Bot) SendStatus() error {
+	bot.lock.Lock()
+	var buf bytes.Buffer
+	writeByte(&buf, 0)
+	writeUTF(&buf, bot.UUID)
+	writeUTF(&buf, bot.ServerIP)
+	write(&buf, bot.X, bot.Y, bot.Z)
+	write(&buf, float32(0), float32(0)) // yaw and pitch
+	writeBool(&buf, true)               // on ground
+	write(&buf, bot.Health, bot.Saturation, int32(bot.FoodLevel), int32(bot.Dimension))
+	write(&buf, int32(bot.X), int32(bot.Y), int32(bot.Z)) // path start
+	writeBool(&buf, false)                                // has current segment
+	writeBool(&buf, false)                                // has next segment
+	writeBool(&buf, false)                                // calc in progress
+	write(&buf, float64(0))                               // ticks remaining in current
+	writeBool(&buf, false)                                // calc failed last tick
+	writeBool(&buf, true)                                 // safe to cancel
+	writeUTF(&buf, bot.CurrentGoal)
+	writeUTF(&buf, bot.CurrentProcess)
+	for _, item := range bot.Inventory {
+		writeUTF(&buf, item)
+	}
+	for i := 0; i < 4; i++ {
+		writeUTF(&buf, Empty) // armor
+	}
+	writeUTF(&buf, Empty) // off hand
+	windowID := 0
+	if bot.EchestOpen {
+		windowID = EchestWindowID
+	}
+	write(&buf, int32(windowID))
+	writeBool(&buf, bot.EchestOpen)
+	bot.lock.Unlock()
+	return bot.send(buf.Bytes())
+}
+
+// packet 4
+func (bot *Bot) SendEchestSlot(slot int) error {
+	bot.lock.Lock()
+	var buf bytes.Buffer
+	writeByte(&buf, 4)
+	write(&buf, int32(slot))
+	writeUTF(&buf, bot.Echest[slot])
+	bot.lock.Unlock()
+	return bot.send(buf.Bytes())
+}
+
+// packet 6
+func (bot *Bot) SendFullEchest() error {
+	bot.lock.Lock()
+	var buf bytes.Buffer
+	writeByte(&buf, 6)
+	for _, item := range bot.Echest {
+		writeUTF(&buf, item)
+	}
+	bot.lock.Unlock()
+	return bot.send(buf.Bytes())
+}
+
+func (bot *Bot) send(data []byte) error {
+	bot.writeLock.Lock()
+	defer bot.writeLock.Unlock()
+	_, err := bot.conn.Write(data)
+	return err
+}
+
+func (bot *Bot) readLoop() {
+	defer close(bot.done)
+	r := bufio.NewReader(bot.conn)
+	for {
+		var msgType uint8
+		err := binary.Read(r, binary.BigEndian, &msgType)
+		if err == nil {
+			switch msgType {
+			case 1:
+				var command string
+				command, err = readUTF(r)
+				if err == nil {
+					err = bot.handleChatControl(command)
+				}
+			case 5:
+				var click [4]int32
+				err = binary.Read(r, binary.BigEndian, &click)
+				if err == nil {
+					err = bot.handleWindowClick(WindowClick{int(click[0]), int(click[1]), int(click[2]), int(click[3])})
+				}
+			default:
+				err = fmt.Errorf("unknown packet type %d", msgType)
+			}
+		}
+		if err != nil {
+			bot.lock.Lock()
+			bot.err = err
+			bot.lock.Unlock()
+			bot.conn.Close()
+			return
+		}
+	}
+}
+
+// why the connection ended, nil if it hasn't. io.EOF if the controller hung up
+func (bot *Bot) Err() error {
+	bot.lock.Lock()
+	defer bot.lock.Unlock()
+	return bot.err
+}
+
+func (bot *Bot) handleChatControl(command string) error {
+	bot.lock.Lock()
+	bot.ChatControls = append(bot.ChatControls, command)
+	hook := bot.OnChatControl
+	bot.lock.Unlock()
+	var err error
+	switch {
+	case command == "goto ender_chest":
+		if !bot.isEchestOpen() {
+			err = bot.OpenEchest() // pretend we walked there instantly
+		}
+	case command == "audit ender_chest":
+		err = bot.OpenEchest()
+		if err == nil {
+			err = bot.SendFullEchest()
+		}
+	case command == "eat":
+		bot.Do(func(bot *Bot) {
+			bot.FoodLevel = 20
+			bot.Saturation = 5
+		})
+		err = bot.SendStatus()
+	case command == "logout":
+		return io.EOF
+	case strings.HasPrefix(command, "goto "):
+		coords := strings.Fields(command)[1:]
+		if len(coords) == 3 {
+			bot.Do(func(bot *Bot) {
+				bot.X, _ = strconv.ParseFloat(coords[0], 64)
+				bot.Y, _ = strconv.ParseFloat(coords[1], 64)
+				bot.Z, _ = strconv.ParseFloat(coords[2], 64)
+			})
+			err = bot.SendStatus()
+		}
+	}
+	if hook != nil {
+		hook(bot, command)
+	}
+	return err
+}
+
+func (bot *Bot) isEchestOpen() bool {
+	bot.lock.Lock()
+	defer bot.lock.Unlock()
+	return bot.EchestOpen
+}
+
+// window slot numbers the way minecraft (and the controller) count them
+// in the ender chest window, 0-26 is the chest, 27-53 is the main inventory, 54-62 is the hotbar
+// in the player window, 9-35 is the main inventory, 36-44 is the hotbar
+func (bot *Bot) slotFor(windowID int, slot int) (container []string, index int, ok bool) {
+	if windowID == EchestWindowID && bot.EchestOpen {
+		switch {
+		case slot >= 0 && slot < 27:
+			return bot.Echest[:], slot, true
+		case slot >= 27 && slot < 54:
+			return bot.Inventory[:], slot - 27 + 9, true
+		case slot >= 54 && slot < 63:
+			return bot.Inventory[:], slot - 54, true
+		}
+		return nil, 0, false
+	}
+	if windowID != 0 {
+		return nil, 0, false
+	}
+	switch {
+	case slot >= 9 && slot < 36:
+		return bot.Inventory[:], slot, true
+	case slot >= 36 && slot < 45:
+		return bot.Inventory[:], slot - 36, true
+	}
+	return nil, 0, false
+}
+
+func (bot *Bot) handleWindowClick(click WindowClick) error {
+	bot.lock.Lock()
+	bot.Clicks = append(bot.Clicks, click)
+	container, index, ok := bot.slotFor(click.WindowID, click.Slot)
+	if !ok || container[index] == Empty {
+		bot.lock.Unlock()
+		return nil // minecraft ignores clicks on nothing too
+	}
+	inEchest := click.WindowID == EchestWindowID && click.Slot < 27
+	stashedTo := -1
+	switch click.ClickType {
+	case THROW:
+		bot.Dropped = append(bot.Dropped, container[index])
+		container[index] = Empty
+	case QUICK_MOVE:
+		if inEchest || !bot.EchestOpen {
+			break // shift clicking around our own inventory doesn't matter to the controller
+		}
+		stashedTo = firstEmpty(bot.Echest[:])
+		if stashedTo >= 0 {
+			bot.Echest[stashedTo] = container[index]
+			container[index] = Empty
+		}
+	}
+	bot.lock.Unlock()
+	if stashedTo >= 0 {
+		err := bot.SendEchestSlot(stashedTo)
+		if err != nil {
+			return err
+		}
+	}
+	return bot.SendStatus()
+}
+
+func firstEmpty(items []string) int {
+	for i, item := range items {
+		if item == Empty {
+			return i
+		}
+	}
+	return -1
+}
+
+func write(buf *bytes.Buffer, data ...interface{}) {
+	for _, d := range data {
+		binary.Write(buf, binary.BigEndian, d) // can't fail on a bytes.Buffer
+	}
+}
+
+func writeByte(buf *bytes.Buffer, b uint8) {
+	buf.WriteByte(b)
+}
+
+func writeBool(buf *bytes.Buffer, b bool) {
+	if b {
+		buf.WriteByte(1)
+	} else {
+		buf.WriteByte(0)
+	}
+}
+
+func writeUTF(buf *bytes.Buffer, str string) {
+	write(buf, uint16(len(str)))
+	buf.WriteString(str)
+}
+
+func readUTF(r io.Reader) (string, error) {
+	var l uint16
+	err := binary.Read(r, binary.BigEndian, &l)
+	if err != nil {
+		return "", err
+	}
+	data := make([]byte, l)
+	_, err = io.ReadFull(r, data)
+	return string(data), err
+}
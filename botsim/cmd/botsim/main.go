@@ -0,0 +1,58 @@
+// botsim connects a fake bot to a running exchange and runs a script against it
+//
+//	go run ./botsim/cmd/botsim -uuid 51dcd870-d33b-40e9-9fc1-aecdcff96081 -script deposit.txt
+//
+// see botsim.Run for what a script can do
+package main
+
+import (
+	"flag"
+	"io/ioutil"
+	"log"
+	"os"
+
+	"gitlab.com/2b2tq/exchange/botsim"
+)
+
+func main() {
+	addr := flag.String("addr", "localhost:5021", "where the exchange is listening for bots")
+	uuid := flag.String("uuid", "00000000-0000-0000-0000-000000000000", "uuid the bot reports")
+	server := flag.String("server", "2b2t.org", "server the bot says it's on")
+	scriptFile := flag.String("script", "-", "script to run, - for stdin")
+	stay := flag.Bool("stay", false, "stay connected after the script is done, until the exchange hangs up")
+	flag.Parse()
+
+	var script []byte
+	var err error
+	if *scriptFile == "-" {
+		script, err = ioutil.ReadAll(os.Stdin)
+	} else {
+		script, err = ioutil.ReadFile(*scriptFile)
+	}
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	bot := botsim.New(*uuid, *server)
+	bot.OnChatControl = func(bot *botsim.Bot, command string) {
+		log.Println("Chat control:", command)
+	}
+	err = bot.Connect(*addr)
+	if err != nil {
+		log.Fatal(err)
+	}
+	err = bot.Run(string(script))
+	if err != nil {
+		log.Fatal(err)
+	}
+	if *stay {
+		<-bot.Done()
+		log.Println("Disconnected:", bot.Err())
+	}
+	bot.Do(func(bot *botsim.Bot) {
+		log.Println("Ender chest:", bot.Echest)
+		log.Println("Inventory:", bot.Inventory)
+		log.Println("Dropped:", bot.Dropped)
+	})
+	bot.Close()
+}
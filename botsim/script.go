@@ -0,0 +1,119 @@
+package botsim
+
+import (
+	"bufio"
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// how long "waitdrop" and "waitecho" wait before giving up
+const ScriptWaitTimeout = 5 * time.Second
+
+// Run executes a script against a connected bot, one command per line. blank lines and lines starting with # are skipped
+//
+//	pickup <item>      put an item in the inventory, like "pickup 2b2tq.org#0000abcd$tile.shulkerBox;0;1;,item.totem;0;1;"
+//	open               open the ender chest and report every slot in it
+//	close              close the ender chest
+//	status             send a status packet
+//	audit              send the whole ender chest (packet 6)
+//	health <n>         set health, in half hearts
+//	food <n>           set food level
+//	dimension <n>      -1 nether, 0 overworld, 1 end
+//	move <x> <y> <z>   teleport
+//	wait <duration>    sleep, like "wait 200ms"
+//	waitdrop <n>       wait until the bot has dropped n items in total
+//	waitecho <n>       wait until the ender chest has n items in it
+//
+// health, food, dimension and move don't send a status by themselves, follow them with "status"
+func (bot *Bot) Run(script string) error {
+	scanner := bufio.NewScanner(strings.NewReader(script))
+	scanner.Buffer(make([]byte, 64*1024), 1024*1024) // shulker contents with nbt get long
+	line := 0
+	for scanner.Scan() {
+		line++
+		text := strings.TrimSpace(scanner.Text())
+		if text == "" || strings.HasPrefix(text, "#") {
+			continue
+		}
+		err := bot.runCommand(text)
+		if err != nil {
+			return fmt.Errorf("line %d %q: %v", line, text, err)
+		}
+	}
+	return scanner.Err()
+}
+
+func (bot *Bot) runCommand(text string) error {
+	fields := strings.Fields(text)
+	command, args := fields[0], fields[1:]
+	wantArgs := map[string]int{"open": 0, "close": 0, "status": 0, "audit": 0, "health": 1, "food": 1, "dimension": 1, "move": 3, "wait": 1, "waitdrop": 1, "waitecho": 1}
+	if command == "pickup" {
+		item := strings.TrimSpace(strings.TrimPrefix(text, "pickup"))
+		if item == "" {
+			return fmt.Errorf("pickup needs an item")
+		}
+		return bot.PickUp(item)
+	}
+	n, ok := wantArgs[command]
+	if !ok {
+		return fmt.Errorf("unknown command")
+	}
+	if len(args) != n {
+		return fmt.Errorf("%s takes %d arguments", command, n)
+	}
+	nums := make([]float64, len(args))
+	if command != "wait" {
+		for i, arg := range args {
+			var err error
+			nums[i], err = strconv.ParseFloat(arg, 64)
+			if err != nil {
+				return err
+			}
+		}
+	}
+	switch command {
+	case "open":
+		return bot.OpenEchest()
+	case "close":
+		return bot.CloseEchest()
+	case "status":
+		return bot.SendStatus()
+	case "audit":
+		return bot.SendFullEchest()
+	case "health":
+		bot.Do(func(bot *Bot) { bot.Health = float32(nums[0]) })
+	case "food":
+		bot.Do(func(bot *Bot) { bot.FoodLevel = int(nums[0]) })
+	case "dimension":
+		bot.Do(func(bot *Bot) { bot.Dimension = int(nums[0]) })
+	case "move":
+		bot.Do(func(bot *Bot) { bot.X, bot.Y, bot.Z = nums[0], nums[1], nums[2] })
+	case "wait":
+		d, err := time.ParseDuration(args[0])
+		if err != nil {
+			return err
+		}
+		time.Sleep(d)
+	case "waitdrop":
+		if !bot.WaitFor(ScriptWaitTimeout, func(bot *Bot) bool { return len(bot.Dropped) >= int(nums[0]) }) {
+			return fmt.Errorf("timed out, only dropped %d", len(bot.Dropped))
+		}
+	case "waitecho":
+		if !bot.WaitFor(ScriptWaitTimeout, func(bot *Bot) bool { return 27-countEmpty(bot.Echest[:]) >= int(nums[0]) }) {
+			return fmt.Errorf("timed out waiting for the ender chest to fill")
+		}
+	}
+	return nil
+}
+
+func countEmpty(items []string) int {
+	n := 0
+	for _, item := range items {
+		if item == Empty {
+			n++
+		}
+	}
+	return n
+}
@@ -0,0 +1,34 @@
+package botsim
+
+import (
+	"net"
+	"testing"
+)
+
+func TestScriptErrors(t *testing.T) {
+	client, server := net.Pipe()
+	defer server.Close()
+	go func() {
+		buf := make([]byte, 4096)
+		for {
+			_, err := server.Read(buf) // throw away whatever the bot sends
+			if err != nil {
+				return
+			}
+		}
+	}()
+	bot := New("uuid", "2b2t.org")
+	bot.conn = client
+	err := bot.Run("# comment\n\nhealth 5\nfood 3\nmove 1 2 3\nstatus\npickup a$b")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if bot.Health != 5 || bot.FoodLevel != 3 || bot.Z != 3 || bot.Inventory[0] != "a$b" {
+		t.Errorf("Script didn't change the bot %+v", bot)
+	}
+	for _, bad := range []string{"fly", "health", "health lots", "wait forever"} {
+		if bot.Run(bad) == nil {
+			t.Errorf("Script %q didn't fail", bad)
+		}
+	}
+}
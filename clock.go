@@ -0,0 +1,45 @@
+package main
+
+import (
+	"math/rand"
+	"sync"
+	"time"
+)
+
+// anything that decides whether something has expired asks clock what time it is instead of time.Now or sqlite's strftime('%s', 'now')
+// so that tests can skip ahead days at a time. the time always goes into sql as a parameter
+// bot statuses are the exception, "has this bot talked to us in the last five seconds" is about the real network, not the game
+type Clock interface {
+	Now() time.Time
+}
+
+type realClock struct{}
+
+func (realClock) Now() time.Time {
+	return time.Now()
+}
+
+var clock Clock = realClock{}
+
+// unix seconds, what every timestamp column in the database is in
+func unixNow() int64 {
+	return clock.Now().Unix()
+}
+
+// randomness for things like force sell delays. tests call seedRandom to make it repeatable
+// never for anything someone could profit from guessing, deposit ids and withdrawal codes come from crypto/rand in codes.go
+// a rand.Rand isn't safe to share between goroutines on its own, hence the lock
+var random = rand.New(rand.NewSource(time.Now().UnixNano()))
+var randomLock sync.Mutex
+
+func seedRandom(seed int64) {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	random = rand.New(rand.NewSource(seed))
+}
+
+func randomInt63n(n int64) int64 {
+	randomLock.Lock()
+	defer randomLock.Unlock()
+	return random.Int63n(n)
+}
@@ -0,0 +1,157 @@
+package main
+
+import (
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/binary"
+	"encoding/hex"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// deposit ids and withdrawal codes
+// both come from crypto/rand and never the seeded source in clock.go. anyone who can guess a withdrawal code can have someone else's item dropped to them
+// and both are checked against every live row before being handed out, so two pending things can never share one
+
+const CodeAttempts = 10 // a collision is already astronomically unlikely, this is just so a broken check can't loop forever
+
+var ErrBadWithdrawalCode = errors.New("That isn't a withdrawal code, check it for typos")
+
+// a var so tests can make it collide on purpose
+var secureUint64 = func() (uint64, error) {
+	b := make([]byte, 8)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return 0, err
+	}
+	return binary.BigEndian.Uint64(b), nil
+}
+
+// a deposit id is the 8 hex digits at the end of the anvil name, so it's a uint32 (see depositIDToName)
+// it can't be used by a pending deposit or by anything in the inventory, because a deposit's item keeps its deposit id as its item_id forever
+// 0 is what nameToDepositID returns for a bad name, so that's never used either
+// the name doesn't get a check digit: every shulker we already hold is named in this format, and it's checked against the database anyway when a bot picks it up
+func newDepositID(sql *sql.Tx) (uint32, error) {
+	for i := 0; i < CodeAttempts; i++ {
+		r, err := secureUint64()
+		if err != nil {
+			return 0, err
+		}
+		id := uint32(r)
+		if id == 0 {
+			continue
+		}
+		var taken int
+		err = sql.QueryRow("SELECT (SELECT COUNT(*) FROM pending_deposits WHERE deposit_id = ?) + (SELECT COUNT(*) FROM inventory WHERE item_id = ?)", id, id).Scan(&taken)
+		if err != nil {
+			return 0, err
+		}
+		if taken == 0 {
+			return id, nil
+		}
+		ordersLog.Warn("Deposit id collision, trying another", "corr", depositCorrelation(id))
+	}
+	return 0, errors.New("Unable to find an unused deposit id")
+}
+
+// withdrawal codes get typed into the site or whispered to a bot, so they're shown as base 32 in groups of four, like 7K2M-Q9XD-4HBW
+// the first 11 characters are 55 random bits and the last is a check character, so a typo is caught instead of being looked up
+// the alphabet is crockford's, with no I, L, O or U, and parsing reads I and L as 1 and O as 0
+const withdrawalCodeAlphabet = "0123456789ABCDEFGHJKMNPQRSTVWXYZ"
+const WithdrawalCodeBits = 55
+const withdrawalCodeDigits = WithdrawalCodeBits / 5
+
+func newWithdrawalCode(sql *sql.Tx) (int64, error) {
+	for i := 0; i < CodeAttempts; i++ {
+		r, err := secureUint64()
+		if err != nil {
+			return 0, err
+		}
+		code := int64(r >> (64 - WithdrawalCodeBits))
+		if code == 0 {
+			continue
+		}
+		var taken int
+		err = sql.QueryRow("SELECT COUNT(*) FROM pending_withdrawals WHERE withdrawal_code = ?", code).Scan(&taken)
+		if err != nil {
+			return 0, err
+		}
+		if taken == 0 {
+			return code, nil
+		}
+		ordersLog.Warn("Withdrawal code collision, trying another", "corr", withdrawalCorrelation(code))
+	}
+	return 0, errors.New("Unable to find an unused withdrawal code")
+}
+
+// luhn mod 32 over the digits, catches any one wrong character and nearly every pair of neighbours swapped
+func withdrawalCodeCheck(digits []int) int {
+	sum := 0
+	factor := 2
+	for i := len(digits) - 1; i >= 0; i-- {
+		addend := digits[i] * factor
+		sum += addend/32 + addend%32
+		if factor == 2 {
+			factor = 1
+		} else {
+			factor = 2
+		}
+	}
+	return (32 - sum%32) % 32
+}
+
+func formatWithdrawalCode(code int64) string {
+	digits := make([]int, withdrawalCodeDigits)
+	for i := withdrawalCodeDigits - 1; i >= 0; i-- {
+		digits[i] = int(code % 32)
+		code /= 32
+	}
+	digits = append(digits, withdrawalCodeCheck(digits))
+	var b strings.Builder
+	for i, d := range digits {
+		if i > 0 && i%4 == 0 {
+			b.WriteByte('-')
+		}
+		b.WriteByte(withdrawalCodeAlphabet[d])
+	}
+	return b.String()
+}
+
+// forgiving about case, dashes, spaces and the letters that look like digits, but not about the check character
+func parseWithdrawalCode(str string) (int64, error) {
+	digits := make([]int, 0, withdrawalCodeDigits+1)
+	for _, c := range strings.ToUpper(str) {
+		switch c {
+		case '-', ' ':
+			continue
+		case 'I', 'L':
+			c = '1'
+		case 'O':
+			c = '0'
+		}
+		d := strings.IndexRune(withdrawalCodeAlphabet, c)
+		if d < 0 {
+			return 0, ErrBadWithdrawalCode
+		}
+		digits = append(digits, d)
+	}
+	if len(digits) != withdrawalCodeDigits+1 {
+		return 0, ErrBadWithdrawalCode
+	}
+	if withdrawalCodeCheck(digits[:withdrawalCodeDigits]) != digits[withdrawalCodeDigits] {
+		return 0, ErrBadWithdrawalCode
+	}
+	var code int64
+	for _, d := range digits[:withdrawalCodeDigits] {
+		code = code*32 + int64(d)
+	}
+	return code, nil
+}
+
+// the correlation id is a hash of the code and not the code itself, because the code is as good as the item to anyone who reads the logs
+func withdrawalCorrelation(code int64) string {
+	sum := sha256.Sum256([]byte(strconv.FormatInt(code, 10)))
+	return "withdrawal-" + hex.EncodeToString(sum[:4])
+}
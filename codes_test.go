@@ -0,0 +1,151 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestWithdrawalCodeFormat(t *testing.T) {
+	for _, code := range []int64{1, 12345, 1<<WithdrawalCodeBits - 1} {
+		str := formatWithdrawalCode(code)
+		if len(str) != 14 || strings.Count(str, "-") != 2 {
+			t.Error("Code should look like XXXX-XXXX-XXXX, got", str)
+		}
+		for _, typed := range []string{str, strings.ToLower(str), strings.Replace(str, "-", " ", -1), strings.Replace(str, "-", "", -1)} {
+			parsed, err := parseWithdrawalCode(typed)
+			if err != nil || parsed != code {
+				t.Error("Code didn't round trip", code, typed, parsed, err)
+			}
+		}
+	}
+	if parsed, err := parseWithdrawalCode(strings.Replace(strings.Replace(formatWithdrawalCode(1), "0", "O", -1), "1", "l", -1)); err != nil || parsed != 1 {
+		t.Error("O and l should be read as 0 and 1", parsed, err)
+	}
+
+	// every one character typo and every swap of two different neighbours should be caught
+	str := strings.Replace(formatWithdrawalCode(0x1234567890abc), "-", "", -1)
+	caught, swaps := 0, 0
+	for i := range str {
+		for _, c := range withdrawalCodeAlphabet {
+			if byte(c) == str[i] {
+				continue
+			}
+			if _, err := parseWithdrawalCode(str[:i] + string(c) + str[i+1:]); err == nil {
+				t.Errorf("Typo at %d (%c) wasn't caught", i, c)
+			}
+		}
+		if i+1 < len(str) && str[i] != str[i+1] {
+			swaps++
+			if _, err := parseWithdrawalCode(str[:i] + str[i+1:i+2] + str[i:i+1] + str[i+2:]); err != nil {
+				caught++
+			}
+		}
+	}
+	if caught != swaps {
+		t.Errorf("Only caught %d of %d swaps", caught, swaps)
+	}
+	for _, bad := range []string{"", "ABCD-EFGH", "ABCD-EFGH-JKMN-P", "UUUU-UUUU-UUUU", "!"} {
+		if _, err := parseWithdrawalCode(bad); err != ErrBadWithdrawalCode {
+			t.Error("Should have been rejected:", bad)
+		}
+	}
+}
+
+func TestNewCodes(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := RunSQL(func(sql *sql.Tx) error {
+			seen := make(map[int64]bool)
+			for i := 0; i < 100; i++ {
+				deposit_id, err := newDepositID(sql)
+				if err != nil {
+					return err
+				}
+				if deposit_id == 0 || deposit_id == 6 || deposit_id == 7 || nameToDepositID(depositIDToName(deposit_id)) != deposit_id {
+					t.Error("Bad deposit id", deposit_id)
+				}
+				code, err := newWithdrawalCode(sql)
+				if err != nil {
+					return err
+				}
+				if code <= 0 || code >= 1<<WithdrawalCodeBits || seen[code] {
+					t.Error("Bad withdrawal code", code)
+				}
+				seen[code] = true
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
+
+// replaces the random source with one that returns these, then the last one forever
+func withRandom(values []uint64, fn func()) {
+	saved := secureUint64
+	secureUint64 = func() (uint64, error) {
+		r := values[0]
+		if len(values) > 1 {
+			values = values[1:]
+		}
+		return r, nil
+	}
+	defer func() {
+		secureUint64 = saved
+	}()
+	fn()
+}
+
+func TestCodeCollisions(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t) // items 6 and 7 are in inventory
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO pending_deposits (deposit_id, user_id, listing_id, expiry_time) VALUES (8, 1, 2, ?)", unixNow()+60)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (5, 7, ?)", unixNow()+60)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		// withdrawal codes are the top WithdrawalCodeBits of the random number
+		code := func(c uint64) uint64 {
+			return c << (64 - WithdrawalCodeBits)
+		}
+
+		err = RunSQL(func(sql *sql.Tx) error {
+			withRandom([]uint64{0, 6, 8, 7, 9}, func() {
+				id, err := newDepositID(sql)
+				if err != nil || id != 9 {
+					t.Error("Should have skipped 0 and the ids in use", id, err)
+				}
+			})
+			withRandom([]uint64{7}, func() {
+				_, err := newDepositID(sql)
+				if err == nil || err.Error() != "Unable to find an unused deposit id" {
+					t.Error("Should have given up on an id that's always taken", err)
+				}
+			})
+			withRandom([]uint64{code(0), code(5), code(5), code(6)}, func() {
+				c, err := newWithdrawalCode(sql)
+				if err != nil || c != 6 {
+					t.Error("Should have skipped 0 and the code in use", c, err)
+				}
+			})
+			withRandom([]uint64{code(5)}, func() {
+				_, err := newWithdrawalCode(sql)
+				if err == nil || err.Error() != "Unable to find an unused withdrawal code" {
+					t.Error("Should have given up on a code that's always taken", err)
+				}
+			})
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+	})
+}
@@ -0,0 +1,318 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"reflect"
+	"strconv"
+	"strings"
+)
+
+// everything you'd want to change when deploying somewhere other than your laptop
+// settings come from the profile's defaults, then the config file, then EXCHANGE_* env variables, in that order
+// secrets (SESSION_SECRET, DISCORD_KEY, DISCORD_SECRET, DISCORD_BOT_TOKEN) stay in their own env variables and never go in the file
+
+const (
+	ProfileDev  = "dev"
+	ProfileProd = "prod"
+)
+
+const DefaultConfigFile = "config.json" // override with EXCHANGE_CONFIG
+
+// minecraft won't let you type more than this many characters into an anvil
+const MaxAnvilNameLength = 35
+
+type Config struct {
+	Profile string `json:"profile"` // dev or prod
+
+	DomainName          string `json:"domain_name"`           // where the site lives, like "https://2b2tq.org", no trailing slash. discord redirects back here after login
+	HTTPAddr            string `json:"http_addr"`             // what the website listens on, like ":3000"
+	BotAddr             string `json:"bot_addr"`              // what the baritone bots connect to, like ":5021"
+	CookieHTTPOnly      bool   `json:"cookie_http_only"`      // stop javascript from reading the session cookie
+	CookieSecure        bool   `json:"cookie_secure"`         // only send the session cookie over https
+	CookieSameSite      string `json:"cookie_same_site"`      // lax, strict or none. lax still lets the login redirect back from discord carry the cookie
+	SessionLifetimeDays int64  `json:"session_lifetime_days"` // how long a login lasts before you have to log in again
+	MetricsToken        string `json:"metrics_token"`         // if set, /metrics wants "Authorization: Bearer <this>". empty means anyone can scrape it
+	RateLimits          string `json:"rate_limits"`           // overrides of the defaults in ratelimit.go, like "orders=2:20,bots=off" for 2 a second with bursts of 20
+	BehindProxy         bool   `json:"behind_proxy"`          // trust the last X-Forwarded-For address for rate limiting by IP, only turn this on behind a reverse proxy
+
+	DatabaseFile string `json:"database_file"`
+	BackupDir    string `json:"backup_dir"` // where the database gets copied before migrating, and where scheduled backups go
+
+	BackupIntervalMinutes int64   `json:"backup_interval_minutes"` // how often to take an online backup, 0 turns them off
+	BackupKeep            int64   `json:"backup_keep"`             // how many scheduled backups to keep before deleting the oldest
+	GuildID               string  `json:"guild_id"`                // you have to be in this discord server to log in
+	RequiredRoleIDs       string  `json:"required_role_ids"`       // comma separated discord role ids, you need at least one of them to log in and trade. empty means being in the server is enough
+	MembershipCheckHours  int64   `json:"membership_check_hours"`  // how often everyone's discord membership is checked again, 0 turns the check off (leaving and bans still suspend straight away)
+	AdminDiscordIDs       []int64 `json:"admin_discord_ids"`       // who can use /admin and gets DMed about anything that needs a human. as an env override, comma separated like "1234,5678"
+
+	ForceSellMinSeconds      int64  `json:"force_sell_min_seconds"`     // after a slot expires, it gets force sold somewhere between min and max seconds later
+	ForceSellMaxSeconds      int64  `json:"force_sell_max_seconds"`     //
+	SlotLifetimeSeconds      int64  `json:"slot_lifetime_seconds"`      // how long a slot lasts before it expires, and how much each renewal adds
+	DepositTimeoutSeconds    int64  `json:"deposit_timeout_seconds"`    // how long someone has to hand their shulker to a bot
+	WithdrawalTimeoutSeconds int64  `json:"withdrawal_timeout_seconds"` // how long someone has to confirm a withdrawal
+	ItemPrefix               string `json:"item_prefix"`                // deposited shulkers get renamed to this followed by 8 hex digits
+
+	LogFile        string `json:"log_file"`         // where logs go as well as stdout, empty for only stdout
+	LogLevel       string `json:"log_level"`        // debug, info, warn or error, for every component that isn't in log_levels
+	LogLevels      string `json:"log_levels"`       // per component overrides like "bot=debug,db=warn". admins can change these on /admin while it's running
+	LogMaxSizeMB   int64  `json:"log_max_size_mb"`  // start a new log file once it gets this big, 0 for no limit
+	LogRotateHours int64  `json:"log_rotate_hours"` // and every this many hours, 0 for never
+	LogKeep        int64  `json:"log_keep"`         // how many old log files to keep
+}
+
+var config = defaultConfig(ProfileDev) // tests use the dev defaults, main replaces this with loadConfig
+
+func defaultConfig(profile string) *Config {
+	c := &Config{
+		Profile:                  profile,
+		DomainName:               "http://localhost:3000",
+		HTTPAddr:                 ":3000",
+		BotAddr:                  ":5021",
+		CookieHTTPOnly:           true,
+		CookieSecure:             false,
+		CookieSameSite:           "lax",
+		SessionLifetimeDays:      30,
+		DatabaseFile:             "exchange.db",
+		BackupDir:                "backups",
+		BackupIntervalMinutes:    60,
+		BackupKeep:               48,
+		GuildID:                  "510930252676071439",
+		MembershipCheckHours:     24,
+		ForceSellMinSeconds:      60 * 5,
+		ForceSellMaxSeconds:      60 * 10,
+		SlotLifetimeSeconds:      86400,
+		DepositTimeoutSeconds:    15 * 60,
+		WithdrawalTimeoutSeconds: 15 * 60,
+		ItemPrefix:               "2b2tq.org#",
+		LogFile:                  "exchange.log",
+		LogLevel:                 "info",
+		LogMaxSizeMB:             100,
+		LogRotateHours:           24,
+		LogKeep:                  14,
+	}
+	if profile == ProfileProd {
+		c.DomainName = "" // there's no sensible default, it has to be set
+		c.CookieSecure = true
+	}
+	return c
+}
+
+// reads the config file at path (it's fine if it doesn't exist) and applies env overrides on top
+func loadConfig(path string, getenv func(string) string) (*Config, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil && !os.IsNotExist(err) {
+		return nil, err
+	}
+
+	// the profile picks the defaults, so it has to be figured out before anything else
+	var fromFile struct {
+		Profile string `json:"profile"`
+	}
+	if data != nil {
+		err = json.Unmarshal(data, &fromFile)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	profile := ProfileDev
+	if fromFile.Profile != "" {
+		profile = fromFile.Profile
+	}
+	if env := getenv("EXCHANGE_PROFILE"); env != "" {
+		profile = env
+	}
+	if profile != ProfileDev && profile != ProfileProd {
+		return nil, fmt.Errorf("unknown profile %q, must be %q or %q", profile, ProfileDev, ProfileProd)
+	}
+
+	c := defaultConfig(profile)
+	if data != nil {
+		decoder := json.NewDecoder(bytes.NewReader(data))
+		decoder.DisallowUnknownFields() // a typo in the file should be loud, not silently ignored
+		err = decoder.Decode(c)
+		if err != nil {
+			return nil, fmt.Errorf("%s: %v", path, err)
+		}
+	}
+	c.Profile = profile
+
+	err = c.applyEnv(getenv)
+	if err != nil {
+		return nil, err
+	}
+	err = c.validate()
+	if err != nil {
+		return nil, err
+	}
+	return c, nil
+}
+
+// every field can be overridden by an env variable named after its json key, like EXCHANGE_HTTP_ADDR
+func (c *Config) applyEnv(getenv func(string) string) error {
+	v := reflect.ValueOf(c).Elem()
+	for i := 0; i < v.NumField(); i++ {
+		key := v.Type().Field(i).Tag.Get("json")
+		if key == "profile" {
+			continue // already handled
+		}
+		name := "EXCHANGE_" + strings.ToUpper(key)
+		str := getenv(name)
+		if str == "" {
+			continue
+		}
+		field := v.Field(i)
+		switch field.Kind() {
+		case reflect.String:
+			field.SetString(str)
+		case reflect.Int64:
+			n, err := strconv.ParseInt(str, 10, 64)
+			if err != nil {
+				return fmt.Errorf("%s must be a number: %v", name, err)
+			}
+			field.SetInt(n)
+		case reflect.Bool:
+			b, err := strconv.ParseBool(str)
+			if err != nil {
+				return fmt.Errorf("%s must be true or false: %v", name, err)
+			}
+			field.SetBool(b)
+		case reflect.Slice:
+			if field.Type().Elem().Kind() != reflect.Int64 {
+				panic("config field " + key + " has a type applyEnv doesn't know about")
+			}
+			list := reflect.MakeSlice(field.Type(), 0, 0)
+			for _, item := range strings.Split(str, ",") {
+				item = strings.TrimSpace(item)
+				if item == "" {
+					continue
+				}
+				n, err := strconv.ParseInt(item, 10, 64)
+				if err != nil {
+					return fmt.Errorf("%s must be numbers separated by commas: %v", name, err)
+				}
+				list = reflect.Append(list, reflect.ValueOf(n))
+			}
+			field.Set(list)
+		default:
+			panic("config field " + key + " has a type applyEnv doesn't know about")
+		}
+	}
+	return nil
+}
+
+func (c *Config) validate() error {
+	if c.DomainName == "" {
+		return errors.New("domain_name must be set")
+	}
+	u, err := url.Parse(c.DomainName)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || u.Host == "" || u.Path != "" {
+		return fmt.Errorf("domain_name %q must look like https://example.com with no path or trailing slash", c.DomainName)
+	}
+	if c.Profile == ProfileProd {
+		if u.Scheme != "https" {
+			return errors.New("domain_name must be https in prod")
+		}
+		if !c.CookieSecure || !c.CookieHTTPOnly {
+			return errors.New("cookie_secure and cookie_http_only must both be on in prod")
+		}
+	}
+	if c.CookieSameSite != "lax" && c.CookieSameSite != "strict" && c.CookieSameSite != "none" {
+		return fmt.Errorf("cookie_same_site %q must be lax, strict or none", c.CookieSameSite)
+	}
+	if c.CookieSameSite == "none" && !c.CookieSecure {
+		return errors.New("browsers ignore cookie_same_site none without cookie_secure")
+	}
+	if c.SessionLifetimeDays <= 0 {
+		return errors.New("session_lifetime_days must be positive")
+	}
+	for _, addr := range []string{c.HTTPAddr, c.BotAddr} {
+		_, port, err := net.SplitHostPort(addr)
+		if err != nil {
+			return fmt.Errorf("listen address %q is invalid: %v", addr, err)
+		}
+		_, err = strconv.ParseUint(port, 10, 16)
+		if err != nil {
+			return fmt.Errorf("listen address %q has an invalid port", addr)
+		}
+	}
+	if c.HTTPAddr == c.BotAddr {
+		return errors.New("http_addr and bot_addr can't be the same")
+	}
+	if c.DatabaseFile == "" {
+		return errors.New("database_file must be set")
+	}
+	if c.BackupIntervalMinutes < 0 || c.BackupKeep < 1 {
+		return errors.New("backup_interval_minutes can't be negative and backup_keep must be at least 1")
+	}
+	if c.BackupIntervalMinutes > 0 && c.BackupDir == "" {
+		return errors.New("backup_dir must be set to take scheduled backups")
+	}
+	_, err = strconv.ParseUint(c.GuildID, 10, 64)
+	if err != nil {
+		return fmt.Errorf("guild_id %q must be a discord id", c.GuildID)
+	}
+	for _, role := range strings.Split(c.RequiredRoleIDs, ",") {
+		role = strings.TrimSpace(role)
+		if role == "" {
+			continue
+		}
+		_, err = strconv.ParseUint(role, 10, 64)
+		if err != nil {
+			return fmt.Errorf("required_role_ids %q must be discord ids separated by commas", c.RequiredRoleIDs)
+		}
+	}
+	for _, id := range c.AdminDiscordIDs {
+		if id <= 0 {
+			return fmt.Errorf("admin_discord_ids has %d, which isn't a discord id", id)
+		}
+	}
+	if c.MembershipCheckHours < 0 {
+		return errors.New("membership_check_hours can't be negative")
+	}
+	if c.ForceSellMinSeconds <= 0 || c.ForceSellMaxSeconds < c.ForceSellMinSeconds {
+		return errors.New("force_sell_min_seconds must be positive and no more than force_sell_max_seconds")
+	}
+	if c.SlotLifetimeSeconds <= 0 || c.DepositTimeoutSeconds <= 0 || c.WithdrawalTimeoutSeconds <= 0 {
+		return errors.New("slot_lifetime_seconds, deposit_timeout_seconds and withdrawal_timeout_seconds must be positive")
+	}
+	_, err = parseRateLimits(c.RateLimits)
+	if err != nil {
+		return err
+	}
+	_, err = parseLevel(c.LogLevel)
+	if err != nil {
+		return err
+	}
+	_, err = parseComponentLevels(c.LogLevels)
+	if err != nil {
+		return err
+	}
+	if c.LogMaxSizeMB < 0 || c.LogRotateHours < 0 || c.LogKeep < 1 {
+		return errors.New("log_max_size_mb and log_rotate_hours can't be negative and log_keep must be at least 1")
+	}
+	if c.ItemPrefix == "" || itemNameLength(c.ItemPrefix) > MaxAnvilNameLength {
+		return fmt.Errorf("item_prefix must be between 1 and %d characters so the whole name fits in an anvil", MaxAnvilNameLength-8)
+	}
+	return nil
+}
+
+// called once at startup, before anything else reads config
+func setupConfig() {
+	path := os.Getenv("EXCHANGE_CONFIG")
+	if path == "" {
+		path = DefaultConfigFile
+	}
+	c, err := loadConfig(path, os.Getenv)
+	if err != nil {
+		panic("Invalid configuration: " + err.Error())
+	}
+	config = c
+	mainLog.Info("Loaded config", "profile", c.Profile, "domain", c.DomainName, "http", c.HTTPAddr, "bots", c.BotAddr)
+}
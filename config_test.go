@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func envFrom(env map[string]string) func(string) string {
+	return func(key string) string {
+		return env[key]
+	}
+}
+
+func writeConfigFile(t *testing.T, contents string) string {
+	dir, err := ioutil.TempDir("", "exchange-config")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "config.json")
+	err = ioutil.WriteFile(path, []byte(contents), 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path
+}
+
+func TestConfigDefaultsWithoutFile(t *testing.T) {
+	c, err := loadConfig(filepath.Join(os.TempDir(), "does-not-exist.json"), envFrom(nil))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(c, defaultConfig(ProfileDev)) {
+		t.Error("Missing config file should give the dev defaults", c)
+	}
+}
+
+func TestConfigFileAndEnvOverrides(t *testing.T) {
+	path := writeConfigFile(t, `{"domain_name": "http://example.com", "http_addr": ":8080", "force_sell_max_seconds": 900}`)
+	defer os.RemoveAll(filepath.Dir(path))
+	c, err := loadConfig(path, envFrom(map[string]string{
+		"EXCHANGE_HTTP_ADDR":         ":9090",
+		"EXCHANGE_COOKIE_HTTP_ONLY":  "false",
+		"EXCHANGE_ITEM_PREFIX":       "test#",
+		"EXCHANGE_ADMIN_DISCORD_IDS": "1234, 5678",
+	}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if c.DomainName != "http://example.com" || c.ForceSellMaxSeconds != 900 {
+		t.Error("File settings weren't applied", c)
+	}
+	if c.HTTPAddr != ":9090" || c.CookieHTTPOnly || c.ItemPrefix != "test#" {
+		t.Error("Env overrides weren't applied on top of the file", c)
+	}
+	if !reflect.DeepEqual(c.AdminDiscordIDs, []int64{1234, 5678}) {
+		t.Error("Admin ids from the env should be split on commas", c.AdminDiscordIDs)
+	}
+	if c.BotAddr != ":5021" {
+		t.Error("Settings missing from the file should keep their defaults", c)
+	}
+}
+
+func TestProdProfile(t *testing.T) {
+	_, err := loadConfig("", envFrom(map[string]string{"EXCHANGE_PROFILE": ProfileProd}))
+	if err == nil {
+		t.Error("Prod without a domain name should be rejected")
+	}
+	_, err = loadConfig("", envFrom(map[string]string{"EXCHANGE_PROFILE": ProfileProd, "EXCHANGE_DOMAIN_NAME": "http://2b2tq.org"}))
+	if err == nil {
+		t.Error("Prod without https should be rejected")
+	}
+	_, err = loadConfig("", envFrom(map[string]string{"EXCHANGE_PROFILE": ProfileProd, "EXCHANGE_DOMAIN_NAME": "https://2b2tq.org", "EXCHANGE_COOKIE_SECURE": "false"}))
+	if err == nil {
+		t.Error("Prod without secure cookies should be rejected")
+	}
+	c, err := loadConfig("", envFrom(map[string]string{"EXCHANGE_PROFILE": ProfileProd, "EXCHANGE_DOMAIN_NAME": "https://2b2tq.org"}))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !c.CookieSecure {
+		t.Error("Prod should default to secure cookies")
+	}
+}
+
+func TestConfigValidation(t *testing.T) {
+	bad := []string{
+		`{"profile": "staging"}`,
+		`{"domian_name": "http://example.com"}`,
+		`{"domain_name": "http://example.com/"}`,
+		`{"domain_name": "example.com"}`,
+		`{"http_addr": "3000"}`,
+		`{"bot_addr": ":3000"}`,
+		`{"guild_id": "2b2t"}`,
+		`{"force_sell_min_seconds": 600, "force_sell_max_seconds": 300}`,
+		`{"deposit_timeout_seconds": 0}`,
+		`{"item_prefix": "this prefix is much too long to fit"}`,
+		`{"rate_limits": "orders=fast"}`,
+		`{"log_level": "verbose"}`,
+		`{"cookie_same_site": "sideways"}`,
+		`{"cookie_same_site": "none"}`,
+		`{"session_lifetime_days": 0}`,
+		`{"required_role_ids": "123,moderator"}`,
+		`{"membership_check_hours": -1}`,
+		`{"log_levels": "bot"}`,
+		`{"log_keep": 0}`,
+		`{"admin_discord_ids": [1234, -5]}`,
+		`{"admin_discord_ids": "1234"}`,
+	}
+	for _, contents := range bad {
+		path := writeConfigFile(t, contents)
+		_, err := loadConfig(path, envFrom(nil))
+		os.RemoveAll(filepath.Dir(path))
+		if err == nil {
+			t.Error("Config should have been rejected:", contents)
+		}
+	}
+	_, err := loadConfig("", envFrom(map[string]string{"EXCHANGE_SLOT_LIFETIME_SECONDS": "a day"}))
+	if err == nil {
+		t.Error("Non numeric env override should be rejected")
+	}
+	_, err = loadConfig("", envFrom(map[string]string{"EXCHANGE_ADMIN_DISCORD_IDS": "1234,me"}))
+	if err == nil {
+		t.Error("Non numeric admin id should be rejected")
+	}
+}
@@ -1,13 +1,13 @@
 package main
 
 import (
-	"log"
 	"strconv"
 	"strings"
 )
 
-const ItemPrefix = "2b2tq.org#"
-const ItemNameLength = len(ItemPrefix) + 8 // 8 hex digits == uint32 in hexadecimal
+func itemNameLength(prefix string) int {
+	return len(prefix) + 8 // 8 hex digits == uint32 in hexadecimal
+}
 
 func botHasItemInInventory(pos int, item string, botUUID string, server string) bool {
 	listing, id := parseItem(item, server)
@@ -20,13 +20,13 @@ func botHasItemInInventory(pos int, item string, botUUID string, server string)
 // returns true if bot should drop, false otherwise
 func botHasItemInEchest(pos int, item string, botUUID string, server string) bool {
 	listing, id := parseItem(item, server)
-	log.Println("Got listing and id", listing, "wew", id)
 	if listing == nil {
 		return false // FOR NOW, do not drop items that don't match that we already have in echest
 	}
-	log.Println("IN ENDER CHEST", listing, id)
 	res := confirmedSavedInEchest(botUUID, pos, listing.ListingID, id)
-	log.Println("Result:", res)
+	if !res {
+		botLog.Info("Item in ender chest shouldn't be there, dropping it", "corr", depositCorrelation(id), "bot", botUUID, "slot", pos, "listing", listing.ListingID)
+	}
 	return !res
 }
 
@@ -41,7 +41,7 @@ func parseItem(item string, server string) (*Listing, uint32) {
 	}
 	if depositIDToName(id) != name {
 		// sanity check
-		log.Println(id, name)
+		botLog.Debug("Item name doesn't round trip", "name", name, "id", id)
 		return nil, 0
 	}
 	if len(data) < 40 {
@@ -51,18 +51,17 @@ func parseItem(item string, server string) (*Listing, uint32) {
 		return nil, 0
 	}
 	data = data[strings.Index(data, ";")+6:]
-	log.Println("Depsoit ID", id)
-	return getListingForContentsOnServer(data, server), id
+	return getListingForContentsOnServer(data, server, id), id
 }
 
 func nameToDepositID(name string) uint32 {
-	if len(name) != ItemNameLength {
+	if len(name) != itemNameLength(config.ItemPrefix) {
 		return 0
 	}
-	if name[:len(ItemPrefix)] != ItemPrefix {
+	if name[:len(config.ItemPrefix)] != config.ItemPrefix {
 		return 0
 	}
-	d, err := strconv.ParseUint(name[len(ItemPrefix):], 16, 32) // base 16, 32 bit
+	d, err := strconv.ParseUint(name[len(config.ItemPrefix):], 16, 32) // base 16, 32 bit
 	if err != nil {
 		return 0
 	}
@@ -74,8 +73,8 @@ func depositIDToName(id uint32) string {
 	for len(str) < 8 {
 		str = "0" + str
 	}
-	str = ItemPrefix + str
-	if len(str) != ItemNameLength {
+	str = config.ItemPrefix + str
+	if len(str) != itemNameLength(config.ItemPrefix) {
 		panic(id)
 	}
 	return str
@@ -3,20 +3,38 @@ package main
 import (
 	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"runtime"
+	"runtime/debug"
+	"strconv"
+	"strings"
 	"sync"
+	"syscall"
+	"time"
 
 	_ "github.com/mattn/go-sqlite3"
 )
 
-const databaseFile = "exchange.db"
+// WAL mode lets the read pool keep reading while the writer is in the middle of a transaction
+func databaseFullPath() string {
+	return "file:" + config.DatabaseFile + "?_sync=3&_txlock=exclusive&_foreign_keys=1&_journal_mode=WAL&_busy_timeout=5000"
+}
 
-const databaseFullPath = "file:" + databaseFile + "?_sync=3&_txlock=exclusive&_foreign_keys=1"
+// query_only makes sqlite itself refuse any write, and deferred means a read never takes a lock the writer would have to wait on
+// (not mode=ro, a read only connection can't share the WAL index with the writer)
+func databaseReadPath() string {
+	return "file:" + config.DatabaseFile + "?_query_only=1&_txlock=deferred&_foreign_keys=1&_journal_mode=WAL&_busy_timeout=5000"
+}
 
 // the below is from the faq for go-sqlite3, but with the foreign key part added
 const databaseTestPath = "file::memory:?mode=memory&cache=shared&_foreign_keys=1"
 
 var ErrNoRows = sql.ErrNoRows
+var ErrDatabaseClosed = errors.New("the database has been shut down")
 
 // bunch of crazy stuff in here
 
@@ -25,36 +43,199 @@ var shutdownChan = make(chan struct{})
 var shutdownConfirm = make(chan struct{})
 var ctx = context.Background()
 var lock sync.Mutex
+var readDB *sql.DB                   // the read only pool, nil in test mode where there's no file to share
+var databaseClosed = closedChannel() // closed whenever databaseLoop isn't running, so RunSQL fails instead of waiting forever
+var databaseClosedLock sync.Mutex
+var databaseFileLock *os.File // see lockDatabaseFile, nil in test mode
+
+const ReadPoolSize = 8
+
+const QueryTimeout = 30 * time.Second // for RunSQL, and RunSQLContext when the context doesn't have a deadline already
 
 type Query struct {
+	ctx        context.Context
 	exec       func(sql *sql.Tx) error
+	raw        func(db *sql.DB) error // instead of exec, for the rare thing that needs the whole database and not a transaction
 	completion chan error
+	queuedAt   time.Time
+	caller     string // where RunSQL was called from, for reporting slow and stuck transactions
 }
 
 func SetupDatabase() {
-	setupDatabase(databaseFullPath)
+	// held until ShutdownDatabase, and the kernel lets go of it if we crash
+	var err error
+	databaseFileLock, err = lockDatabaseFile(config.DatabaseFile)
+	if err != nil {
+		panic(err)
+	}
+	setupDatabase(databaseFullPath(), databaseReadPath(), config.BackupDir)
+}
+
+// sqlite only locks the file during a transaction, so an idle exchange looks just like a stopped one
+// this is what tells them apart: whoever has the database open holds an exclusive flock on databaseFile.lock, with their pid in it
+// so a second exchange, or a restore, on the same database refuses instead of pulling it out from under the first one
+func lockDatabaseFile(databaseFile string) (*os.File, error) {
+	f, err := os.OpenFile(databaseFile+".lock", os.O_RDWR|os.O_CREATE, 0600)
+	if err != nil {
+		return nil, err
+	}
+	err = syscall.Flock(int(f.Fd()), syscall.LOCK_EX|syscall.LOCK_NB)
+	if err != nil {
+		holder, _ := ioutil.ReadAll(f)
+		f.Close()
+		if err == syscall.EWOULDBLOCK {
+			return nil, fmt.Errorf("%s is in use by another process (pid %s), stop it first", databaseFile, strings.TrimSpace(string(holder)))
+		}
+		return nil, err
+	}
+	err = f.Truncate(0)
+	if err == nil {
+		_, err = f.WriteAt([]byte(strconv.Itoa(os.Getpid())+"\n"), 0)
+	}
+	if err != nil {
+		f.Close()
+		return nil, err
+	}
+	return f, nil
 }
 
 func SetupDatabaseTestMode() {
-	setupDatabase(databaseTestPath)
+	setupDatabase(databaseTestPath, "", "") // nothing to back up in memory
 }
 
-func setupDatabase(fullPath string) {
+func setupDatabase(fullPath string, readPath string, backupDir string) {
 	lock.Lock()
-	log.Println("Opening database file")
+	dbLog.Info("Opening database file", "file", config.DatabaseFile)
 	db, err := sql.Open("sqlite3", fullPath)
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Database connection created")
+	dbLog.Debug("Database connection created")
+	_, err = migrate(db, false, config.DatabaseFile, backupDir)
+	if err != nil {
+		panic(err) // immediately quit if we cannot create or update our tables
+	}
+	if readPath != "" {
+		// opened after migrating, so the file and its WAL definitely exist by now
+		readDB, err = sql.Open("sqlite3", readPath)
+		if err != nil {
+			panic(err)
+		}
+		readDB.SetMaxOpenConns(ReadPoolSize)
+		readDB.SetMaxIdleConns(ReadPoolSize)
+	}
+	dbLog.Info("Database setup completed")
+	storageCheckLock.Lock()
+	lastStorageCheck = nil // whatever was checked before was a different database
+	storageCheckLock.Unlock()
+	databaseClosedLock.Lock()
+	databaseClosed = make(chan struct{})
+	databaseClosedLock.Unlock()
 	go databaseLoop(db)
-	initialSetup()
 }
 
+// RunSQL with no deadline of its own, it gets QueryTimeout
 func RunSQL(fn func(sql *sql.Tx) error) error {
-	ch := make(chan error)
-	queriesChan <- Query{exec: fn, completion: ch}
-	return <-ch
+	return runSQL(ctx, fn, callerLocation(1))
+}
+
+// runs fn in a transaction on databaseLoop, one at a time, and commits unless fn returns an error
+// if c is cancelled or its deadline passes while waiting in the queue, fn never runs. if it happens during fn, the transaction is rolled back
+// either way, this only returns once the loop is done with it, so an error always means nothing was committed
+func RunSQLContext(c context.Context, fn func(sql *sql.Tx) error) error {
+	return runSQL(c, fn, callerLocation(1))
+}
+
+func runSQL(c context.Context, fn func(sql *sql.Tx) error, caller string) error {
+	c, cancel := withQueryTimeout(c)
+	defer cancel()
+	return enqueue(c, Query{exec: fn, caller: caller})
+}
+
+// like RunSQL but fn gets the database itself, still with nothing else running at the same time
+// only for things like backups that can't happen inside a transaction, so there's no timeout. use RunSQL for everything else
+func RunOnDatabase(fn func(db *sql.DB) error) error {
+	return enqueue(ctx, Query{raw: fn, caller: callerLocation(1)})
+}
+
+func enqueue(c context.Context, q Query) error {
+	q.ctx = c
+	q.completion = make(chan error, 1) // buffered so databaseLoop never waits on us
+	q.queuedAt = time.Now()
+	databaseClosedLock.Lock()
+	closed := databaseClosed
+	databaseClosedLock.Unlock()
+	queueDepth(1)
+	select {
+	case queriesChan <- q:
+		return <-q.completion
+	case <-closed:
+		queueDepth(-1)
+		dbLog.Warn("Database is shut down, dropping transaction", "caller", q.caller)
+		return ErrDatabaseClosed
+	case <-c.Done():
+		queueDepth(-1)
+		dbLog.Warn("Gave up waiting for the database", "caller", q.caller, "waited", time.Since(q.queuedAt), "err", c.Err())
+		return c.Err()
+	}
+}
+
+func withQueryTimeout(c context.Context) (context.Context, context.CancelFunc) {
+	if _, ok := c.Deadline(); ok {
+		return context.WithCancel(c)
+	}
+	return context.WithTimeout(c, QueryTimeout)
+}
+
+// file:line of whoever called the function that called this, skip levels further up
+func callerLocation(skip int) string {
+	_, file, line, ok := runtime.Caller(skip + 1)
+	if !ok {
+		return "unknown"
+	}
+	return filepath.Base(file) + ":" + strconv.Itoa(line)
+}
+
+// RunReadSQL with no deadline of its own, it gets QueryTimeout
+func RunReadSQL(fn func(sql *sql.Tx) error) error {
+	return runReadSQL(ctx, fn, callerLocation(1))
+}
+
+// for anything that only reads, like rendering a page or answering the api
+// these go straight to the read pool instead of queueing up behind order matching in databaseLoop
+// every read in fn sees the same snapshot of the database, just like in RunSQL. any write is an error
+func RunReadSQLContext(c context.Context, fn func(sql *sql.Tx) error) error {
+	return runReadSQL(c, fn, callerLocation(1))
+}
+
+func runReadSQL(c context.Context, fn func(sql *sql.Tx) error, caller string) error {
+	c, cancel := withQueryTimeout(c)
+	defer cancel()
+	if readDB == nil {
+		return enqueue(c, Query{exec: readOnly(fn), caller: caller})
+	}
+	start := time.Now()
+	tx, err := readDB.BeginTx(c, nil)
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback() // nothing to commit
+	waited := time.Now()
+	err = fn(tx)
+	recordQueryLatency(QueryKindRead, caller, waited.Sub(start), time.Since(waited))
+	return err
+}
+
+// test mode has no read pool, but a write in RunReadSQL should still fail there instead of only in production
+func readOnly(fn func(sql *sql.Tx) error) func(sql *sql.Tx) error {
+	return func(sql *sql.Tx) error {
+		_, err := sql.Exec("PRAGMA query_only = 1")
+		if err != nil {
+			return err
+		}
+		defer sql.Exec("PRAGMA query_only = 0") // deferred so it happens even if fn panics, this outlives the transaction
+		return fn(sql)
+	}
 }
 
 func databaseLoop(db *sql.DB) {
@@ -66,31 +247,73 @@ func databaseLoop(db *sql.DB) {
 	for {
 		select {
 		case <-shutdownChan:
+			databaseClosedLock.Lock()
+			close(databaseClosed)
+			databaseClosedLock.Unlock()
 			return
 		case query := <-queriesChan:
-			query.execute(db)
+			queueDepth(-1)
+			start := time.Now()
+			setRunningQuery(query.caller, start)
+			err := query.execute(db)
+			setRunningQuery("", time.Time{})
+			recordQueryLatency(QueryKindWrite, query.caller, start.Sub(query.queuedAt), time.Since(start)) // before completing, so the caller always sees itself counted
+			query.completion <- err
 		}
 	}
 }
 
-func (q Query) execute(db *sql.DB) {
-	tx, err := db.BeginTx(ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+// a panic in here would kill databaseLoop and freeze the whole exchange, so it's turned into an error like any other
+func (q Query) execute(db *sql.DB) (err error) {
+	err = q.ctx.Err()
 	if err != nil {
-		log.Println("Unable to even begin transaction!")
-		q.completion <- err
-		return
+		return err // gave up while it was queued, don't bother
+	}
+	var tx *sql.Tx
+	defer func() {
+		r := recover()
+		if r == nil {
+			return
+		}
+		dbLog.Error("Recovered from panic in database transaction", "caller", q.caller, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+		if tx != nil {
+			tx.Rollback()
+		}
+		err = fmt.Errorf("panic in database transaction: %v", r)
+	}()
+	if q.raw != nil {
+		return q.raw(db)
+	}
+	tx, err = db.BeginTx(q.ctx, &sql.TxOptions{Isolation: sql.LevelSerializable})
+	if err != nil {
+		dbLog.Error("Unable to even begin transaction", "caller", q.caller, "err", err)
+		return err
 	}
 	err = (q.exec)(tx)
 	if err != nil {
 		tx.Rollback()
-		log.Println("Rolling back database transaction due to error ", err)
-		q.completion <- err
-		return
+		dbLog.Debug("Rolling back database transaction", "caller", q.caller, "err", err)
+		return err
 	}
-	q.completion <- tx.Commit()
+	return tx.Commit()
 }
 
 func ShutdownDatabase() {
 	shutdownChan <- struct{}{}
 	<-shutdownConfirm
+	if readDB != nil {
+		readDB.Close()
+		readDB = nil
+	}
+	if databaseFileLock != nil {
+		databaseFileLock.Close()
+		databaseFileLock = nil
+	}
+}
+
+// before the database is first set up, it counts as shut down
+func closedChannel() chan struct{} {
+	c := make(chan struct{})
+	close(c)
+	return c
 }
@@ -1,9 +1,15 @@
 package main
 
 import (
+	"context"
 	"database/sql"
+	"io/ioutil"
 	"log"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 // two helper funcs to test the database
@@ -13,6 +19,25 @@ func WithTestingDatabase(fn func()) {
 	fn()
 }
 
+// a real database file in WAL mode with the read pool, like in production
+func WithTestingDatabaseFile(t *testing.T, fn func()) {
+	dir, err := ioutil.TempDir("", "exchange-db")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	saved := config
+	c := *config
+	c.DatabaseFile = filepath.Join(dir, "exchange.db")
+	config = &c
+	defer func() {
+		config = saved
+	}()
+	SetupDatabase()
+	defer ShutdownDatabase()
+	fn()
+}
+
 func WithTestingSingleQuery(t *testing.T, fn func(sql *sql.Tx) error) {
 	WithTestingDatabase(func() {
 		err := RunSQL(fn)
@@ -134,3 +159,207 @@ func TestForeignKeys(t *testing.T) {
 		}
 	})
 }
+
+func TestReadsRejectWrites(t *testing.T) {
+	write := func(sql *sql.Tx) error {
+		_, err := sql.Exec("INSERT INTO users (user_id) VALUES (1)")
+		return err
+	}
+	WithTestingDatabase(func() {
+		if RunReadSQL(write) == nil {
+			t.Error("Write in RunReadSQL should fail in test mode")
+		}
+		// and the connection shouldn't be stuck read only afterwards
+		err := RunSQL(write)
+		if err != nil {
+			t.Error(err)
+		}
+	})
+	WithTestingDatabaseFile(t, func() {
+		if RunReadSQL(write) == nil {
+			t.Error("Write in RunReadSQL should fail on the read pool")
+		}
+	})
+}
+
+func TestReadsDontWaitForWriter(t *testing.T) {
+	WithTestingDatabaseFile(t, func() {
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO users (user_id) VALUES (1)")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		before := getQueryLatencies()
+
+		// hold the writer in the middle of a transaction for a while
+		writing := make(chan struct{})
+		written := make(chan error)
+		go func() {
+			written <- RunSQL(func(sql *sql.Tx) error {
+				_, err := sql.Exec("INSERT INTO users (user_id) VALUES (2)")
+				close(writing)
+				time.Sleep(300 * time.Millisecond)
+				return err
+			})
+		}()
+		<-writing
+		queued := make(chan error)
+		go func() {
+			queued <- RunSQL(func(sql *sql.Tx) error {
+				return nil
+			})
+		}()
+
+		start := time.Now()
+		var users int
+		err = RunReadSQL(func(sql *sql.Tx) error {
+			return sql.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+		})
+		elapsed := time.Since(start)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if elapsed > 150*time.Millisecond {
+			t.Error("Read waited for the writer, took", elapsed)
+		}
+		if users != 1 {
+			t.Error("Read should see the last committed state, not the write in progress, saw", users, "users")
+		}
+		if err := <-written; err != nil {
+			t.Fatal(err)
+		}
+		if err := <-queued; err != nil {
+			t.Fatal(err)
+		}
+
+		after := getQueryLatencies()
+		if after[1].Count <= before[1].Count {
+			t.Error("Read wasn't counted")
+		}
+		if after[0].MaxWait < 100*time.Millisecond {
+			t.Error("The write queued behind the slow one should have waited, max wait was", after[0].MaxWait)
+		}
+		err = RunReadSQL(func(sql *sql.Tx) error {
+			return sql.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+		})
+		if err != nil || users != 2 {
+			t.Error("Read after the write committed should see it", users, err)
+		}
+	})
+}
+
+func TestWaitPercentile(t *testing.T) {
+	l := QueryLatency{Count: 100, Buckets: make([]int64, len(QueryWaitBuckets)+1)}
+	l.Buckets[0] = 90
+	l.Buckets[2] = 9
+	l.Buckets[len(QueryWaitBuckets)] = 1
+	if p := l.WaitPercentile(0.5); p != "≤ 1ms" {
+		t.Error("p50 should be in the first bucket, got", p)
+	}
+	if p := l.WaitPercentile(0.99); p != "≤ 25ms" {
+		t.Error("p99 should be in the third bucket, got", p)
+	}
+	if p := l.WaitPercentile(1); p != "> 2.5s" {
+		t.Error("p100 should be the overflow bucket, got", p)
+	}
+}
+
+func TestPanicInTransaction(t *testing.T) {
+	WithTestingDatabase(func() {
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO users (user_id) VALUES (?)", 5021)
+			if err != nil {
+				return err
+			}
+			var listing *Listing
+			listing.ItemName = "boom" // nil pointer dereference
+			return nil
+		})
+		if err == nil || !strings.Contains(err.Error(), "panic") {
+			t.Fatal("Panic should have come back as an error, got", err)
+		}
+
+		// the loop is still alive, and the insert before the panic was rolled back
+		var users int
+		err = RunSQL(func(sql *sql.Tx) error {
+			return sql.QueryRow("SELECT COUNT(*) FROM users").Scan(&users)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if users != 0 {
+			t.Error("Transaction that panicked should have been rolled back, found", users, "users")
+		}
+	})
+}
+
+func TestCancelledWhileQueued(t *testing.T) {
+	WithTestingDatabase(func() {
+		release := make(chan struct{})
+		started := make(chan struct{})
+		blocking := make(chan error)
+		go func() {
+			blocking <- RunSQL(func(sql *sql.Tx) error {
+				close(started)
+				<-release
+				return nil
+			})
+		}()
+		<-started
+
+		c, cancel := context.WithTimeout(context.Background(), 50*time.Millisecond)
+		defer cancel()
+		ran := false
+		err := RunSQLContext(c, func(sql *sql.Tx) error {
+			ran = true
+			return nil
+		})
+		if err != context.DeadlineExceeded {
+			t.Error("Should have given up waiting once the deadline passed, got", err)
+		}
+		if getWriteQueueDepth() != 0 {
+			t.Error("Giving up should take it out of the queue depth, it's", getWriteQueueDepth())
+		}
+
+		// accepted by the loop but cancelled before it got a turn
+		c, cancel = context.WithCancel(context.Background())
+		queued := make(chan error)
+		go func() {
+			queued <- RunSQLContext(c, func(sql *sql.Tx) error {
+				ran = true
+				return nil
+			})
+		}()
+		time.Sleep(20 * time.Millisecond)
+		cancel()
+		close(release)
+		if err := <-blocking; err != nil {
+			t.Fatal(err)
+		}
+		err = <-queued
+		if err != context.Canceled {
+			t.Error("Should have been cancelled, got", err)
+		}
+		if ran {
+			t.Error("Cancelled transaction should never have run")
+		}
+	})
+}
+
+func TestFindStuckQuery(t *testing.T) {
+	defer setRunningQuery("", time.Time{})
+	setRunningQuery("orders.go:1", time.Now())
+	if message := findStuckQuery(); message != "" {
+		t.Error("Just started, shouldn't be stuck", message)
+	}
+	setRunningQuery("orders.go:1", time.Now().Add(-2*StuckQueryThreshold))
+	message := findStuckQuery()
+	if !strings.Contains(message, "orders.go:1") {
+		t.Error("Should have reported the stuck transaction, got", message)
+	}
+	if message := findStuckQuery(); message != "" {
+		t.Error("Should only be reported once, got", message)
+	}
+}
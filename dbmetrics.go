@@ -0,0 +1,197 @@
+package main
+
+import (
+	"strconv"
+	"sync"
+	"time"
+)
+
+// how long queries wait for the database, so we can see whether the writer queue is what's making pages slow
+// "write" is everything through RunSQL, where waiting means sitting in queriesChan until databaseLoop picks it up
+// "read" is RunReadSQL on the read pool, where waiting means getting a connection and starting the transaction
+
+const (
+	QueryKindWrite = "write"
+	QueryKindRead  = "read"
+)
+
+const SlowQueryThreshold = time.Second       // transactions that take longer than this to run get logged
+const StuckQueryThreshold = 60 * time.Second // admins get DMed if databaseLoop has been on one transaction this long
+
+// upper bounds of the wait time histogram buckets, anything slower goes in one last bucket
+var QueryWaitBuckets = []time.Duration{
+	time.Millisecond,
+	5 * time.Millisecond,
+	25 * time.Millisecond,
+	100 * time.Millisecond,
+	500 * time.Millisecond,
+	2500 * time.Millisecond,
+}
+
+type QueryLatency struct {
+	Kind      string
+	Count     int64
+	TotalWait time.Duration
+	MaxWait   time.Duration
+	TotalRun  time.Duration // time actually spent in the transaction
+	MaxRun    time.Duration
+	Slow      int64   // how many took longer than SlowQueryThreshold to run
+	Buckets   []int64 // Buckets[i] is how many waited at most QueryWaitBuckets[i], the extra last one is everything slower
+}
+
+var queryLatencyLock sync.Mutex
+var queryLatencies = make(map[string]*QueryLatency)
+var writeQueueDepth int64 // RunSQL callers that haven't been picked up by databaseLoop yet
+
+// what databaseLoop is working on right now
+var runningQueryCaller string
+var runningQuerySince time.Time
+var stuckQueryReported time.Time // runningQuerySince of the last one admins were told about, so they're only told once
+
+func queueDepth(delta int64) {
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	writeQueueDepth += delta
+}
+
+func getWriteQueueDepth() int64 {
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	return writeQueueDepth
+}
+
+func setRunningQuery(caller string, since time.Time) {
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	runningQueryCaller = caller
+	runningQuerySince = since
+}
+
+// where the transaction databaseLoop is running came from and how long it's been going, "" if it's idle
+func getRunningQuery() (string, time.Duration) {
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	if runningQueryCaller == "" {
+		return "", 0
+	}
+	return runningQueryCaller, time.Since(runningQuerySince)
+}
+
+// the database watchdog job, returns 1 if it told admins about a stuck transaction
+func databaseWatchdog() (int64, error) {
+	message := findStuckQuery()
+	if message == "" {
+		return 0, nil
+	}
+	dbLog.Error(message)
+	go DMadmins(message)
+	return 1, nil
+}
+
+// a message about the transaction databaseLoop is stuck on, or "" if it isn't stuck or admins already know
+func findStuckQuery() string {
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	if runningQueryCaller == "" || runningQuerySince.Equal(stuckQueryReported) {
+		return ""
+	}
+	running := time.Since(runningQuerySince)
+	if running < StuckQueryThreshold {
+		return ""
+	}
+	stuckQueryReported = runningQuerySince
+	return "Database transaction from " + runningQueryCaller + " has been running for " + running.Round(time.Second).String() + ", everything else that writes is waiting on it. " + strconv.FormatInt(writeQueueDepth, 10) + " queued"
+}
+
+func recordQueryLatency(kind string, caller string, wait time.Duration, run time.Duration) {
+	if run > SlowQueryThreshold {
+		dbLog.Warn("Slow transaction", "kind", kind, "caller", caller, "waited", wait, "ran", run)
+	}
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	l, ok := queryLatencies[kind]
+	if !ok {
+		l = &QueryLatency{Kind: kind, Buckets: make([]int64, len(QueryWaitBuckets)+1)}
+		queryLatencies[kind] = l
+	}
+	l.Count++
+	l.TotalWait += wait
+	l.TotalRun += run
+	if wait > l.MaxWait {
+		l.MaxWait = wait
+	}
+	if run > l.MaxRun {
+		l.MaxRun = run
+	}
+	if run > SlowQueryThreshold {
+		l.Slow++
+	}
+	bucket := len(QueryWaitBuckets)
+	for i, bound := range QueryWaitBuckets {
+		if wait <= bound {
+			bucket = i
+			break
+		}
+	}
+	l.Buckets[bucket]++
+}
+
+// a copy of the latencies so far, writes first
+func getQueryLatencies() []QueryLatency {
+	queryLatencyLock.Lock()
+	defer queryLatencyLock.Unlock()
+	result := make([]QueryLatency, 0, 2)
+	for _, kind := range []string{QueryKindWrite, QueryKindRead} {
+		l, ok := queryLatencies[kind]
+		if !ok {
+			result = append(result, QueryLatency{Kind: kind, Buckets: make([]int64, len(QueryWaitBuckets)+1)})
+			continue
+		}
+		copied := *l
+		copied.Buckets = append([]int64(nil), l.Buckets...)
+		result = append(result, copied)
+	}
+	return result
+}
+
+func (l QueryLatency) AverageWait() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.TotalWait / time.Duration(l.Count)
+}
+
+func (l QueryLatency) AverageRun() time.Duration {
+	if l.Count == 0 {
+		return 0
+	}
+	return l.TotalRun / time.Duration(l.Count)
+}
+
+// which bucket the p'th percentile wait falls in, like "≤ 5ms", from the histogram
+func (l QueryLatency) WaitPercentile(p float64) string {
+	if l.Count == 0 {
+		return "-"
+	}
+	target := int64(float64(l.Count)*p + 0.999999) // round up, the 99th percentile of 10 queries is the 10th
+	var seen int64
+	for i, n := range l.Buckets {
+		seen += n
+		if seen >= target {
+			if i == len(QueryWaitBuckets) {
+				return "> " + QueryWaitBuckets[len(QueryWaitBuckets)-1].String()
+			}
+			return "≤ " + QueryWaitBuckets[i].String()
+		}
+	}
+	return "-"
+}
+
+// for the admin page, what each bucket's column heading is
+func queryWaitBucketNames() []string {
+	names := make([]string, 0, len(QueryWaitBuckets)+1)
+	for _, bound := range QueryWaitBuckets {
+		names = append(names, "≤ "+bound.String())
+	}
+	return append(names, "> "+QueryWaitBuckets[len(QueryWaitBuckets)-1].String())
+}
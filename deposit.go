@@ -1,28 +1,25 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"log"
-	"math/rand"
 	"strconv"
-	"time"
 )
 
-const TimeToCompleteDepositSeconds = 15 * 60
-
-func pendingDepositCleanup() {
-	ticker := time.NewTicker(time.Second * 10)
-	for range ticker.C {
-		err := RunSQL(func(sql *sql.Tx) error {
-			_, err := sql.Exec("DELETE FROM pending_deposits WHERE expiry_time < strftime('%s', 'now') AND (picked_up_at IS NULL OR picked_up_at < strftime('%s', 'now') - 86400)")
-			return err
-		})
+// the pending deposit cleanup job, returns how many it deleted
+func cleanupPendingDeposits() (int64, error) {
+	now := unixNow()
+	var deleted int64
+	err := RunSQL(func(sql *sql.Tx) error {
+		result, err := sql.Exec("DELETE FROM pending_deposits WHERE expiry_time < ? AND (picked_up_at IS NULL OR picked_up_at < ? - 86400)", now, now)
 		if err != nil {
-			log.Println("Error while cleaning up unfulfilled pending deposits")
-			log.Println(err)
+			return err
 		}
-	}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	return deleted, err
 }
 
 // Called when a bot picks up an item and validated it as a correct item to check if the item is a valid deposit
@@ -33,23 +30,24 @@ func pendingDepositCleanup() {
 // Deposit valid -> return true
 // Deposit invalid -> return false
 func botPicksUpItem(listing_id int64, name uint32) bool {
+	logger := ordersLog.With("corr", depositCorrelation(name), "listing", listing_id)
 	err := RunSQL(func(sql *sql.Tx) error {
 		var user_id int64
-		err := sql.QueryRow("SELECT user_id FROM pending_deposits WHERE deposit_id = ? AND listing_id = ? AND expiry_time > strftime('%s', 'now')", name, listing_id).Scan(&user_id)
+		now := unixNow()
+		err := sql.QueryRow("SELECT user_id FROM pending_deposits WHERE deposit_id = ? AND listing_id = ? AND expiry_time > ?", name, listing_id, now).Scan(&user_id)
 		if err != nil {
 			return err
 		}
-		_, err = sql.Exec("UPDATE pending_deposits SET picked_up_at = strftime('%s', 'now') WHERE deposit_id = ?", name)
+		_, err = sql.Exec("UPDATE pending_deposits SET picked_up_at = ? WHERE deposit_id = ?", now, name)
 		if err != nil {
 			return err
 		}
-		go DMuser(user_id, "The deposit bot has picked up your item for listing "+strconv.FormatInt(listing_id, 10)+" and verified its contents and name. Ender chest verification is pending, and should only take a few seconds.")
+		logger.Info("Bot picked up deposit", "user", user_id)
+		go DMuserCorr(user_id, depositCorrelation(name), "The deposit bot has picked up your item for listing "+strconv.FormatInt(listing_id, 10)+" and verified its contents and name. Ender chest verification is pending, and should only take a few seconds.")
 		return nil // no error
 	})
 	if err != nil {
-		log.Println("Verifying listing", listing_id, "and deposit id", name)
-		log.Println("Deposit check error")
-		log.Println(err)
+		logger.Info("Rejecting picked up item", "err", err)
 		// there was no matching row found in pending_deposits, or there was an error setting picked_up_at
 		// either way, it's not safe for the bot to keep this item
 		return false
@@ -65,6 +63,7 @@ func botPicksUpItem(listing_id int64, name uint32) bool {
 // Everything okay -> return true (keep in echest)
 // Something wrong -> return false (bot drops it?)
 func confirmedSavedInEchest(bot_uuid string, slot_number int, listing_id int64, name uint32) bool {
+	logger := ordersLog.With("corr", depositCorrelation(name), "listing", listing_id)
 	shouldDrop := false
 	err := RunSQL(func(sql *sql.Tx) error {
 		var user_id int64
@@ -99,7 +98,7 @@ func confirmedSavedInEchest(bot_uuid string, slot_number int, listing_id int64,
 		if err != nil {
 			return err
 		}
-		log.Println("Adding to inventory", listing_id, bot_uuid, slot_number)
+		logger.Info("Deposit confirmed in ender chest, adding to inventory", "bot", bot_uuid, "slot", slot_number)
 		_, err = sql.Exec("INSERT INTO inventory (listing_id, bot_uuid, slot_number, item_id) VALUES (?, ?, ?, ?)", listing_id, bot_uuid, slot_number, name)
 		if err != nil {
 			return err
@@ -124,12 +123,12 @@ func confirmedSavedInEchest(bot_uuid string, slot_number int, listing_id int64,
 			return err
 		}
 
-		go DMuser(user_id, "Deposit confirmed!!!!!!!!!!")
+		go DMuserCorr(user_id, depositCorrelation(name), "Deposit confirmed!!!!!!!!!!")
 
 		return nil
 	})
 	if err != nil {
-		log.Println("Pickup error", err)
+		logger.Warn("Unable to confirm item in ender chest", "bot", bot_uuid, "slot", slot_number, "drop", shouldDrop, "err", err)
 	}
 	// this system needs to be fail-safe
 	// if there is a generic SQL error, we do NOT want to drop all our stock immediately!
@@ -146,18 +145,33 @@ func clearPending(user_id int64, name uint32) {
 		return err
 	})
 	if err != nil {
-		log.Println("Error while deleting from pending deposits??", err)
+		ordersLog.Error("Unable to delete pending deposit", "corr", depositCorrelation(name), "err", err)
 	}
-	DMuser(user_id, "Error while completing deposit: all of your slots are full. Bot will drop item back to you.")
+	DMuserCorr(user_id, depositCorrelation(name), "Error while completing deposit: all of your slots are full. Bot will drop item back to you.")
 }
 
 // Creates a pending deposit with a randomly generated ID
-func createPendingDeposit(user_id int64, listing_id int64) (int64, error) {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	deposit_id := r.Int63()
-	err := RunSQL(func(sql *sql.Tx) error {
-		_, err := sql.Exec("INSERT INTO pending_deposits (deposit_id, user_id, listing_id, expiry_time) VALUES (?, ?, ?, strftime('%s','now') + ?)", deposit_id, user_id, listing_id, TimeToCompleteDepositSeconds)
+func createPendingDeposit(ctx context.Context, user_id int64, listing_id int64) (int64, error) {
+	var deposit_id int64
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		err := checkNotSuspended(sql, user_id)
+		if err != nil {
+			return err
+		}
+		err = checkListingTradable(sql, listing_id)
+		if err != nil {
+			return err
+		}
+		id, err := newDepositID(sql)
+		if err != nil {
+			return err
+		}
+		deposit_id = int64(id)
+		_, err = sql.Exec("INSERT INTO pending_deposits (deposit_id, user_id, listing_id, expiry_time) VALUES (?, ?, ?, ?)", deposit_id, user_id, listing_id, unixNow()+config.DepositTimeoutSeconds)
 		return err
 	})
+	if err == nil {
+		logFor(ctx, ordersLog).Info("Created pending deposit", "corr", depositCorrelation(uint32(deposit_id)), "user", user_id, "listing", listing_id)
+	}
 	return deposit_id, err
 }
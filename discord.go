@@ -2,7 +2,6 @@ package main
 
 import (
 	"errors"
-	"log"
 	"os"
 	"strconv"
 
@@ -11,37 +10,90 @@ import (
 
 const Currency = "R€" // i literally hate pasting the euro symbol everywhere so im making it a constant
 
-var discord *discordgo.Session
+// everything we need from discord, so tests can swap in a fake that just records what would have been sent
+type Discord interface {
+	DM(user_id int64, message string) error
+	// their role ids, and false if they aren't in the guild at all
+	GuildMemberRoles(guild_id string, user_id int64) ([]string, bool, error)
+	Connected() bool // whether the gateway connection is up right now, for /readyz
+}
+
+var discord Discord // nil until setupDiscordBot connects
+
+type discordSession struct {
+	session *discordgo.Session
+}
 
 func setupDiscordBot() {
 	token := os.Getenv("DISCORD_BOT_TOKEN")
 	if token == "" {
 		panic("Must set environment variable DISCORD_BOT_TOKEN")
 	}
-	log.Println("Establishing discord connection")
-	var err error
-	discord, err = discordgo.New("Bot " + token)
+	discordLog.Info("Establishing discord connection")
+	session, err := discordgo.New("Bot " + token)
 	if err != nil {
 		panic(err)
 	}
-	err = discord.Open()
+	// see suspensions.go
+	session.AddHandler(onGuildMemberRemove)
+	session.AddHandler(onGuildBanAdd)
+	session.AddHandler(onGuildMemberAdd)
+	session.AddHandler(onGuildMemberUpdate)
+	err = session.Open()
 	if err != nil {
 		panic(err)
 	}
-	log.Println("Connected to discord")
+	discord = &discordSession{session}
+	discordLog.Info("Connected to discord")
+}
+
+func (d *discordSession) DM(user_id int64, message string) error {
+	ch, err := d.session.UserChannelCreate(strconv.FormatInt(user_id, 10)) // only creates it if it doesn't already exist
+	if err != nil {
+		return err
+	}
+	_, err = d.session.ChannelMessageSend(ch.ID, message)
+	return err
+}
+
+func (d *discordSession) GuildMemberRoles(guild_id string, user_id int64) ([]string, bool, error) {
+	membership, err := d.session.GuildMember(guild_id, strconv.FormatInt(user_id, 10))
+	if restErr, ok := err.(*discordgo.RESTError); ok && restErr.Message != nil && restErr.Message.Code == discordgo.ErrCodeUnknownMember {
+		return nil, false, nil // not being in the guild is an answer, not an error
+	}
+	if err != nil {
+		return nil, false, err
+	}
+	return membership.Roles, true, nil
+}
+
+func (d *discordSession) Connected() bool {
+	d.session.RLock()
+	defer d.session.RUnlock()
+	return d.session.DataReady
 }
 
 func DMuser(user_id int64, message string) error {
+	return DMuserCorr(user_id, "", message)
+}
+
+// a DM that's part of a deposit, withdrawal or trade, so the log line has that correlation id
+func DMuserCorr(user_id int64, corr string, message string) error {
+	logger := discordLog.With("user", user_id)
+	if corr != "" {
+		logger = logger.With("corr", corr)
+	}
 	if discord == nil {
+		recordDMFailure()
+		logger.Warn("Unable to DM user, discord isn't connected")
 		return errors.New("Discord not connected!")
 	}
-	userIdAsStr := strconv.FormatInt(user_id, 10) // base 10 lol
-	log.Println("Attempting to DM the message\"", message, "\" to user "+userIdAsStr)
-	ch, err := discord.UserChannelCreate(userIdAsStr) // only creates it if it doesn't already exist
+	logger.Debug("Sending DM", "message", message)
+	err := discord.DM(user_id, message)
 	if err != nil {
-		return err
+		recordDMFailure()
+		logger.Warn("Unable to DM user", "err", err)
 	}
-	_, err = discord.ChannelMessageSend(ch.ID, message)
 	return err
 }
 
@@ -0,0 +1,304 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"net/http"
+	"net/http/cookiejar"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"regexp"
+	"strconv"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/markbates/goth"
+	"gitlab.com/2b2tq/exchange/botsim"
+)
+
+type fakeDM struct {
+	UserID  int64
+	Message string
+}
+
+// records every DM instead of sending it, and pretends whoever is in members is in the discord, with whatever roles are in roles
+type fakeDiscord struct {
+	lock    sync.Mutex
+	dms     []fakeDM
+	members map[int64]bool
+	roles   map[int64][]string
+}
+
+func (d *fakeDiscord) DM(user_id int64, message string) error {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	d.dms = append(d.dms, fakeDM{user_id, message})
+	return nil
+}
+
+func (d *fakeDiscord) GuildMemberRoles(guild_id string, user_id int64) ([]string, bool, error) {
+	d.lock.Lock()
+	defer d.lock.Unlock()
+	return d.roles[user_id], d.members[user_id], nil
+}
+
+func (d *fakeDiscord) Connected() bool {
+	return true
+}
+
+// DMs go out on their own goroutines, so wait for one that contains substr
+func (d *fakeDiscord) waitForDM(t *testing.T, user_id int64, substr string) string {
+	var found string
+	ok := eventually(func() bool {
+		d.lock.Lock()
+		defer d.lock.Unlock()
+		for _, dm := range d.dms {
+			if dm.UserID == user_id && strings.Contains(dm.Message, substr) {
+				found = dm.Message
+				return true
+			}
+		}
+		return false
+	})
+	if !ok {
+		t.Fatalf("User %d never got a DM containing %q, got %v", user_id, substr, d.dms)
+	}
+	return found
+}
+
+type fakeClock struct {
+	lock sync.Mutex
+	now  time.Time
+}
+
+func (c *fakeClock) Now() time.Time {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	return c.now
+}
+
+func (c *fakeClock) Advance(d time.Duration) {
+	c.lock.Lock()
+	defer c.lock.Unlock()
+	c.now = c.now.Add(d)
+}
+
+type testSite struct {
+	server  *httptest.Server
+	discord *fakeDiscord
+	clock   *fakeClock
+}
+
+// the whole site on a random port, with a fake discord and a fake clock
+func withTestSite(t *testing.T, fn func(site *testSite)) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		site := &testSite{
+			discord: &fakeDiscord{members: make(map[int64]bool), roles: make(map[int64][]string)},
+			clock:   &fakeClock{now: time.Now()},
+		}
+		os.Setenv("SESSION_SECRET", "testing")
+		os.Setenv("DISCORD_KEY", "testing")
+		os.Setenv("DISCORD_SECRET", "testing")
+		discord, clock = site.discord, site.clock
+		resetRateLimits() // every test site request comes from the same IP
+		completeUserAuth = func(res http.ResponseWriter, req *http.Request) (goth.User, error) {
+			// pretend discord's oauth page said they're whoever they asked to be
+			return goth.User{UserID: req.URL.Query().Get("user"), Name: "tester"}, nil
+		}
+		defer func() {
+			discord, clock = nil, realClock{}
+		}()
+		site.server = httptest.NewServer(newRouter())
+		defer site.server.Close()
+		fn(site)
+	})
+}
+
+// a client that keeps cookies, and doesn't follow redirects so we can see them
+func (site *testSite) client(t *testing.T) *http.Client {
+	jar, err := cookiejar.New(nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return &http.Client{
+		Jar: jar,
+		CheckRedirect: func(req *http.Request, via []*http.Request) error {
+			return http.ErrUseLastResponse
+		},
+	}
+}
+
+func (site *testSite) login(t *testing.T, user_id int64) *http.Client {
+	site.discord.lock.Lock()
+	site.discord.members[user_id] = true
+	site.discord.lock.Unlock()
+	client := site.client(t)
+	status, body := site.get(t, client, "/auth/discord/callback?user="+strconv.FormatInt(user_id, 10))
+	if status != http.StatusFound {
+		t.Fatalf("Login as %d failed with %d %s", user_id, status, body)
+	}
+	return client
+}
+
+func (site *testSite) get(t *testing.T, client *http.Client, path string) (int, string) {
+	resp, err := client.Get(site.server.URL + path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+func (site *testSite) post(t *testing.T, client *http.Client, path string, form url.Values) (int, string) {
+	resp, err := client.PostForm(site.server.URL+path, form)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, _ := ioutil.ReadAll(resp.Body)
+	return resp.StatusCode, string(body)
+}
+
+// posts and expects to be redirected, like every action does when it works
+func (site *testSite) act(t *testing.T, client *http.Client, path string, form url.Values) {
+	status, body := site.post(t, client, path, form)
+	if status != http.StatusFound {
+		t.Fatalf("POST %s %v failed with %d %s", path, form, status, body)
+	}
+}
+
+func balanceOf(t *testing.T, user_id int64) int64 {
+	var balance int64
+	err := RunSQL(func(sql *sql.Tx) error {
+		return sql.QueryRow("SELECT balance FROM users WHERE user_id = ?", user_id).Scan(&balance)
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return balance
+}
+
+func TestLoginRequiresGuildMembership(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		client := site.client(t)
+		status, body := site.get(t, client, "/auth/discord/callback?user=1003")
+		if status == http.StatusFound || !strings.Contains(body, "must be a member") {
+			t.Errorf("Non member was able to log in %d %s", status, body)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM users WHERE user_id = 1003") != 0 {
+			t.Errorf("Non member got a user row")
+		}
+		status, _ = site.post(t, client, "/trade/2/buy", url.Values{"price": {"1"}, "quantity": {"1"}})
+		if status != http.StatusForbidden {
+			t.Errorf("Logged out user was able to place an order, got %d", status)
+		}
+		site.login(t, 1001)
+		if countRows(t, "SELECT COUNT(*) FROM users WHERE user_id = 1001") != 1 {
+			t.Errorf("Member didn't get a user row")
+		}
+	})
+}
+
+// two users trade a shulker of totems all the way from deposit to withdrawal, through the site and a simulated bot
+func TestExchangeScenario(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		const seller_id, buyer_id = 1001, 1002
+		seller := site.login(t, seller_id)
+		buyer := site.login(t, buyer_id)
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("UPDATE users SET balance = 100 WHERE user_id = ?", buyer_id)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot := connectSimulatedBot(t)
+		defer disconnectSimulatedBot(t, bot)
+
+		// deposit
+		site.act(t, seller, "/trade/2/deposit", nil)
+		name := regexp.MustCompile(regexp.QuoteMeta(config.ItemPrefix) + "[0-9a-f]{8}").FindString(site.discord.waitForDM(t, seller_id, "rename it to"))
+		item := botsim.Shulker(name, fullTotemShulker())
+		err = bot.Run("pickup " + item + "\nwaitecho 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		site.discord.waitForDM(t, seller_id, "Deposit confirmed")
+
+		// order placement and matching
+		site.act(t, seller, "/slot/0/sell", url.Values{"price": {"60"}})
+		site.act(t, buyer, "/trade/2/buy", url.Values{"price": {"60"}, "quantity": {"1"}})
+		site.discord.waitForDM(t, seller_id, "You just sold")
+		site.discord.waitForDM(t, buyer_id, "You just bought")
+		if balanceOf(t, seller_id) != 60 || balanceOf(t, buyer_id) != 40 {
+			t.Errorf("Wrong balances after trade, seller %d buyer %d", balanceOf(t, seller_id), balanceOf(t, buyer_id))
+		}
+
+		// withdrawal
+		err = bot.Run("status") // withdrawals need a bot with a fresh status
+		if err != nil {
+			t.Fatal(err)
+		}
+		site.act(t, buyer, "/slot/0/withdraw", nil)
+		code := regexp.MustCompile("withdrawal code for slot `#0` is `([0-9A-Z]{4}-[0-9A-Z]{4}-[0-9A-Z]{4})`").FindStringSubmatch(site.discord.waitForDM(t, buyer_id, "withdrawal code"))
+		if code == nil {
+			t.Fatal("No withdrawal code in the DM")
+		}
+		site.act(t, buyer, "/withdraw", url.Values{"code": {code[1]}})
+		site.discord.waitForDM(t, buyer_id, "confirmed!")
+		err = bot.Run("open\nwaitdrop 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM inventory")+countRows(t, "SELECT COUNT(*) FROM slots") != 0 {
+			t.Errorf("Withdrawn item is still accounted for")
+		}
+	})
+}
+
+// nobody does anything with a shulker, so once it expires it gets force sold into the highest buy order
+func TestForceSellScenario(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		const holder_id, bidder_id = 1001, 1002
+		site.login(t, holder_id)
+		bidder := site.login(t, bidder_id)
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("UPDATE users SET balance = 100 WHERE user_id = ?", bidder_id)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (1, 2, ?, 0)", testBotUUID)
+			if err != nil {
+				return err
+			}
+			return fillSlot(sql, holder_id, 2)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		site.act(t, bidder, "/trade/2/buy", url.Values{"price": {"30"}, "quantity": {"1"}})
+		checkSlotExpiries()
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE locked = 1") != 0 {
+			t.Fatal("Slot was locked before it expired")
+		}
+		site.clock.Advance(25 * time.Hour)
+		checkSlotExpiries()
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = ? AND locked = 1", holder_id) != 1 {
+			t.Fatal("Expired slot wasn't locked for force sale")
+		}
+		site.clock.Advance(time.Duration(config.ForceSellMaxSeconds+1) * time.Second)
+		checkSlotExpiries()
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = ? AND listing_id = 2", bidder_id) != 1 {
+			t.Fatal("Force sale didn't go to the highest buy order")
+		}
+		if balanceOf(t, holder_id) != 30 || balanceOf(t, bidder_id) != 70 {
+			t.Errorf("Wrong balances after force sale, holder %d bidder %d", balanceOf(t, holder_id), balanceOf(t, bidder_id))
+		}
+		site.discord.waitForDM(t, bidder_id, "You just bought")
+	})
+}
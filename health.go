@@ -0,0 +1,197 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"encoding/json"
+	"net/http"
+	"time"
+)
+
+// for whatever supervises the exchange (systemd, docker, kubernetes...)
+// /healthz is "is the process stuck", if it fails the exchange should be restarted
+// /readyz is "can people actually deposit, trade and withdraw right now", if it fails someone should be alerted, but restarting probably won't help
+// both return 200 when everything is fine and 503 when it isn't, with JSON saying why
+// /readyz is public, so it only says which part failed and how badly, in booleans and counts. /admin/health has the details
+
+const HealthCheckTimeout = 5 * time.Second
+
+// one failed run is usually a blip (discord or the disk having a bad moment) that the next run gets past, so a job only counts against readiness once it keeps failing
+const JobFailuresBeforeUnready = 3
+
+type HealthCheck struct {
+	OK    bool   `json:"ok"`
+	Error string `json:"error,omitempty"`
+}
+
+type ReadinessServer struct {
+	Server    string `json:"server"`
+	FreshBots int    `json:"fresh_bots"`
+	OK        bool   `json:"ok"`
+}
+
+type ReadinessJob struct {
+	Name                string     `json:"name"`
+	LastSuccess         *time.Time `json:"last_success"` // null if it hasn't worked since startup
+	LastError           string     `json:"last_error,omitempty"`
+	ConsecutiveFailures int        `json:"consecutive_failures"`
+	OK                  bool       `json:"ok"`
+}
+
+// what /readyz shows to anyone who asks
+type ReadinessSummary struct {
+	OK                bool `json:"ok"`
+	Database          bool `json:"database"`
+	Discord           bool `json:"discord"`
+	Storage           bool `json:"storage"`
+	StorageViolations int  `json:"storage_violations"`
+	Servers           int  `json:"servers"`
+	ServersReady      int  `json:"servers_ready"`
+	Jobs              int  `json:"jobs"`
+	JobsFailing       int  `json:"jobs_failing"`
+}
+
+type Readiness struct {
+	OK       bool              `json:"ok"`
+	Database HealthCheck       `json:"database"`
+	Discord  HealthCheck       `json:"discord"`
+	Storage  StorageHealth     `json:"storage"`
+	Servers  []ReadinessServer `json:"servers"`
+	Jobs     []ReadinessJob    `json:"jobs"`
+}
+
+// the database loop is the one thing that can get stuck in a way that's invisible from the outside, so this goes through it the same way a trade would
+func checkDatabaseLoop(ctx context.Context) HealthCheck {
+	ctx, cancel := context.WithTimeout(ctx, HealthCheckTimeout)
+	defer cancel()
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var one int
+		return sql.QueryRow("SELECT 1").Scan(&one)
+	})
+	if err != nil {
+		return HealthCheck{Error: err.Error()}
+	}
+	return HealthCheck{OK: true}
+}
+
+func handleHealthz(w http.ResponseWriter, r *http.Request) {
+	check := checkDatabaseLoop(r.Context())
+	writeHealthJSON(w, check.OK, check)
+}
+
+func handleReadyz(w http.ResponseWriter, r *http.Request) {
+	readiness := getReadiness(r.Context())
+	writeHealthJSON(w, readiness.OK, readiness.Summary())
+}
+
+// everything /readyz checks with all the details it leaves out, and a storage check done right now instead of the last one
+func handleAdminHealth(w http.ResponseWriter, r *http.Request) {
+	if getAdmin(r) == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	_, err := checkStorage()
+	if err != nil {
+		requestLogger(r, dbLog).Error("Unable to check storage invariants", "err", err)
+		http.Error(w, "Unable to check storage invariants. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	readiness := getReadiness(r.Context())
+	writeHealthJSON(w, readiness.OK, readiness)
+}
+
+func (readiness Readiness) Summary() ReadinessSummary {
+	summary := ReadinessSummary{
+		OK:                readiness.OK,
+		Database:          readiness.Database.OK,
+		Discord:           readiness.Discord.OK,
+		Storage:           readiness.Storage.OK,
+		StorageViolations: len(readiness.Storage.Violations),
+		Servers:           len(readiness.Servers),
+		Jobs:              len(readiness.Jobs),
+	}
+	for _, server := range readiness.Servers {
+		if server.OK {
+			summary.ServersReady++
+		}
+	}
+	for _, job := range readiness.Jobs {
+		if !job.OK {
+			summary.JobsFailing++
+		}
+	}
+	return summary
+}
+
+func writeHealthJSON(w http.ResponseWriter, ok bool, body interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.Header().Set("Cache-Control", "no-store")
+	if !ok {
+		w.WriteHeader(http.StatusServiceUnavailable)
+	}
+	json.NewEncoder(w).Encode(body)
+}
+
+func getReadiness(ctx context.Context) Readiness {
+	var readiness Readiness
+	readiness.Database = checkDatabaseLoop(ctx)
+
+	readiness.Discord.OK = discord != nil && discord.Connected()
+	if !readiness.Discord.OK {
+		readiness.Discord.Error = "not connected to discord, so nobody can log in or get DMs"
+	}
+
+	// every enabled server needs at least one bot that can take deposits and drop withdrawals
+	servers, err := getServersWithBots(ctx)
+	storage := cachedStorageHealth()
+	if err == nil && storage == nil {
+		// nothing has checked yet since startup
+		_, err = checkStorage()
+		storage = cachedStorageHealth()
+	}
+	if err != nil {
+		// the database check above will usually have failed too, but say why here as well
+		readiness.Database = HealthCheck{Error: err.Error()}
+	}
+	if storage != nil {
+		readiness.Storage = *storage
+	}
+	if readiness.Storage.Violations == nil {
+		readiness.Storage.Violations = make([]StorageViolation, 0)
+	}
+	readiness.Servers = make([]ReadinessServer, 0)
+	for _, server := range servers {
+		if !server.Enabled {
+			continue
+		}
+		readiness.Servers = append(readiness.Servers, ReadinessServer{
+			Server:    server.ServerIP,
+			FreshBots: server.OnlineBots,
+			OK:        server.OnlineBots > 0,
+		})
+	}
+
+	// a job is only a problem once its last few runs have all failed, one that just hasn't come up yet is fine
+	readiness.Jobs = make([]ReadinessJob, 0)
+	for _, status := range getJobStatuses() {
+		job := ReadinessJob{Name: status.Name, ConsecutiveFailures: status.ConsecutiveFailures()}
+		job.OK = job.ConsecutiveFailures < JobFailuresBeforeUnready
+		if !status.LastSuccess.IsZero() {
+			lastSuccess := status.LastSuccess
+			job.LastSuccess = &lastSuccess
+		}
+		if last := status.LastRun(); last != nil && last.Err != "" {
+			job.LastError = last.Err
+		}
+		readiness.Jobs = append(readiness.Jobs, job)
+	}
+
+	readiness.OK = readiness.Database.OK && readiness.Discord.OK && readiness.Storage.OK
+	for _, server := range readiness.Servers {
+		readiness.OK = readiness.OK && server.OK
+	}
+	for _, job := range readiness.Jobs {
+		readiness.OK = readiness.OK && job.OK
+	}
+	return readiness
+}
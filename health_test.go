@@ -0,0 +1,164 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"errors"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestHealthz(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		status, body := site.get(t, site.client(t), "/healthz")
+		if status != http.StatusOK || !strings.Contains(body, `"ok":true`) {
+			t.Error("Healthz should pass with the database running", status, body)
+		}
+	})
+}
+
+func TestReadyz(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		client := site.client(t)
+		readyz := func() (int, ReadinessSummary) {
+			status, body := site.get(t, client, "/readyz")
+			var readiness ReadinessSummary
+			err := json.Unmarshal([]byte(body), &readiness)
+			if err != nil {
+				t.Fatal(body, err)
+			}
+			return status, readiness
+		}
+
+		status, readiness := readyz()
+		if status != http.StatusServiceUnavailable || readiness.OK {
+			t.Error("There are no bots, so it shouldn't be ready", status, readiness)
+		}
+		if readiness.Servers != 1 || readiness.ServersReady != 0 {
+			t.Error("2b2t.org should be counted as having no bots", readiness)
+		}
+		if !readiness.Database || !readiness.Discord || !readiness.Storage {
+			t.Error("Everything else should be fine", readiness)
+		}
+
+		bot := connectSimulatedBot(t)
+		defer disconnectSimulatedBot(t, bot)
+		status, readiness = readyz()
+		if status != http.StatusOK || !readiness.OK || readiness.ServersReady != 1 {
+			t.Error("With a bot on the only server it should be ready", status, readiness)
+		}
+
+		fails := true
+		job := &Job{Name: "flaky", Run: func() (int64, error) {
+			if fails {
+				return 0, errors.New("nope")
+			}
+			return 0, nil
+		}}
+		jobsLock.Lock()
+		saved := jobs
+		jobs = []*Job{job}
+		jobsLock.Unlock()
+		defer func() {
+			jobsLock.Lock()
+			jobs = saved
+			jobsLock.Unlock()
+		}()
+		for i := 0; i < JobFailuresBeforeUnready; i++ {
+			job.runNow(JobTriggerSchedule)
+		}
+		status, readiness = readyz()
+		if status != http.StatusServiceUnavailable || readiness.Jobs != 1 || readiness.JobsFailing != 1 {
+			t.Error("A job that keeps failing should make it not ready", status, readiness)
+		}
+		details := getReadiness(ctx)
+		if details.Jobs[0].OK || details.Jobs[0].LastError != "nope" || details.Jobs[0].LastSuccess != nil || details.Jobs[0].ConsecutiveFailures != JobFailuresBeforeUnready {
+			t.Error("The details should say why", details.Jobs)
+		}
+		fails = false
+		job.runNow(JobTriggerSchedule)
+		status, readiness = readyz()
+		if status != http.StatusOK || readiness.JobsFailing != 0 {
+			t.Error("Once the job works again it should be ready", status, readiness)
+		}
+	})
+}
+
+func TestOneFailedMembershipCheckIsStillReady(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		bot := connectSimulatedBot(t)
+		defer disconnectSimulatedBot(t, bot)
+
+		discordDown := false
+		job := &Job{Name: "membership check", Run: func() (int64, error) {
+			if discordDown {
+				return 0, errors.New("discord is having a moment")
+			}
+			return 0, nil
+		}}
+		jobsLock.Lock()
+		saved := jobs
+		jobs = []*Job{job}
+		jobsLock.Unlock()
+		defer func() {
+			jobsLock.Lock()
+			jobs = saved
+			jobsLock.Unlock()
+		}()
+
+		job.runNow(JobTriggerSchedule)
+		discordDown = true
+		job.runNow(JobTriggerSchedule)
+		status, body := site.get(t, site.client(t), "/readyz")
+		if status != http.StatusOK || !strings.Contains(body, `"jobs_failing":0`) {
+			t.Error("One failed membership check shouldn't make it unready", status, body)
+		}
+		details := getReadiness(ctx)
+		if !details.Jobs[0].OK || details.Jobs[0].ConsecutiveFailures != 1 || details.Jobs[0].LastError == "" {
+			t.Error("The details should still show the failure", details.Jobs)
+		}
+	})
+}
+
+func TestReadyzHidesStorageDetails(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		config.AdminDiscordIDs = []int64{1}
+		defer func() { config.AdminDiscordIDs = nil }()
+		admin := site.login(t, 1)
+		anyone := site.client(t)
+		status, body := site.get(t, anyone, "/readyz")
+		if !strings.Contains(body, `"storage":true`) {
+			t.Fatal("Storage should start out fine", status, body)
+		}
+
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id) VALUES (1, 0, 1)")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, body = site.get(t, anyone, "/readyz")
+		if !strings.Contains(body, `"storage":true`) {
+			t.Error("Readyz shouldn't check storage itself, only the job does", body)
+		}
+		violations, err := checkStorage()
+		if err != nil || violations != 1 {
+			t.Fatal("Job should find the slot with no item", violations, err)
+		}
+		status, body = site.get(t, anyone, "/readyz")
+		if status != http.StatusServiceUnavailable || !strings.Contains(body, `"storage":false`) || !strings.Contains(body, `"storage_violations":1`) || strings.Contains(body, "slot_count") {
+			t.Error("Readyz should count the violation without saying what it is", status, body)
+		}
+
+		status, _ = site.get(t, anyone, "/admin/health")
+		if status != http.StatusForbidden {
+			t.Error("Only admins get the details", status)
+		}
+		status, body = site.get(t, admin, "/admin/health")
+		if status != http.StatusServiceUnavailable || !strings.Contains(body, `"kind":"slot_count"`) {
+			t.Error("Admins should see what the violation is", status, body)
+		}
+	})
+}
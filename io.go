@@ -1,11 +1,15 @@
 package main
 
 import (
+	"bytes"
 	"encoding/binary"
+	"time"
 )
 
 // aka i'm so used to datainputstream i made it in go
 
+var BotWriteTimeout = 10 * time.Second // a var so tests don't have to wait this long
+
 func (bot *Bot) readUTF() string {
 	l := bot.readShort()
 	data := make([]byte, l)
@@ -74,32 +78,33 @@ func (bot *Bot) readManyStrings(num int) []string {
 }
 
 func (bot *Bot) sendChatControl(str string) { // send chat control to a bot
-	err := binary.Write(bot.conn, binary.BigEndian, uint8(1))
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(bot.conn, binary.BigEndian, uint16(len(str)))
-	if err != nil {
-		panic(err)
-	}
-	err = binary.Write(bot.conn, binary.BigEndian, []byte(str))
-	if err != nil {
-		panic(err)
-	}
+	var buf bytes.Buffer
+	writeByte(&buf, 1)
+	binary.Write(&buf, binary.BigEndian, uint16(len(str)))
+	buf.WriteString(str)
+	bot.send(buf.Bytes())
 }
 
-func (bot *Bot) writeByte(byte uint8) {
-	err := binary.Write(bot.conn, binary.BigEndian, byte) // remember, on a 64-bit system int means int64 so gotta make sure to only send a 4-byte int because that's what java expects here
+// packets get sent from the bot's own message loop and from other goroutines (drops, audits), so a whole packet is written at once
+// unlike reading, a failed write doesn't panic since we could be on any goroutine. closing the connection makes handleMessages clean up the bot
+// a bot that stops reading gets disconnected after BotWriteTimeout instead of blocking whoever is sending to it forever
+func (bot *Bot) send(data []byte) {
+	bot.writeLock.Lock()
+	defer bot.writeLock.Unlock()
+	bot.conn.SetWriteDeadline(time.Now().Add(BotWriteTimeout))
+	_, err := bot.conn.Write(data)
 	if err != nil {
-		panic(err)
+		botLog.Warn("Unable to send to bot, disconnecting it", "addr", bot.conn.RemoteAddr().String(), "err", err)
+		bot.conn.Close()
 	}
 }
 
-func (bot *Bot) writeInt(i int) {
-	err := binary.Write(bot.conn, binary.BigEndian, int32(i)) // remember, on a 64-bit system int means int64 so gotta make sure to only send a 4-byte int because that's what java expects here
-	if err != nil {
-		panic(err)
-	}
+func writeByte(buf *bytes.Buffer, byte uint8) {
+	buf.WriteByte(byte)
+}
+
+func writeInt(buf *bytes.Buffer, i int) {
+	binary.Write(buf, binary.BigEndian, int32(i)) // remember, on a 64-bit system int means int64 so gotta make sure to only send a 4-byte int because that's what java expects here
 }
 
 type ClickType int
@@ -118,9 +123,11 @@ const (
 // for example, PICKUP is 0 and THROW is 4
 
 func (bot *Bot) sendWindowClick(windowId int, slotId int, mouseButton int, clickType ClickType) {
-	bot.writeByte(uint8(5))
-	bot.writeInt(windowId)
-	bot.writeInt(slotId)
-	bot.writeInt(mouseButton)
-	bot.writeInt(int(clickType)) // clickType is an "int" but go won't convert automatically for safety
+	var buf bytes.Buffer
+	writeByte(&buf, 5)
+	writeInt(&buf, windowId)
+	writeInt(&buf, slotId)
+	writeInt(&buf, mouseButton)
+	writeInt(&buf, int(clickType)) // clickType is an "int" but go won't convert automatically for safety
+	bot.send(buf.Bytes())
 }
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"net/http"
+	"runtime/debug"
+	"sync"
+	"time"
+)
+
+// everything that happens on a timer is a job here, so it all shows up in one place on /admin/jobs
+// a job only ever has one run going at a time. if it's still going when its next turn comes up (or an admin hits run now), that turn is skipped
+// jobs that work through rows do at most JobBatchSize per run, anything left over waits for the next run instead of piling up goroutines
+
+const JobBatchSize = 100
+const JobHistoryLength = 50 // runs remembered per job, newest first
+
+const (
+	JobTriggerSchedule = "schedule"
+	JobTriggerAdmin    = "admin"
+)
+
+type Job struct {
+	Name     string
+	Interval time.Duration
+	Run      func() (int64, error) // returns how many rows (or bots, or backups) it dealt with
+
+	running     bool
+	history     []JobRun
+	lastSuccess time.Time // when a run last finished without an error, which can be longer ago than the history goes back
+}
+
+type JobRun struct {
+	Trigger  string
+	Started  time.Time
+	Duration time.Duration
+	Rows     int64
+	Err      string // "" if it worked
+	Skipped  bool   // the previous run was still going
+}
+
+// for the admin page, a copy of a job and its history
+type JobStatus struct {
+	Name        string
+	Interval    time.Duration
+	Running     bool
+	History     []JobRun
+	LastSuccess time.Time
+}
+
+var jobs []*Job
+var jobsLock sync.Mutex
+
+// the list of jobs. a function and not a var, because intervals come from config which isn't loaded yet when vars are
+func defaultJobs() []*Job {
+	list := []*Job{
+		{Name: "slot expiries", Interval: 10 * time.Second, Run: checkSlotExpiries},
+		{Name: "pending deposit cleanup", Interval: 10 * time.Second, Run: cleanupPendingDeposits},
+		{Name: "pending withdrawal cleanup", Interval: 10 * time.Second, Run: cleanupPendingWithdrawals},
+		{Name: "ender chest audits", Interval: EchestAuditInterval, Run: requestEchestAudits},
+		{Name: "bot watchdog", Interval: 5 * time.Second, Run: botWatchdog},
+		{Name: "bot status history cleanup", Interval: time.Hour, Run: botStatusHistoryCleanup},
+		{Name: "database watchdog", Interval: 5 * time.Second, Run: databaseWatchdog},
+		{Name: "rate limit cleanup", Interval: time.Minute, Run: cleanupRateLimits},
+		{Name: "session cleanup", Interval: time.Hour, Run: cleanupSessions},
+		{Name: "storage check", Interval: time.Minute, Run: checkStorage},
+	}
+	if config.MembershipCheckHours > 0 {
+		list = append(list, &Job{Name: "membership check", Interval: 10 * time.Minute, Run: recheckMemberships})
+	} else {
+		jobsLog.Info("Scheduled discord membership checks are turned off")
+	}
+	if config.BackupIntervalMinutes > 0 {
+		list = append(list, &Job{Name: "database backups", Interval: time.Duration(config.BackupIntervalMinutes) * time.Minute, Run: databaseBackups})
+	} else {
+		jobsLog.Info("Scheduled database backups are turned off")
+	}
+	return list
+}
+
+// starts every job on its interval, they stop along with the rest of the workers when we shut down
+func scheduleJobs(l *Lifecycle, list []*Job) {
+	jobsLock.Lock()
+	jobs = list
+	jobsLock.Unlock()
+	for _, job := range list {
+		job := job
+		l.Go(StageWorkers, "job "+job.Name, func(ctx context.Context) {
+			runEvery(ctx, job.Interval, func() {
+				job.runNow(JobTriggerSchedule)
+			})
+		})
+	}
+}
+
+func getJob(name string) *Job {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	for _, job := range jobs {
+		if job.Name == name {
+			return job
+		}
+	}
+	return nil
+}
+
+// runs the job right here unless it's already running, either way the outcome goes in its history
+func (job *Job) runNow(trigger string) JobRun {
+	run := JobRun{Trigger: trigger, Started: time.Now()}
+	jobsLock.Lock()
+	if job.running {
+		run.Skipped = true
+		job.record(run)
+		jobsLock.Unlock()
+		return run
+	}
+	job.running = true
+	jobsLock.Unlock()
+
+	rows, err := job.call()
+	run.Duration = time.Since(run.Started)
+	run.Rows = rows
+	if err != nil {
+		run.Err = err.Error()
+		jobsLog.Error("Job failed", "job", job.Name, "trigger", trigger, "duration", run.Duration, "err", err)
+	}
+
+	jobsLock.Lock()
+	job.running = false
+	if err == nil {
+		job.lastSuccess = run.Started
+	}
+	job.record(run)
+	jobsLock.Unlock()
+	return run
+}
+
+// a panicking job would take its worker down with it and never run again, so it counts as a failed run instead
+func (job *Job) call() (rows int64, err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			jobsLog.Error("Recovered from panic in job", "job", job.Name, "panic", fmt.Sprint(r), "stack", string(debug.Stack()))
+			err = fmt.Errorf("panic: %v", r)
+		}
+	}()
+	return job.Run()
+}
+
+// only call this with jobsLock held
+func (job *Job) record(run JobRun) {
+	job.history = append([]JobRun{run}, job.history...)
+	if len(job.history) > JobHistoryLength {
+		job.history = job.history[:JobHistoryLength]
+	}
+}
+
+func getJobStatuses() []JobStatus {
+	jobsLock.Lock()
+	defer jobsLock.Unlock()
+	statuses := make([]JobStatus, 0, len(jobs))
+	for _, job := range jobs {
+		statuses = append(statuses, JobStatus{
+			Name:        job.Name,
+			Interval:    job.Interval,
+			Running:     job.running,
+			History:     append([]JobRun(nil), job.history...),
+			LastSuccess: job.lastSuccess,
+		})
+	}
+	return statuses
+}
+
+// the most recent run that actually ran, for the summary line on the admin page
+func (s JobStatus) LastRun() *JobRun {
+	for i := range s.History {
+		if !s.History[i].Skipped {
+			return &s.History[i]
+		}
+	}
+	return nil
+}
+
+// how many runs in a row have failed, counting back from the most recent one
+func (s JobStatus) ConsecutiveFailures() int {
+	failures := 0
+	for _, run := range s.History {
+		if run.Skipped {
+			continue
+		}
+		if run.Err == "" {
+			break
+		}
+		failures++
+	}
+	return failures
+}
+
+type AdminJobsPageTemplate struct {
+	Profile *User
+	Jobs    []JobStatus
+}
+
+func handleAdminJobsPage(w http.ResponseWriter, r *http.Request) {
+	admin := getAdmin(r)
+	if admin == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	data := &AdminJobsPageTemplate{
+		Profile: admin,
+		Jobs:    getJobStatuses(),
+	}
+	err := templates.ExecuteTemplate(w, "admin_jobs.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the jobs page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+// starts a run of the job in the background, its result shows up in the history like any other run
+func handleAdminRunJob(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin/jobs", func(admin *User, reason string) error {
+		job := getJob(r.FormValue("job"))
+		if job == nil {
+			return errors.New("there's no job called " + r.FormValue("job"))
+		}
+		adminLog.Info("Admin is running job", "admin", admin.UserID, "job", job.Name)
+		go job.runNow(JobTriggerAdmin)
+		return nil
+	})
+}
@@ -0,0 +1,125 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestJobSingleFlight(t *testing.T) {
+	release := make(chan struct{})
+	started := make(chan struct{})
+	job := &Job{Name: "slow", Run: func() (int64, error) {
+		close(started)
+		<-release
+		return 3, nil
+	}}
+	first := make(chan JobRun)
+	go func() {
+		first <- job.runNow(JobTriggerSchedule)
+	}()
+	<-started
+	if run := job.runNow(JobTriggerAdmin); !run.Skipped {
+		t.Error("Second run should be skipped while the first is still going")
+	}
+	close(release)
+	if run := <-first; run.Skipped || run.Rows != 3 || run.Err != "" {
+		t.Error("First run should have finished normally", run)
+	}
+	if len(job.history) != 2 || job.history[0].Skipped || !job.history[1].Skipped {
+		t.Error("History should have the finished run on top of the skipped one", job.history)
+	}
+}
+
+func TestJobHistory(t *testing.T) {
+	calls := 0
+	job := &Job{Name: "flaky", Run: func() (int64, error) {
+		calls++
+		switch calls {
+		case 1:
+			return 0, errors.New("nope")
+		case 2:
+			var listing *Listing
+			return int64(len(listing.ItemName)), nil // nil pointer dereference
+		}
+		return 1, nil
+	}}
+	if run := job.runNow(JobTriggerSchedule); run.Err != "nope" {
+		t.Error("Error should be recorded, got", run)
+	}
+	if run := job.runNow(JobTriggerSchedule); !strings.HasPrefix(run.Err, "panic") {
+		t.Error("Panic should be recorded as an error, got", run)
+	}
+	for i := 0; i < JobHistoryLength; i++ {
+		job.runNow(JobTriggerSchedule)
+	}
+	if len(job.history) != JobHistoryLength {
+		t.Error("History should be capped at", JobHistoryLength, "got", len(job.history))
+	}
+	status := JobStatus{History: job.history}
+	if last := status.LastRun(); last == nil || last.Rows != 1 || last.Err != "" {
+		t.Error("Last run should be the newest one", last)
+	}
+}
+
+// more expired slots than fit in a batch get locked over several runs instead of all at once
+func TestSlotExpiryBatches(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		const slots = JobBatchSize + JobBatchSize/2
+		err := RunSQL(func(sql *sql.Tx) error {
+			for user_id := 1; user_id <= slots; user_id++ {
+				_, err := sql.Exec("INSERT INTO users (user_id) VALUES (?)", user_id)
+				if err != nil {
+					return err
+				}
+				_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id, expiry_time) VALUES (?, 0, 1, ?)", user_id, unixNow()-10)
+				if err != nil {
+					return err
+				}
+			}
+			return nil
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		rows, err := checkSlotExpiries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != JobBatchSize || countRows(t, "SELECT COUNT(*) FROM slots WHERE locked = 1") != JobBatchSize {
+			t.Error("First run should lock exactly one batch, dealt with", rows)
+		}
+		rows, err = checkSlotExpiries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if rows != slots-JobBatchSize || countRows(t, "SELECT COUNT(*) FROM slots WHERE locked = 1") != slots {
+			t.Error("Second run should lock the rest, dealt with", rows)
+		}
+	})
+}
+
+func TestScheduledJobsStop(t *testing.T) {
+	l := newLifecycle()
+	ran := make(chan struct{}, 100)
+	list := []*Job{{Name: "tick", Interval: time.Millisecond, Run: func() (int64, error) {
+		ran <- struct{}{}
+		return 0, nil
+	}}}
+	scheduleJobs(l, list)
+	defer scheduleJobs(newLifecycle(), nil)
+	select {
+	case <-ran:
+	case <-time.After(time.Second):
+		t.Fatal("Job never ran")
+	}
+	if stuck := l.Shutdown(time.Second, func() {}); len(stuck) != 0 {
+		t.Error("Job didn't stop", stuck)
+	}
+	if getJob("tick") == nil || len(getJobStatuses()) != 1 {
+		t.Error("Job should be listed for the admin page")
+	}
+}
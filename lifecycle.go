@@ -0,0 +1,122 @@
+package main
+
+import (
+	"context"
+	"strings"
+	"sync"
+	"time"
+)
+
+// everything that runs in the background registers here, so shutting down can stop it all in the right order
+// each stage is told to stop and waited on before the next one is, then the database is closed last
+// that way nothing is still trying to RunSQL when the database goes away
+
+type Stage int
+
+const (
+	StageListeners Stage = iota // the website and the bot listener, stop these first so no new work comes in
+	StageWorkers                // tickers like slot expiries and pending cleanups
+	stageCount
+)
+
+var stageNames = []string{"listeners", "workers"}
+
+const ShutdownStageTimeout = 15 * time.Second // how long a stage gets to stop before we give up on it and move on
+
+type worker struct {
+	name    string
+	stage   Stage
+	done    chan struct{}
+	stopped time.Duration // how long after its stage was told to stop it actually did
+}
+
+type Lifecycle struct {
+	lock    sync.Mutex
+	stopped bool
+	cancels [stageCount]context.CancelFunc
+	ctxs    [stageCount]context.Context
+	workers []*worker
+}
+
+var lifecycle = newLifecycle()
+
+func newLifecycle() *Lifecycle {
+	l := &Lifecycle{}
+	for i := range l.ctxs {
+		l.ctxs[i], l.cancels[i] = context.WithCancel(context.Background())
+	}
+	return l
+}
+
+// runs fn in its own goroutine, fn should return soon after ctx is done
+func (l *Lifecycle) Go(stage Stage, name string, fn func(ctx context.Context)) {
+	l.lock.Lock()
+	defer l.lock.Unlock()
+	if l.stopped {
+		mainLog.Warn("Not starting worker because we're shutting down", "worker", name)
+		return
+	}
+	w := &worker{name: name, stage: stage, done: make(chan struct{})}
+	l.workers = append(l.workers, w)
+	go func() {
+		defer close(w.done)
+		fn(l.ctxs[stage])
+	}()
+}
+
+// stops every stage in order, then the database, and logs how it all went
+// returns the names of anything that didn't stop in time
+func (l *Lifecycle) Shutdown(timeout time.Duration, closeDatabase func()) []string {
+	l.lock.Lock()
+	l.stopped = true
+	workers := append([]*worker(nil), l.workers...)
+	l.lock.Unlock()
+
+	start := time.Now()
+	stuck := make([]string, 0)
+	for stage := Stage(0); stage < stageCount; stage++ {
+		mainLog.Info("Stopping", "stage", stageNames[stage])
+		stageStart := time.Now()
+		l.cancels[stage]()
+		deadline := time.After(timeout)
+		for _, w := range workers {
+			if w.stage != stage {
+				continue
+			}
+			select {
+			case <-w.done:
+				w.stopped = time.Since(stageStart)
+				mainLog.Info("Stopped", "worker", w.name, "after", w.stopped.Round(time.Millisecond))
+			case <-deadline:
+				mainLog.Error("Worker didn't stop in time, moving on without it", "worker", w.name, "timeout", timeout)
+				stuck = append(stuck, w.name)
+			}
+		}
+	}
+
+	// nothing registered is running anymore, so whatever's still queued is a straggler like a DM goroutine
+	queued := getWriteQueueDepth()
+	mainLog.Info("Closing database", "queued", queued)
+	closeDatabase()
+
+	state := "cleanly"
+	if len(stuck) > 0 {
+		state = "with " + strings.Join(stuck, ", ") + " still running"
+	}
+	mainLog.Info("Shut down", "stopped", len(workers)-len(stuck), "workers", len(workers), "took", time.Since(start).Round(time.Millisecond), "state", state)
+	return stuck
+}
+
+// calls fn every interval until ctx is done. a run that's already going when ctx is done gets to finish
+func runEvery(ctx context.Context, interval time.Duration, fn func()) {
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ctx.Done():
+			return
+		case <-ticker.C:
+			fn()
+		}
+	}
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"gitlab.com/2b2tq/exchange/botsim"
+)
+
+func TestShutdownOrder(t *testing.T) {
+	l := newLifecycle()
+	var lock sync.Mutex
+	order := make([]string, 0)
+	stopped := func(name string) {
+		lock.Lock()
+		defer lock.Unlock()
+		order = append(order, name)
+	}
+	// registered backwards on purpose, the stage decides the order and not when they were started
+	l.Go(StageWorkers, "worker", func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond) // finishing up whatever it was doing
+		stopped("worker")
+	})
+	l.Go(StageListeners, "listener", func(ctx context.Context) {
+		<-ctx.Done()
+		time.Sleep(20 * time.Millisecond)
+		stopped("listener")
+	})
+	stuck := l.Shutdown(time.Second, func() {
+		stopped("database")
+	})
+	if len(stuck) != 0 {
+		t.Error("Nothing should be stuck", stuck)
+	}
+	if len(order) != 3 || order[0] != "listener" || order[1] != "worker" || order[2] != "database" {
+		t.Error("Should stop listeners, then workers, then the database, got", order)
+	}
+
+	ran := false
+	l.Go(StageWorkers, "late", func(ctx context.Context) {
+		ran = true
+	})
+	time.Sleep(10 * time.Millisecond)
+	if ran {
+		t.Error("Shouldn't start anything after shutting down")
+	}
+}
+
+func TestShutdownStuckWorker(t *testing.T) {
+	l := newLifecycle()
+	release := make(chan struct{})
+	defer close(release)
+	l.Go(StageWorkers, "stubborn", func(ctx context.Context) {
+		<-release // ignores ctx
+	})
+	l.Go(StageWorkers, "ticker", func(ctx context.Context) {
+		runEvery(ctx, time.Millisecond, func() {})
+	})
+	closed := false
+	stuck := l.Shutdown(50*time.Millisecond, func() {
+		closed = true
+	})
+	if len(stuck) != 1 || stuck[0] != "stubborn" {
+		t.Error("Only the worker ignoring its context should be stuck, got", stuck)
+	}
+	if !closed {
+		t.Error("Database should still get closed")
+	}
+}
+
+func TestRunSQLAfterShutdown(t *testing.T) {
+	WithTestingDatabase(func() {})
+	result := make(chan error)
+	go func() {
+		result <- RunSQL(func(sql *sql.Tx) error {
+			return nil
+		})
+	}()
+	select {
+	case err := <-result:
+		if err != ErrDatabaseClosed {
+			t.Error("Should say the database is closed, got", err)
+		}
+	case <-time.After(simulatorTimeout):
+		t.Fatal("RunSQL after shutdown blocked instead of failing")
+	}
+	if getWriteQueueDepth() != 0 {
+		t.Error("Queue depth should be back to 0, it's", getWriteQueueDepth())
+	}
+}
+
+func TestBotListenerShutdown(t *testing.T) {
+	WithTestingDatabase(func() {
+		l, err := net.Listen("tcp", "127.0.0.1:0")
+		if err != nil {
+			t.Fatal(err)
+		}
+		c, cancel := context.WithCancel(context.Background())
+		listening := make(chan struct{})
+		go func() {
+			defer close(listening)
+			acceptBots(c, l)
+			disconnectAllBots()
+		}()
+		bot := botsim.New(testBotUUID, "2b2t.org")
+		err = bot.Connect(l.Addr().String())
+		if err != nil {
+			t.Fatal(err)
+		}
+		defer bot.Close()
+		if !eventually(func() bool { return getByUUIDAndServer(testBotUUID, "2b2t.org") != nil }) {
+			t.Fatal("Simulated bot never showed up")
+		}
+
+		cancel()
+		select {
+		case <-listening:
+		case <-time.After(simulatorTimeout):
+			t.Fatal("Bot listener didn't stop")
+		}
+		if len(GetBotStatuses()) != 0 {
+			t.Error("Every bot should have been disconnected")
+		}
+		_, err = net.Dial("tcp", l.Addr().String())
+		if err == nil {
+			t.Error("Should have stopped accepting bots")
+		}
+	})
+}
@@ -1,8 +1,8 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
 	"net/http"
 	"strconv"
 )
@@ -27,9 +27,9 @@ type ListingTemplate struct {
 	BotStatuses []BotStatus
 }
 
-func currentMarketStatus(listing_id int64) (MarketStatus, error) {
+func currentMarketStatus(ctx context.Context, listing_id int64) (MarketStatus, error) {
 	var result MarketStatus
-	err := RunSQL(func(sql *sql.Tx) error {
+	err := RunReadSQLContext(ctx, func(sql *sql.Tx) error {
 		row := sql.QueryRow("SELECT COUNT(*), COALESCE(MIN(sale_price), 0) FROM slots WHERE listing_id = ? AND sale_price IS NOT NULL", listing_id)
 		var sellOrdersCount int
 		var minSalePrice int64
@@ -56,26 +56,24 @@ func currentMarketStatus(listing_id int64) (MarketStatus, error) {
 
 func handleListing(w http.ResponseWriter, r *http.Request) { // handle a request to the main page
 	listingIdStr := r.URL.Query().Get(":listing")
-	log.Println("Listing id str", listingIdStr)
 	listingId, err := strconv.ParseInt(listingIdStr, 10, 64)
 	if err != nil {
 		http.Error(w, "Invalid listing "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 	listing := getListingById(listingId)
-	log.Println("Request to listing", listing)
 	if listing == nil {
 		http.Error(w, "Invalid listing", http.StatusInternalServerError)
 		return
 	}
-	status, err := currentMarketStatus(listingId)
+	status, err := currentMarketStatus(r.Context(), listingId)
 	if err != nil {
 		http.Error(w, "Invalid listing "+err.Error(), http.StatusInternalServerError)
 		return
 	}
 
 	data := &ListingTemplate{
-		Navigation:  generateNavigation(),
+		Navigation:  generateNavigation(r.Context(), listing.Server), // only show the other listings on the same server
 		Info:        status,
 		ItemInfo:    *listing,
 		Profile:     getUser(r), // call getUser in serve.go to get user info
@@ -84,7 +82,7 @@ func handleListing(w http.ResponseWriter, r *http.Request) { // handle a request
 		BotStatuses: GetBotStatuses(),
 	}
 	if data.Profile != nil {
-		err := RunSQL(func(sql *sql.Tx) error {
+		err := RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
 			return sql.QueryRow("SELECT balance FROM users WHERE user_id = ?", data.Profile.UserID).Scan(&data.Balance)
 		})
 
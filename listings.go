@@ -1,8 +1,11 @@
 package main
 
 import (
+	"context"
 	"database/sql"
-	"log"
+	"errors"
+	"strconv"
+	"strings"
 )
 
 type Listing struct {
@@ -15,7 +18,7 @@ type Listing struct {
 
 func getListingById(listing_id int64) *Listing {
 	var result Listing
-	err := RunSQL(func(sql *sql.Tx) error {
+	err := RunReadSQL(func(sql *sql.Tx) error {
 		row := sql.QueryRow("SELECT listing_id, server, item_key, item_name, item_photo FROM listings WHERE listing_id = ?", listing_id)
 		return row.Scan(&result.ListingID, &result.Server, &result.ItemKey, &result.ItemName, &result.ItemPhoto)
 	})
@@ -27,7 +30,7 @@ func getListingById(listing_id int64) *Listing {
 
 func createInitialListings() {
 	// TODO automatically create listings for all item keys on all servers
-	// TODO add some more listings, like
+	// TODO add some more listings (admins can also add them at /admin/listings without a restart), like
 	// cooked fish
 	// cooked salmon
 	// ender chests
@@ -49,18 +52,31 @@ func createInitialListings() {
 		{0, "2b2t.org", createShulkerFull("item.totem;0"), "totems", "/static/totem.png"},
 		{0, "2b2t.org", createShulkerFull("item.end_crystal;0"), "end crystals", "/static/endcrystal.png"},
 	}
+	// totems don't stack, so a "full" shulker of them is 27 totems, one per slot
+	shulkerTemplates := map[string]ShulkerTemplate{
+		createShulkerFull("item.totem;0"): {Rules: []TemplateRule{{Item: "item.totem;0", MinCount: 27, PerSlot: 1}}},
+	}
 	err := RunSQL(func(sql *sql.Tx) error {
 		for _, l := range toCreate {
 			_, err := sql.Exec("INSERT OR IGNORE INTO listings (server, item_key, item_name, item_photo) VALUES (?, ?, ?, ?)", l.Server, l.ItemKey, l.ItemName, l.ItemPhoto)
 			if err != nil {
 				return err
 			}
+			template, ok := shulkerTemplates[l.ItemKey]
+			if !ok {
+				continue
+			}
+			_, err = sql.Exec("INSERT OR IGNORE INTO listing_templates (listing_id, template) SELECT listing_id, ? FROM listings WHERE server = ? AND item_key = ?", template.String(), l.Server, l.ItemKey)
+			if err != nil {
+				return err
+			}
 		}
 		return nil
 	})
 	if err != nil {
 		panic(err)
 	}
+	createInitialServers()
 }
 
 func createShulkerFull(itemWithDamage string) string {
@@ -72,19 +88,244 @@ func createShulkerFull(itemWithDamage string) string {
 	return result
 }
 
-func getListingForContentsOnServer(contents string, server string) *Listing {
-	log.Println("CONTENTS", contents)
-	log.Println("SERVER", server)
+// id is the deposit id the shulker is named with
+// listings with a template can't be found from the contents alone, since more than one template could fit the same shulker
+// so for those, the deposit id tells us which listing it's supposed to be (from pending_deposits or inventory), and then we check the template
+func getListingForContentsOnServer(contents string, server string, id uint32) *Listing {
 	var result Listing
 	err := RunSQL(func(sql *sql.Tx) error {
-		row := sql.QueryRow("SELECT listing_id, server, item_key, item_name, item_photo FROM listings WHERE item_key = ? AND server = ?", contents, server)
-		return row.Scan(&result.ListingID, &result.Server, &result.ItemKey, &result.ItemName, &result.ItemPhoto)
+		row := sql.QueryRow("SELECT listing_id, server, item_key, item_name, item_photo FROM listings WHERE item_key = ? AND server = ? AND listing_id NOT IN (SELECT listing_id FROM listing_templates)", contents, server)
+		err := row.Scan(&result.ListingID, &result.Server, &result.ItemKey, &result.ItemName, &result.ItemPhoto)
+		if err != ErrNoRows {
+			return err
+		}
+		var templateStr string
+		row = sql.QueryRow(`SELECT listings.listing_id, listings.server, listings.item_key, listings.item_name, listings.item_photo, listing_templates.template FROM listings
+			INNER JOIN listing_templates ON listing_templates.listing_id = listings.listing_id
+			WHERE listings.server = ? AND listings.listing_id IN (
+				SELECT listing_id FROM pending_deposits WHERE deposit_id = ?
+				UNION
+				SELECT listing_id FROM inventory WHERE item_id = ?
+			) LIMIT 1`, server, id, id)
+		err = row.Scan(&result.ListingID, &result.Server, &result.ItemKey, &result.ItemName, &result.ItemPhoto, &templateStr)
+		if err == ErrNoRows {
+			// not a deposit and not in stock, like something that was just withdrawn and is about to be dropped
+			// it still has to be recognized as its listing, otherwise it would never get dropped
+			return findTemplateListing(sql, contents, server, &result)
+		}
+		if err != nil {
+			return err
+		}
+		template, err := parseShulkerTemplate(templateStr)
+		if err != nil {
+			return err
+		}
+		if !template.Matches(contents) {
+			return errors.New("Contents don't match the template of listing " + strconv.FormatInt(result.ListingID, 10))
+		}
+		return nil
 	})
 	if err != nil {
-		log.Println("RETURNING ERROR")
-		log.Println(err)
+		ordersLog.Debug("No listing for these contents", "corr", depositCorrelation(id), "server", server, "contents", contents, "err", err)
 		return nil
 	}
-	log.Println("RETURNING LISTING", result)
 	return &result
 }
+
+// can only be called within the context of a sql transaction
+func findTemplateListing(sql *sql.Tx, contents string, server string, result *Listing) error {
+	rows, err := sql.Query(`SELECT listings.listing_id, listings.server, listings.item_key, listings.item_name, listings.item_photo, listing_templates.template FROM listings
+		INNER JOIN listing_templates ON listing_templates.listing_id = listings.listing_id
+		WHERE listings.server = ? ORDER BY listings.listing_id`, server)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var templateStr string
+		err = rows.Scan(&result.ListingID, &result.Server, &result.ItemKey, &result.ItemName, &result.ItemPhoto, &templateStr)
+		if err != nil {
+			return err
+		}
+		template, err := parseShulkerTemplate(templateStr)
+		if err != nil {
+			return err
+		}
+		if template.Matches(contents) {
+			return nil
+		}
+	}
+	err = rows.Err()
+	if err != nil {
+		return err
+	}
+	return ErrNoRows
+}
+
+var ErrListingRetired = errors.New("This listing is retired. You can still withdraw anything you have in it, but no new orders or deposits")
+
+// can only be called within the context of a sql transaction
+// a listing is tradable if it's neither frozen by an audit nor retired by an admin, and its server is enabled
+func checkListingTradable(sql *sql.Tx, listing_id int64) error {
+	err := checkNotFrozen(sql, listing_id)
+	if err != nil {
+		return err
+	}
+	var retirements int
+	err = sql.QueryRow("SELECT COUNT(*) FROM listing_retirements WHERE listing_id = ?", listing_id).Scan(&retirements)
+	if err != nil {
+		return err
+	}
+	if retirements > 0 {
+		return ErrListingRetired
+	}
+	var server string
+	err = sql.QueryRow("SELECT server FROM listings WHERE listing_id = ?", listing_id).Scan(&server)
+	if err != nil {
+		return err
+	}
+	return checkServerEnabled(sql, server)
+}
+
+// itemKey is either a single item with damage like "item.totem;0", which makes a listing for a shulker full of that
+// or the full comma separated contents of the shulker, exactly like createShulkerFull returns
+// templateStr is optional, if it's there it's the JSON of a ShulkerTemplate and itemKey is just a unique name for the listing, like "kit.pvp"
+func createListing(ctx context.Context, admin_id int64, server string, itemKey string, itemName string, itemPhoto string, templateStr string, reason string) (int64, error) {
+	var template *ShulkerTemplate
+	if templateStr != "" {
+		var err error
+		template, err = parseShulkerTemplate(templateStr)
+		if err != nil {
+			return 0, err
+		}
+	} else if !strings.Contains(itemKey, ",") {
+		itemKey = createShulkerFull(itemKey)
+	}
+	server = normalizeServerIP(server)
+	var listing_id int64
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		err := checkServerEnabled(sql, server)
+		if err != nil {
+			return err
+		}
+		res, err := sql.Exec("INSERT INTO listings (server, item_key, item_name, item_photo) VALUES (?, ?, ?, ?)", server, itemKey, itemName, itemPhoto) // the CHECK and UNIQUE constraints stop empty fields and duplicates
+		if err != nil {
+			return err
+		}
+		listing_id, err = res.LastInsertId()
+		if err != nil {
+			return err
+		}
+		detail := "created listing " + strconv.FormatInt(listing_id, 10) + " for " + itemName + " on " + server + " with item key " + itemKey
+		if template != nil {
+			_, err = sql.Exec("INSERT INTO listing_templates (listing_id, template) VALUES (?, ?)", listing_id, template.String())
+			if err != nil {
+				return err
+			}
+			detail += " and template " + template.String()
+		}
+		return writeAdminLog(sql, admin_id, "create_listing", 0, detail, reason)
+	})
+	return listing_id, err
+}
+
+// only the name and the photo can change, changing what item a listing is would make everything already in it wrong
+func editListing(ctx context.Context, admin_id int64, listing_id int64, itemName string, itemPhoto string, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var oldName string
+		var oldPhoto string
+		err := sql.QueryRow("SELECT item_name, item_photo FROM listings WHERE listing_id = ?", listing_id).Scan(&oldName, &oldPhoto)
+		if err != nil {
+			return err
+		}
+		_, err = sql.Exec("UPDATE listings SET item_name = ?, item_photo = ? WHERE listing_id = ?", itemName, itemPhoto, listing_id)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "edit_listing", 0, "listing "+strconv.FormatInt(listing_id, 10)+" renamed from "+oldName+" to "+itemName+", photo changed from "+oldPhoto+" to "+itemPhoto, reason)
+	})
+}
+
+// retiring a listing stops all new orders and deposits, refunds every open buy order, takes every sell order down,
+// and unlocks anything that was waiting to be force sold. everyone holding one can still withdraw it.
+func retireListing(ctx context.Context, admin_id int64, listing_id int64, reason string) error {
+	buyers := make([]int64, 0)
+	holders := make([]int64, 0)
+	var itemName string
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		err := sql.QueryRow("SELECT item_name FROM listings WHERE listing_id = ?", listing_id).Scan(&itemName)
+		if err != nil {
+			return err
+		}
+		_, err = sql.Exec("INSERT INTO listing_retirements (listing_id, retired_by) VALUES (?, ?)", listing_id, admin_id)
+		if err != nil {
+			return err // most likely already retired
+		}
+
+		rows, err := sql.Query("SELECT DISTINCT user_id FROM listing_buy_orders WHERE listing_id = ?", listing_id)
+		if err != nil {
+			return err
+		}
+		for rows.Next() {
+			var user_id int64
+			err = rows.Scan(&user_id)
+			if err != nil {
+				rows.Close()
+				return err
+			}
+			buyers = append(buyers, user_id)
+		}
+		rows.Close()
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+		for _, user_id := range buyers {
+			err = cancelAllBuysInListing(sql, user_id, listing_id)
+			if err != nil {
+				return err
+			}
+		}
+
+		// deposits that a bot already picked up still get to finish, they'll just end up as something to withdraw
+		_, err = sql.Exec("DELETE FROM pending_deposits WHERE listing_id = ? AND picked_up_at IS NULL", listing_id)
+		if err != nil {
+			return err
+		}
+
+		_, err = sql.Exec("UPDATE slots SET sale_price = NULL, for_sale_since = NULL, locked = 0 WHERE listing_id = ? AND locked != 2", listing_id)
+		if err != nil {
+			return err
+		}
+
+		rows, err = sql.Query("SELECT DISTINCT user_id FROM slots WHERE listing_id = ?", listing_id)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var user_id int64
+			err = rows.Scan(&user_id)
+			if err != nil {
+				return err
+			}
+			holders = append(holders, user_id)
+		}
+		err = rows.Err()
+		if err != nil {
+			return err
+		}
+
+		return writeAdminLog(sql, admin_id, "retire_listing", 0, "retired listing "+strconv.FormatInt(listing_id, 10)+" ("+itemName+"), refunded "+strconv.Itoa(len(buyers))+" buyers", reason)
+	})
+	if err != nil {
+		return err
+	}
+	for _, user_id := range buyers {
+		go DMuser(user_id, "The `"+itemName+"` listing has been retired. Your buy orders in it were cancelled and refunded.")
+	}
+	for _, user_id := range holders {
+		go DMuser(user_id, "The `"+itemName+"` listing has been retired. Your sell orders in it were taken down, please withdraw your items.")
+	}
+	return nil
+}
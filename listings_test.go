@@ -0,0 +1,121 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"testing"
+)
+
+func TestCreateListing(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		listing_id, err := createListing(ctx, 42, "2b2t.org", "tile.obsidian;0", "obsidian", "/static/obsidian.png", "", "people keep asking")
+		if err != nil {
+			t.Fatal(err)
+		}
+		listing := getListingForContentsOnServer(createShulkerFull("tile.obsidian;0"), "2b2t.org", 0)
+		if listing == nil || listing.ListingID != listing_id || listing.ItemName != "obsidian" {
+			t.Errorf("Created listing can't be found by its contents %v", listing)
+		}
+		_, err = createListing(ctx, 42, "2b2t.org", "tile.obsidian;0", "obsidian again", "/static/obsidian.png", "", "oops")
+		if err == nil {
+			t.Errorf("Was able to create the same listing twice")
+		}
+		err = editListing(ctx, 42, listing_id, "obby", "/static/obby.png", "shorter name")
+		if err != nil {
+			t.Error(err)
+		}
+		if getListingById(listing_id).ItemName != "obby" {
+			t.Errorf("Listing wasn't renamed")
+		}
+	})
+}
+
+func TestRetireListing(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := RunSQL(func(sql *sql.Tx) error {
+			// user 2 wants another end crystal shulker, user 1 is selling one
+			return createBuyOrder(sql, 2, 3, 3, 1)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = retireListing(ctx, 42, 3, "nobody trades crystals")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = retireListing(ctx, 42, 3, "again")
+		if err == nil {
+			t.Errorf("Was able to retire a listing twice")
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			var i int64
+			err := sql.QueryRow("SELECT balance FROM users WHERE user_id = 2").Scan(&i)
+			if err != nil {
+				return err
+			}
+			if i != 100 {
+				t.Errorf("Buy order wasn't refunded, balance is %d", i)
+			}
+			err = sql.QueryRow("SELECT COUNT(*) FROM slots WHERE listing_id = 3 AND sale_price IS NOT NULL").Scan(&i)
+			if err != nil {
+				return err
+			}
+			if i != 0 {
+				t.Errorf("Sell order is still up in a retired listing")
+			}
+			err = sql.QueryRow("SELECT COUNT(*) FROM slots WHERE listing_id = 3").Scan(&i)
+			if err != nil {
+				return err
+			}
+			if i != 1 {
+				t.Errorf("Holder lost their item when the listing was retired")
+			}
+			if createBuyOrder(sql, 2, 3, 3, 1) != ErrListingRetired {
+				t.Errorf("Was able to place a buy order in a retired listing")
+			}
+			if createSellOrder(sql, 1, 2, 5) != ErrListingRetired {
+				t.Errorf("Was able to place a sell order in a retired listing")
+			}
+			// and long after it would have expired, the holder can still get it out
+			_, err = sql.Exec("UPDATE slots SET expiry_time = ? WHERE user_id = 1 AND slot_index = 2", unixNow()-86400)
+			if err != nil {
+				return err
+			}
+			return verifyStorage(sql)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		locked, err := checkSlotExpiries()
+		if err != nil || countRows(t, "SELECT COUNT(*) FROM slots WHERE locked != 0") != 0 {
+			t.Error("Expired slot in a retired listing shouldn't be locked", locked, err)
+		}
+		bot := connectSimulatedBot(t)
+		defer disconnectSimulatedBot(t, bot)
+		err = bot.Run("status")
+		if err != nil {
+			t.Fatal(err)
+		}
+		_, err = createWithdrawal(ctx, 1, 2)
+		if err != nil {
+			t.Error("Wasn't able to withdraw an expired slot from a retired listing", err)
+		}
+		for _, info := range generateNavigation(ctx, "") {
+			if info.ItemInfo.ListingID == 3 {
+				t.Errorf("Retired listing is still in the navigation")
+			}
+		}
+	})
+}
+
+func TestAdminListingsTemplateRenders(t *testing.T) {
+	err := templates.ExecuteTemplate(ioutil.Discard, "admin_listings.html", &AdminListingsPageTemplate{
+		Profile:  &User{UserID: 42},
+		Listings: []AdminListing{{Listing: Listing{ListingID: 1}}, {Listing: Listing{ListingID: 2}, Retired: true}},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,16 +1,402 @@
 package main
 
 import (
+	"bytes"
+	"context"
+	cryptorand "crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
 	"io"
 	"log"
+	"net/http"
 	"os"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
 )
 
-func init() {
-	f, err := os.OpenFile("exchange.log", os.O_RDWR|os.O_CREATE|os.O_APPEND, 0666)
+// every log line is one JSON object, like
+// {"time":"2019-02-01T15:04:05.123Z","level":"info","component":"bot","msg":"Bot connected","bot":"51dc...","corr":"deposit-abcd1234"}
+// each subsystem logs through its own component logger, and each component has its own level that admins can change while it's running
+// "corr" is a correlation id that follows one deposit, withdrawal, trade or web request through every component it touches, grep for it
+
+type Level int
+
+const (
+	LevelDebug Level = iota
+	LevelInfo
+	LevelWarn
+	LevelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+func (l Level) String() string {
+	return levelNames[l]
+}
+
+func parseLevel(name string) (Level, error) {
+	for i, n := range levelNames {
+		if n == name {
+			return Level(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q, must be one of %s", name, strings.Join(levelNames, ", "))
+}
+
+type Logger struct {
+	component string
+	fields    []interface{} // key, value, key, value... added to every line, from With
+}
+
+var (
+	dbLog      = newLogger("db")
+	ordersLog  = newLogger("orders")
+	botLog     = newLogger("bot")
+	httpLog    = newLogger("http")
+	discordLog = newLogger("discord")
+	jobsLog    = newLogger("jobs")
+	adminLog   = newLogger("admin")
+	mainLog    = newLogger("main")
+)
+
+var logLock sync.Mutex
+var logOutput io.Writer = os.Stdout // setupLogging adds the file
+var defaultLogLevel = LevelInfo
+var componentLevels = make(map[string]Level) // overrides of defaultLogLevel
+var logComponents []string                   // every component there's a logger for, for the admin page
+
+func newLogger(component string) *Logger {
+	logLock.Lock()
+	defer logLock.Unlock()
+	logComponents = append(logComponents, component)
+	return &Logger{component: component}
+}
+
+// a logger that adds these key value pairs to every line, like botLog.With("bot", uuid)
+func (l *Logger) With(kv ...interface{}) *Logger {
+	fields := make([]interface{}, 0, len(l.fields)+len(kv))
+	fields = append(fields, l.fields...)
+	return &Logger{component: l.component, fields: append(fields, kv...)}
+}
+
+func (l *Logger) Debug(msg string, kv ...interface{}) { l.log(LevelDebug, msg, kv) }
+func (l *Logger) Info(msg string, kv ...interface{})  { l.log(LevelInfo, msg, kv) }
+func (l *Logger) Warn(msg string, kv ...interface{})  { l.log(LevelWarn, msg, kv) }
+func (l *Logger) Error(msg string, kv ...interface{}) { l.log(LevelError, msg, kv) }
+
+func (l *Logger) Enabled(level Level) bool {
+	return level >= getLogLevel(l.component)
+}
+
+func (l *Logger) log(level Level, msg string, kv []interface{}) {
+	if !l.Enabled(level) {
+		return
+	}
+	line := formatLogLine(time.Now(), level, l.component, msg, append(append([]interface{}(nil), l.fields...), kv...))
+	logLock.Lock()
+	defer logLock.Unlock()
+	logOutput.Write(line)
+}
+
+func formatLogLine(t time.Time, level Level, component string, msg string, kv []interface{}) []byte {
+	var buf bytes.Buffer
+	buf.WriteString(`{"time":`)
+	writeLogValue(&buf, t.UTC().Format("2006-01-02T15:04:05.000Z07:00"))
+	buf.WriteString(`,"level":`)
+	writeLogValue(&buf, level.String())
+	buf.WriteString(`,"component":`)
+	writeLogValue(&buf, component)
+	buf.WriteString(`,"msg":`)
+	writeLogValue(&buf, msg)
+	for i := 0; i < len(kv); i += 2 {
+		key := fmt.Sprint(kv[i])
+		var value interface{} = "MISSING" // an odd number of arguments is a bug, but not one worth losing the line over
+		if i+1 < len(kv) {
+			value = kv[i+1]
+		}
+		buf.WriteByte(',')
+		writeLogValue(&buf, key)
+		buf.WriteByte(':')
+		writeLogValue(&buf, value)
+	}
+	buf.WriteString("}\n")
+	return buf.Bytes()
+}
+
+func writeLogValue(buf *bytes.Buffer, value interface{}) {
+	switch v := value.(type) {
+	case error:
+		value = v.Error()
+	case fmt.Stringer: // durations, levels
+		value = v.String()
+	}
+	data, err := json.Marshal(value)
+	if err != nil {
+		data, _ = json.Marshal(fmt.Sprint(value))
+	}
+	buf.Write(data)
+}
+
+func getLogLevel(component string) Level {
+	logLock.Lock()
+	defer logLock.Unlock()
+	if level, ok := componentLevels[component]; ok {
+		return level
+	}
+	return defaultLogLevel
+}
+
+// changes one component's level while running, from the admin page
+func setLogLevel(component string, level Level) error {
+	logLock.Lock()
+	defer logLock.Unlock()
+	for _, c := range logComponents {
+		if c == component {
+			componentLevels[component] = level
+			return nil
+		}
+	}
+	return errors.New("there's no log component called " + component)
+}
+
+type ComponentLevel struct {
+	Component string
+	Level     Level
+}
+
+func getLogLevels() []ComponentLevel {
+	logLock.Lock()
+	defer logLock.Unlock()
+	result := make([]ComponentLevel, 0, len(logComponents))
+	for _, c := range logComponents {
+		level, ok := componentLevels[c]
+		if !ok {
+			level = defaultLogLevel
+		}
+		result = append(result, ComponentLevel{c, level})
+	}
+	sort.Slice(result, func(i, j int) bool {
+		return result[i].Component < result[j].Component
+	})
+	return result
+}
+
+// log_levels in the config is like "bot=debug,db=warn"
+func parseComponentLevels(str string) (map[string]Level, error) {
+	result := make(map[string]Level)
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("log level %q must look like component=level", part)
+		}
+		level, err := parseLevel(strings.TrimSpace(kv[1]))
+		if err != nil {
+			return nil, err
+		}
+		result[strings.TrimSpace(kv[0])] = level
+	}
+	return result, nil
+}
+
+// called once at startup, after setupConfig
+func setupLogging() {
+	level, err := parseLevel(config.LogLevel)
+	if err != nil {
+		panic(err) // validate already checked this
+	}
+	levels, err := parseComponentLevels(config.LogLevels)
+	if err != nil {
+		panic(err)
+	}
+	var output io.Writer = os.Stdout
+	if config.LogFile != "" {
+		f, err := openRotatingFile(config.LogFile, config.LogMaxSizeMB*1024*1024, time.Duration(config.LogRotateHours)*time.Hour, int(config.LogKeep))
+		if err != nil {
+			panic("Unable to open log file: " + err.Error())
+		}
+		output = io.MultiWriter(os.Stdout, f)
+	}
+	logLock.Lock()
+	logOutput = output
+	defaultLogLevel = level
+	componentLevels = levels
+	logLock.Unlock()
+
+	// anything still using the standard logger, like the libraries we use, ends up as a main info line
+	log.SetFlags(0)
+	log.SetOutput(stdlibLogWriter{})
+	mainLog.Info("Logging set up", "file", config.LogFile, "level", level, "levels", config.LogLevels)
+}
+
+type stdlibLogWriter struct{}
+
+func (stdlibLogWriter) Write(p []byte) (int, error) {
+	mainLog.Info(strings.TrimSuffix(string(p), "\n"))
+	return len(p), nil
+}
+
+// correlation ids, one for each thing worth following through the logs
+
+func depositCorrelation(deposit_id uint32) string {
+	return "deposit-" + fmt.Sprintf("%08x", deposit_id)
+}
+
+// withdrawalCorrelation is in codes.go
+
+func newTradeCorrelation() string {
+	return "trade-" + randomCorrelation()
+}
+
+func newRequestCorrelation() string {
+	return "req-" + randomCorrelation()
+}
+
+// from crypto/rand and not the seeded source in random.go, so logging doesn't change what a seeded run does
+func randomCorrelation() string {
+	b := make([]byte, 4)
+	cryptorand.Read(b)
+	return hex.EncodeToString(b)
+}
+
+// an io.Writer for the log file that starts a new file once it gets too big or too old
+// old ones are renamed to exchange.log.20190201-150405 and only the newest keep of them are kept
+type rotatingFile struct {
+	lock    sync.Mutex
+	path    string
+	maxSize int64         // 0 means no limit
+	every   time.Duration // rotate when now is in a different period of this length than when the file was started, 0 means never
+	keep    int
+	file    *os.File
+	size    int64
+	started time.Time
+}
+
+func openRotatingFile(path string, maxSize int64, every time.Duration, keep int) (*rotatingFile, error) {
+	f := &rotatingFile{path: path, maxSize: maxSize, every: every, keep: keep}
+	return f, f.open()
+}
+
+func (f *rotatingFile) open() error {
+	file, err := os.OpenFile(f.path, os.O_WRONLY|os.O_CREATE|os.O_APPEND, 0644)
+	if err != nil {
+		return err
+	}
+	info, err := file.Stat()
 	if err != nil {
-		log.Fatalf("error opening file: %v", err)
-		panic("=(")
+		file.Close()
+		return err
 	}
-	log.SetOutput(io.MultiWriter(os.Stdout, f))
+	f.file = file
+	f.size = info.Size()
+	f.started = time.Now()
+	if f.size > 0 {
+		f.started = info.ModTime() // a restart shouldn't put off the next rotation
+	}
+	return nil
+}
+
+func (f *rotatingFile) Write(p []byte) (int, error) {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	now := time.Now()
+	tooBig := f.maxSize > 0 && f.size > 0 && f.size+int64(len(p)) > f.maxSize
+	tooOld := f.every > 0 && !now.Truncate(f.every).Equal(f.started.Truncate(f.every))
+	if tooBig || tooOld {
+		err := f.rotate(now)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "Unable to rotate log file", err)
+		}
+	}
+	n, err := f.file.Write(p)
+	f.size += int64(n)
+	return n, err
+}
+
+func (f *rotatingFile) rotate(now time.Time) error {
+	f.file.Close()
+	rotated := f.path + "." + now.Format("20060102-150405")
+	for i := 1; ; i++ { // two rotations in the same second
+		if _, err := os.Stat(rotated); os.IsNotExist(err) {
+			break
+		}
+		rotated = f.path + "." + now.Format("20060102-150405") + "." + strconv.Itoa(i)
+	}
+	err := os.Rename(f.path, rotated)
+	openErr := f.open()
+	if openErr != nil {
+		return openErr
+	}
+	if err != nil {
+		return err
+	}
+	return f.deleteOld()
+}
+
+func (f *rotatingFile) deleteOld() error {
+	old, err := filepath.Glob(f.path + ".*")
+	if err != nil {
+		return err
+	}
+	sort.Strings(old) // the timestamps sort oldest first
+	for len(old) > f.keep {
+		err = os.Remove(old[0])
+		if err != nil {
+			return err
+		}
+		old = old[1:]
+	}
+	return nil
+}
+
+func (f *rotatingFile) Close() error {
+	f.lock.Lock()
+	defer f.lock.Unlock()
+	return f.file.Close()
+}
+
+// every web request gets a correlation id, so everything one request logs can be found together
+// it goes in the request's context, and anything with that context can tag its lines with logFor
+
+type requestCorrelationKey struct{}
+
+func withRequestCorrelation(ctx context.Context, corr string) context.Context {
+	return context.WithValue(ctx, requestCorrelationKey{}, corr)
+}
+
+// l, tagged with the web request's id if ctx came from one
+func logFor(ctx context.Context, l *Logger) *Logger {
+	if corr, ok := ctx.Value(requestCorrelationKey{}).(string); ok {
+		return l.With("req", corr)
+	}
+	return l
+}
+
+func requestLogger(r *http.Request, l *Logger) *Logger {
+	return logFor(r.Context(), l)
+}
+
+// from the logging section of the admin page
+func handleAdminSetLogLevel(w http.ResponseWriter, r *http.Request) {
+	adminActionThen(w, r, "/admin", func(admin *User, reason string) error {
+		level, err := parseLevel(r.FormValue("level"))
+		if err != nil {
+			return err
+		}
+		err = setLogLevel(r.FormValue("component"), level)
+		if err != nil {
+			return err
+		}
+		adminLog.Info("Admin changed log level", "admin", admin.UserID, "component", r.FormValue("component"), "level", level)
+		return nil
+	})
 }
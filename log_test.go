@@ -0,0 +1,158 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"errors"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+)
+
+// captures everything logged while fn runs, one decoded line each
+func captureLogs(t *testing.T, fn func()) []map[string]interface{} {
+	var buf bytes.Buffer
+	logLock.Lock()
+	saved := logOutput
+	logOutput = &buf
+	logLock.Unlock()
+	defer func() {
+		logLock.Lock()
+		logOutput = saved
+		logLock.Unlock()
+	}()
+	fn()
+	logLock.Lock()
+	defer logLock.Unlock()
+	var lines []map[string]interface{}
+	for _, line := range strings.Split(strings.TrimSpace(buf.String()), "\n") {
+		if line == "" {
+			continue
+		}
+		var decoded map[string]interface{}
+		err := json.Unmarshal([]byte(line), &decoded)
+		if err != nil {
+			t.Fatal("Log line isn't JSON", line, err)
+		}
+		lines = append(lines, decoded)
+	}
+	return lines
+}
+
+func TestFormatLogLine(t *testing.T) {
+	at := time.Date(2019, 2, 1, 15, 4, 5, 123e6, time.UTC)
+	line := formatLogLine(at, LevelWarn, "bot", `said "hi"`, []interface{}{"bot", "abc", "err", errors.New("oh no"), "took", time.Second, "count", 3, "odd"})
+	expected := `{"time":"2019-02-01T15:04:05.123Z","level":"warn","component":"bot","msg":"said \"hi\"","bot":"abc","err":"oh no","took":"1s","count":3,"odd":"MISSING"}` + "\n"
+	if string(line) != expected {
+		t.Errorf("Got %s expected %s", line, expected)
+	}
+}
+
+func TestLogLevels(t *testing.T) {
+	defer setLogLevel("orders", defaultLogLevel)
+	lines := captureLogs(t, func() {
+		ordersLog.Debug("hidden")
+		ordersLog.Info("shown")
+		setLogLevel("orders", LevelDebug)
+		ordersLog.Debug("now shown")
+		setLogLevel("orders", LevelError)
+		ordersLog.With("corr", "trade-1").Warn("hidden again")
+		ordersLog.With("corr", "trade-1").Error("failed", "user", 5)
+	})
+	var msgs []string
+	for _, line := range lines {
+		msgs = append(msgs, line["msg"].(string))
+	}
+	if strings.Join(msgs, ",") != "shown,now shown,failed" {
+		t.Error("Wrong lines made it through", msgs)
+	}
+	if last := lines[len(lines)-1]; last["component"] != "orders" || last["corr"] != "trade-1" || last["user"] != 5.0 {
+		t.Error("Fields from With and the call should both be there", last)
+	}
+	if setLogLevel("nope", LevelDebug) == nil {
+		t.Error("Unknown components should be rejected")
+	}
+	for _, c := range getLogLevels() {
+		if c.Component == "orders" && c.Level != LevelError {
+			t.Error("Admin page should show the changed level", c)
+		}
+	}
+}
+
+func TestParseComponentLevels(t *testing.T) {
+	levels, err := parseComponentLevels(" bot=debug, db=warn ,")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(levels) != 2 || levels["bot"] != LevelDebug || levels["db"] != LevelWarn {
+		t.Error("Wrong levels", levels)
+	}
+	for _, bad := range []string{"bot", "bot=loud"} {
+		if _, err := parseComponentLevels(bad); err == nil {
+			t.Error("Should have been rejected:", bad)
+		}
+	}
+}
+
+func TestRequestCorrelation(t *testing.T) {
+	lines := captureLogs(t, func() {
+		logFor(context.Background(), httpLog).Info("no request")
+		logFor(withRequestCorrelation(context.Background(), "req-1"), ordersLog).Info("in a request")
+	})
+	if _, ok := lines[0]["req"]; ok {
+		t.Error("There's no request to tag", lines[0])
+	}
+	if lines[1]["req"] != "req-1" || lines[1]["component"] != "orders" {
+		t.Error("Line should be tagged with the request", lines[1])
+	}
+}
+
+func TestRotatingFile(t *testing.T) {
+	dir, err := ioutil.TempDir("", "exchange-log")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	path := filepath.Join(dir, "exchange.log")
+	f, err := openRotatingFile(path, 10, 0, 2)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer f.Close()
+	for i := 0; i < 5; i++ {
+		_, err = f.Write([]byte("12345678\n"))
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	old, err := filepath.Glob(path + ".*")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(old) != 2 {
+		t.Error("Should keep exactly 2 old files", old)
+	}
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "12345678\n" {
+		t.Errorf("Current file should only have the last line, has %q", data)
+	}
+
+	// a new period starts a new file even if it's small
+	f.started = f.started.Add(-2 * time.Hour)
+	f.every = time.Hour
+	f.Write([]byte("x\n"))
+	data, err = ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(data) != "x\n" {
+		t.Errorf("Should have rotated for being too old, has %q", data)
+	}
+}
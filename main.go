@@ -1,24 +1,44 @@
 package main
 
 import (
-	"log"
+	"flag"
 	"os"
 	"os/signal"
 	"syscall"
 )
 
 func main() {
+	dryRun := flag.Bool("migrate-dry-run", false, "check which database migrations would run, then exit without changing anything")
+	restore := flag.String("restore", "", "replace the database with this backup, then exit. stop the exchange first")
+	restoreTo := flag.String("restore-to", "", "like -restore, but with the newest backup taken at or before this time, like 2019-02-01T15:04:05Z")
+	flag.Parse()
+	setupConfig()
+	setupLogging()
+	if *dryRun {
+		dryRunMigrations()
+		return
+	}
+	if *restore != "" || *restoreTo != "" {
+		if *restore != "" && *restoreTo != "" {
+			mainLog.Error("Use -restore or -restore-to, not both")
+			os.Exit(1)
+		}
+		err := restoreFromCommandLine(*restore, *restoreTo)
+		if err != nil {
+			mainLog.Error("Restore failed", "err", err)
+			os.Exit(1)
+		}
+		return
+	}
 	SetupDatabase() // not in a goroutine because this just sets up a connection, it doesn't block
 	createInitialListings()
 	setupDiscordBot()
-	go slotExpiries()
-	go pendingDepositCleanup()
-	go pendingWithdrawalCleanup()
-	go baritoneListen()
-	go serve()
+	scheduleJobs(lifecycle, defaultJobs())
+	lifecycle.Go(StageListeners, "bot listener", baritoneListen)
+	lifecycle.Go(StageListeners, "HTTP server", serve)
 
 	awaitControlC() // not in a goroutine because this is intended to wait until it's time to shut down
-	log.Println("Goodbye")
+	mainLog.Info("Goodbye")
 	// Go programs exit once the main function is over, so once "awaitControlC" returns, the program will quit immediately
 }
 
@@ -34,15 +54,10 @@ func awaitControlC() {
 
 	// at this point, we've just received a signal that's either SIGINT or SIGTERM so time to shut down
 
-	log.Println("Control C pressed, shutting down cleanly")
-	log.Println("Signal received:", sig)
+	mainLog.Info("Shutting down cleanly", "signal", sig)
 
-	log.Println("Shutting down HTTP server")
-	ShutdownHTTP()
-
-	log.Println("Shutting down database")
-	ShutdownDatabase()
-
-	log.Println("Everything is shut down")
+	// first the website and bots stop, and whatever trades they were in the middle of finish
+	// then the tickers stop, then once nothing else could possibly want it, the database closes
+	lifecycle.Shutdown(ShutdownStageTimeout, ShutdownDatabase)
 	//time to shut down for real, everything is cleaned up already
 }
@@ -16,7 +16,7 @@ type MainPageTemplate struct { // this struct represents the data that is passed
 
 func handleMainPage(w http.ResponseWriter, r *http.Request) { // handle a request to the main page
 	data := &MainPageTemplate{
-		Navigation:  generateNavigation(),
+		Navigation:  generateNavigation(r.Context(), ""),
 		Profile:     getUser(r), // call getUser in serve.go to get user info
 		Balance:     0,
 		Statistics:  "yep statistics",
@@ -28,7 +28,7 @@ func handleMainPage(w http.ResponseWriter, r *http.Request) { // handle a reques
 		// note that their profile is just getUser(request), which returns nil if they are not logged in
 
 		// this function runs a SQL query in a completely guaranteed to be safe manner
-		err := RunSQL(func(sql *sql.Tx) error {
+		err := RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
 			row := sql.QueryRow("SELECT balance FROM users WHERE user_id = ?", data.Profile.UserID)
 			err := row.Scan(&data.Balance) // this "scans" one row from the result of that query into a pointer to data.Balance
 			// this is how the result of the query "gets outside" this nested function definition
@@ -0,0 +1,349 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"io"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/gorilla/mux"
+	"github.com/gorilla/pat"
+)
+
+// /metrics, in the prometheus text format so prometheus can scrape it directly
+// https://prometheus.io/docs/instrumenting/exposition_formats/
+// everything from the database is counted fresh on every scrape, the http and discord numbers are kept in memory since startup
+
+// upper bounds in seconds for the http latency histogram, same as prometheus' own defaults
+var HTTPLatencyBuckets = []float64{0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5, 10}
+
+type routeLatency struct {
+	buckets []int64 // not cumulative, buckets[i] is how many took at most HTTPLatencyBuckets[i], the extra last one is everything slower
+	sum     float64
+	count   int64
+	codes   map[int]int64
+}
+
+var metricsLock sync.Mutex
+var httpLatencies = make(map[string]*routeLatency) // by route, like "GET /trade/{listing}"
+var dmFailures int64
+
+func recordDMFailure() {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	dmFailures++
+}
+
+func recordHTTPRequest(route string, code int, took time.Duration) {
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	l, ok := httpLatencies[route]
+	if !ok {
+		l = &routeLatency{buckets: make([]int64, len(HTTPLatencyBuckets)+1), codes: make(map[int]int64)}
+		httpLatencies[route] = l
+	}
+	seconds := took.Seconds()
+	bucket := len(HTTPLatencyBuckets)
+	for i, bound := range HTTPLatencyBuckets {
+		if seconds <= bound {
+			bucket = i
+			break
+		}
+	}
+	l.buckets[bucket]++
+	l.sum += seconds
+	l.count++
+	l.codes[code]++
+}
+
+// remembers the status code a handler wrote, for the per route response counts
+type statusRecorder struct {
+	http.ResponseWriter
+	code int
+}
+
+func (w *statusRecorder) WriteHeader(code int) {
+	w.code = code
+	w.ResponseWriter.WriteHeader(code)
+}
+
+// times and logs every request under a fresh request id, labelled by the pattern it matched in p instead of the real path, so /trade/1 and /trade/2 are both "GET /trade/{listing}"
+func instrumentHTTP(p *pat.Router, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		route := routeName(p, r)
+		start := time.Now()
+		corr := newRequestCorrelation()
+		w.Header().Set("X-Request-Id", corr)
+		recorder := &statusRecorder{w, http.StatusOK}
+		next.ServeHTTP(recorder, r.WithContext(withRequestCorrelation(r.Context(), corr)))
+		duration := time.Since(start)
+		recordHTTPRequest(route, recorder.code, duration)
+		level := LevelDebug
+		if recorder.code >= 500 {
+			level = LevelWarn
+		}
+		httpLog.log(level, "Request", []interface{}{"req", corr, "route", route, "path", r.URL.Path, "status", recorder.code, "duration", duration})
+	})
+}
+
+func routeName(p *pat.Router, r *http.Request) string {
+	if strings.HasPrefix(r.URL.Path, "/assets/") {
+		return r.Method + " /assets/"
+	}
+	var match mux.RouteMatch
+	if p.Match(r, &match) && match.Route != nil {
+		template, err := match.Route.GetPathTemplate()
+		if err == nil {
+			return r.Method + " " + template
+		}
+	}
+	return r.Method + " unmatched" // anything else would let a scanner make as many series as it has urls
+}
+
+func handleMetrics(w http.ResponseWriter, r *http.Request) {
+	if config.MetricsToken != "" && r.Header.Get("Authorization") != "Bearer "+config.MetricsToken {
+		http.Error(w, "wrong or missing metrics token", http.StatusUnauthorized)
+		return
+	}
+	var out strings.Builder
+	err := writeMetrics(r.Context(), &out)
+	if err != nil {
+		http.Error(w, "Unable to collect metrics. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	w.Header().Set("Content-Type", "text/plain; version=0.0.4")
+	io.WriteString(w, out.String())
+}
+
+var labelEscaper = strings.NewReplacer(`\`, `\\`, `"`, `\"`, "\n", `\n`)
+
+type metricsWriter struct {
+	w io.Writer
+}
+
+func (m metricsWriter) family(name string, kind string, help string) {
+	fmt.Fprintf(m.w, "# HELP %s %s\n# TYPE %s %s\n", name, help, name, kind)
+}
+
+// labels go in as name, value, name, value...
+func (m metricsWriter) sample(name string, value float64, labels ...string) {
+	io.WriteString(m.w, name)
+	if len(labels) > 0 {
+		parts := make([]string, 0, len(labels)/2)
+		for i := 0; i+1 < len(labels); i += 2 {
+			parts = append(parts, labels[i]+`="`+labelEscaper.Replace(labels[i+1])+`"`)
+		}
+		io.WriteString(m.w, "{"+strings.Join(parts, ",")+"}")
+	}
+	io.WriteString(m.w, " "+strconv.FormatFloat(value, 'g', -1, 64)+"\n")
+}
+
+type listingMetrics struct {
+	listing_id string
+	server     string
+	item_name  string
+	trades     int64
+	volume     int64
+	sells      int64
+	buys       int64
+	bestAsk    sql.NullInt64
+	bestBid    sql.NullInt64
+}
+
+func (l listingMetrics) labels() []string {
+	return []string{"listing", l.listing_id, "server", l.server, "item", l.item_name}
+}
+
+func writeMetrics(ctx context.Context, w io.Writer) error {
+	m := metricsWriter{w}
+	var listings []listingMetrics
+	var pendingDeposits, pendingWithdrawals int64
+	err := RunReadSQLContext(ctx, func(sql *sql.Tx) error {
+		rows, err := sql.Query(`
+			SELECT
+				listings.listing_id, listings.server, listings.item_name,
+				(SELECT COUNT(*) FROM completed_listing_trades WHERE listing_id = listings.listing_id),
+				(SELECT COALESCE(SUM(price), 0) FROM completed_listing_trades WHERE listing_id = listings.listing_id),
+				(SELECT COUNT(*) FROM slots WHERE listing_id = listings.listing_id AND sale_price IS NOT NULL),
+				(SELECT COALESCE(SUM(quantity), 0) FROM listing_buy_orders WHERE listing_id = listings.listing_id),
+				(SELECT MIN(sale_price) FROM slots WHERE listing_id = listings.listing_id AND sale_price IS NOT NULL),
+				(SELECT MAX(price) FROM listing_buy_orders WHERE listing_id = listings.listing_id)
+			FROM listings ORDER BY listings.listing_id`)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var l listingMetrics
+			err = rows.Scan(&l.listing_id, &l.server, &l.item_name, &l.trades, &l.volume, &l.sells, &l.buys, &l.bestAsk, &l.bestBid)
+			if err != nil {
+				return err
+			}
+			listings = append(listings, l)
+		}
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		err = sql.QueryRow("SELECT COUNT(*) FROM pending_deposits").Scan(&pendingDeposits)
+		if err != nil {
+			return err
+		}
+		return sql.QueryRow("SELECT COUNT(*) FROM pending_withdrawals").Scan(&pendingWithdrawals)
+	})
+	if err != nil {
+		return err
+	}
+
+	m.family("exchange_trades_total", "counter", "Completed trades in each listing.")
+	for _, l := range listings {
+		m.sample("exchange_trades_total", float64(l.trades), l.labels()...)
+	}
+	m.family("exchange_trade_volume_total", "counter", "Total "+Currency+" paid in completed trades in each listing.")
+	for _, l := range listings {
+		m.sample("exchange_trade_volume_total", float64(l.volume), l.labels()...)
+	}
+	m.family("exchange_open_orders", "gauge", "Slots for sale (side=sell) and shulkers wanted by buy orders (side=buy) in each listing.")
+	for _, l := range listings {
+		m.sample("exchange_open_orders", float64(l.sells), append(l.labels(), "side", "sell")...)
+		m.sample("exchange_open_orders", float64(l.buys), append(l.labels(), "side", "buy")...)
+	}
+	m.family("exchange_best_price", "gauge", "Lowest sell price (side=ask) and highest buy price (side=bid) in each listing, missing if there are no orders on that side.")
+	for _, l := range listings {
+		if l.bestAsk.Valid {
+			m.sample("exchange_best_price", float64(l.bestAsk.Int64), append(l.labels(), "side", "ask")...)
+		}
+		if l.bestBid.Valid {
+			m.sample("exchange_best_price", float64(l.bestBid.Int64), append(l.labels(), "side", "bid")...)
+		}
+	}
+	m.family("exchange_pending_deposits", "gauge", "Deposits waiting for a shulker to be handed to a bot.")
+	m.sample("exchange_pending_deposits", float64(pendingDeposits))
+	m.family("exchange_pending_withdrawals", "gauge", "Withdrawals waiting to be confirmed in game.")
+	m.sample("exchange_pending_withdrawals", float64(pendingWithdrawals))
+
+	writeDatabaseMetrics(m)
+	writeBotMetrics(m)
+	writeRateLimitMetrics(m)
+
+	metricsLock.Lock()
+	defer metricsLock.Unlock()
+	m.family("exchange_dm_failures_total", "counter", "Discord DMs that couldn't be sent.")
+	m.sample("exchange_dm_failures_total", float64(dmFailures))
+	writeHTTPMetrics(m)
+	return nil
+}
+
+func writeRateLimitMetrics(m metricsWriter) {
+	stats := getRateLimiterStats()
+	m.family("exchange_rate_limit_requests_total", "counter", "Requests and bot status packets checked against each rate limit class, by whether they were let through.")
+	for _, s := range stats {
+		m.sample("exchange_rate_limit_requests_total", float64(s.Allowed), "class", s.Class, "result", "allowed")
+		m.sample("exchange_rate_limit_requests_total", float64(s.Limited), "class", s.Class, "result", "limited")
+	}
+	m.family("exchange_rate_limit_buckets", "gauge", "Users, keys, IPs or bots each rate limit class is currently tracking.")
+	for _, s := range stats {
+		m.sample("exchange_rate_limit_buckets", float64(s.Buckets), "class", s.Class)
+	}
+	m.family("exchange_rate_limit_rate", "gauge", "Requests per second each rate limit class refills at, 0 if it's turned off.")
+	for _, s := range stats {
+		m.sample("exchange_rate_limit_rate", s.Limit.Rate, "class", s.Class)
+	}
+	m.family("exchange_rate_limit_burst", "gauge", "Most requests each rate limit class allows at once.")
+	for _, s := range stats {
+		m.sample("exchange_rate_limit_burst", s.Limit.Burst, "class", s.Class)
+	}
+}
+
+func writeDatabaseMetrics(m metricsWriter) {
+	m.family("exchange_db_write_queue_depth", "gauge", "RunSQL callers waiting for the database loop.")
+	m.sample("exchange_db_write_queue_depth", float64(getWriteQueueDepth()))
+	_, running := getRunningQuery()
+	m.family("exchange_db_running_transaction_seconds", "gauge", "How long the database loop has been on its current transaction, 0 if it's idle.")
+	m.sample("exchange_db_running_transaction_seconds", running.Seconds())
+
+	latencies := getQueryLatencies()
+	m.family("exchange_db_wait_seconds", "histogram", "How long transactions waited before they started, by kind (write is RunSQL, read is RunReadSQL).")
+	for _, l := range latencies {
+		var cumulative int64
+		for i, bound := range QueryWaitBuckets {
+			cumulative += l.Buckets[i]
+			m.sample("exchange_db_wait_seconds_bucket", float64(cumulative), "kind", l.Kind, "le", strconv.FormatFloat(bound.Seconds(), 'g', -1, 64))
+		}
+		m.sample("exchange_db_wait_seconds_bucket", float64(l.Count), "kind", l.Kind, "le", "+Inf")
+		m.sample("exchange_db_wait_seconds_sum", l.TotalWait.Seconds(), "kind", l.Kind)
+		m.sample("exchange_db_wait_seconds_count", float64(l.Count), "kind", l.Kind)
+	}
+	m.family("exchange_db_run_seconds_total", "counter", "Time spent inside transactions, by kind.")
+	for _, l := range latencies {
+		m.sample("exchange_db_run_seconds_total", l.TotalRun.Seconds(), "kind", l.Kind)
+	}
+	m.family("exchange_db_slow_transactions_total", "counter", "Transactions that ran for longer than "+SlowQueryThreshold.String()+", by kind.")
+	for _, l := range latencies {
+		m.sample("exchange_db_slow_transactions_total", float64(l.Slow), "kind", l.Kind)
+	}
+}
+
+func writeBotMetrics(m metricsWriter) {
+	botsLock.Lock()
+	connections := len(bots)
+	botsLock.Unlock()
+	statuses := GetBotStatuses()
+	perServer := make(map[string]int)
+	for _, status := range statuses {
+		perServer[status.ServerIP]++
+	}
+	servers := make([]string, 0, len(perServer))
+	for server := range perServer {
+		servers = append(servers, server)
+	}
+	sort.Strings(servers)
+
+	m.family("exchange_bot_connections", "gauge", "Bots connected right now, including ones that haven't sent a status yet.")
+	m.sample("exchange_bot_connections", float64(connections))
+	m.family("exchange_bots_connected", "gauge", "Connected bots that have sent a status, by the server they're on.")
+	for _, server := range servers {
+		m.sample("exchange_bots_connected", float64(perServer[server]), "server", server)
+	}
+	m.family("exchange_bot_status_age_seconds", "gauge", "How long ago each connected bot last sent a status.")
+	for _, status := range statuses {
+		m.sample("exchange_bot_status_age_seconds", float64(status.AgeMillis())/1000, "bot", status.BotUUID, "server", status.ServerIP)
+	}
+}
+
+// only call this with metricsLock held
+func writeHTTPMetrics(m metricsWriter) {
+	routes := make([]string, 0, len(httpLatencies))
+	for route := range httpLatencies {
+		routes = append(routes, route)
+	}
+	sort.Strings(routes)
+	m.family("exchange_http_request_duration_seconds", "histogram", "How long the website took to answer, by route.")
+	for _, route := range routes {
+		l := httpLatencies[route]
+		var cumulative int64
+		for i, bound := range HTTPLatencyBuckets {
+			cumulative += l.buckets[i]
+			m.sample("exchange_http_request_duration_seconds_bucket", float64(cumulative), "route", route, "le", strconv.FormatFloat(bound, 'g', -1, 64))
+		}
+		m.sample("exchange_http_request_duration_seconds_bucket", float64(l.count), "route", route, "le", "+Inf")
+		m.sample("exchange_http_request_duration_seconds_sum", l.sum, "route", route)
+		m.sample("exchange_http_request_duration_seconds_count", float64(l.count), "route", route)
+	}
+	m.family("exchange_http_responses_total", "counter", "Responses the website sent, by route and status code.")
+	for _, route := range routes {
+		codes := make([]int, 0, len(httpLatencies[route].codes))
+		for code := range httpLatencies[route].codes {
+			codes = append(codes, code)
+		}
+		sort.Ints(codes)
+		for _, code := range codes {
+			m.sample("exchange_http_responses_total", float64(httpLatencies[route].codes[code]), "route", route, "code", strconv.Itoa(code))
+		}
+	}
+}
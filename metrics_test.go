@@ -0,0 +1,90 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+func TestMetrics(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		// other tests have been making requests and failing DMs too
+		metricsLock.Lock()
+		httpLatencies = make(map[string]*routeLatency)
+		dmFailures = 0
+		metricsLock.Unlock()
+
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO users (user_id, balance) VALUES (1, 0), (2, 100)")
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO completed_listing_trades (seller_id, buyer_id, listing_id, price) VALUES (1, 2, 2, 60), (1, 2, 2, 40)")
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO listing_buy_orders (user_id, listing_id, quantity, price) VALUES (2, 2, 3, 25), (2, 2, 1, 30)")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		discord = nil
+		DMuser(1, "this fails") // discord isn't connected
+		discord = site.discord
+
+		client := site.client(t)
+		site.get(t, client, "/trade/2")
+		site.get(t, client, "/trade/3")
+		status, body := site.get(t, client, "/metrics")
+		if status != http.StatusOK {
+			t.Fatal("Metrics failed", status, body)
+		}
+		for _, want := range []string{
+			`exchange_trades_total{listing="2",server="2b2t.org",item="`,
+			`"} 2`,
+			`exchange_trade_volume_total{listing="2"`,
+			`"} 100`,
+			`side="buy"} 4`,
+			`side="bid"} 30`,
+			"exchange_pending_deposits 0",
+			"exchange_db_write_queue_depth 0",
+			`exchange_db_wait_seconds_bucket{kind="write",le="+Inf"}`,
+			"exchange_bot_connections 0",
+			"exchange_dm_failures_total 1",
+			`exchange_http_request_duration_seconds_count{route="GET /trade/{listing}"} 2`,
+			`exchange_http_responses_total{route="GET /trade/{listing}",code="200"} 2`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Metrics should contain %q\n%s", want, body)
+			}
+		}
+		if strings.Contains(body, `side="ask"`) {
+			t.Error("There are no sell orders, so there shouldn't be an ask")
+		}
+
+		saved := config.MetricsToken
+		config.MetricsToken = "secret"
+		defer func() {
+			config.MetricsToken = saved
+		}()
+		status, _ = site.get(t, client, "/metrics")
+		if status != http.StatusUnauthorized {
+			t.Error("Metrics without the token should be refused, got", status)
+		}
+		req, err := http.NewRequest("GET", site.server.URL+"/metrics", nil)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req.Header.Set("Authorization", "Bearer secret")
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusOK {
+			t.Error("Metrics with the token should work, got", resp.StatusCode)
+		}
+	})
+}
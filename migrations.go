@@ -0,0 +1,303 @@
+package main
+
+import (
+	"database/sql"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// every change to the database's shape is a numbered migration that runs exactly once per database
+// schema_version remembers which ones have already run, a database from before it existed counts as version 0
+// to change a table, add a migration to the end of this list. never edit or reorder one that's already been released
+
+type Migration struct {
+	Version     int
+	Description string
+	Up          func(sql *sql.Tx) error
+}
+
+var migrations = []Migration{
+	{1, "initial schema", createInitialSchema},
+	{2, "add users.created_at to databases from before it existed", addUserCreatedAt},
+	{3, "add server side sessions", addSessions},
+	{4, "add user suspensions and membership checks", addSuspensions},
+	{5, "remember confirmed withdrawals until the bot has dropped them", addWithdrawalDrops},
+}
+
+func latestSchemaVersion() int {
+	return migrations[len(migrations)-1].Version
+}
+
+// brings the database up to the latest version, or with dryRun, checks that it could and changes nothing
+// this runs before databaseLoop starts, on a connection of its own, because sqlite ignores turning foreign keys off inside a transaction
+// if backupDir isn't empty, the database file gets copied there before anything is changed
+// returns the migrations that were (or in a dry run, would have been) applied
+func migrate(db *sql.DB, dryRun bool, databaseFile string, backupDir string) ([]Migration, error) {
+	conn, err := db.Conn(ctx)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	var current int
+	var tables int
+	err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&tables)
+	if err == nil && tables > 0 {
+		err = conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&current)
+	}
+	if err != nil {
+		return nil, err
+	}
+	if current > latestSchemaVersion() {
+		return nil, fmt.Errorf("database is at schema version %d but this build only knows up to %d, refusing to touch it", current, latestSchemaVersion())
+	}
+	pending := make([]Migration, 0)
+	for _, m := range migrations {
+		if m.Version > current {
+			pending = append(pending, m)
+		}
+	}
+	if len(pending) == 0 {
+		return pending, nil
+	}
+
+	// a brand new database has nothing worth backing up, but one from before schema_version existed does
+	err = conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table'").Scan(&tables)
+	if err != nil {
+		return nil, err
+	}
+	if !dryRun && backupDir != "" && tables > 0 {
+		path, err := backupDatabaseFile(databaseFile, backupDir, current)
+		if err != nil {
+			return nil, err
+		}
+		dbLog.Info("Backed up database before migrating", "version", current, "path", path)
+	}
+
+	// some migrations have to rebuild a table, and dropping the old one would cascade into everything that references it
+	// so foreign keys are off while migrating, and checked all at once at the end instead
+	_, err = conn.ExecContext(ctx, "PRAGMA foreign_keys = OFF")
+	if err != nil {
+		return nil, err
+	}
+	defer conn.ExecContext(ctx, "PRAGMA foreign_keys = ON")
+
+	// all of the pending migrations go in one transaction, so the database is either fully migrated or not touched at all
+	tx, err := conn.BeginTx(ctx, nil)
+	if err != nil {
+		return nil, err
+	}
+	_, err = tx.Exec(`CREATE TABLE IF NOT EXISTS schema_version ( /* one row per migration that's been applied */
+
+		version     INTEGER NOT NULL PRIMARY KEY,
+		description TEXT    NOT NULL,
+		applied_at  INTEGER NOT NULL
+	);`)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	for _, m := range pending {
+		dbLog.Info("Migrating database", "version", m.Version, "description", m.Description)
+		err = m.Up(tx)
+		if err == nil {
+			_, err = tx.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)", m.Version, m.Description, unixNow())
+		}
+		if err != nil {
+			tx.Rollback()
+			return nil, fmt.Errorf("migration %d (%s) failed: %v", m.Version, m.Description, err)
+		}
+	}
+	err = checkForeignKeys(tx)
+	if err != nil {
+		tx.Rollback()
+		return nil, err
+	}
+	if dryRun {
+		dbLog.Info("Dry run, rolling back migrations that would have applied cleanly", "count", len(pending))
+		return pending, tx.Rollback()
+	}
+	err = tx.Commit()
+	if err != nil {
+		return nil, err
+	}
+	dbLog.Info("Database is at the latest schema version", "version", latestSchemaVersion())
+	return pending, nil
+}
+
+func checkForeignKeys(sql *sql.Tx) error {
+	rows, err := sql.Query("PRAGMA foreign_key_check")
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+	problems := make([]string, 0)
+	for rows.Next() {
+		var table, parent string
+		var rowid, fkid interface{}
+		err = rows.Scan(&table, &rowid, &parent, &fkid)
+		if err != nil {
+			return err
+		}
+		problems = append(problems, fmt.Sprintf("%s row %v references a missing %s", table, rowid, parent))
+	}
+	if len(problems) > 0 {
+		return errors.New("foreign key check failed after migrating: " + strings.Join(problems, ", "))
+	}
+	return rows.Err()
+}
+
+// copies the database file into backupDir as something like exchange.db.v1.1550000000.bak
+func backupDatabaseFile(databaseFile string, backupDir string, version int) (string, error) {
+	err := os.MkdirAll(backupDir, 0700)
+	if err != nil {
+		return "", err
+	}
+	path := filepath.Join(backupDir, filepath.Base(databaseFile)+".v"+strconv.Itoa(version)+"."+strconv.FormatInt(unixNow(), 10)+".bak")
+	err = copyFile(databaseFile, path)
+	if err != nil {
+		return "", err
+	}
+	return path, nil
+}
+
+func hasColumn(sql *sql.Tx, table string, column string) (bool, error) {
+	rows, err := sql.Query("PRAGMA table_info(" + table + ")")
+	if err != nil {
+		return false, err
+	}
+	defer rows.Close()
+	for rows.Next() {
+		var cid int
+		var name, kind string
+		var notNull, pk int
+		var defaultValue interface{}
+		err = rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk)
+		if err != nil {
+			return false, err
+		}
+		if name == column {
+			return true, nil
+		}
+	}
+	return false, rows.Err()
+}
+
+// migration 2
+// users.created_at was added to createInitialSchema after the first databases were made, so they never got it (see bak/exchange.db)
+// sqlite can't ADD COLUMN with a default of strftime('%s', 'now'), so the table gets rebuilt
+func addUserCreatedAt(sql *sql.Tx) error {
+	has, err := hasColumn(sql, "users", "created_at")
+	if err != nil || has {
+		return err // made by a createInitialSchema that already had it
+	}
+	_, err = sql.Exec(`CREATE TABLE users_new (
+
+		user_id    INTEGER NOT NULL PRIMARY KEY,                     /* use discord id not @# tag because you can change your username */
+		balance    INTEGER NOT NULL DEFAULT 0,                       /* this verifies and guarantees at the database level that your balance can never be negative */
+		max_slots  INTEGER NOT NULL DEFAULT 4,                       /* how many slots this user has */
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this account was created */
+
+		CHECK(balance >= 0),
+		CHECK(max_slots >= 0),
+		CHECK(user_id > 0),
+		CHECK(created_at > 0)
+
+	);`)
+	if err != nil {
+		return err
+	}
+	// nobody knows when these accounts were really made, so they all get the time of the migration
+	_, err = sql.Exec("INSERT INTO users_new (user_id, balance, max_slots, created_at) SELECT user_id, balance, max_slots, ? FROM users", unixNow())
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("DROP TABLE users")
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("ALTER TABLE users_new RENAME TO users")
+	return err
+}
+
+// migration 3
+func addSessions(sql *sql.Tx) error {
+	_, err := sql.Exec(`CREATE TABLE sessions ( /* one row per login, the cookie has a random token and this has its sha256 */
+
+		session_id INTEGER NOT NULL PRIMARY KEY,
+		token_hash TEXT    NOT NULL UNIQUE,
+		user_id    INTEGER NOT NULL,
+		name       TEXT    NOT NULL, /* what discord said about them when they logged in */
+		avatar_url TEXT    NOT NULL,
+		user_agent TEXT    NOT NULL, /* so they can tell their sessions apart */
+		ip         TEXT    NOT NULL, /* where it was last seen from */
+		created_at INTEGER NOT NULL, /* sessions expire session_lifetime_days after this */
+		last_seen  INTEGER NOT NULL,
+
+		FOREIGN KEY(user_id) REFERENCES users(user_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("CREATE INDEX sessions_by_user ON sessions (user_id)")
+	return err
+}
+
+// migration 4
+func addSuspensions(sql *sql.Tx) error {
+	_, err := sql.Exec(`CREATE TABLE user_suspensions ( /* people who can't trade or withdraw right now, see suspensions.go */
+
+		user_id      INTEGER NOT NULL PRIMARY KEY,
+		source       TEXT    NOT NULL, /* discord if they left or lost a role, lifted once they're back. admin if it was done by hand */
+		reason       TEXT    NOT NULL, /* shown to them */
+		suspended_at INTEGER NOT NULL,
+
+		CHECK(source IN ('discord', 'admin')),
+		FOREIGN KEY(user_id) REFERENCES users(user_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	if err != nil {
+		return err
+	}
+	// a constant default, so ADD COLUMN works here unlike created_at. 0 means they get checked on the first run
+	_, err = sql.Exec("ALTER TABLE users ADD COLUMN membership_checked_at INTEGER NOT NULL DEFAULT 0")
+	return err
+}
+
+// migration 5
+func addWithdrawalDrops(sql *sql.Tx) error {
+	_, err := sql.Exec(`CREATE TABLE withdrawal_drops ( /* items whose withdrawal was confirmed, so they're out of inventory but may still be in the ender chest */
+
+		item_id      INTEGER NOT NULL PRIMARY KEY,
+		listing_id   INTEGER NOT NULL,
+		bot_uuid     TEXT    NOT NULL,
+		confirmed_at INTEGER NOT NULL, /* forgotten a day after this even if no audit ever sees it gone */
+
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	return err
+}
+
+// prints what migrating would do to the configured database without changing it, for -migrate-dry-run
+func dryRunMigrations() {
+	db, err := sql.Open("sqlite3", databaseFullPath())
+	if err != nil {
+		panic(err)
+	}
+	defer db.Close()
+	pending, err := migrate(db, true, config.DatabaseFile, "")
+	if err != nil {
+		dbLog.Error("Migrating would fail", "file", config.DatabaseFile, "err", err)
+		return
+	}
+	if len(pending) == 0 {
+		dbLog.Info("Already at the latest schema version", "file", config.DatabaseFile, "version", latestSchemaVersion())
+		return
+	}
+	for _, m := range pending {
+		dbLog.Info("Would apply migration", "version", m.Version, "description", m.Description)
+	}
+}
@@ -0,0 +1,193 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// copies bak/exchange.db, which is the shape of the very first databases, somewhere the test can scribble on it
+func copyOldDatabase(t *testing.T) (string, *sql.DB) {
+	dir, err := ioutil.TempDir("", "exchange-migrate")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data, err := ioutil.ReadFile(filepath.Join("bak", "exchange.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "exchange.db")
+	err = ioutil.WriteFile(path, data, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	db, err := sql.Open("sqlite3", "file:"+path+"?_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return path, db
+}
+
+// table name -> column names, for comparing two databases
+func schemaShape(t *testing.T, db *sql.DB) map[string][]string {
+	shape := make(map[string][]string)
+	rows, err := db.Query("SELECT name FROM sqlite_master WHERE type = 'table' ORDER BY name")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tables := make([]string, 0)
+	for rows.Next() {
+		var name string
+		rows.Scan(&name)
+		tables = append(tables, name)
+	}
+	rows.Close()
+	for _, table := range tables {
+		rows, err := db.Query("PRAGMA table_info(" + table + ")")
+		if err != nil {
+			t.Fatal(err)
+		}
+		for rows.Next() {
+			var cid, notNull, pk int
+			var name, kind string
+			var defaultValue interface{}
+			rows.Scan(&cid, &name, &kind, &notNull, &defaultValue, &pk)
+			shape[table] = append(shape[table], name+" "+kind)
+		}
+		rows.Close()
+	}
+	return shape
+}
+
+func schemaVersion(t *testing.T, db *sql.DB) int {
+	var version int
+	err := db.QueryRow("SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version)
+	if err != nil {
+		return 0
+	}
+	return version
+}
+
+func TestMigrateOldDatabase(t *testing.T) {
+	path, db := copyOldDatabase(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+	backupDir := filepath.Join(filepath.Dir(path), "backups")
+
+	applied, err := migrate(db, false, path, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(applied) != len(migrations) || schemaVersion(t, db) != latestSchemaVersion() {
+		t.Fatal("Unversioned database should have had every migration applied, got", len(applied))
+	}
+
+	// it should end up exactly the same shape as a database made from scratch
+	fresh, err := sql.Open("sqlite3", "file:migratefresh?mode=memory&cache=shared&_foreign_keys=1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer fresh.Close()
+	_, err = migrate(fresh, false, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if migrated, made := schemaShape(t, db), schemaShape(t, fresh); !reflect.DeepEqual(migrated, made) {
+		t.Errorf("Migrated database doesn't match a fresh one\nmigrated: %v\nfresh:    %v", migrated, made)
+	}
+
+	// and keep what was in it
+	var balance int
+	var createdAt int64
+	err = db.QueryRow("SELECT balance, created_at FROM users WHERE user_id = 379769819844575242").Scan(&balance, &createdAt)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if balance != 3 || createdAt <= 0 {
+		t.Error("User wasn't carried over properly", balance, createdAt)
+	}
+	if n := countRowsIn(t, db, "SELECT COUNT(*) FROM listings"); n != 3 {
+		t.Error("Expected the 3 old listings to survive, got", n)
+	}
+	// foreign keys into the rebuilt users table still work
+	_, err = db.Exec("INSERT INTO slots (user_id, slot_index, listing_id) VALUES (12345, 0, 1)")
+	if err == nil {
+		t.Error("Foreign key to users should still be enforced")
+	}
+	_, err = db.Exec("INSERT INTO slots (user_id, slot_index, listing_id) VALUES (379769819844575242, 0, 1)")
+	if err != nil {
+		t.Error(err)
+	}
+
+	backups, err := ioutil.ReadDir(backupDir)
+	if err != nil || len(backups) != 1 {
+		t.Fatal("Expected exactly one backup", err)
+	}
+	original, _ := ioutil.ReadFile(filepath.Join("bak", "exchange.db"))
+	backup, _ := ioutil.ReadFile(filepath.Join(backupDir, backups[0].Name()))
+	if string(original) != string(backup) {
+		t.Error("Backup isn't a copy of the database from before migrating")
+	}
+
+	// running again does nothing
+	applied, err = migrate(db, false, path, backupDir)
+	if err != nil || len(applied) != 0 {
+		t.Error("Second migrate should be a no-op", applied, err)
+	}
+	backups, _ = ioutil.ReadDir(backupDir)
+	if len(backups) != 1 {
+		t.Error("No-op migrate shouldn't make a backup")
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	path, db := copyOldDatabase(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+	backupDir := filepath.Join(filepath.Dir(path), "backups")
+	before := schemaShape(t, db)
+
+	pending, err := migrate(db, true, path, backupDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(pending) != len(migrations) {
+		t.Error("Dry run should report every migration as pending, got", len(pending))
+	}
+	if after := schemaShape(t, db); !reflect.DeepEqual(before, after) {
+		t.Error("Dry run changed the database")
+	}
+	if _, err := os.Stat(backupDir); !os.IsNotExist(err) {
+		t.Error("Dry run shouldn't make a backup")
+	}
+}
+
+func TestMigrateRefusesNewerDatabase(t *testing.T) {
+	path, db := copyOldDatabase(t)
+	defer os.RemoveAll(filepath.Dir(path))
+	defer db.Close()
+	_, err := migrate(db, false, path, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = db.Exec("INSERT INTO schema_version (version, description, applied_at) VALUES (?, 'from the future', 1)", latestSchemaVersion()+1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = migrate(db, false, path, "")
+	if err == nil {
+		t.Error("Migrating a database from a newer build should fail")
+	}
+}
+
+func countRowsIn(t *testing.T, db *sql.DB, query string) int {
+	var n int
+	err := db.QueryRow(query).Scan(&n)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return n
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"strconv"
 )
@@ -13,10 +14,11 @@ type NavInfo struct {
 
 type Navigation []NavInfo
 
-func generateNavigation() Navigation {
+// server is which server to show the listings of, "" for every server
+func generateNavigation(ctx context.Context, server string) Navigation {
 	var result Navigation
-	err := RunSQL(func(sql *sql.Tx) error {
-		rows, err := sql.Query(`SELECT listings.listing_id, listings.server, listings.item_name, listings.item_photo, COALESCE(MAX(listing_buy_orders.price), -1) AS buy_order_max, COALESCE(MIN(slots.sale_price), -1) AS sell_order_min FROM listings LEFT OUTER JOIN listing_buy_orders ON listings.listing_id = listing_buy_orders.listing_id LEFT OUTER JOIN (SELECT * FROM slots WHERE sale_price IS NOT NULL) slots ON listings.listing_id = slots.listing_id GROUP BY listings.listing_id`)
+	err := RunReadSQLContext(ctx, func(sql *sql.Tx) error {
+		rows, err := sql.Query(`SELECT listings.listing_id, listings.server, listings.item_name, listings.item_photo, COALESCE(MAX(listing_buy_orders.price), -1) AS buy_order_max, COALESCE(MIN(slots.sale_price), -1) AS sell_order_min FROM listings LEFT OUTER JOIN listing_buy_orders ON listings.listing_id = listing_buy_orders.listing_id LEFT OUTER JOIN (SELECT * FROM slots WHERE sale_price IS NOT NULL) slots ON listings.listing_id = slots.listing_id WHERE listings.listing_id NOT IN (SELECT listing_id FROM listing_retirements) AND (? = '' OR listings.server = ?) GROUP BY listings.listing_id`, server, server)
 		if err != nil {
 			return err
 		}
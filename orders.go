@@ -1,9 +1,9 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"log"
 	"strconv"
 )
 
@@ -26,6 +26,17 @@ func createSellOrder(sql *sql.Tx, user_id int64, slot_index int, price int) erro
 	if locked == 1 && price != 0 {
 		return errors.New("Slot is locked for force selling, cannot put up for sale for nonzero price")
 	}
+	if locked == 0 {
+		// force selling (locked 1) is the exchange's doing, so it goes ahead even for someone who's suspended
+		err = checkNotSuspended(sql, user_id)
+		if err != nil {
+			return err
+		}
+	}
+	err = checkListingTradable(sql, listing_id)
+	if err != nil {
+		return err
+	}
 
 	// let's grab the highest buy order that we could execute against immediately
 	// this is any buy order that is for this listing whose buy price is greater than or equal to the sell price
@@ -38,7 +49,7 @@ func createSellOrder(sql *sql.Tx, user_id int64, slot_index int, price int) erro
 		if err == ErrNoRows {
 			// there is no buyer
 			// therefore we can just put this up for sale without having to worry about that
-			_, err = sql.Exec("UPDATE slots SET sale_price = ?, for_sale_since = strftime('%s', 'now') WHERE user_id = ? AND slot_index = ?", price, user_id, slot_index)
+			_, err = sql.Exec("UPDATE slots SET sale_price = ?, for_sale_since = ? WHERE user_id = ? AND slot_index = ?", price, unixNow(), user_id, slot_index)
 			// all done
 		}
 		return err
@@ -77,13 +88,20 @@ func createBuyOrder(sql *sql.Tx, user_id int64, listing_id int64, price int, qua
 	if quantity <= 0 {
 		return errors.New("Cannot create buy for quantity of 0 or less")
 	}
+	err := checkNotSuspended(sql, user_id)
+	if err != nil {
+		return err
+	}
+	err = checkListingTradable(sql, listing_id)
+	if err != nil {
+		return err
+	}
 
 	var currentFullSlots int
-	err := sql.QueryRow("SELECT COUNT(*) FROM slots WHERE user_id = ?", user_id).Scan(&currentFullSlots)
+	err = sql.QueryRow("SELECT COUNT(*) FROM slots WHERE user_id = ?", user_id).Scan(&currentFullSlots)
 	if err != nil {
 		return err
 	}
-	log.Println("Currently full", currentFullSlots)
 	var maxSlots int
 	var balance int64
 	err = sql.QueryRow("SELECT max_slots, balance FROM users WHERE user_id = ?", user_id).Scan(&maxSlots, &balance)
@@ -178,7 +196,7 @@ func createBuyOrder(sql *sql.Tx, user_id int64, listing_id int64, price int, qua
 	}
 
 	// the remaining quantity is an open buy offer
-	_, err = sql.Exec("INSERT INTO listing_buy_orders (user_id, listing_id, quantity, price) VALUES (?, ?, ?, ?)", user_id, listing_id, quantity, price)
+	_, err = sql.Exec("INSERT INTO listing_buy_orders (user_id, listing_id, quantity, price, created_at) VALUES (?, ?, ?, ?, ?)", user_id, listing_id, quantity, price, unixNow())
 	if err != nil {
 		// already have one here
 		_, err = sql.Exec("UPDATE listing_buy_orders SET quantity = quantity + ? WHERE user_id = ? AND listing_id = ? AND price = ?", quantity, user_id, listing_id, price)
@@ -189,7 +207,8 @@ func createBuyOrder(sql *sql.Tx, user_id int64, listing_id int64, price int, qua
 }
 
 func executeTrade(sql *sql.Tx, seller_id int64, seller_slot_index int, buyer_id int64, listing_id int64, tradePrice int64) error {
-	log.Println("1 item from listing", listing_id, "is being sold by", seller_id, "to", buyer_id, "for", tradePrice)
+	corr := newTradeCorrelation()
+	ordersLog.Info("Trade", "corr", corr, "listing", listing_id, "seller", seller_id, "buyer", buyer_id, "price", tradePrice)
 
 	// buy order is decremented, now to transfer the RC
 	// note that as part of placing a buy order, your RC is locked up in the order
@@ -217,14 +236,14 @@ func executeTrade(sql *sql.Tx, seller_id int64, seller_slot_index int, buyer_id
 		return err
 	}
 
-	_, err = sql.Exec("INSERT INTO completed_listing_trades (buyer_id, seller_id, listing_id, price) VALUES (?, ?, ?, ?)", buyer_id, seller_id, listing_id, tradePrice)
+	_, err = sql.Exec("INSERT INTO completed_listing_trades (buyer_id, seller_id, listing_id, price, timestamp) VALUES (?, ?, ?, ?, ?)", buyer_id, seller_id, listing_id, tradePrice, unixNow())
 	if err != nil {
 		return err
 	}
 
 	// TODO this should only send out once it's guaranteed to have happened
-	go DMuser(seller_id, "You just sold an item! Balance increased by "+strconv.FormatInt(tradePrice, 10)+Currency+".")
-	go DMuser(buyer_id, "You just bought an item!")
+	go DMuserCorr(seller_id, corr, "You just sold an item! Balance increased by "+strconv.FormatInt(tradePrice, 10)+Currency+".")
+	go DMuserCorr(buyer_id, corr, "You just bought an item!")
 	return nil
 	// note that by the magic of sql transactions, every previous query will get automatically rolled back as if they never happened, if this ends up returning any error
 }
@@ -241,14 +260,14 @@ func fillSlot(sql *sql.Tx, user_id int64, listing_id int64) error {
 
 	for i := 0; i < slotCount; i++ {
 		// try giving them the item in slot i
-		_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id) VALUES (?, ?, ?)", user_id, i, listing_id) // leave all other columns at defaults
+		_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id, expiry_time) VALUES (?, ?, ?, ?)", user_id, i, listing_id, unixNow()+config.SlotLifetimeSeconds) // leave all other columns at defaults
 		if err != nil {
-			log.Println("Unable to give this item to them in slot", i, "because of insertion error", err)
+			ordersLog.Debug("Slot is taken", "user", user_id, "slot", i, "err", err)
 			// most likely, they already have something in that slot
 			// and the error is from the constraint UNIQUE(user_id, slot_index),
 			continue
 		}
-		log.Println("Completed trade. Item is now in slot", i, "of their account")
+		ordersLog.Debug("Filled slot", "user", user_id, "listing", listing_id, "slot", i)
 
 		var currentFullSlots int
 		err = sql.QueryRow("SELECT COUNT(*) FROM slots WHERE user_id = ?", user_id).Scan(&currentFullSlots)
@@ -256,7 +275,7 @@ func fillSlot(sql *sql.Tx, user_id int64, listing_id int64) error {
 			return err
 		}
 		if currentFullSlots >= slotCount {
-			log.Println("This filled up their last slot. Time to cancel all of their open buy orders, because they can't be fulfilled.")
+			ordersLog.Info("Filled their last slot, cancelling all of their buy orders", "user", user_id)
 			err = cancelAllBuys(sql, user_id)
 			if err != nil {
 				return err
@@ -303,26 +322,34 @@ func cancelAllBuysInListing(sql *sql.Tx, user_id int64, listing_id int64) error
 
 func cancelSpecificBuy(user_id int64, listing_id int64, price int) error {
 	return RunSQL(func(sql *sql.Tx) error {
-		var totalRefund int64
-		err := sql.QueryRow("SELECT COALESCE(SUM(price * quantity), 0) FROM listing_buy_orders WHERE user_id = ? AND listing_id = ? AND price = ?", user_id, listing_id, price).Scan(&totalRefund)
-		if err != nil {
-			return err
-		}
+		return cancelBuy(sql, user_id, listing_id, price)
+	})
+}
 
-		_, err = sql.Exec("UPDATE users SET balance = balance + ? WHERE user_id = ?", totalRefund, user_id)
-		if err != nil {
-			return err
-		}
+func cancelBuy(sql *sql.Tx, user_id int64, listing_id int64, price int) error {
+	var totalRefund int64
+	err := sql.QueryRow("SELECT COALESCE(SUM(price * quantity), 0) FROM listing_buy_orders WHERE user_id = ? AND listing_id = ? AND price = ?", user_id, listing_id, price).Scan(&totalRefund)
+	if err != nil {
+		return err
+	}
 
-		_, err = sql.Exec("DELETE FROM listing_buy_orders WHERE user_id = ? AND listing_id = ? AND price = ?", user_id, listing_id, price)
+	_, err = sql.Exec("UPDATE users SET balance = balance + ? WHERE user_id = ?", totalRefund, user_id)
+	if err != nil {
 		return err
-	})
+	}
+
+	_, err = sql.Exec("DELETE FROM listing_buy_orders WHERE user_id = ? AND listing_id = ? AND price = ?", user_id, listing_id, price)
+	return err
 }
 
-func cancelSell(user_id int64, slot_index int) error {
-	return RunSQL(func(sql *sql.Tx) error {
-		// no need to check locked, withdrawal_code, etc, database constraints will take care of that
-		_, err := sql.Exec("UPDATE slots SET sale_price = NULL, for_sale_since = NULL WHERE user_id = ? AND slot_index = ?", user_id, slot_index)
-		return err
+func cancelSell(ctx context.Context, user_id int64, slot_index int) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		return cancelSale(sql, user_id, slot_index)
 	})
 }
+
+func cancelSale(sql *sql.Tx, user_id int64, slot_index int) error {
+	// no need to check locked, withdrawal_code, etc, database constraints will take care of that
+	_, err := sql.Exec("UPDATE slots SET sale_price = NULL, for_sale_since = NULL WHERE user_id = ? AND slot_index = ?", user_id, slot_index)
+	return err
+}
@@ -0,0 +1,234 @@
+package main
+
+import (
+	"fmt"
+	"math"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// token buckets, one per whoever is making requests, in a separate set for each class of route
+// a bucket holds up to Burst tokens and refills at Rate tokens a second, every request takes one, and with none left it's a 429
+// web requests are keyed by who's logged in, then by API key (the metrics token is the only one so far), then by IP
+// bots are keyed by their UUID, and an over the limit status packet is read and thrown away instead of being acted on
+
+const (
+	RateClassPages  = "pages"  // everything you can look at
+	RateClassOrders = "orders" // anything that changes balances, slots or orders, or makes the bots do something
+	RateClassAPI    = "api"    // the json endpoints and /metrics
+	RateClassLogin  = "login"  // starting and finishing a discord login
+	RateClassBots   = "bots"   // status packets from each bot
+	RateClassAdmin  = "admin"  // every admin page and action, so a stolen admin session can't hammer the database either
+	RateClassProbes = "probes" // /readyz, in its own bucket so busy api clients behind the same proxy can't make it look down
+)
+
+type RateLimit struct {
+	Rate  float64 // tokens per second, 0 means unlimited
+	Burst float64
+}
+
+// defaults, anything in rate_limits in the config replaces these
+var defaultRateLimits = map[string]RateLimit{
+	RateClassPages:  {Rate: 10, Burst: 60},
+	RateClassOrders: {Rate: 1, Burst: 10},
+	RateClassAPI:    {Rate: 5, Burst: 30},
+	RateClassLogin:  {Rate: 0.2, Burst: 10},
+	RateClassBots:   {Rate: 20, Burst: 40}, // the real bot sends one every tick
+	RateClassAdmin:  {Rate: 2, Burst: 30},
+	RateClassProbes: {Rate: 2, Burst: 10}, // plenty for a supervisor checking every few seconds
+}
+
+type tokenBucket struct {
+	tokens  float64
+	updated time.Time
+}
+
+type rateLimiter struct {
+	limit   RateLimit
+	buckets map[string]*tokenBucket
+	allowed int64
+	limited int64
+}
+
+var rateLimiters map[string]*rateLimiter // made from the config the first time they're needed
+var rateLimitLock sync.Mutex
+
+// rate_limits in the config is like "orders=2:20,bots=off", rate per second then burst
+func parseRateLimits(str string) (map[string]RateLimit, error) {
+	result := make(map[string]RateLimit)
+	for _, part := range strings.Split(str, ",") {
+		part = strings.TrimSpace(part)
+		if part == "" {
+			continue
+		}
+		kv := strings.SplitN(part, "=", 2)
+		if len(kv) != 2 {
+			return nil, fmt.Errorf("rate limit %q must look like class=rate:burst or class=off", part)
+		}
+		class := strings.TrimSpace(kv[0])
+		if _, ok := defaultRateLimits[class]; !ok {
+			return nil, fmt.Errorf("there's no rate limit class called %q", class)
+		}
+		value := strings.TrimSpace(kv[1])
+		if value == "off" {
+			result[class] = RateLimit{}
+			continue
+		}
+		rateBurst := strings.SplitN(value, ":", 2)
+		if len(rateBurst) != 2 {
+			return nil, fmt.Errorf("rate limit %q must look like class=rate:burst or class=off", part)
+		}
+		rate, err := strconv.ParseFloat(rateBurst[0], 64)
+		if err != nil || rate <= 0 || math.IsInf(rate, 0) {
+			return nil, fmt.Errorf("rate limit %q must have a positive rate", part)
+		}
+		burst, err := strconv.ParseFloat(rateBurst[1], 64)
+		if err != nil || burst < 1 || math.IsInf(burst, 0) {
+			return nil, fmt.Errorf("rate limit %q must have a burst of at least 1", part)
+		}
+		result[class] = RateLimit{Rate: rate, Burst: burst}
+	}
+	return result, nil
+}
+
+// only call this with rateLimitLock held
+func getRateLimiter(class string) *rateLimiter {
+	if rateLimiters == nil {
+		overrides, err := parseRateLimits(config.RateLimits)
+		if err != nil {
+			panic(err) // validate already checked this
+		}
+		rateLimiters = make(map[string]*rateLimiter)
+		for name, limit := range defaultRateLimits {
+			if override, ok := overrides[name]; ok {
+				limit = override
+			}
+			rateLimiters[name] = &rateLimiter{limit: limit, buckets: make(map[string]*tokenBucket)}
+		}
+	}
+	return rateLimiters[class]
+}
+
+// forgets every bucket and rereads the config, for tests
+func resetRateLimits() {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	rateLimiters = nil
+}
+
+// takes a token from key's bucket in class. if there isn't one, says how long until there will be
+func allowRate(class string, key string, now time.Time) (bool, time.Duration) {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	l := getRateLimiter(class)
+	if l.limit.Rate == 0 {
+		l.allowed++
+		return true, 0
+	}
+	bucket, ok := l.buckets[key]
+	if !ok {
+		bucket = &tokenBucket{tokens: l.limit.Burst, updated: now}
+		l.buckets[key] = bucket
+	}
+	if now.After(bucket.updated) {
+		bucket.tokens = math.Min(l.limit.Burst, bucket.tokens+now.Sub(bucket.updated).Seconds()*l.limit.Rate)
+		bucket.updated = now
+	}
+	if bucket.tokens >= 1 {
+		bucket.tokens--
+		l.allowed++
+		return true, 0
+	}
+	l.limited++
+	return false, time.Duration((1 - bucket.tokens) / l.limit.Rate * float64(time.Second))
+}
+
+// the rate limit cleanup job. a bucket that would have refilled by now is the same as no bucket, so it goes, otherwise every IP that ever visited would stay in memory
+func cleanupRateLimits() (int64, error) {
+	return deleteFullBuckets(time.Now()), nil
+}
+
+func deleteFullBuckets(now time.Time) int64 {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	var deleted int64
+	for _, l := range rateLimiters {
+		for key, bucket := range l.buckets {
+			if bucket.tokens+now.Sub(bucket.updated).Seconds()*l.limit.Rate >= l.limit.Burst {
+				delete(l.buckets, key)
+				deleted++
+			}
+		}
+	}
+	return deleted
+}
+
+type RateLimiterStats struct {
+	Class   string
+	Limit   RateLimit
+	Buckets int
+	Allowed int64
+	Limited int64
+}
+
+func getRateLimiterStats() []RateLimiterStats {
+	rateLimitLock.Lock()
+	defer rateLimitLock.Unlock()
+	stats := make([]RateLimiterStats, 0, len(defaultRateLimits))
+	for class := range defaultRateLimits {
+		l := getRateLimiter(class)
+		stats = append(stats, RateLimiterStats{class, l.limit, len(l.buckets), l.allowed, l.limited})
+	}
+	sort.Slice(stats, func(i, j int) bool {
+		return stats[i].Class < stats[j].Class
+	})
+	return stats
+}
+
+// who a web request counts against
+func rateLimitKey(r *http.Request) string {
+	if user := getUser(r); user != nil {
+		return "user:" + strconv.FormatInt(user.UserID, 10)
+	}
+	if config.MetricsToken != "" && r.Header.Get("Authorization") == "Bearer "+config.MetricsToken {
+		return "key:metrics" // not the token itself, these end up in logs
+	}
+	return "ip:" + clientIP(r)
+}
+
+// behind a reverse proxy every request comes from the proxy, so the real address is the last one it added to X-Forwarded-For
+// the earlier ones came from the client and could be anything, so they're ignored
+func clientIP(r *http.Request) string {
+	if config.BehindProxy {
+		forwarded := strings.Split(r.Header.Get("X-Forwarded-For"), ",")
+		if last := strings.TrimSpace(forwarded[len(forwarded)-1]); last != "" {
+			return last
+		}
+	}
+	host, _, err := net.SplitHostPort(r.RemoteAddr)
+	if err != nil {
+		return r.RemoteAddr
+	}
+	return host
+}
+
+// wraps a handler so that it's rate limited in class
+func rateLimited(class string, handler http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		key := rateLimitKey(r)
+		ok, wait := allowRate(class, key, time.Now())
+		if !ok {
+			seconds := int(math.Ceil(wait.Seconds()))
+			requestLogger(r, httpLog).Info("Rate limited", "class", class, "key", key, "path", r.URL.Path, "retry", seconds)
+			w.Header().Set("Retry-After", strconv.Itoa(seconds))
+			http.Error(w, "Too many requests, try again in "+strconv.Itoa(seconds)+" seconds", http.StatusTooManyRequests)
+			return
+		}
+		handler(w, r)
+	}
+}
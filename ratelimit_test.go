@@ -0,0 +1,167 @@
+package main
+
+import (
+	"net/http"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestTokenBucket(t *testing.T) {
+	saved := config.RateLimits
+	config.RateLimits = "orders=2:3"
+	resetRateLimits()
+	defer func() {
+		config.RateLimits = saved
+		resetRateLimits()
+	}()
+	start := time.Now()
+	for i := 0; i < 3; i++ {
+		if ok, _ := allowRate(RateClassOrders, "user:1", start); !ok {
+			t.Fatal("The burst should be let through, failed at", i)
+		}
+	}
+	ok, wait := allowRate(RateClassOrders, "user:1", start)
+	if ok || wait != 500*time.Millisecond {
+		t.Error("Should be limited until the next token half a second later", ok, wait)
+	}
+	if ok, _ := allowRate(RateClassOrders, "user:2", start); !ok {
+		t.Error("Someone else has their own bucket")
+	}
+	if ok, _ := allowRate(RateClassOrders, "user:1", start.Add(500*time.Millisecond)); !ok {
+		t.Error("A token should have refilled")
+	}
+	if deleted := deleteFullBuckets(start.Add(time.Second)); deleted != 1 {
+		t.Error("Only user 2's bucket is full again, deleted", deleted)
+	}
+	if deleted := deleteFullBuckets(start.Add(time.Hour)); deleted != 1 {
+		t.Error("User 1's bucket should be full eventually, deleted", deleted)
+	}
+	for _, s := range getRateLimiterStats() {
+		if s.Class == RateClassOrders && (s.Allowed != 5 || s.Limited != 1 || s.Buckets != 0) {
+			t.Error("Wrong stats", s)
+		}
+	}
+}
+
+func TestParseRateLimits(t *testing.T) {
+	limits, err := parseRateLimits("orders=0.5:5, bots=off")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if limits[RateClassOrders] != (RateLimit{0.5, 5}) || limits[RateClassBots] != (RateLimit{}) || len(limits) != 2 {
+		t.Error("Wrong limits", limits)
+	}
+	for _, bad := range []string{"orders", "nope=1:1", "orders=1", "orders=0:5", "orders=1:0", "orders=x:y"} {
+		if _, err := parseRateLimits(bad); err == nil {
+			t.Error("Should have been rejected:", bad)
+		}
+	}
+}
+
+func TestRateLimitedRequests(t *testing.T) {
+	saved := config.RateLimits
+	config.RateLimits = "orders=0.1:2"
+	defer func() {
+		config.RateLimits = saved
+		resetRateLimits()
+	}()
+	withTestSite(t, func(site *testSite) {
+		first := site.login(t, 1)
+		for i := 0; i < 2; i++ {
+			status, body := site.get(t, first, "/freere")
+			if status != http.StatusFound {
+				t.Fatal("Burst should be let through", status, body)
+			}
+		}
+		resp, err := first.Get(site.server.URL + "/freere")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusTooManyRequests || resp.Header.Get("Retry-After") != "10" {
+			t.Error("Third claim should be limited for 10 seconds", resp.StatusCode, resp.Header.Get("Retry-After"))
+		}
+		if status, _ := site.get(t, site.login(t, 2), "/freere"); status != http.StatusFound {
+			t.Error("Another user shouldn't be limited by the first one", status)
+		}
+		if status, _ := site.get(t, first, "/dashboard"); status == http.StatusTooManyRequests {
+			t.Error("Pages are limited separately from orders")
+		}
+		_, body := site.get(t, site.client(t), "/metrics")
+		for _, want := range []string{
+			`exchange_rate_limit_requests_total{class="orders",result="limited"} 1`,
+			`exchange_rate_limit_requests_total{class="orders",result="allowed"} 3`,
+			`exchange_rate_limit_buckets{class="orders"} 2`,
+			`exchange_rate_limit_rate{class="orders"} 0.1`,
+		} {
+			if !strings.Contains(body, want) {
+				t.Errorf("Metrics should contain %q", want)
+			}
+		}
+	})
+}
+
+func TestHealthAndAdminRateLimits(t *testing.T) {
+	saved := config.RateLimits
+	config.RateLimits = "api=0.001:1,probes=0.001:1,admin=0.001:1"
+	defer func() {
+		config.RateLimits = saved
+		resetRateLimits()
+	}()
+	withTestSite(t, func(site *testSite) {
+		client := site.client(t)
+		if status, _ := site.get(t, client, "/metrics"); status != http.StatusOK {
+			t.Fatal("First api request should be let through", status)
+		}
+		if status, _ := site.get(t, client, "/metrics"); status != http.StatusTooManyRequests {
+			t.Fatal("The api bucket should be empty now", status)
+		}
+		for i := 0; i < 3; i++ {
+			if status, _ := site.get(t, client, "/healthz"); status != http.StatusOK {
+				t.Error("Health checks should never be limited", status)
+			}
+		}
+		if status, _ := site.get(t, client, "/readyz"); status == http.StatusTooManyRequests {
+			t.Error("An empty api bucket shouldn't limit readiness checks", status)
+		}
+		if status, _ := site.get(t, client, "/readyz"); status != http.StatusTooManyRequests {
+			t.Error("/readyz should be in the probes class", status)
+		}
+		if status, _ := site.get(t, client, "/admin"); status != http.StatusForbidden {
+			t.Error("Admin class has its own bucket", status)
+		}
+		if status, _ := site.get(t, client, "/admin/jobs"); status != http.StatusTooManyRequests {
+			t.Error("Admin pages should be limited too", status)
+		}
+	})
+}
+
+func TestBotStatusRateLimit(t *testing.T) {
+	saved := config.RateLimits
+	config.RateLimits = "bots=0.001:1"
+	resetRateLimits()
+	defer func() {
+		config.RateLimits = saved
+		resetRateLimits()
+	}()
+	WithTestingDatabase(func() {
+		bot := connectSimulatedBot(t) // its first status uses up the bucket
+		defer disconnectSimulatedBot(t, bot)
+		err := bot.SendStatus()
+		if err != nil {
+			t.Fatal(err)
+		}
+		limited := eventually(func() bool {
+			for _, s := range getRateLimiterStats() {
+				if s.Class == RateClassBots && s.Limited == 1 {
+					return true
+				}
+			}
+			return false
+		})
+		if !limited {
+			t.Error("Second status packet should have been ignored", getRateLimiterStats())
+		}
+	})
+}
@@ -0,0 +1,256 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"fmt"
+	"math"
+	"net/http"
+	"strconv"
+	"sync"
+	"time"
+)
+
+// bots tell us their health and hunger in every status packet, this is where we act on it
+// each rule sends the bot a chat control when its threshold is crossed, and every time one fires it goes into bot_safety_actions
+
+const SafetyEatCommand = "eat"       // eat whatever food is in the hotbar
+const SafetyLogoutCommand = "logout" // disconnect from the server right now
+const SafetyFleeCommand = "goto ender_chest"
+
+// don't send the same command again until the bot has had a chance to act on it
+const SafetyActionCooldown = 5 * time.Second
+
+type SafetyRules struct {
+	EatBelowFood      int     // eat when FoodLevel is below this, 0 turns it off
+	FleeBelowHealth   float32 // path home when health is below this and the bot isn't home, 0 turns it off
+	LogoutBelowHealth float32 // log out when health is below this, 0 turns it off
+	HasHome           bool    // if there's no home, "home" means standing at the ender chest with it open
+	HomeX             int
+	HomeY             int
+	HomeZ             int
+	HomeRadius        float64 // how far from home still counts as home
+}
+
+// what every bot gets unless an admin set something else for it
+var DefaultSafetyRules = SafetyRules{
+	EatBelowFood:      14,
+	FleeBelowHealth:   12,
+	LogoutBelowHealth: 6,
+	HomeRadius:        32,
+}
+
+type SafetyAction struct {
+	Rule    string // "eat", "flee" or "logout"
+	Command string // the chat control that was sent
+	Reason  string
+}
+
+type SafetyActionLog struct {
+	SafetyAction
+	Health    float32
+	FoodLevel int
+	CreatedAt int64
+}
+
+var safetyRulesCache = make(map[string]SafetyRules)
+var safetyRulesChanges int64 // bumped by setSafetyRules, so a load that raced with a change doesn't cache the old rules
+var safetyRulesLock sync.Mutex
+
+func (rules SafetyRules) isHome(status *BotStatus) bool {
+	if !rules.HasHome {
+		return status.EChestOpenNow
+	}
+	dx := status.X - float64(rules.HomeX)
+	dy := status.Y - float64(rules.HomeY)
+	dz := status.Z - float64(rules.HomeZ)
+	return math.Sqrt(dx*dx+dy*dy+dz*dz) <= rules.HomeRadius
+}
+
+func (rules SafetyRules) fleeCommand() string {
+	if !rules.HasHome {
+		return SafetyFleeCommand
+	}
+	return fmt.Sprintf("goto %d %d %d", rules.HomeX, rules.HomeY, rules.HomeZ)
+}
+
+// which rules fire for this status. lastFired is when each rule last fired for this bot, in unix nanos
+func evaluateSafety(rules SafetyRules, status *BotStatus, lastFired map[string]int64) []SafetyAction {
+	actions := make([]SafetyAction, 0)
+	now := status.timeReceivedUnixNano
+	fire := func(rule string, command string, reason string) {
+		if now-lastFired[rule] < int64(SafetyActionCooldown) {
+			return
+		}
+		actions = append(actions, SafetyAction{Rule: rule, Command: command, Reason: reason})
+	}
+	if rules.LogoutBelowHealth > 0 && status.Health < rules.LogoutBelowHealth {
+		// nothing else matters if we're about to die
+		fire("logout", SafetyLogoutCommand, fmt.Sprintf("health %.0f is below %.0f", status.Health, rules.LogoutBelowHealth))
+		return actions
+	}
+	if rules.FleeBelowHealth > 0 && status.Health < rules.FleeBelowHealth && !rules.isHome(status) {
+		fire("flee", rules.fleeCommand(), fmt.Sprintf("health %.0f is below %.0f away from home", status.Health, rules.FleeBelowHealth))
+	}
+	if rules.EatBelowFood > 0 && status.FoodLevel < rules.EatBelowFood {
+		fire("eat", SafetyEatCommand, fmt.Sprintf("food level %d is below %d", status.FoodLevel, rules.EatBelowFood))
+	}
+	return actions
+}
+
+// called on every status packet
+func (bot *Bot) superviseSafety(status *BotStatus) {
+	if bot.safetyLastFired == nil {
+		bot.safetyLastFired = make(map[string]int64)
+	}
+	for _, action := range evaluateSafety(getSafetyRules(status.BotUUID), status, bot.safetyLastFired) {
+		bot.safetyLastFired[action.Rule] = status.timeReceivedUnixNano
+		botLog.Warn("Safety rule fired", "bot", status.BotUUID, "rule", action.Rule, "reason", action.Reason, "command", action.Command)
+		bot.sendChatControl(action.Command)
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO bot_safety_actions (bot_uuid, server, rule, command, reason, health, food_level) VALUES (?, ?, ?, ?, ?, ?, ?)", status.BotUUID, status.ServerIP, action.Rule, action.Command, action.Reason, status.Health, status.FoodLevel)
+			return err
+		})
+		if err != nil {
+			botLog.Error("Unable to save safety action", "bot", status.BotUUID, "err", err)
+		}
+		if action.Rule == "logout" {
+			raiseBotAlert(BotAlert{
+				BotUUID: status.BotUUID,
+				Server:  status.ServerIP,
+				Kind:    "logout",
+				Message: "Bot " + status.BotUUID + " was told to log out because its " + action.Reason,
+			})
+		}
+	}
+}
+
+// a cache miss reads through the read pool without holding safetyRulesLock, so no bot's status packet ever waits behind order matching or another bot's load
+func getSafetyRules(botUUID string) SafetyRules {
+	safetyRulesLock.Lock()
+	rules, ok := safetyRulesCache[botUUID]
+	changes := safetyRulesChanges
+	safetyRulesLock.Unlock()
+	if ok {
+		return rules
+	}
+	err := RunReadSQL(func(sql *sql.Tx) error {
+		var err error
+		rules, err = loadSafetyRules(sql, botUUID)
+		return err
+	})
+	if err != nil {
+		botLog.Error("Unable to load safety rules, using the defaults", "bot", botUUID, "err", err)
+		return DefaultSafetyRules // don't cache, try again next packet
+	}
+	safetyRulesLock.Lock()
+	if safetyRulesChanges == changes {
+		safetyRulesCache[botUUID] = rules
+	}
+	safetyRulesLock.Unlock()
+	return rules
+}
+
+// can only be called within the context of a sql transaction
+func loadSafetyRules(sql *sql.Tx, botUUID string) (SafetyRules, error) {
+	rules := DefaultSafetyRules
+	var homeX, homeY, homeZ *int
+	err := sql.QueryRow("SELECT eat_below_food, flee_below_health, logout_below_health, home_x, home_y, home_z, home_radius FROM bot_safety_rules WHERE bot_uuid = ?", botUUID).Scan(&rules.EatBelowFood, &rules.FleeBelowHealth, &rules.LogoutBelowHealth, &homeX, &homeY, &homeZ, &rules.HomeRadius)
+	if err == ErrNoRows {
+		return DefaultSafetyRules, nil
+	}
+	if err != nil {
+		return rules, err
+	}
+	if homeX != nil && homeY != nil && homeZ != nil {
+		rules.HasHome = true
+		rules.HomeX, rules.HomeY, rules.HomeZ = *homeX, *homeY, *homeZ
+	}
+	return rules, nil
+}
+
+func setSafetyRules(ctx context.Context, admin_id int64, botUUID string, rules SafetyRules, reason string) error {
+	if rules.LogoutBelowHealth > 0 && rules.FleeBelowHealth > 0 && rules.LogoutBelowHealth >= rules.FleeBelowHealth {
+		return errors.New("The bot would log out before it ever got a chance to flee")
+	}
+	if rules.HomeRadius < 0 {
+		return errors.New("Home radius can't be negative")
+	}
+	var homeX, homeY, homeZ *int
+	if rules.HasHome {
+		homeX, homeY, homeZ = &rules.HomeX, &rules.HomeY, &rules.HomeZ
+	}
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		_, err := sql.Exec("INSERT OR REPLACE INTO bot_safety_rules (bot_uuid, eat_below_food, flee_below_health, logout_below_health, home_x, home_y, home_z, home_radius) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", botUUID, rules.EatBelowFood, rules.FleeBelowHealth, rules.LogoutBelowHealth, homeX, homeY, homeZ, rules.HomeRadius)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "safety_rules", 0, fmt.Sprintf("set safety rules of bot %s to %+v", botUUID, rules), reason)
+	})
+	if err != nil {
+		return err
+	}
+	safetyRulesLock.Lock()
+	delete(safetyRulesCache, botUUID)
+	safetyRulesChanges++
+	safetyRulesLock.Unlock()
+	return nil
+}
+
+// can only be called within the context of a sql transaction
+func getSafetyActions(sql *sql.Tx, botUUID string, since int64) ([]SafetyActionLog, error) {
+	rows, err := sql.Query("SELECT rule, command, reason, health, food_level, created_at FROM bot_safety_actions WHERE bot_uuid = ? AND created_at >= ? ORDER BY created_at DESC, rowid DESC LIMIT 100", botUUID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]SafetyActionLog, 0)
+	for rows.Next() {
+		var action SafetyActionLog
+		err = rows.Scan(&action.Rule, &action.Command, &action.Reason, &action.Health, &action.FoodLevel, &action.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, action)
+	}
+	return result, rows.Err()
+}
+
+func handleAdminSetSafetyRules(w http.ResponseWriter, r *http.Request) {
+	botUUID := r.URL.Query().Get(":uuid")
+	adminActionThen(w, r, "/admin/bot/"+botUUID, func(admin *User, reason string) error {
+		var rules SafetyRules
+		var err error
+		rules.EatBelowFood, err = strconv.Atoi(r.FormValue("eat_below_food"))
+		if err != nil {
+			return err
+		}
+		flee, err := strconv.ParseFloat(r.FormValue("flee_below_health"), 32)
+		if err != nil {
+			return err
+		}
+		logout, err := strconv.ParseFloat(r.FormValue("logout_below_health"), 32)
+		if err != nil {
+			return err
+		}
+		rules.FleeBelowHealth, rules.LogoutBelowHealth = float32(flee), float32(logout)
+		rules.HomeRadius, err = strconv.ParseFloat(r.FormValue("home_radius"), 64)
+		if err != nil {
+			return err
+		}
+		if r.FormValue("home_x") != "" {
+			rules.HasHome = true
+			for _, coord := range []struct {
+				field string
+				dest  *int
+			}{{"home_x", &rules.HomeX}, {"home_y", &rules.HomeY}, {"home_z", &rules.HomeZ}} {
+				*coord.dest, err = strconv.Atoi(r.FormValue(coord.field))
+				if err != nil {
+					return err
+				}
+			}
+		}
+		return setSafetyRules(r.Context(), admin.UserID, botUUID, rules, reason)
+	})
+}
@@ -0,0 +1,96 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func TestEvaluateSafety(t *testing.T) {
+	now := time.Now().UnixNano()
+	rules := DefaultSafetyRules
+	healthy := &BotStatus{Health: 20, FoodLevel: 20, timeReceivedUnixNano: now}
+	if len(evaluateSafety(rules, healthy, map[string]int64{})) != 0 {
+		t.Errorf("Healthy bot triggered a safety rule")
+	}
+	hungry := &BotStatus{Health: 20, FoodLevel: 10, timeReceivedUnixNano: now}
+	actions := evaluateSafety(rules, hungry, map[string]int64{})
+	if len(actions) != 1 || actions[0].Command != SafetyEatCommand {
+		t.Errorf("Hungry bot didn't eat %v", actions)
+	}
+	if len(evaluateSafety(rules, hungry, map[string]int64{"eat": now - int64(time.Second)})) != 0 {
+		t.Errorf("Eat fired again during its cooldown")
+	}
+	hurt := &BotStatus{Health: 10, FoodLevel: 20, timeReceivedUnixNano: now}
+	actions = evaluateSafety(rules, hurt, map[string]int64{})
+	if len(actions) != 1 || actions[0].Command != SafetyFleeCommand {
+		t.Errorf("Hurt bot away from the ender chest didn't flee %v", actions)
+	}
+	hurt.EChestOpenNow = true
+	if len(evaluateSafety(rules, hurt, map[string]int64{})) != 0 {
+		t.Errorf("Hurt bot at the ender chest fled")
+	}
+	rules.HasHome = true
+	rules.HomeX, rules.HomeY, rules.HomeZ = 100, 64, 100
+	actions = evaluateSafety(rules, hurt, map[string]int64{})
+	if len(actions) != 1 || actions[0].Command != "goto 100 64 100" {
+		t.Errorf("Hurt bot away from its home didn't go home %v", actions)
+	}
+	dying := &BotStatus{Health: 2, FoodLevel: 0, timeReceivedUnixNano: now}
+	actions = evaluateSafety(rules, dying, map[string]int64{})
+	if len(actions) != 1 || actions[0].Command != SafetyLogoutCommand {
+		t.Errorf("Dying bot didn't only log out %v", actions)
+	}
+}
+
+func TestSafetyRules(t *testing.T) {
+	WithTestingDatabase(func() {
+		defer func() {
+			safetyRulesCache = make(map[string]SafetyRules) // it outlives the testing database
+		}()
+		if getSafetyRules("bot") != DefaultSafetyRules {
+			t.Errorf("Bot with no rules didn't get the defaults")
+		}
+		rules := SafetyRules{EatBelowFood: 10, FleeBelowHealth: 8, LogoutBelowHealth: 4, HasHome: true, HomeX: 1, HomeY: 2, HomeZ: 3, HomeRadius: 5}
+		err := setSafetyRules(ctx, 42, "bot", rules, "closer to spawn")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if getSafetyRules("bot") != rules {
+			t.Errorf("Got %+v back instead of %+v", getSafetyRules("bot"), rules)
+		}
+		rules.LogoutBelowHealth = 10
+		if setSafetyRules(ctx, 42, "bot", rules, "oops") == nil {
+			t.Errorf("Was able to make a bot log out before it can flee")
+		}
+	})
+}
+
+func TestSafetyRulesDontWaitForTheWriter(t *testing.T) {
+	WithTestingDatabaseFile(t, func() {
+		defer func() {
+			safetyRulesCache = make(map[string]SafetyRules)
+		}()
+		started := make(chan struct{})
+		release := make(chan struct{})
+		go RunSQL(func(sql *sql.Tx) error {
+			close(started)
+			<-release // pretend order matching is taking its time
+			return nil
+		})
+		<-started
+		defer close(release)
+		done := make(chan SafetyRules)
+		go func() {
+			done <- getSafetyRules("bot")
+		}()
+		select {
+		case rules := <-done:
+			if rules != DefaultSafetyRules {
+				t.Error("Bot with no rules didn't get the defaults", rules)
+			}
+		case <-time.After(2 * time.Second):
+			t.Error("Loading safety rules waited for the writer")
+		}
+	})
+}
@@ -2,244 +2,382 @@ package main
 
 import (
 	"database/sql"
-	"log"
 )
 
-func initialSetup() {
-	err := RunSQL(func(sql *sql.Tx) error {
-		_, err := sql.Exec(`CREATE TABLE IF NOT EXISTS users (
-
-			user_id    INTEGER NOT NULL PRIMARY KEY,                     /* use discord id not @# tag because you can change your username */
-			balance    INTEGER NOT NULL DEFAULT 0,                       /* this verifies and guarantees at the database level that your balance can never be negative */
-			max_slots  INTEGER NOT NULL DEFAULT 4,                       /* how many slots this user has */
-			created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this account was created */
-
-			CHECK(balance >= 0),
-			CHECK(max_slots >= 0),
-			CHECK(user_id > 0),
-			CHECK(created_at > 0)
-
-		);`)
-		if err != nil {
-			log.Println("Unable to create users table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listings (
-
-			listing_id INTEGER NOT NULL PRIMARY KEY, /* id of this listing */
-			item_key   TEXT    NOT NULL,             /* e.g. enchanted golden apple is "item.appleGold;1", it's translation key semicolon damage value */
-			server     TEXT    NOT NULL,             /* what server this is on, 2b2t or whatever */
-			item_name  TEXT    NOT NULL,             /* name of the item, like "shulker of gapples" */
-			item_photo TEXT    NOT NULL,             /* i guess the URL of the image of this? like "/static/gapple.png" */
-
-			UNIQUE(server, item_key), /* can't have two listings for the same item on the same server */
-			CHECK(LENGTH(item_key) > 0 AND LENGTH(server) > 0 AND LENGTH(item_name) > 0 AND LENGTH(item_photo) > 0),
-			CHECK(listing_id >= 0) /* makes the code easier if they never start with a -. shrug. */
-		);
-		CREATE INDEX IF NOT EXISTS listingsserveritem ON listings(server, item_key);`)
-		if err != nil {
-			log.Println("Unable to create listings table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS slots (  /* the big one */
-
-			user_id         INTEGER NOT NULL,                                         /* which user owns this slot */
-			slot_index      INTEGER NOT NULL,                                         /* which slot this is for the user that owns it, 0 through 3 */
-			listing_id      INTEGER NOT NULL,                                         /* what listing is in this slot, empty slots have no row in this table */
-			expiry_time     INTEGER NOT NULL DEFAULT (strftime('%s', 'now') + 86400), /* when will this slot expire, unix time, seconds since epoch */
-			renewals        INTEGER NOT NULL DEFAULT 14,                              /* how many more times can this slot be renewed */
-			sale_price      INTEGER,                                                  /* how much it's for sale for, NULL means not for sale. note that 0 DOES mean for sale, just up for grabs for free. force sells are at price 0. */
-			for_sale_since  INTEGER,                                                  /* when it was put up for sale */
-			locked          INTEGER NOT NULL DEFAULT 0,                               /* 0: not locked, 1: locked for force sale, 2: withdrawal in progress */
-			withdrawal_code INTEGER,                                                  /* reference to pending_withdrawals table, NULL if not currently in process of withdrawal */
-
-			UNIQUE(user_id, slot_index),                                                                          /* a user can't have two different items in the same slot */
-			CHECK(slot_index >= 0),
-			CHECK(expiry_time > 0),
-			CHECK(renewals >= 0),
-			CHECK(sale_price IS NULL OR sale_price >= 0),                                                         /* sale price can never be negative but it can be null */
-			CHECK(locked == 0 OR locked == 1 OR locked == 2),                                                     /* locked is basically an enum, must be 0 through 2 */
-			CHECK(sale_price IS NULL OR locked != 2),                                                             /* AKA something cannot be for sale and in the middle of withdrawal AKA it cannot be true that: sale_price IS NOT NULL AND locked == 2 */
-			CHECK(sale_price IS NULL OR sale_price == 0 OR locked != 1),                                          /* AKA something cannot be locked for force sale and for sale for a nonzero price AKA it cannot be true that: sale_price IS NOT NULL AND sale_price > 0 AND locked == 1 */
-			CHECK((withdrawal_code IS NULL AND locked != 2) OR (withdrawal_code IS NOT NULL AND locked == 2)),                 /* make sure withdrawal_code and locked==2 are in sync */
-			CHECK((sale_price IS NULL AND for_sale_since IS NULL) OR (sale_price IS NOT NULL AND for_sale_since IS NOT NULL)), /* make sure that sale_price and for_sale_since are in sync */
-			FOREIGN KEY(user_id)         REFERENCES users(user_id)                       ON UPDATE CASCADE ON DELETE RESTRICT, /* cannot delete a user with inventory */
-			FOREIGN KEY(listing_id)      REFERENCES listings(listing_id)                 ON UPDATE CASCADE ON DELETE RESTRICT, /* cannot delete a listing that someone still has */
-			FOREIGN KEY(withdrawal_code) REFERENCES pending_withdrawals(withdrawal_code) ON UPDATE CASCADE ON DELETE SET NULL
-
-		);
-		CREATE INDEX IF NOT EXISTS slotownerindex ON slots(user_id, slot_index);
-		CREATE INDEX IF NOT EXISTS slotowner      ON slots(user_id);
-		CREATE INDEX IF NOT EXISTS slotlisting    ON slots(listing_id);
-		CREATE INDEX IF NOT EXISTS slotwithdrawal ON slots(withdrawal_code); /* the table is queried by this column once */`)
-		if err != nil {
-			log.Println("Unable to create slots table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listing_buy_orders (
-
-			user_id    INTEGER NOT NULL,                                 /* which user placed this buy order */
-			listing_id INTEGER NOT NULL,                                 /* which listing the buy order is in */
-			quantity   INTEGER NOT NULL,                                 /* how many they're willing to buy */
-			price      INTEGER NOT NULL,                                 /* how much they're willing to pay for each one */
-			created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this buy order was created */
-
-			UNIQUE(user_id, listing_id, price),  /* can't have two buy orders open for the same item by the same user for the same price */
-			CHECK(quantity > 0),
-			CHECK(price > 0),
-			FOREIGN KEY(user_id)    REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE CASCADE,
-			FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
-		);
-		CREATE INDEX IF NOT EXISTS buyowner   ON listing_buy_orders(user_id);
-		CREATE INDEX IF NOT EXISTS buylisting ON listing_buy_orders(listing_id);`)
-		if err != nil {
-			log.Println("Unable to create listing_buy_orders table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS inventory ( /* 100 percent confirmed items that our bots definitely have in echests */
-
-			item_id     INTEGER NOT NULL PRIMARY KEY, /* item name */
-			listing_id  INTEGER NOT NULL,             /* which listing this item is. this also determines which server we're talking about since listings are server specific */
-			bot_uuid    TEXT    NOT NULL,             /* UUID of the bot that has this item in its ender chest */
-			slot_number INTEGER NOT NULL,             /* where in the bot's echest is this, 0 through 26 inclusive */
-
-			/* CANNOT do UNIQUE(bot_uuid,slot_number) because we reuse bots across servers, the same bot in slot 1 of its echest can have a different item on two different servers */
-			CHECK(item_id > 0),
-			CHECK(LENGTH(bot_uuid) = 36),
-			CHECK(slot_number >= 0 AND slot_number < 27),
-			FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE RESTRICT /* cannot delete a listing that still has inventory */
-		);
-		CREATE INDEX IF NOT EXISTS inventorylisting ON inventory(listing_id);`)
-		if err != nil {
-			log.Println("Unable to create inventory table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS pending_deposits (
-
-			deposit_id   INTEGER NOT NULL PRIMARY KEY, /* ID of this deposit, the name of the item will be this in hexadecimal */
-			user_id      INTEGER NOT NULL,             /* which user initiated this deposit */
-			listing_id   INTEGER NOT NULL,             /* which listing the deposit is into */
-			expiry_time  INTEGER NOT NULL,             /* when will this deposit expire if not completed, unix time, seconds since epoch. if a bot picks up the item after this time, it will throw it out */
-			picked_up_at INTEGER,                      /* when a bot picked up this deposit, MAYBE. NULL if we've never seen this deposit at all. unix time, seconds since epoch of course. NOT actually confirmed yet! */
-
-			UNIQUE(user_id, expiry_time),   /* a user can't make more than one a second LOL */
-			CHECK(expiry_time > 0),
-			CHECK(deposit_id > 0),
-			CHECK(picked_up_at IS NULL OR picked_up_at > 0),
-			FOREIGN KEY(user_id)    REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE CASCADE,
-			FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
-		);
-		CREATE INDEX IF NOT EXISTS depositowner ON pending_deposits(user_id);`)
-		if err != nil {
-			log.Println("Unable to create pending_deposits table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS pending_withdrawals (
-
-			withdrawal_code INTEGER NOT NULL PRIMARY KEY, /* code that causes the bot to drop the item */
-			item_id         INTEGER NOT NULL,             /* reference to inventory of which item is being withdrawn from where */
-			expiry_time     INTEGER NOT NULL,             /* when will this withdrawal expire if not completex, unix time, seconds since epoch */
-
-			UNIQUE(item_id), /* not possible for two currently pending withdrawals to be on the same specific item */
-			CHECK(expiry_time > 0),
-			FOREIGN KEY(item_id) REFERENCES inventory(item_id) ON UPDATE CASCADE ON DELETE RESTRICT
-		);`)
-		if err != nil {
-			log.Println("Unable to create pending_withdrawals table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS completed_listing_trades (
-
-			seller_id INTEGER NOT NULL,                                 /* who sold the item */
-			buyer_id INTEGER NOT NULL,                                  /* who bought the item */
-			listing_id INTEGER NOT NULL,                                /* the item */
-			price INTEGER NOT NULL,                                     /* the price */
-			timestamp INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when it happened */
-
-			CHECK(price >= 0), /* you can indeed sell something for free */
-			CHECK(timestamp > 0),
-			CHECK(buyer_id != seller_id),
-			FOREIGN KEY(buyer_id)   REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE RESTRICT, /* TODO figure out what should happen here. */
-			FOREIGN KEY(seller_id)  REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE RESTRICT,
-			FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
-		);
-		CREATE INDEX IF NOT EXISTS tradebuyer  ON completed_listing_trades(buyer_id);
-		CREATE INDEX IF NOT EXISTS tradeseller ON completed_listing_trades(seller_id);
-		CREATE INDEX IF NOT EXISTS tradeitem   ON completed_listing_trades(listing_id);`)
-		if err != nil {
-			log.Println("Unable to create completed_listing_trades table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS currencies (
-
-			currency_id INTEGER NOT NULL PRIMARY KEY,
-			currency_name TEXT NOT NULL,
-
-			UNIQUE(currency_name),
-			CHECK(LENGTH(currency_name) > 0)
-		);
-		`)
-		if err != nil {
-			log.Println("Unable to create currencies table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS balances (
-
-			user_id INTEGER NOT NULL,     /* who has this currency */
-			currency_id INTEGER NOT NULL, /* what is the currency */
-			balance INTEGER NOT NULL,     /* how much of it do they have */
-
-			CHECK(balance >= 0),
-			FOREIGN KEY(user_id)     REFERENCES users(user_id)          ON UPDATE CASCADE ON DELETE RESTRICT,
-			FOREIGN KEY(currency_id) REFERENCES currencies(currency_id) ON UPDATE CASCADE ON DELETE RESTRICT
-		);
-		CREATE INDEX IF NOT EXISTS balancesuser     ON balances(user_id);
-		CREATE INDEX IF NOT EXISTS balancescurrency ON balances(currency_id);
-		`)
-		if err != nil {
-			log.Println("Unable to create balances table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS currency_buy_orders (
-
-			user_id     INTEGER NOT NULL,                                 /* which user placed this buy order */
-			currency_id INTEGER NOT NULL,                                 /* which currency the buy order is for */
-			quantity    INTEGER NOT NULL,                                 /* how many they're willing to buy */
-			price       INTEGER NOT NULL,                                 /* how much they're willing to pay for each one */
-			created_at  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this buy order was created */
-
-			UNIQUE(user_id, currency_id, price),  /* can't have two buy orders open for the same currency by the same user for the same price */
-			CHECK(quantity > 0),
-			CHECK(price > 0),
-			FOREIGN KEY(user_id)     REFERENCES users(user_id)          ON UPDATE CASCADE ON DELETE CASCADE,
-			FOREIGN KEY(currency_id) REFERENCES currencies(currency_id) ON UPDATE CASCADE ON DELETE CASCADE
-		);`)
-		if err != nil {
-			log.Println("Unable to create currency_buy_orders table")
-			return err
-		}
-		_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS currency_sell_orders (
-
-			user_id     INTEGER NOT NULL,                                 /* which user placed this sell order */
-			currency_id INTEGER NOT NULL,                                 /* which currency the sell order is for */
-			quantity    INTEGER NOT NULL,                                 /* how many they're willing to sell (of currency, not of RE) */
-			price       INTEGER NOT NULL,                                 /* how much they want to receive for each one */
-			created_at  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this sell order was created */
-
-			UNIQUE(user_id, currency_id, price),  /* can't have two sell orders open for the same currency by the same user for the same price */
-			CHECK(quantity > 0),
-			CHECK(price > 0),
-			FOREIGN KEY(user_id)     REFERENCES users(user_id)          ON UPDATE CASCADE ON DELETE CASCADE,
-			FOREIGN KEY(currency_id) REFERENCES currencies(currency_id) ON UPDATE CASCADE ON DELETE CASCADE
-		);`)
-		if err != nil {
-			log.Println("Unable to create currency_sell_orders table")
-			return err
-		}
-		return nil
-	})
-	if err != nil {
-		panic(err) // immediately quit if we cannot create our tables
-	}
-	log.Println("Database setup completed")
+// migration 1, everything up to when schema_version was added
+// this is IF NOT EXISTS all the way down so that databases from before then get adopted as-is instead of erroring
+// NEVER edit this to change a table, add a new migration to migrations.go instead, otherwise existing databases won't get the change
+func createInitialSchema(sql *sql.Tx) error {
+	_, err := sql.Exec(`CREATE TABLE IF NOT EXISTS users (
+
+		user_id    INTEGER NOT NULL PRIMARY KEY,                     /* use discord id not @# tag because you can change your username */
+		balance    INTEGER NOT NULL DEFAULT 0,                       /* this verifies and guarantees at the database level that your balance can never be negative */
+		max_slots  INTEGER NOT NULL DEFAULT 4,                       /* how many slots this user has */
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this account was created */
+
+		CHECK(balance >= 0),
+		CHECK(max_slots >= 0),
+		CHECK(user_id > 0),
+		CHECK(created_at > 0)
+
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create users table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listings (
+
+		listing_id INTEGER NOT NULL PRIMARY KEY, /* id of this listing */
+		item_key   TEXT    NOT NULL,             /* e.g. enchanted golden apple is "item.appleGold;1", it's translation key semicolon damage value */
+		server     TEXT    NOT NULL,             /* what server this is on, 2b2t or whatever */
+		item_name  TEXT    NOT NULL,             /* name of the item, like "shulker of gapples" */
+		item_photo TEXT    NOT NULL,             /* i guess the URL of the image of this? like "/static/gapple.png" */
+
+		UNIQUE(server, item_key), /* can't have two listings for the same item on the same server */
+		CHECK(LENGTH(item_key) > 0 AND LENGTH(server) > 0 AND LENGTH(item_name) > 0 AND LENGTH(item_photo) > 0),
+		CHECK(listing_id >= 0) /* makes the code easier if they never start with a -. shrug. */
+	);
+	CREATE INDEX IF NOT EXISTS listingsserveritem ON listings(server, item_key);`)
+	if err != nil {
+		dbLog.Error("Unable to create listings table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS slots (  /* the big one */
+
+		user_id         INTEGER NOT NULL,                                         /* which user owns this slot */
+		slot_index      INTEGER NOT NULL,                                         /* which slot this is for the user that owns it, 0 through 3 */
+		listing_id      INTEGER NOT NULL,                                         /* what listing is in this slot, empty slots have no row in this table */
+		expiry_time     INTEGER NOT NULL DEFAULT (strftime('%s', 'now') + 86400), /* when will this slot expire, unix time, seconds since epoch */
+		renewals        INTEGER NOT NULL DEFAULT 14,                              /* how many more times can this slot be renewed */
+		sale_price      INTEGER,                                                  /* how much it's for sale for, NULL means not for sale. note that 0 DOES mean for sale, just up for grabs for free. force sells are at price 0. */
+		for_sale_since  INTEGER,                                                  /* when it was put up for sale */
+		locked          INTEGER NOT NULL DEFAULT 0,                               /* 0: not locked, 1: locked for force sale, 2: withdrawal in progress */
+		withdrawal_code INTEGER,                                                  /* reference to pending_withdrawals table, NULL if not currently in process of withdrawal */
+
+		UNIQUE(user_id, slot_index),                                                                          /* a user can't have two different items in the same slot */
+		CHECK(slot_index >= 0),
+		CHECK(expiry_time > 0),
+		CHECK(renewals >= 0),
+		CHECK(sale_price IS NULL OR sale_price >= 0),                                                         /* sale price can never be negative but it can be null */
+		CHECK(locked == 0 OR locked == 1 OR locked == 2),                                                     /* locked is basically an enum, must be 0 through 2 */
+		CHECK(sale_price IS NULL OR locked != 2),                                                             /* AKA something cannot be for sale and in the middle of withdrawal AKA it cannot be true that: sale_price IS NOT NULL AND locked == 2 */
+		CHECK(sale_price IS NULL OR sale_price == 0 OR locked != 1),                                          /* AKA something cannot be locked for force sale and for sale for a nonzero price AKA it cannot be true that: sale_price IS NOT NULL AND sale_price > 0 AND locked == 1 */
+		CHECK((withdrawal_code IS NULL AND locked != 2) OR (withdrawal_code IS NOT NULL AND locked == 2)),                 /* make sure withdrawal_code and locked==2 are in sync */
+		CHECK((sale_price IS NULL AND for_sale_since IS NULL) OR (sale_price IS NOT NULL AND for_sale_since IS NOT NULL)), /* make sure that sale_price and for_sale_since are in sync */
+		FOREIGN KEY(user_id)         REFERENCES users(user_id)                       ON UPDATE CASCADE ON DELETE RESTRICT, /* cannot delete a user with inventory */
+		FOREIGN KEY(listing_id)      REFERENCES listings(listing_id)                 ON UPDATE CASCADE ON DELETE RESTRICT, /* cannot delete a listing that someone still has */
+		FOREIGN KEY(withdrawal_code) REFERENCES pending_withdrawals(withdrawal_code) ON UPDATE CASCADE ON DELETE SET NULL
+
+	);
+	CREATE INDEX IF NOT EXISTS slotownerindex ON slots(user_id, slot_index);
+	CREATE INDEX IF NOT EXISTS slotowner      ON slots(user_id);
+	CREATE INDEX IF NOT EXISTS slotlisting    ON slots(listing_id);
+	CREATE INDEX IF NOT EXISTS slotwithdrawal ON slots(withdrawal_code); /* the table is queried by this column once */`)
+	if err != nil {
+		dbLog.Error("Unable to create slots table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listing_buy_orders (
+
+		user_id    INTEGER NOT NULL,                                 /* which user placed this buy order */
+		listing_id INTEGER NOT NULL,                                 /* which listing the buy order is in */
+		quantity   INTEGER NOT NULL,                                 /* how many they're willing to buy */
+		price      INTEGER NOT NULL,                                 /* how much they're willing to pay for each one */
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this buy order was created */
+
+		UNIQUE(user_id, listing_id, price),  /* can't have two buy orders open for the same item by the same user for the same price */
+		CHECK(quantity > 0),
+		CHECK(price > 0),
+		FOREIGN KEY(user_id)    REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS buyowner   ON listing_buy_orders(user_id);
+	CREATE INDEX IF NOT EXISTS buylisting ON listing_buy_orders(listing_id);`)
+	if err != nil {
+		dbLog.Error("Unable to create listing_buy_orders table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS inventory ( /* 100 percent confirmed items that our bots definitely have in echests */
+
+		item_id     INTEGER NOT NULL PRIMARY KEY, /* item name */
+		listing_id  INTEGER NOT NULL,             /* which listing this item is. this also determines which server we're talking about since listings are server specific */
+		bot_uuid    TEXT    NOT NULL,             /* UUID of the bot that has this item in its ender chest */
+		slot_number INTEGER NOT NULL,             /* where in the bot's echest is this, 0 through 26 inclusive */
+
+		/* CANNOT do UNIQUE(bot_uuid,slot_number) because we reuse bots across servers, the same bot in slot 1 of its echest can have a different item on two different servers */
+		CHECK(item_id > 0),
+		CHECK(LENGTH(bot_uuid) = 36),
+		CHECK(slot_number >= 0 AND slot_number < 27),
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE RESTRICT /* cannot delete a listing that still has inventory */
+	);
+	CREATE INDEX IF NOT EXISTS inventorylisting ON inventory(listing_id);`)
+	if err != nil {
+		dbLog.Error("Unable to create inventory table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS pending_deposits (
+
+		deposit_id   INTEGER NOT NULL PRIMARY KEY, /* ID of this deposit, the name of the item will be this in hexadecimal */
+		user_id      INTEGER NOT NULL,             /* which user initiated this deposit */
+		listing_id   INTEGER NOT NULL,             /* which listing the deposit is into */
+		expiry_time  INTEGER NOT NULL,             /* when will this deposit expire if not completed, unix time, seconds since epoch. if a bot picks up the item after this time, it will throw it out */
+		picked_up_at INTEGER,                      /* when a bot picked up this deposit, MAYBE. NULL if we've never seen this deposit at all. unix time, seconds since epoch of course. NOT actually confirmed yet! */
+
+		UNIQUE(user_id, expiry_time),   /* a user can't make more than one a second LOL */
+		CHECK(expiry_time > 0),
+		CHECK(deposit_id > 0),
+		CHECK(picked_up_at IS NULL OR picked_up_at > 0),
+		FOREIGN KEY(user_id)    REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS depositowner ON pending_deposits(user_id);`)
+	if err != nil {
+		dbLog.Error("Unable to create pending_deposits table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS pending_withdrawals (
+
+		withdrawal_code INTEGER NOT NULL PRIMARY KEY, /* code that causes the bot to drop the item */
+		item_id         INTEGER NOT NULL,             /* reference to inventory of which item is being withdrawn from where */
+		expiry_time     INTEGER NOT NULL,             /* when will this withdrawal expire if not completex, unix time, seconds since epoch */
+
+		UNIQUE(item_id), /* not possible for two currently pending withdrawals to be on the same specific item */
+		CHECK(expiry_time > 0),
+		FOREIGN KEY(item_id) REFERENCES inventory(item_id) ON UPDATE CASCADE ON DELETE RESTRICT
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create pending_withdrawals table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS completed_listing_trades (
+
+		seller_id INTEGER NOT NULL,                                 /* who sold the item */
+		buyer_id INTEGER NOT NULL,                                  /* who bought the item */
+		listing_id INTEGER NOT NULL,                                /* the item */
+		price INTEGER NOT NULL,                                     /* the price */
+		timestamp INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when it happened */
+
+		CHECK(price >= 0), /* you can indeed sell something for free */
+		CHECK(timestamp > 0),
+		CHECK(buyer_id != seller_id),
+		FOREIGN KEY(buyer_id)   REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE RESTRICT, /* TODO figure out what should happen here. */
+		FOREIGN KEY(seller_id)  REFERENCES users(user_id)       ON UPDATE CASCADE ON DELETE RESTRICT,
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS tradebuyer  ON completed_listing_trades(buyer_id);
+	CREATE INDEX IF NOT EXISTS tradeseller ON completed_listing_trades(seller_id);
+	CREATE INDEX IF NOT EXISTS tradeitem   ON completed_listing_trades(listing_id);`)
+	if err != nil {
+		dbLog.Error("Unable to create completed_listing_trades table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS currencies (
+
+		currency_id INTEGER NOT NULL PRIMARY KEY,
+		currency_name TEXT NOT NULL,
+
+		UNIQUE(currency_name),
+		CHECK(LENGTH(currency_name) > 0)
+	);
+	`)
+	if err != nil {
+		dbLog.Error("Unable to create currencies table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS balances (
+
+		user_id INTEGER NOT NULL,     /* who has this currency */
+		currency_id INTEGER NOT NULL, /* what is the currency */
+		balance INTEGER NOT NULL,     /* how much of it do they have */
+
+		CHECK(balance >= 0),
+		FOREIGN KEY(user_id)     REFERENCES users(user_id)          ON UPDATE CASCADE ON DELETE RESTRICT,
+		FOREIGN KEY(currency_id) REFERENCES currencies(currency_id) ON UPDATE CASCADE ON DELETE RESTRICT
+	);
+	CREATE INDEX IF NOT EXISTS balancesuser     ON balances(user_id);
+	CREATE INDEX IF NOT EXISTS balancescurrency ON balances(currency_id);
+	`)
+	if err != nil {
+		dbLog.Error("Unable to create balances table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS currency_buy_orders (
+
+		user_id     INTEGER NOT NULL,                                 /* which user placed this buy order */
+		currency_id INTEGER NOT NULL,                                 /* which currency the buy order is for */
+		quantity    INTEGER NOT NULL,                                 /* how many they're willing to buy */
+		price       INTEGER NOT NULL,                                 /* how much they're willing to pay for each one */
+		created_at  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this buy order was created */
+
+		UNIQUE(user_id, currency_id, price),  /* can't have two buy orders open for the same currency by the same user for the same price */
+		CHECK(quantity > 0),
+		CHECK(price > 0),
+		FOREIGN KEY(user_id)     REFERENCES users(user_id)          ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY(currency_id) REFERENCES currencies(currency_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create currency_buy_orders table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS currency_sell_orders (
+
+		user_id     INTEGER NOT NULL,                                 /* which user placed this sell order */
+		currency_id INTEGER NOT NULL,                                 /* which currency the sell order is for */
+		quantity    INTEGER NOT NULL,                                 /* how many they're willing to sell (of currency, not of RE) */
+		price       INTEGER NOT NULL,                                 /* how much they want to receive for each one */
+		created_at  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when this sell order was created */
+
+		UNIQUE(user_id, currency_id, price),  /* can't have two sell orders open for the same currency by the same user for the same price */
+		CHECK(quantity > 0),
+		CHECK(price > 0),
+		FOREIGN KEY(user_id)     REFERENCES users(user_id)          ON UPDATE CASCADE ON DELETE CASCADE,
+		FOREIGN KEY(currency_id) REFERENCES currencies(currency_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create currency_sell_orders table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS servers ( /* every anarchy server the exchange runs on */
+
+		server_ip    TEXT    NOT NULL PRIMARY KEY,                      /* normalized address, like "2b2t.org". listings.server is one of these */
+		display_name TEXT    NOT NULL,                                  /* what to call it on the site, like "2b2t" */
+		enabled      INTEGER NOT NULL DEFAULT 1,                        /* 0 means bots on it are ignored and its listings can't be traded */
+		created_at   INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when it was added */
+
+		CHECK(LENGTH(server_ip) > 0 AND LENGTH(display_name) > 0),
+		CHECK(enabled == 0 OR enabled == 1)
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create servers table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS bot_status_history ( /* a snapshot of a bot's status every so often, old ones get deleted */
+
+		bot_uuid        TEXT    NOT NULL,
+		server          TEXT    NOT NULL,
+		sampled_at      INTEGER NOT NULL, /* unix seconds of when the status packet was received */
+		x               REAL    NOT NULL,
+		y               REAL    NOT NULL,
+		z               REAL    NOT NULL,
+		health          REAL    NOT NULL, /* half hearts, 20 is full */
+		food_level      INTEGER NOT NULL,
+		saturation      REAL    NOT NULL,
+		dimension       INTEGER NOT NULL, /* -1 nether, 0 overworld, 1 end */
+		current_goal    TEXT    NOT NULL,
+		current_process TEXT    NOT NULL,
+		calc_failed     INTEGER NOT NULL  /* 1 if baritone failed to calculate a path on that tick */
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create bot_status_history table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE INDEX IF NOT EXISTS bot_status_history_by_bot ON bot_status_history (bot_uuid, sampled_at)`)
+	if err != nil {
+		dbLog.Error("Unable to create bot_status_history index", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS bot_alerts ( /* things about a bot that admins were DMed about */
+
+		bot_uuid   TEXT    NOT NULL,
+		server     TEXT    NOT NULL,
+		kind       TEXT    NOT NULL, /* health, dimension, stale or recovered */
+		message    TEXT    NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create bot_alerts table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS bot_safety_rules ( /* per bot overrides of DefaultSafetyRules */
+
+		bot_uuid            TEXT    NOT NULL PRIMARY KEY,
+		eat_below_food      INTEGER NOT NULL, /* 0 means never eat */
+		flee_below_health   REAL    NOT NULL, /* 0 means never flee */
+		logout_below_health REAL    NOT NULL, /* 0 means never log out */
+		home_x              INTEGER,          /* all three NULL means home is wherever the ender chest is */
+		home_y              INTEGER,
+		home_z              INTEGER,
+		home_radius         REAL    NOT NULL,
+
+		CHECK((home_x IS NULL) == (home_y IS NULL) AND (home_y IS NULL) == (home_z IS NULL))
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create bot_safety_rules table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS bot_safety_actions ( /* every time a safety rule told a bot to do something */
+
+		bot_uuid   TEXT    NOT NULL,
+		server     TEXT    NOT NULL,
+		rule       TEXT    NOT NULL, /* eat, flee or logout */
+		command    TEXT    NOT NULL, /* the chat control we sent */
+		reason     TEXT    NOT NULL,
+		health     REAL    NOT NULL,
+		food_level INTEGER NOT NULL,
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now'))
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create bot_safety_actions table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listing_freezes ( /* listings where an ender chest audit found something that doesn't add up */
+
+		listing_id INTEGER NOT NULL,                                 /* which listing is frozen, no trading, deposits or withdrawals while there's any row for it */
+		bot_uuid   TEXT    NOT NULL,                                 /* which bot's audit froze it. the next clean audit of this bot lifts it */
+		reason     TEXT    NOT NULL,                                 /* the audit report, so an admin can see what was wrong */
+		frozen_at  INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when it was frozen */
+
+		UNIQUE(listing_id, bot_uuid),
+		CHECK(LENGTH(bot_uuid) = 36),
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);
+	CREATE INDEX IF NOT EXISTS freezelisting ON listing_freezes(listing_id);`)
+	if err != nil {
+		dbLog.Error("Unable to create listing_freezes table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS admin_audit_log ( /* everything an admin does by hand goes in here */
+
+		log_id     INTEGER NOT NULL PRIMARY KEY,
+		admin_id   INTEGER NOT NULL,                                 /* discord id of the admin that did it */
+		action     TEXT    NOT NULL,                                 /* what kind of thing they did, like "adjust_balance" */
+		user_id    INTEGER,                                          /* which user it was done to, NULL if it wasn't about one user. deliberately no foreign key, the log should outlive anything */
+		detail     TEXT    NOT NULL,                                 /* exactly what was changed */
+		reason     TEXT    NOT NULL,                                 /* why, as typed in by the admin */
+		created_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')), /* when */
+
+		CHECK(admin_id > 0),
+		CHECK(LENGTH(action) > 0),
+		CHECK(LENGTH(reason) > 0)
+	);
+	CREATE INDEX IF NOT EXISTS adminloguser ON admin_audit_log(user_id);`)
+	if err != nil {
+		dbLog.Error("Unable to create admin_audit_log table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listing_retirements ( /* listings that are being wound down. no new orders or deposits, but people can still withdraw what they have */
+
+		listing_id INTEGER NOT NULL PRIMARY KEY,                      /* which listing is retired */
+		retired_by INTEGER NOT NULL,                                  /* discord id of the admin that retired it */
+		retired_at INTEGER NOT NULL DEFAULT (strftime('%s', 'now')),  /* when */
+
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create listing_retirements table", "err", err)
+		return err
+	}
+	_, err = sql.Exec(`CREATE TABLE IF NOT EXISTS listing_templates ( /* for listings that take more than one exact shulker, like kits or totems at 1 per slot */
+
+		listing_id INTEGER NOT NULL PRIMARY KEY, /* which listing this template is for */
+		template   TEXT    NOT NULL,             /* ShulkerTemplate as JSON, see shulker.go */
+
+		CHECK(LENGTH(template) > 0),
+		FOREIGN KEY(listing_id) REFERENCES listings(listing_id) ON UPDATE CASCADE ON DELETE CASCADE
+	);`)
+	if err != nil {
+		dbLog.Error("Unable to create listing_templates table", "err", err)
+		return err
+	}
+	return nil
 }
@@ -4,7 +4,6 @@ import (
 	"context"
 	"database/sql"
 	"html/template"
-	"log"
 	"net/http"
 	"os"
 	"path/filepath"
@@ -37,7 +36,7 @@ func parseTemplates() *template.Template {
 }
 
 func handleEnderChest(w http.ResponseWriter, r *http.Request) { // handle a request to ender_chest
-	log.Println("Going to an ENDER CHEST OWO")
+	requestLogger(r, botLog).Info("Sending every bot to its ender chest")
 	goToEnderChest()                           // lol
 	http.Redirect(w, r, "/", http.StatusFound) // redirect back to main page, 302 temporary redirect
 }
@@ -48,7 +47,7 @@ func handleFreeRE(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "not logged in LOL", http.StatusInternalServerError)
 		return
 	}
-	err := RunSQL(func(sql *sql.Tx) error {
+	err := RunSQLContext(r.Context(), func(sql *sql.Tx) error {
 		_, err := sql.Exec("UPDATE users SET balance = balance + 1 WHERE user_id = ?", user.UserID)
 		// this query returns a result, which I think is their new balance, but we ignore it, we just care about if there was an error
 		return err
@@ -57,40 +56,65 @@ func handleFreeRE(w http.ResponseWriter, r *http.Request) {
 		http.Error(w, "Unable to execute SQL to increment your balance. "+err.Error(), http.StatusInternalServerError)
 		return
 	}
-	err = user.DM("You just claimed 1 free " + Currency + "!")
-	if err != nil {
-		log.Println(err)
-	}
+	user.DM("You just claimed 1 free " + Currency + "!")
 	http.Redirect(w, r, "/", http.StatusFound) // redirect back to main page, 302 temporary redirect
 }
 
-func serve() {
+func serve(ctx context.Context) {
+	server = &http.Server{
+		Addr:    config.HTTPAddr,
+		Handler: newRouter(),
+	}
+	httpLog.Info("Listening for HTTP", "addr", config.HTTPAddr)
+	errs := make(chan error, 1)
+	go func() {
+		errs <- server.ListenAndServe()
+	}()
+	select {
+	case err := <-errs:
+		httpLog.Error("HTTP server stopped", "err", err) // if the server stops on its own, this prints out why
+		os.Exit(1)
+	case <-ctx.Done():
+		ShutdownHTTP() // ListenAndServe returns as soon as this starts, but this waits for requests in progress to finish
+	}
+}
+
+// every route the site has. split out of serve so tests can run the whole site with httptest
+func newRouter() http.Handler {
 	p := pat.New() // this is a simple library (imported above), pat is short for pattern, and it makes it easier to do routes (get / post / etc)
 
-	setupAuth(p) // setup login with discord and logout, calls auth.go
+	setupAuth(p)  // setup login with discord and logout, calls auth.go
+	setupAdmin(p) // the admin console, calls admin_page.go
 
 	// this is where all the webserver files are located!
 
-	p.Get("/ender_chest", handleEnderChest) // going to /ender_chest should do the ender chest thing
-	p.Get("/freere", handleFreeRE)          // just for testing
-	p.Get("/trade/{listing}", handleListing)
-	p.Get("/dashboard", handleDashboardPage)
-	p.Get("/categories", handleCategories)
-	p.Get("/neworders", handleorders)
-	p.Get("/market", handlemarket)
-	p.Get("/", handleMainPage) // going to / should render the main page
+	p.Get("/ender_chest", rateLimited(RateClassOrders, handleEnderChest)) // going to /ender_chest should do the ender chest thing
+	p.Get("/freere", rateLimited(RateClassOrders, handleFreeRE))          // just for testing
+	p.Post("/trade/{listing}/deposit", rateLimited(RateClassOrders, handleDeposit))
+	p.Post("/trade/{listing}/buy", rateLimited(RateClassOrders, handleBuy))
+	p.Post("/slot/{slot}/sell", rateLimited(RateClassOrders, handleSell))
+	p.Post("/slot/{slot}/cancel", rateLimited(RateClassOrders, handleCancelSell))
+	p.Post("/slot/{slot}/withdraw", rateLimited(RateClassOrders, handleWithdraw))
+	p.Post("/withdraw", rateLimited(RateClassOrders, handleConfirmWithdrawal))
+	p.Get("/trade/{listing}", rateLimited(RateClassPages, handleListing))
+	p.Get("/dashboard", rateLimited(RateClassPages, handleDashboardPage))
+	p.Get("/categories", rateLimited(RateClassAPI, handleCategories))
+	p.Get("/neworders", rateLimited(RateClassAPI, handleorders))
+	p.Get("/market", rateLimited(RateClassAPI, handlemarket))
+	p.Get("/servers", rateLimited(RateClassPages, handleServersPage))
+	p.Get("/server/{server}", rateLimited(RateClassPages, handleServerPage))
+	p.Get("/", rateLimited(RateClassPages, handleMainPage)) // going to / should render the main page
 
 	// this is where all the unchanging things are!
 
-	http.Handle("/assets/", http.FileServer(http.Dir("."))) // any request that begins with "/assets/" will be a file server, this is for css and js and image files in static/
-
-	http.Handle("/", p)
+	mux := http.NewServeMux()
+	mux.Handle("/assets/", http.FileServer(http.Dir("."))) // any request that begins with "/assets/" will be a file server, this is for css and js and image files in static/
 
-	server = &http.Server{
-		Addr: ":3000",
-	}
-	log.Println("Listening for HTTP...")
-	log.Fatal(server.ListenAndServe()) // if serve() returns an error, this prints it out
+	mux.HandleFunc("/metrics", rateLimited(RateClassAPI, handleMetrics))
+	mux.HandleFunc("/healthz", handleHealthz) // never limited, a 429 here would get a perfectly healthy exchange restarted
+	mux.HandleFunc("/readyz", rateLimited(RateClassProbes, handleReadyz))
+	mux.Handle("/", p)
+	return instrumentHTTP(p, mux)
 }
 
 func ShutdownHTTP() {
@@ -108,7 +132,6 @@ func ShutdownHTTP() {
 	ctx, cancel := context.WithTimeout(context.Background(), 5*time.Second)
 	defer cancel()
 	if err := server.Shutdown(ctx); err != nil {
-		log.Println("Wowzers I cannot shut down this http server =(")
-		log.Println(err)
+		httpLog.Error("Unable to shut down the HTTP server", "err", err)
 	}
 }
@@ -0,0 +1,214 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+)
+
+// the same exchange can run on more than one anarchy server at once
+// every listing is on exactly one server, and every bot reports which server it's connected to in its status packet
+
+type Server struct {
+	ServerIP    string
+	DisplayName string
+	Enabled     bool
+	Listings    int // how many listings there are on this server
+	OnlineBots  int // how many bots are connected to it with a fresh status right now
+}
+
+type ServersPageTemplate struct {
+	Profile *User
+	Servers []Server
+}
+
+type ServerPageTemplate struct {
+	Navigation  Navigation
+	Profile     *User
+	Server      Server
+	BotStatuses []BotStatus
+}
+
+// bots report whatever they typed into the multiplayer menu, so "2B2T.org:25565" and "2b2t.org" are the same server
+func normalizeServerIP(ip string) string {
+	ip = strings.ToLower(strings.TrimSpace(ip))
+	ip = strings.TrimSuffix(ip, ":25565") // default minecraft port
+	ip = strings.TrimSuffix(ip, ".")      // fully qualified domain name
+	return ip
+}
+
+func createInitialServers() {
+	err := RunSQL(func(sql *sql.Tx) error {
+		_, err := sql.Exec("INSERT OR IGNORE INTO servers (server_ip, display_name) VALUES (?, ?)", "2b2t.org", "2b2t")
+		if err != nil {
+			return err
+		}
+		// any server that some listing is already on has to exist
+		_, err = sql.Exec("INSERT OR IGNORE INTO servers (server_ip, display_name) SELECT DISTINCT server, server FROM listings")
+		return err
+	})
+	if err != nil {
+		panic(err)
+	}
+}
+
+// is this a server we run the exchange on right now
+func isServerEnabled(server string) bool {
+	var enabled bool
+	err := RunReadSQL(func(sql *sql.Tx) error {
+		return sql.QueryRow("SELECT enabled FROM servers WHERE server_ip = ?", server).Scan(&enabled)
+	})
+	if err != nil {
+		if err != ErrNoRows {
+			dbLog.Error("Unable to check server", "server", server, "err", err)
+		}
+		return false
+	}
+	return enabled
+}
+
+// can only be called within the context of a sql transaction
+func checkServerEnabled(sql *sql.Tx, server string) error {
+	var enabled bool
+	err := sql.QueryRow("SELECT enabled FROM servers WHERE server_ip = ?", server).Scan(&enabled)
+	if err == ErrNoRows {
+		return errors.New("The exchange doesn't run on " + server)
+	}
+	if err != nil {
+		return err
+	}
+	if !enabled {
+		return errors.New("The exchange is currently disabled on " + server)
+	}
+	return nil
+}
+
+// every connected bot with a fresh status, grouped by which server it's on
+func botPools() map[string][]*Bot {
+	botsLock.Lock()
+	defer botsLock.Unlock()
+	pools := make(map[string][]*Bot)
+	for _, bot := range bots {
+		if !bot.hasReceivedStatusUpdateInTheLastFiveSeconds() {
+			continue
+		}
+		pools[bot.latestStatus.ServerIP] = append(pools[bot.latestStatus.ServerIP], bot)
+	}
+	return pools
+}
+
+func getServers(sql *sql.Tx) ([]Server, error) {
+	rows, err := sql.Query("SELECT servers.server_ip, servers.display_name, servers.enabled, COUNT(listings.listing_id) FROM servers LEFT OUTER JOIN listings ON listings.server = servers.server_ip GROUP BY servers.server_ip ORDER BY servers.server_ip")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]Server, 0)
+	for rows.Next() {
+		var server Server
+		err = rows.Scan(&server.ServerIP, &server.DisplayName, &server.Enabled, &server.Listings)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, server)
+	}
+	return result, rows.Err()
+}
+
+func getServersWithBots(ctx context.Context) ([]Server, error) {
+	var servers []Server
+	err := RunReadSQLContext(ctx, func(sql *sql.Tx) error {
+		var err error
+		servers, err = getServers(sql)
+		return err
+	})
+	if err != nil {
+		return nil, err
+	}
+	pools := botPools()
+	for i := range servers {
+		servers[i].OnlineBots = len(pools[servers[i].ServerIP])
+	}
+	return servers, nil
+}
+
+func createServer(ctx context.Context, admin_id int64, server string, displayName string, reason string) error {
+	server = normalizeServerIP(server)
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		_, err := sql.Exec("INSERT INTO servers (server_ip, display_name) VALUES (?, ?)", server, displayName)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "create_server", 0, "added server "+server+" as "+displayName, reason)
+	})
+}
+
+// a disabled server's bots are ignored, and its listings can't be traded, deposited into or withdrawn from
+func setServerEnabled(ctx context.Context, admin_id int64, server string, enabled bool, reason string) error {
+	server = normalizeServerIP(server) // the same as createServer stored it
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		res, err := sql.Exec("UPDATE servers SET enabled = ? WHERE server_ip = ?", enabled, server)
+		if err != nil {
+			return err
+		}
+		n, err := res.RowsAffected()
+		if err != nil {
+			return err
+		}
+		if n != 1 {
+			return errors.New("No such server")
+		}
+		return writeAdminLog(sql, admin_id, "enable_server", 0, "set enabled of server "+server+" to "+strconv.FormatBool(enabled), reason)
+	})
+}
+
+func handleServersPage(w http.ResponseWriter, r *http.Request) {
+	servers, err := getServersWithBots(r.Context())
+	if err != nil {
+		http.Error(w, "Unable to load servers. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := &ServersPageTemplate{
+		Profile: getUser(r),
+		Servers: servers,
+	}
+	err = templates.ExecuteTemplate(w, "servers.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the servers page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleServerPage(w http.ResponseWriter, r *http.Request) {
+	serverIP := normalizeServerIP(r.URL.Query().Get(":server"))
+	servers, err := getServersWithBots(r.Context())
+	if err != nil {
+		http.Error(w, "Unable to load servers. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := &ServerPageTemplate{
+		Navigation:  generateNavigation(r.Context(), serverIP),
+		Profile:     getUser(r),
+		BotStatuses: make([]BotStatus, 0),
+	}
+	found := false
+	for _, server := range servers {
+		if server.ServerIP == serverIP {
+			data.Server = server
+			found = true
+		}
+	}
+	if !found {
+		http.Error(w, "The exchange doesn't run on that server", http.StatusNotFound)
+		return
+	}
+	for _, bot := range botPools()[serverIP] {
+		data.BotStatuses = append(data.BotStatuses, *bot.status())
+	}
+	err = templates.ExecuteTemplate(w, "server.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the server page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
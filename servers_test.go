@@ -0,0 +1,126 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"testing"
+)
+
+func TestNormalizeServerIP(t *testing.T) {
+	for _, ip := range []string{"2b2t.org", "2B2T.ORG", " 2b2t.org:25565", "2b2t.org."} {
+		if normalizeServerIP(ip) != "2b2t.org" {
+			t.Errorf("%q normalized to %q", ip, normalizeServerIP(ip))
+		}
+	}
+	if normalizeServerIP("2b2t.org:25566") == "2b2t.org" {
+		t.Errorf("Non default port was stripped")
+	}
+}
+
+func TestDisabledServer(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		if !isServerEnabled("2b2t.org") {
+			t.Fatal("2b2t isn't enabled by default")
+		}
+		if isServerEnabled("9b9t.com") {
+			t.Errorf("Unknown server is enabled")
+		}
+		_, err := createListing(ctx, 42, "9b9t.com", "tile.obsidian;0", "obsidian", "/static/obsidian.png", "", "no such server")
+		if err == nil {
+			t.Errorf("Created a listing on a server the exchange doesn't run on")
+		}
+		err = createServer(ctx, 42, "9B9T.com:25565", "9b9t", "expanding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		obsidian, err := createListing(ctx, 42, "9b9t.com", "tile.obsidian;0", "obsidian", "/static/obsidian.png", "", "first listing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = setServerEnabled(ctx, 42, " 2B2T.org:25565", false, "queue is down")
+		if err != nil {
+			t.Fatal("Should find the server however the admin typed it", err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM admin_audit_log WHERE detail = 'set enabled of server 2b2t.org to false'") != 1 {
+			t.Errorf("Audit log should have the server as it's stored")
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			if createBuyOrder(sql, 2, 3, 3, 1) == nil {
+				t.Errorf("Was able to place a buy order on a disabled server")
+			}
+			return createBuyOrder(sql, 2, obsidian, 3, 1)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		for _, info := range generateNavigation(ctx, "9b9t.com") {
+			if info.ItemInfo.Server != "9b9t.com" {
+				t.Errorf("Listing %d from %s is in the 9b9t navigation", info.ItemInfo.ListingID, info.ItemInfo.Server)
+			}
+		}
+		if len(generateNavigation(ctx, "9b9t.com")) != 1 {
+			t.Errorf("Obsidian isn't in the 9b9t navigation")
+		}
+	})
+}
+
+func TestForceSellSkipsDisabledServers(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := createServer(ctx, 42, "9b9t.com", "9b9t", "expanding")
+		if err != nil {
+			t.Fatal(err)
+		}
+		obsidian, err := createListing(ctx, 42, "9b9t.com", "tile.obsidian;0", "obsidian", "/static/obsidian.png", "", "first listing")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			// user 1's 2b2t slot has been waiting to be force sold the longest, so it's the first one the job looks at
+			_, err := sql.Exec("UPDATE slots SET locked = 1, sale_price = NULL, for_sale_since = NULL, expiry_time = ? WHERE user_id = 1", unixNow()-100)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("UPDATE slots SET expiry_time = ? WHERE user_id = 2", unixNow()-100)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id, locked, expiry_time) VALUES (2, 4, ?, 1, ?); INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (8, ?, ?, 6)", obsidian, unixNow()-50, obsidian, testBotUUID)
+			if err != nil {
+				return err
+			}
+			return verifyStorage(sql)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = setServerEnabled(ctx, 42, "2b2t.org", false, "queue is down")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		_, err = checkSlotExpiries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE listing_id = ? AND sale_price = 0", obsidian) != 1 {
+			t.Error("Expired slot on 9b9t should have been force sold even though 2b2t is disabled")
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND sale_price IS NULL") != 1 || countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 2 AND slot_index = 3 AND locked = 0") != 1 {
+			t.Error("Nothing on the disabled server should be locked or force sold")
+		}
+	})
+}
+
+func TestServerTemplatesRender(t *testing.T) {
+	server := Server{ServerIP: "2b2t.org", DisplayName: "2b2t", Enabled: true, Listings: 3, OnlineBots: 1}
+	err := templates.ExecuteTemplate(ioutil.Discard, "servers.html", &ServersPageTemplate{Servers: []Server{server}})
+	if err != nil {
+		t.Error(err)
+	}
+	err = templates.ExecuteTemplate(ioutil.Discard, "server.html", &ServerPageTemplate{Server: server, BotStatuses: []BotStatus{{}}})
+	if err != nil {
+		t.Error(err)
+	}
+}
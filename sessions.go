@@ -0,0 +1,342 @@
+package main
+
+import (
+	"context"
+	cryptorand "crypto/rand"
+	"crypto/sha256"
+	"database/sql"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+	"time"
+
+	"github.com/gorilla/pat"
+)
+
+// a login is a row in sessions, and the cookie is only a random token that finds it
+// so anyone can see where they're logged in and end any of those sessions, and so can admins, which a signed cookie could never do
+// the table has the sha256 of the token and not the token itself, so a copy of the database (or a backup) can't be used to log in as anyone
+
+const SessionTokenBytes = 32
+const SessionTouchInterval = 5 * time.Minute // last_seen is only written this often, otherwise every page view would be a write
+const MaxUserAgentLength = 256
+
+type Session struct {
+	SessionID int64
+	UserID    int64
+	UserAgent string
+	IP        string
+	CreatedAt int64
+	LastSeen  int64
+	Current   bool // the one the request came in on
+}
+
+type SessionsPageTemplate struct {
+	Profile  *User
+	Sessions []Session
+}
+
+func setupSessions(p *pat.Router) {
+	p.Post("/sessions/logout_all", rateLimited(RateClassOrders, handleLogoutEverywhere))
+	p.Post("/sessions/{session}/logout", rateLimited(RateClassOrders, handleLogoutSession))
+	p.Get("/sessions", rateLimited(RateClassPages, handleSessionsPage))
+}
+
+func hashSessionToken(token string) string {
+	sum := sha256.Sum256([]byte(token))
+	return hex.EncodeToString(sum[:])
+}
+
+func sessionLifetime() time.Duration {
+	return time.Duration(config.SessionLifetimeDays) * 24 * time.Hour
+}
+
+func cookieSameSite() http.SameSite {
+	switch config.CookieSameSite {
+	case "strict":
+		return http.SameSiteStrictMode
+	case "none":
+		return http.SameSiteNoneMode
+	}
+	return http.SameSiteLaxMode
+}
+
+// maxAge < 0 deletes the cookie
+func setSessionCookie(w http.ResponseWriter, token string, maxAge int) {
+	http.SetCookie(w, &http.Cookie{
+		Name:     OurCookieName,
+		Value:    token,
+		Path:     "/",
+		MaxAge:   maxAge,
+		HttpOnly: config.CookieHTTPOnly,
+		Secure:   config.CookieSecure,
+		SameSite: cookieSameSite(),
+	})
+}
+
+// called once discord has told us who they are
+func createSession(ctx context.Context, w http.ResponseWriter, r *http.Request, user *User) error {
+	b := make([]byte, SessionTokenBytes)
+	_, err := cryptorand.Read(b)
+	if err != nil {
+		return err
+	}
+	token := base64.RawURLEncoding.EncodeToString(b)
+	userAgent := r.UserAgent()
+	if len(userAgent) > MaxUserAgentLength {
+		userAgent = userAgent[:MaxUserAgentLength]
+	}
+	now := unixNow()
+	err = RunSQLContext(ctx, func(sql *sql.Tx) error {
+		_, err := sql.Exec("INSERT INTO sessions (token_hash, user_id, name, avatar_url, user_agent, ip, created_at, last_seen) VALUES (?, ?, ?, ?, ?, ?, ?, ?)", hashSessionToken(token), user.UserID, user.Name, user.AvatarURL, userAgent, clientIP(r), now, now)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	setSessionCookie(w, token, int(sessionLifetime().Seconds()))
+	return nil
+}
+
+// the session and user for the cookie on this request, nil if there isn't one or it's been logged out or expired
+func getSession(r *http.Request) (*Session, *User) {
+	cookie, err := r.Cookie(OurCookieName)
+	if err != nil || cookie.Value == "" {
+		return nil, nil
+	}
+	session := &Session{Current: true}
+	user := &User{}
+	err = RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
+		return sql.QueryRow("SELECT sessions.session_id, sessions.user_id, sessions.name, sessions.avatar_url, sessions.user_agent, sessions.ip, sessions.created_at, sessions.last_seen, COALESCE(user_suspensions.reason, '') FROM sessions LEFT OUTER JOIN user_suspensions ON user_suspensions.user_id = sessions.user_id WHERE sessions.token_hash = ? AND sessions.created_at > ?", hashSessionToken(cookie.Value), unixNow()-int64(sessionLifetime().Seconds())).Scan(&session.SessionID, &session.UserID, &user.Name, &user.AvatarURL, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeen, &user.Suspension)
+	})
+	if err != nil {
+		if err != ErrNoRows {
+			requestLogger(r, httpLog).Error("Unable to look up session", "err", err)
+		}
+		return nil, nil
+	}
+	user.UserID = session.UserID
+	if unixNow()-session.LastSeen >= int64(SessionTouchInterval.Seconds()) {
+		session.LastSeen = unixNow()
+		session.IP = clientIP(r)
+		err = RunSQLContext(r.Context(), func(sql *sql.Tx) error {
+			_, err := sql.Exec("UPDATE sessions SET last_seen = ?, ip = ? WHERE session_id = ?", session.LastSeen, session.IP, session.SessionID)
+			return err
+		})
+		if err != nil {
+			requestLogger(r, httpLog).Warn("Unable to update session last seen", "session", session.SessionID, "err", err)
+		}
+	}
+	return session, user
+}
+
+func getSessions(sql *sql.Tx, user_id int64) ([]Session, error) {
+	rows, err := sql.Query("SELECT session_id, user_id, user_agent, ip, created_at, last_seen FROM sessions WHERE user_id = ? AND created_at > ? ORDER BY last_seen DESC", user_id, unixNow()-int64(sessionLifetime().Seconds()))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]Session, 0)
+	for rows.Next() {
+		var session Session
+		err = rows.Scan(&session.SessionID, &session.UserID, &session.UserAgent, &session.IP, &session.CreatedAt, &session.LastSeen)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, session)
+	}
+	return result, rows.Err()
+}
+
+// session_id 0 means every one of their sessions
+func deleteSessions(sql *sql.Tx, user_id int64, session_id int64) (int64, error) {
+	query := "DELETE FROM sessions WHERE user_id = ?"
+	args := []interface{}{user_id}
+	if session_id != 0 {
+		query += " AND session_id = ?"
+		args = append(args, session_id)
+	}
+	result, err := sql.Exec(query, args...)
+	if err != nil {
+		return 0, err
+	}
+	return result.RowsAffected()
+}
+
+// a rough "Firefox on Windows" from the user agent, for telling sessions apart
+func (s Session) Device() string {
+	ua := s.UserAgent
+	browser := ""
+	for _, b := range []struct{ token, name string }{
+		{"Edg/", "Edge"}, {"OPR/", "Opera"}, {"Firefox/", "Firefox"}, {"Chrome/", "Chrome"}, {"Safari/", "Safari"},
+	} {
+		if strings.Contains(ua, b.token) {
+			browser = b.name
+			break
+		}
+	}
+	system := ""
+	for _, o := range []struct{ token, name string }{
+		{"Android", "Android"}, {"iPhone", "iPhone"}, {"iPad", "iPad"}, {"Windows", "Windows"}, {"Mac OS X", "macOS"}, {"Linux", "Linux"},
+	} {
+		if strings.Contains(ua, o.token) {
+			system = o.name
+			break
+		}
+	}
+	switch {
+	case browser != "" && system != "":
+		return browser + " on " + system
+	case browser != "" || system != "":
+		return browser + system
+	case ua == "":
+		return "unknown device"
+	}
+	return ua
+}
+
+func (s Session) LastSeenTime() time.Time {
+	return time.Unix(s.LastSeen, 0).UTC()
+}
+
+func (s Session) CreatedTime() time.Time {
+	return time.Unix(s.CreatedAt, 0).UTC()
+}
+
+// the session cleanup job, expired sessions can't be used anyway so there's no point keeping them
+func cleanupSessions() (int64, error) {
+	var deleted int64
+	err := RunSQL(func(sql *sql.Tx) error {
+		result, err := sql.Exec("DELETE FROM sessions WHERE created_at <= ?", unixNow()-int64(sessionLifetime().Seconds()))
+		if err != nil {
+			return err
+		}
+		deleted, err = result.RowsAffected()
+		return err
+	})
+	return deleted, err
+}
+
+func handleLogout(w http.ResponseWriter, r *http.Request) {
+	session, user := getSession(r)
+	if session != nil {
+		err := RunSQLContext(r.Context(), func(sql *sql.Tx) error {
+			_, err := deleteSessions(sql, user.UserID, session.SessionID)
+			return err
+		})
+		if err != nil {
+			http.Error(w, "Unable to log out. "+err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	setSessionCookie(w, "", -1)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+func handleSessionsPage(w http.ResponseWriter, r *http.Request) {
+	current, user := getSession(r)
+	if user == nil {
+		http.Redirect(w, r, "/auth/discord", http.StatusFound)
+		return
+	}
+	data := &SessionsPageTemplate{Profile: user}
+	err := RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
+		var err error
+		data.Sessions, err = getSessions(sql, user.UserID)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Unable to load your sessions. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	for i := range data.Sessions {
+		data.Sessions[i].Current = data.Sessions[i].SessionID == current.SessionID
+	}
+	err = templates.ExecuteTemplate(w, "sessions.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the sessions page template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
+
+func handleLogoutSession(w http.ResponseWriter, r *http.Request) {
+	current, user := getSession(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to do that", http.StatusForbidden)
+		return
+	}
+	session_id, err := strconv.ParseInt(r.URL.Query().Get(":session"), 10, 64)
+	if err != nil || session_id <= 0 {
+		http.Error(w, "Invalid session", http.StatusBadRequest)
+		return
+	}
+	err = RunSQLContext(r.Context(), func(sql *sql.Tx) error {
+		deleted, err := deleteSessions(sql, user.UserID, session_id)
+		if err == nil && deleted == 0 {
+			err = errors.New("No such session")
+		}
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Unable to log out that session. "+err.Error(), http.StatusBadRequest)
+		return
+	}
+	if session_id == current.SessionID {
+		setSessionCookie(w, "", -1)
+		http.Redirect(w, r, "/", http.StatusFound)
+		return
+	}
+	http.Redirect(w, r, "/sessions", http.StatusFound)
+}
+
+func handleLogoutEverywhere(w http.ResponseWriter, r *http.Request) {
+	_, user := getSession(r)
+	if user == nil {
+		http.Error(w, "You must be logged in to do that", http.StatusForbidden)
+		return
+	}
+	err := RunSQLContext(r.Context(), func(sql *sql.Tx) error {
+		_, err := deleteSessions(sql, user.UserID, 0)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Unable to log out everywhere. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	setSessionCookie(w, "", -1)
+	http.Redirect(w, r, "/", http.StatusFound)
+}
+
+// session_id 0 revokes every session they have
+func adminRevokeSessions(ctx context.Context, admin_id int64, user_id int64, session_id int64, reason string) error {
+	return RunSQLContext(ctx, func(sql *sql.Tx) error {
+		deleted, err := deleteSessions(sql, user_id, session_id)
+		if err != nil {
+			return err
+		}
+		if deleted == 0 {
+			return errors.New("No such session")
+		}
+		detail := "revoked session " + strconv.FormatInt(session_id, 10)
+		if session_id == 0 {
+			detail = "revoked all " + strconv.FormatInt(deleted, 10) + " sessions"
+		}
+		return writeAdminLog(sql, admin_id, "revoke_sessions", user_id, detail, reason)
+	})
+}
+
+func handleAdminRevokeSessions(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		session_id := int64(0)
+		if r.FormValue("session") != "all" {
+			var err error
+			session_id, err = strconv.ParseInt(r.FormValue("session"), 10, 64)
+			if err != nil || session_id <= 0 {
+				return errors.New("Invalid session")
+			}
+		}
+		return adminRevokeSessions(r.Context(), admin.UserID, user_id, session_id, reason)
+	})
+}
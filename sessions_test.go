@@ -0,0 +1,152 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func sessionIDs(t *testing.T, user_id int64) []int64 {
+	var ids []int64
+	err := RunSQL(func(sql *sql.Tx) error {
+		sessions, err := getSessions(sql, user_id)
+		for _, s := range sessions {
+			ids = append(ids, s.SessionID)
+		}
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ids
+}
+
+func loggedIn(t *testing.T, site *testSite, client *http.Client) bool {
+	status, _ := site.get(t, client, "/sessions")
+	return status == http.StatusOK
+}
+
+func TestSessionCookie(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		site.discord.members[1] = true
+		resp, err := site.client(t).Get(site.server.URL + "/auth/discord/callback?user=1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		cookies := resp.Cookies()
+		if len(cookies) != 1 || cookies[0].Name != OurCookieName || !cookies[0].HttpOnly || cookies[0].SameSite != http.SameSiteLaxMode || cookies[0].Secure {
+			t.Fatal("Wrong session cookie for the dev config", resp.Header["Set-Cookie"])
+		}
+		if countRows(t, "SELECT COUNT(*) FROM sessions WHERE user_id = 1 AND token_hash = '"+hashSessionToken(cookies[0].Value)+"'") != 1 {
+			t.Error("Session should be stored by the hash of its token")
+		}
+		if countRows(t, "SELECT COUNT(*) FROM sessions WHERE token_hash = '"+cookies[0].Value+"'") != 0 {
+			t.Error("The token itself shouldn't be in the database")
+		}
+	})
+}
+
+// the session_id of the cookie client is logged in with
+func sessionOf(t *testing.T, site *testSite, client *http.Client) int64 {
+	u, _ := url.Parse(site.server.URL)
+	for _, cookie := range client.Jar.Cookies(u) {
+		if cookie.Name == OurCookieName {
+			var session_id int64
+			err := RunSQL(func(sql *sql.Tx) error {
+				return sql.QueryRow("SELECT session_id FROM sessions WHERE token_hash = ?", hashSessionToken(cookie.Value)).Scan(&session_id)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			return session_id
+		}
+	}
+	t.Fatal("No session cookie")
+	return 0
+}
+
+func TestSessionRevocation(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		laptop := site.login(t, 1)
+		phone := site.login(t, 1)
+		other := site.login(t, 2)
+		if len(sessionIDs(t, 1)) != 2 {
+			t.Fatal("Both logins should have their own session", sessionIDs(t, 1))
+		}
+		status, body := site.get(t, laptop, "/sessions")
+		if status != http.StatusOK || strings.Count(body, "(this one)") != 1 || strings.Count(body, "/logout\"") != 2 {
+			t.Error("Sessions page should list both sessions and mark this one", status, body)
+		}
+
+		site.act(t, laptop, "/sessions/"+strconv.FormatInt(sessionOf(t, site, phone), 10)+"/logout", nil)
+		if loggedIn(t, site, phone) || !loggedIn(t, site, laptop) {
+			t.Error("Only the phone should have been logged out")
+		}
+		if status, _ := site.post(t, other, "/sessions/"+strconv.FormatInt(sessionOf(t, site, laptop), 10)+"/logout", nil); status != http.StatusBadRequest {
+			t.Error("Shouldn't be able to log out someone else's session", status)
+		}
+
+		site.login(t, 1)
+		site.act(t, laptop, "/sessions/logout_all", nil)
+		if len(sessionIDs(t, 1)) != 0 || loggedIn(t, site, laptop) {
+			t.Error("Logging out everywhere should end every session")
+		}
+		if !loggedIn(t, site, other) {
+			t.Error("Someone else's session shouldn't be touched")
+		}
+
+		if adminRevokeSessions(ctx, 42, 2, 0, "") == nil {
+			t.Error("Admins need a reason")
+		}
+		err := adminRevokeSessions(ctx, 42, 2, 0, "account compromised")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if loggedIn(t, site, other) || countRows(t, "SELECT COUNT(*) FROM admin_audit_log WHERE action = 'revoke_sessions' AND user_id = 2") != 1 {
+			t.Error("Admin should have revoked and audited it")
+		}
+		if adminRevokeSessions(ctx, 42, 2, 0, "again") == nil {
+			t.Error("There's nothing left to revoke")
+		}
+	})
+}
+
+func TestSessionExpiry(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		client := site.login(t, 1)
+		site.clock.Advance(time.Hour)
+		if !loggedIn(t, site, client) {
+			t.Fatal("Session should still be good")
+		}
+		if countRows(t, "SELECT COUNT(*) FROM sessions WHERE last_seen = "+strconv.FormatInt(unixNow(), 10)) != 1 {
+			t.Error("Last seen should have been updated")
+		}
+		site.clock.Advance(sessionLifetime())
+		if loggedIn(t, site, client) {
+			t.Error("Session should have expired")
+		}
+		deleted, err := cleanupSessions()
+		if err != nil || deleted != 1 {
+			t.Error("Cleanup should delete the expired session", deleted, err)
+		}
+	})
+}
+
+func TestSessionDevice(t *testing.T) {
+	for ua, expected := range map[string]string{
+		"Mozilla/5.0 (Windows NT 10.0; Win64; x64; rv:65.0) Gecko/20100101 Firefox/65.0":                                            "Firefox on Windows",
+		"Mozilla/5.0 (Macintosh; Intel Mac OS X 10_14_3) AppleWebKit/537.36 (KHTML, like Gecko) Chrome/72.0.3626.96 Safari/537.36":  "Chrome on macOS",
+		"Mozilla/5.0 (iPhone; CPU iPhone OS 12_1 like Mac OS X) AppleWebKit/605.1.15 (KHTML, like Gecko) Version/12.0 Safari/604.1": "Safari on iPhone",
+		"Go-http-client/1.1": "Go-http-client/1.1",
+		"":                   "unknown device",
+	} {
+		if device := (Session{UserAgent: ua}).Device(); device != expected {
+			t.Errorf("%q should be %q, got %q", ua, expected, device)
+		}
+	}
+}
@@ -0,0 +1,430 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"strconv"
+	"strings"
+)
+
+// how bots describe the contents of a shulker:
+// every slot is "translationkey;damage;count;nbt", and the slots are separated by commas
+// e.g. "item.appleGold;1;64;,item.totem;0;1;,item.swordDiamond;0;1;{ench:[{lvl:5s,id:16s}]}"
+// the nbt can have commas and semicolons of its own, so it can't just be split on them
+
+type ItemStack struct {
+	Item  string // translation key semicolon damage value, like "item.appleGold;1"
+	Count int
+	NBT   string // empty if the item has none
+}
+
+// a ShulkerTemplate describes what a listing will accept, for listings that aren't just "27 full stacks of one thing"
+// every stack in the shulker has to match one of the rules, and every rule's total has to be in range
+type ShulkerTemplate struct {
+	Rules []TemplateRule `json:"rules"`
+}
+
+type TemplateRule struct {
+	Item     string `json:"item"`      // translation key semicolon damage value, like "item.totem;0"
+	MinCount int    `json:"min_count"` // there have to be at least this many in total across the whole shulker
+	MaxCount int    `json:"max_count"` // and at most this many, 0 means no limit
+	PerSlot  int    `json:"per_slot"`  // every stack has to be exactly this big, like 1 for totems. 0 means any size
+	NBT      string `json:"nbt"`       // enchantments the item has to have, like "{lvl:5s,id:16s}" or "{lvl:5s,id:16s},{lvl:3s,id:34s}". empty means the item must have NO nbt
+}
+
+func splitOutsideNBT(str string, sep byte) []string {
+	result := make([]string, 0)
+	depth := 0
+	inString := false
+	start := 0
+	for i := 0; i < len(str); i++ {
+		c := str[i]
+		switch {
+		case inString:
+			if c == '\\' {
+				i++ // skip whatever is escaped
+			} else if c == '"' {
+				inString = false
+			}
+		case c == '"':
+			inString = true
+		case c == '{' || c == '[':
+			depth++
+		case c == '}' || c == ']':
+			depth--
+		case c == sep && depth == 0:
+			result = append(result, str[start:i])
+			start = i + 1
+		}
+	}
+	return append(result, str[start:])
+}
+
+// parses the contents of a shulker, skipping empty slots
+func parseShulkerContents(contents string) ([]ItemStack, error) {
+	result := make([]ItemStack, 0)
+	for _, entry := range splitOutsideNBT(contents, ',') {
+		if entry == "" || entry == "empty" {
+			continue
+		}
+		fields := splitOutsideNBT(entry, ';')
+		if len(fields) < 3 {
+			return nil, errors.New("Unable to parse shulker slot " + entry)
+		}
+		count, err := strconv.Atoi(fields[2])
+		if err != nil {
+			return nil, err
+		}
+		if count <= 0 {
+			continue // minecraft's way of saying empty
+		}
+		stack := ItemStack{
+			Item:  fields[0] + ";" + fields[1],
+			Count: count,
+		}
+		if len(fields) > 3 {
+			stack.NBT = strings.Join(fields[3:], ";")
+		}
+		result = append(result, stack)
+	}
+	return result, nil
+}
+
+func parseShulkerTemplate(str string) (*ShulkerTemplate, error) {
+	var template ShulkerTemplate
+	err := json.Unmarshal([]byte(str), &template)
+	if err != nil {
+		return nil, err
+	}
+	err = template.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return &template, nil
+}
+
+func (template ShulkerTemplate) Validate() error {
+	if len(template.Rules) == 0 {
+		return errors.New("A template needs at least one rule")
+	}
+	minimumSlots := 0
+	for _, rule := range template.Rules {
+		if strings.Count(rule.Item, ";") != 1 {
+			return errors.New("Template item " + rule.Item + " should be a translation key and damage value, like item.totem;0")
+		}
+		if rule.MinCount <= 0 {
+			return errors.New("Template item " + rule.Item + " needs a minimum count, otherwise an empty shulker would be accepted")
+		}
+		if rule.MaxCount != 0 && rule.MaxCount < rule.MinCount {
+			return errors.New("Template item " + rule.Item + " has a max count below its min count")
+		}
+		if rule.PerSlot < 0 || rule.PerSlot > 64 {
+			return errors.New("Template item " + rule.Item + " has an impossible stack size")
+		}
+		if rule.NBT != "" {
+			_, err := rule.enchantments()
+			if err != nil {
+				return errors.New("Template item " + rule.Item + " should list enchantments like {lvl:5s,id:16s}: " + err.Error())
+			}
+		}
+		perSlot := rule.PerSlot
+		if perSlot == 0 {
+			perSlot = 64
+		}
+		minimumSlots += (rule.MinCount + perSlot - 1) / perSlot
+	}
+	if minimumSlots > 27 {
+		return errors.New("That template can't fit in one shulker")
+	}
+	return nil
+}
+
+func (template ShulkerTemplate) String() string {
+	data, err := json.Marshal(template)
+	if err != nil {
+		panic(err) // can't happen, it's just strings and ints
+	}
+	return string(data)
+}
+
+func (rule TemplateRule) accepts(stack ItemStack) bool {
+	if stack.Item != rule.Item {
+		return false
+	}
+	if rule.PerSlot != 0 && stack.Count != rule.PerSlot {
+		return false
+	}
+	if rule.NBT == "" {
+		return stack.NBT == ""
+	}
+	want, err := rule.enchantments()
+	if err != nil {
+		return false
+	}
+	have, err := stackEnchantments(stack.NBT)
+	if err != nil {
+		return false
+	}
+	for _, w := range want {
+		found := false
+		for _, h := range have {
+			if h == w {
+				found = true
+				break
+			}
+		}
+		if !found {
+			return false
+		}
+	}
+	return true
+}
+
+// an enchantment is compared by its id and level and nothing else, and never by looking for text in the raw nbt
+// anyone with an anvil can put "{lvl:5s,id:16s}" in an item's display name
+type Enchantment struct {
+	ID  string
+	Lvl string
+}
+
+func (rule TemplateRule) enchantments() ([]Enchantment, error) {
+	list, err := parseSNBT("[" + rule.NBT + "]")
+	if err != nil {
+		return nil, err
+	}
+	return enchantmentList(list)
+}
+
+// only the ench (enchanted items) and StoredEnchantments (enchanted books) lists at the top of the item's nbt count
+// so display, lore and anything nested somewhere else is ignored
+func stackEnchantments(nbt string) ([]Enchantment, error) {
+	result := make([]Enchantment, 0)
+	if nbt == "" {
+		return result, nil
+	}
+	parsed, err := parseSNBT(nbt)
+	if err != nil {
+		return nil, err
+	}
+	compound, ok := parsed.(map[string]interface{})
+	if !ok {
+		return nil, errors.New("Item nbt isn't a compound")
+	}
+	for _, key := range []string{"ench", "StoredEnchantments"} {
+		list, ok := compound[key]
+		if !ok {
+			continue
+		}
+		enchantments, err := enchantmentList(list)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, enchantments...)
+	}
+	return result, nil
+}
+
+func enchantmentList(value interface{}) ([]Enchantment, error) {
+	list, ok := value.([]interface{})
+	if !ok {
+		return nil, errors.New("Enchantments aren't a list")
+	}
+	result := make([]Enchantment, 0, len(list))
+	for _, entry := range list {
+		compound, ok := entry.(map[string]interface{})
+		if !ok {
+			return nil, errors.New("Enchantment isn't a compound")
+		}
+		id, ok1 := compound["id"].(string)
+		lvl, ok2 := compound["lvl"].(string)
+		if !ok1 || !ok2 {
+			return nil, errors.New("Enchantment needs an id and a lvl")
+		}
+		result = append(result, Enchantment{ID: snbtNumber(id), Lvl: snbtNumber(lvl)})
+	}
+	return result, nil
+}
+
+// 16s, 16S and 16 are all the same number, whatever type suffix the bot's nbt printer put on it
+func snbtNumber(str string) string {
+	trimmed := strings.TrimRight(str, "bBsSlLiI")
+	n, err := strconv.ParseInt(trimmed, 10, 64)
+	if err != nil {
+		return str
+	}
+	return strconv.FormatInt(n, 10)
+}
+
+// a small parser for the stringified nbt that bots send, like {ench:[{lvl:5s,id:16s}],display:{Name:"Sword"}}
+// compounds become map[string]interface{}, lists (and typed arrays like [I;1,2]) become []interface{}, and everything else is left as a string
+// quoted strings are unquoted, so a name can never be mistaken for anything but a string
+func parseSNBT(str string) (interface{}, error) {
+	p := &snbtParser{str: str}
+	value, err := p.value()
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos != len(p.str) {
+		return nil, errors.New("Unexpected " + strconv.Quote(p.str[p.pos:]) + " after nbt")
+	}
+	return value, nil
+}
+
+type snbtParser struct {
+	str string
+	pos int
+}
+
+func (p *snbtParser) skipSpace() {
+	for p.pos < len(p.str) && (p.str[p.pos] == ' ' || p.str[p.pos] == '\n' || p.str[p.pos] == '\t') {
+		p.pos++
+	}
+}
+
+func (p *snbtParser) expect(c byte) error {
+	p.skipSpace()
+	if p.pos >= len(p.str) || p.str[p.pos] != c {
+		return errors.New("Expected " + string(c) + " at " + strconv.Itoa(p.pos) + " of nbt")
+	}
+	p.pos++
+	return nil
+}
+
+func (p *snbtParser) value() (interface{}, error) {
+	p.skipSpace()
+	if p.pos >= len(p.str) {
+		return nil, errors.New("Nbt ended early")
+	}
+	switch p.str[p.pos] {
+	case '{':
+		return p.compound()
+	case '[':
+		return p.list()
+	}
+	return p.scalar()
+}
+
+func (p *snbtParser) compound() (interface{}, error) {
+	result := make(map[string]interface{})
+	err := p.expect('{')
+	if err != nil {
+		return nil, err
+	}
+	p.skipSpace()
+	if p.pos < len(p.str) && p.str[p.pos] == '}' {
+		p.pos++
+		return result, nil
+	}
+	for {
+		key, err := p.scalar()
+		if err != nil {
+			return nil, err
+		}
+		err = p.expect(':')
+		if err != nil {
+			return nil, err
+		}
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		result[key] = value
+		p.skipSpace()
+		if p.pos < len(p.str) && p.str[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		return result, p.expect('}')
+	}
+}
+
+func (p *snbtParser) list() (interface{}, error) {
+	result := make([]interface{}, 0)
+	err := p.expect('[')
+	if err != nil {
+		return nil, err
+	}
+	// typed arrays like [I;1,2,3] just lose their type
+	if p.pos+1 < len(p.str) && p.str[p.pos+1] == ';' {
+		p.pos += 2
+	}
+	p.skipSpace()
+	if p.pos < len(p.str) && p.str[p.pos] == ']' {
+		p.pos++
+		return result, nil
+	}
+	for {
+		value, err := p.value()
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, value)
+		p.skipSpace()
+		if p.pos < len(p.str) && p.str[p.pos] == ',' {
+			p.pos++
+			continue
+		}
+		return result, p.expect(']')
+	}
+}
+
+func (p *snbtParser) scalar() (string, error) {
+	p.skipSpace()
+	if p.pos < len(p.str) && (p.str[p.pos] == '"' || p.str[p.pos] == '\'') {
+		quote := p.str[p.pos]
+		var b strings.Builder
+		for p.pos++; p.pos < len(p.str); p.pos++ {
+			c := p.str[p.pos]
+			if c == '\\' && p.pos+1 < len(p.str) {
+				p.pos++
+				b.WriteByte(p.str[p.pos])
+			} else if c == quote {
+				p.pos++
+				return b.String(), nil
+			} else {
+				b.WriteByte(c)
+			}
+		}
+		return "", errors.New("Unterminated string in nbt")
+	}
+	start := p.pos
+	for p.pos < len(p.str) && !strings.ContainsRune(",:{}[] \n\t\"'", rune(p.str[p.pos])) {
+		p.pos++
+	}
+	if p.pos == start {
+		return "", errors.New("Expected a value at " + strconv.Itoa(p.pos) + " of nbt")
+	}
+	return p.str[start:p.pos], nil
+}
+
+// does a shulker with these contents fit this template?
+func (template ShulkerTemplate) Matches(contents string) bool {
+	stacks, err := parseShulkerContents(contents)
+	if err != nil {
+		return false
+	}
+	totals := make([]int, len(template.Rules))
+	for _, stack := range stacks {
+		matched := false
+		for i, rule := range template.Rules {
+			if rule.accepts(stack) {
+				totals[i] += stack.Count
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			return false // something in here that this listing doesn't take
+		}
+	}
+	for i, rule := range template.Rules {
+		if totals[i] < rule.MinCount {
+			return false
+		}
+		if rule.MaxCount != 0 && totals[i] > rule.MaxCount {
+			return false
+		}
+	}
+	return true
+}
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"database/sql"
+	"strings"
+	"testing"
+)
+
+func TestParseShulkerContents(t *testing.T) {
+	stacks, err := parseShulkerContents(`item.appleGold;1;64;,empty,item.swordDiamond;0;1;{ench:[{lvl:5s,id:16s},{lvl:3s,id:34s}],display:{Name:"a;b,c"}},item.totem;0;0;`)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(stacks) != 2 {
+		t.Fatalf("Expected 2 stacks, got %v", stacks)
+	}
+	if stacks[0] != (ItemStack{"item.appleGold;1", 64, ""}) {
+		t.Errorf("Wrong first stack %v", stacks[0])
+	}
+	if stacks[1] != (ItemStack{"item.swordDiamond;0", 1, `{ench:[{lvl:5s,id:16s},{lvl:3s,id:34s}],display:{Name:"a;b,c"}}`}) {
+		t.Errorf("Wrong second stack %v", stacks[1])
+	}
+	_, err = parseShulkerContents("item.appleGold;1")
+	if err == nil {
+		t.Errorf("Parsed a slot with no count")
+	}
+}
+
+func TestShulkerTemplates(t *testing.T) {
+	totems := ShulkerTemplate{Rules: []TemplateRule{{Item: "item.totem;0", MinCount: 27, PerSlot: 1}}}
+	if !totems.Matches(fullTotemShulker()) {
+		t.Errorf("Full shulker of totems didn't match")
+	}
+	if totems.Matches(strings.TrimSuffix(strings.Repeat("item.totem;0;1;,", 26), ",")) {
+		t.Errorf("26 totems matched a template that wants 27")
+	}
+	if totems.Matches(createShulkerFull("item.totem;0")) {
+		t.Errorf("Stacked totems matched a template that wants 1 per slot")
+	}
+
+	kit := ShulkerTemplate{Rules: []TemplateRule{
+		{Item: "item.appleGold;1", MinCount: 64 * 4},
+		{Item: "item.totem;0", MinCount: 10, PerSlot: 1},
+		{Item: "item.swordDiamond;0", MinCount: 1, MaxCount: 1, PerSlot: 1, NBT: "{lvl:5s,id:16s}"},
+	}}
+	err := kit.Validate()
+	if err != nil {
+		t.Error(err)
+	}
+	contents := strings.Repeat("item.appleGold;1;64;,", 4) + strings.Repeat("item.totem;0;1;,", 10) + "item.swordDiamond;0;1;{ench:[{lvl:5s,id:16s}]}"
+	if !kit.Matches(contents) {
+		t.Errorf("Kit didn't match")
+	}
+	if kit.Matches(contents + ",item.swordDiamond;0;1;{ench:[{lvl:5s,id:16s}]}") {
+		t.Errorf("Kit with two swords matched a template that wants exactly one")
+	}
+	if kit.Matches(strings.Replace(contents, "lvl:5s", "lvl:4s", 1)) {
+		t.Errorf("Kit with sharpness 4 matched a template that wants sharpness 5")
+	}
+	if kit.Matches(strings.Replace(contents, "{ench:[{lvl:5s,id:16s}]}", "{display:{Name:\"{lvl:5s,id:16s}\"}}", 1)) {
+		t.Errorf("Unenchanted sword with the enchantment in its name matched")
+	}
+	if kit.Matches(strings.Replace(contents, "{ench:[{lvl:5s,id:16s}]}", "{ench:[{lvl:1s,id:34s}],display:{Name:\"{lvl:5s,id:16s}\",Lore:[\"ench:[{lvl:5s,id:16s}]\"]}}", 1)) {
+		t.Errorf("Sword with the wrong enchantment and the right one in its name matched")
+	}
+	if !kit.Matches(strings.Replace(contents, "{ench:[{lvl:5s,id:16s}]}", "{display:{Name:\"Sharp\"},ench:[{id:34s,lvl:3s},{id:16S,lvl:5}],RepairCost:3}", 1)) {
+		t.Errorf("Renamed sword with sharpness 5 and unbreaking didn't match")
+	}
+	if kit.Matches(contents + ",tile.dirt;0;1;") {
+		t.Errorf("Kit with some dirt in it matched")
+	}
+	if kit.Matches(strings.Replace(contents, "item.appleGold;1;64;", "item.appleGold;1;64;{display:{Name:\"scam\"}}", 1)) {
+		t.Errorf("Named gapples matched a rule that wants no nbt")
+	}
+
+	if (ShulkerTemplate{}).Validate() == nil {
+		t.Errorf("Empty template is valid")
+	}
+	if (ShulkerTemplate{Rules: []TemplateRule{{Item: "item.swordDiamond;0", MinCount: 1, NBT: "ench:[{lvl:5s,id:16s}]"}}}).Validate() == nil {
+		t.Errorf("Template with raw nbt instead of a list of enchantments is valid")
+	}
+	if (ShulkerTemplate{Rules: []TemplateRule{{Item: "item.totem;0", MinCount: 28, PerSlot: 1}}}).Validate() == nil {
+		t.Errorf("Template that can't fit in a shulker is valid")
+	}
+}
+
+func TestDepositAgainstTemplate(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO users (user_id) VALUES (1)")
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO pending_deposits (deposit_id, user_id, listing_id, expiry_time) VALUES (?, ?, ?, ?)", 1234, 1, 2, 1<<40)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		listing, id := parseItem(testShulker(1234, fullTotemShulker()), "2b2t.org")
+		if listing == nil || listing.ListingID != 2 || id != 1234 {
+			t.Errorf("Totem deposit wasn't matched to the totem listing %v", listing)
+		}
+		listing, _ = parseItem(testShulker(1234, createShulkerFull("item.totem;0")), "2b2t.org")
+		if listing != nil {
+			t.Errorf("Impossible stacked totems were accepted")
+		}
+		// totems nobody deposited are still totems, so an unaccounted one can be dropped, but the bot won't keep them
+		listing, id = parseItem(testShulker(4321, fullTotemShulker()), "2b2t.org")
+		if listing == nil || listing.ListingID != 2 {
+			t.Errorf("Totems with no pending deposit weren't recognized %v", listing)
+		} else if botPicksUpItem(listing.ListingID, id) {
+			t.Errorf("Totems with no pending deposit were accepted")
+		}
+	})
+}
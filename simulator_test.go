@@ -0,0 +1,160 @@
+package main
+
+import (
+	"database/sql"
+	"net"
+	"testing"
+	"time"
+
+	"gitlab.com/2b2tq/exchange/botsim"
+)
+
+const simulatorTimeout = 5 * time.Second
+
+// starts accepting bots on a random port, and connects a simulated one to it
+func connectSimulatedBot(t *testing.T) *botsim.Bot {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go acceptBots(ctx, l)
+	bot := botsim.New(testBotUUID, "2b2t.org")
+	err = bot.Connect(l.Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if getByUUIDAndServer(testBotUUID, "2b2t.org") == nil && !eventually(func() bool { return getByUUIDAndServer(testBotUUID, "2b2t.org") != nil }) {
+		t.Fatal("Simulated bot never showed up")
+	}
+	return bot
+}
+
+// the controller has to forget about the bot before the testing database goes away, otherwise its packet loop would be stuck in RunSQL
+func disconnectSimulatedBot(t *testing.T, bot *botsim.Bot) {
+	bot.Close()
+	if !eventually(func() bool { return len(GetBotStatuses()) == 0 }) {
+		t.Error("Controller never noticed the simulated bot disconnect")
+	}
+}
+
+func eventually(cond func() bool) bool {
+	deadline := time.Now().Add(simulatorTimeout)
+	for time.Now().Before(deadline) {
+		if cond() {
+			return true
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+	return false
+}
+
+func countRows(t *testing.T, query string, args ...interface{}) int {
+	var count int
+	err := RunSQL(func(sql *sql.Tx) error {
+		return sql.QueryRow(query, args...).Scan(&count)
+	})
+	if err != nil {
+		t.Error(err)
+	}
+	return count
+}
+
+// deposit -> ender chest stash -> trade -> withdrawal -> drop, all through the bot protocol
+func TestSimulatedBotRoundTrip(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		const depositID = 0xabcd1234
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := sql.Exec("INSERT INTO users (user_id, balance) VALUES (1, 0), (2, 100)")
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO pending_deposits (deposit_id, user_id, listing_id, expiry_time) VALUES (?, 1, 2, strftime('%s', 'now') + 60)", depositID)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot := connectSimulatedBot(t)
+		defer disconnectSimulatedBot(t, bot)
+
+		item := botsim.Shulker(depositIDToName(depositID), fullTotemShulker())
+		err = bot.Run("pickup " + item + "\nwaitecho 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !eventually(func() bool {
+			return countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND listing_id = 2") == 1
+		}) {
+			t.Fatal("Deposit never showed up in the user's slots")
+		}
+		bot.Do(func(bot *botsim.Bot) {
+			if bot.Echest[0] != item || len(bot.Dropped) != 0 {
+				t.Errorf("Deposit wasn't stashed, echest %v dropped %v", bot.Echest, bot.Dropped)
+			}
+		})
+
+		var slot_index int
+		err = RunSQL(func(sql *sql.Tx) error {
+			err := sql.QueryRow("SELECT slot_index FROM slots WHERE user_id = 1").Scan(&slot_index)
+			if err != nil {
+				return err
+			}
+			err = createSellOrder(sql, 1, slot_index, 60)
+			if err != nil {
+				return err
+			}
+			err = createBuyOrder(sql, 2, 2, 60, 1)
+			if err != nil {
+				return err
+			}
+			return sql.QueryRow("SELECT slot_index FROM slots WHERE user_id = 2 AND listing_id = 2").Scan(&slot_index)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		err = bot.Run("status") // withdrawals need a bot with a fresh status
+		if err != nil {
+			t.Fatal(err)
+		}
+		code, err := createWithdrawal(ctx, 2, slot_index)
+		if err != nil {
+			t.Fatal(err)
+		}
+		botReceivesWithdrawalCode(code)
+		err = bot.Run("open\nwaitdrop 1")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot.Do(func(bot *botsim.Bot) {
+			if bot.Dropped[0] != item || bot.Echest[0] != botsim.Empty {
+				t.Errorf("Wrong item was dropped, echest %v dropped %v", bot.Echest, bot.Dropped)
+			}
+		})
+		if countRows(t, "SELECT COUNT(*) FROM inventory")+countRows(t, "SELECT COUNT(*) FROM slots") != 0 {
+			t.Errorf("Withdrawn item is still accounted for")
+		}
+	})
+}
+
+func TestSimulatedBotIgnoresDisabledServer(t *testing.T) {
+	WithTestingDatabase(func() {
+		createInitialListings()
+		bot := connectSimulatedBot(t)
+		defer disconnectSimulatedBot(t, bot)
+		err := setServerEnabled(ctx, 42, "2b2t.org", false, "maintenance")
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = bot.Run("pickup some random dirt\nwait 100ms")
+		if err != nil {
+			t.Fatal(err)
+		}
+		bot.Do(func(bot *botsim.Bot) {
+			if len(bot.Dropped) != 0 {
+				t.Errorf("Bot on a disabled server was told to throw out %v", bot.Dropped)
+			}
+		})
+	})
+}
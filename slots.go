@@ -2,54 +2,30 @@ package main
 
 import (
 	"database/sql"
-	"errors"
-	"log"
-	"math/rand"
-	"time"
+	"fmt"
 )
 
-const (
-	ForceSellMin = 60 * 5
-	ForceSellMax = 60 * 10
-)
-
-func slotExpiries() {
-	ticker := time.NewTicker(time.Second * 10)
-	for range ticker.C {
-		checkSlotExpiries() // <^ fancy go trickery. this just schedules checkSlotExpiries to be called every ten seconds lol
-	}
-}
-
 // pick a random length of time (in seconds) to wait before actually force selling, after expiry
 func randomForceSellDelay() int64 {
-	r := rand.New(rand.NewSource(time.Now().UnixNano()))
-	return int64(r.Intn(ForceSellMax-ForceSellMin+1) + ForceSellMin)
+	return randomInt63n(config.ForceSellMaxSeconds-config.ForceSellMinSeconds+1) + config.ForceSellMinSeconds
 }
 
-func verifyStorage(sql *sql.Tx) error {
-	var listing_id int64
-	var amountInSlots int
-	var amountInEchests int
-	err := sql.QueryRow(`
-			SELECT debts.listing_id, debts.cnt, storage.cnt FROM
-				(SELECT listings.listing_id, COUNT(slots.listing_id)     AS cnt FROM listings LEFT OUTER JOIN slots     ON slots.listing_id = listings.listing_id     GROUP BY listings.listing_id)
-			debts INNER JOIN
-				(SELECT listings.listing_id, COUNT(inventory.listing_id) AS cnt FROM listings LEFT OUTER JOIN inventory ON inventory.listing_id = listings.listing_id GROUP BY listings.listing_id)
-			storage ON debts.listing_id = storage.listing_id WHERE debts.cnt != storage.cnt;
-			`).Scan(&listing_id, &amountInSlots, &amountInEchests)
-	if err == ErrNoRows {
-		return nil // all good here
-	}
-	return errors.New("UH OH SPAGHETTI O")
+type expiredSlot struct {
+	user_id    int64
+	slot_index int
+	listing_id int64
 }
 
-func checkSlotExpiries() {
-	now := time.Now().Unix()
+// the slot expiries job (see jobs.go), returns how many slots it renewed, locked and force sold
+// it locks and force sells at most JobBatchSize slots each, the rest wait for the next run
+func checkSlotExpiries() (int64, error) {
+	now := clock.Now().Unix()
+	var renewed int64
 	err := RunSQL(func(sql *sql.Tx) error {
 		// auto renew slots that are expired, unlocked, for sale, and have free renewals remaining
-		_, err := sql.Exec(`
+		result, err := sql.Exec(`
 			UPDATE slots SET
-				expiry_time = expiry_time + 86400, /* one day is 86400 seconds */
+				expiry_time = expiry_time + ?, /* slot lifetime */
 				renewals = renewals - 1
 			WHERE
 					expiry_time < ?
@@ -60,90 +36,110 @@ func checkSlotExpiries() {
 				AND
 					locked == 0
 			;
-				`, now)
+				`, config.SlotLifetimeSeconds, now)
+		if err != nil {
+			return err
+		}
+		renewed, err = result.RowsAffected()
 		return err
 	})
 	if err != nil {
-		log.Println("Unable to auto renew slots")
-		log.Println(err)
-		return
+		return 0, fmt.Errorf("unable to auto renew slots: %v", err)
 	}
 
 	// now that for-sale s have been auto renewed, anything whose expiry is before "now" should be locked and auto sold
 	// we use a single consistent variable for now instead of "strftime('%s', 'now')" because what if one second passes between the previous query and this one?
 
+	var locked int64
 	err = RunSQL(func(sql *sql.Tx) error {
 
-		row := sql.QueryRow("SELECT user_id, slot_index, listing_id FROM slots WHERE locked == 0 AND expiry_time < ? ORDER BY expiry_time ASC LIMIT 1", now)
-		var user_id int64
-		var slot_index int
-		var listing_id int64
-		err := row.Scan(&user_id, &slot_index, &listing_id)
+		// retired listings have no market left to force sell into, so their slots are left alone, and createWithdrawal lets them be withdrawn even after they've expired
+		// and suspended users can't renew, sell or withdraw, so their slots wait for the suspension to be lifted, which gives them the time back
+		// and nothing on a disabled server can be traded, so those wait until it's turned back on
+		rows, err := sql.Query("SELECT user_id, slot_index, listing_id FROM slots WHERE locked == 0 AND expiry_time < ? AND listing_id NOT IN (SELECT listing_id FROM listing_retirements) AND user_id NOT IN (SELECT user_id FROM user_suspensions) AND listing_id NOT IN (SELECT listings.listing_id FROM listings INNER JOIN servers ON servers.server_ip = listings.server WHERE NOT servers.enabled) ORDER BY expiry_time ASC LIMIT ?", now, JobBatchSize)
 		if err != nil {
-			if err == ErrNoRows {
-				// there are no slots to lock for force selling. oh well.
-				// we ignore this error and return nil because this isn't truly an error, there just weren't any rows given back from that select statement
-				return nil
-			} else {
+			return err
+		}
+		expired := make([]expiredSlot, 0)
+		for rows.Next() {
+			var slot expiredSlot
+			err = rows.Scan(&slot.user_id, &slot.slot_index, &slot.listing_id)
+			if err != nil {
+				rows.Close()
 				return err
 			}
+			expired = append(expired, slot)
 		}
-		// we found one slot, there might be more
-		// check in another thread
-		go checkSlotExpiries()
-		// back to this one...
-		delay := randomForceSellDelay()
-		_, err = sql.Exec("UPDATE slots SET locked = 1, sale_price = NULL, for_sale_since = NULL, expiry_time = ? WHERE user_id = ? AND slot_index = ?", now+delay, user_id, slot_index)
-		log.Println("Saying it'll take between 5 and 10 minutes but it'll really be force sold in exactly", delay, "seconds")
-
-		log.Println("Here I would notify discord that 1 shulker of", listing_id, "will be auto force sold sometime in the next 5 to 10 minutes. Put in buy orders if you want it, it goes to the highest open one!")
-		return err
+		rows.Close()
+		if err = rows.Err(); err != nil {
+			return err
+		}
+		for _, slot := range expired {
+			delay := randomForceSellDelay()
+			_, err = sql.Exec("UPDATE slots SET locked = 1, sale_price = NULL, for_sale_since = NULL, expiry_time = ? WHERE user_id = ? AND slot_index = ?", now+delay, slot.user_id, slot.slot_index)
+			if err != nil {
+				return err
+			}
+			// TODO notify discord that 1 shulker of this listing will be auto force sold sometime in the next 5 to 10 minutes. put in buy orders if you want it, it goes to the highest open one!
+			ordersLog.Info("Slot expired, locking it to be force sold", "user", slot.user_id, "slot", slot.slot_index, "listing", slot.listing_id, "delay", delay)
+		}
+		locked = int64(len(expired))
+		return nil
 	})
 	if err != nil {
-		log.Println("Unable to expire slots")
-		log.Println(err)
-		return
+		return renewed, fmt.Errorf("unable to expire slots: %v", err)
 	}
 
-	err = RunSQL(func(sql *sql.Tx) error {
-		row := sql.QueryRow("SELECT user_id, slot_index, listing_id FROM slots WHERE locked == 1 AND expiry_time < ? AND (sale_price IS NULL OR sale_price > 0) ORDER BY expiry_time ASC LIMIT 1", now)
-		// grab all rows that are locked and expired, where they're not for sale, or for sale for a price that's greater than zero
-		// this prevents us from force selling the same item over and over, it's okay to leave the order up for 0 each, indefinitely
-		var user_id int64
-		var slot_index int
-		var listing_id int64
-		err := row.Scan(&user_id, &slot_index, &listing_id)
-		if err != nil {
-			if err == ErrNoRows {
-				// there are no slots to force sell. oh well.
-				// we ignore this error and return nil because this isn't truly an error, there just weren't any rows given back from that select statement
-				return nil
-			} else {
-				return err
+	// each force sell is its own transaction, since it's a whole order being matched
+	var sold int64
+	for sold < JobBatchSize {
+		found := false
+		err = RunSQL(func(sql *sql.Tx) error {
+			row := sql.QueryRow("SELECT user_id, slot_index, listing_id FROM slots WHERE locked == 1 AND expiry_time < ? AND (sale_price IS NULL OR sale_price > 0) AND listing_id NOT IN (SELECT listing_id FROM listing_freezes) AND listing_id NOT IN (SELECT listing_id FROM listing_retirements) AND user_id NOT IN (SELECT user_id FROM user_suspensions) AND listing_id NOT IN (SELECT listings.listing_id FROM listings INNER JOIN servers ON servers.server_ip = listings.server WHERE NOT servers.enabled) ORDER BY expiry_time ASC LIMIT 1", now)
+			// grab all rows that are locked and expired, where they're not for sale, or for sale for a price that's greater than zero
+			// this prevents us from force selling the same item over and over, it's okay to leave the order up for 0 each, indefinitely
+			// frozen listings are skipped, they'll get force sold once the freeze is lifted. same for suspended users and disabled servers
+			// skipping them here matters, createSellOrder would refuse them and this same slot would be picked first every time, stopping force sales everywhere
+			var user_id int64
+			var slot_index int
+			var listing_id int64
+			err := row.Scan(&user_id, &slot_index, &listing_id)
+			if err != nil {
+				if err == ErrNoRows {
+					// there are no slots to force sell. oh well.
+					// we ignore this error and return nil because this isn't truly an error, there just weren't any rows given back from that select statement
+					return nil
+				} else {
+					return err
+				}
 			}
-		}
 
-		// you can't sell against yourself
-		// so before putting the sell order up for free, we cancel any buy orders they may have had up in this listing
-		err = cancelAllBuysInListing(sql, user_id, listing_id)
+			// you can't sell against yourself
+			// so before putting the sell order up for free, we cancel any buy orders they may have had up in this listing
+			err = cancelAllBuysInListing(sql, user_id, listing_id)
 
-		if err != nil {
-			return err
-		}
+			if err != nil {
+				return err
+			}
 
-		err = createSellOrder(sql, user_id, slot_index, 0)
+			err = createSellOrder(sql, user_id, slot_index, 0)
 
+			if err != nil {
+				return err
+			}
+
+			// TODO notify discord on the same channel that the force sell order has been placed
+			ordersLog.Info("Force selling slot", "user", user_id, "slot", slot_index, "listing", listing_id)
+			found = true
+			return nil
+		})
 		if err != nil {
-			return err
+			return renewed + locked + sold, fmt.Errorf("unable to force sell slots: %v", err)
 		}
-
-		log.Println("Sorry dude, it's force selling")
-		log.Println("Here I would notify discord on the same channel that the force sell order has been placed")
-		return nil
-	})
-	if err != nil {
-		log.Println("Unable to force sell slots")
-		log.Println(err)
-		return
+		if !found {
+			break
+		}
+		sold++
 	}
+	return renewed + locked + sold, nil
 }
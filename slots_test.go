@@ -0,0 +1,134 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+	"time"
+)
+
+func withFakeClock(fn func(c *fakeClock)) {
+	c := &fakeClock{now: time.Unix(1500000000, 0)}
+	clock = c
+	defer func() {
+		clock = realClock{}
+	}()
+	fn(c)
+}
+
+// a for sale slot renews itself once a day for 14 days, then gets locked and force sold
+func TestSlotRenewals(t *testing.T) {
+	WithTestingDatabase(func() {
+		withFakeClock(func(c *fakeClock) {
+			createInitialListings()
+			err := RunSQL(func(sql *sql.Tx) error {
+				_, err := sql.Exec("INSERT INTO users (user_id) VALUES (1)")
+				if err != nil {
+					return err
+				}
+				_, err = sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (1, 1, ?, 0)", testBotUUID)
+				if err != nil {
+					return err
+				}
+				err = fillSlot(sql, 1, 1)
+				if err != nil {
+					return err
+				}
+				return createSellOrder(sql, 1, 0, 50)
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Advance(time.Second) // expiry is strictly before now
+			for day := 1; day <= 14; day++ {
+				c.Advance(time.Duration(config.SlotLifetimeSeconds) * time.Second)
+				checkSlotExpiries()
+				if countRows(t, "SELECT COUNT(*) FROM slots WHERE renewals = ? AND locked = 0", 14-day) != 1 {
+					t.Fatalf("Slot wasn't renewed on day %d", day)
+				}
+			}
+			c.Advance(time.Duration(config.SlotLifetimeSeconds) * time.Second)
+			checkSlotExpiries()
+			if countRows(t, "SELECT COUNT(*) FROM slots WHERE locked = 1") != 1 {
+				t.Fatal("Slot with no renewals left wasn't locked for force sale")
+			}
+			c.Advance(time.Duration(config.ForceSellMaxSeconds+1) * time.Second)
+			checkSlotExpiries()
+			if countRows(t, "SELECT COUNT(*) FROM slots WHERE locked = 1 AND sale_price = 0") != 1 {
+				t.Error("Slot wasn't force sold")
+			}
+		})
+	})
+}
+
+func TestPendingCleanup(t *testing.T) {
+	WithTestingDatabase(func() {
+		withFakeClock(func(c *fakeClock) {
+			createInitialListings()
+			err := RunSQL(func(sql *sql.Tx) error {
+				_, err := sql.Exec("INSERT INTO users (user_id) VALUES (1)")
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			_, err = createPendingDeposit(ctx, 1, 1)
+			if err != nil {
+				t.Fatal(err)
+			}
+			c.Advance(time.Duration(config.DepositTimeoutSeconds) * time.Second / 2)
+			cleanupPendingDeposits()
+			if countRows(t, "SELECT COUNT(*) FROM pending_deposits") != 1 {
+				t.Fatal("Deposit was cleaned up before it expired")
+			}
+			c.Advance(time.Duration(config.DepositTimeoutSeconds) * time.Second)
+			cleanupPendingDeposits()
+			if countRows(t, "SELECT COUNT(*) FROM pending_deposits") != 0 {
+				t.Error("Expired deposit wasn't cleaned up")
+			}
+
+			err = RunSQL(func(sql *sql.Tx) error {
+				_, err := sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (1, 1, ?, 0)", testBotUUID)
+				if err != nil {
+					return err
+				}
+				err = fillSlot(sql, 1, 1)
+				if err != nil {
+					return err
+				}
+				_, err = sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (5, 1, ?)", unixNow()+config.WithdrawalTimeoutSeconds)
+				if err != nil {
+					return err
+				}
+				_, err = sql.Exec("UPDATE slots SET withdrawal_code = 5, locked = 2")
+				return err
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			cleanupPendingWithdrawals()
+			if countRows(t, "SELECT COUNT(*) FROM pending_withdrawals") != 1 {
+				t.Fatal("Withdrawal was cleaned up before it expired")
+			}
+			c.Advance(time.Duration(config.WithdrawalTimeoutSeconds+1) * time.Second)
+			cleanupPendingWithdrawals()
+			if countRows(t, "SELECT COUNT(*) FROM pending_withdrawals")+countRows(t, "SELECT COUNT(*) FROM slots WHERE locked != 0") != 0 {
+				t.Error("Expired withdrawal wasn't cleaned up")
+			}
+		})
+	})
+}
+
+func TestSeededRandom(t *testing.T) {
+	defer seedRandom(time.Now().UnixNano())
+	seedRandom(1)
+	first := []int64{randomForceSellDelay(), randomForceSellDelay(), randomForceSellDelay()}
+	seedRandom(1)
+	for i, delay := range first {
+		if delay < config.ForceSellMinSeconds || delay > config.ForceSellMaxSeconds {
+			t.Errorf("Delay %d out of range", delay)
+		}
+		if again := randomForceSellDelay(); again != delay {
+			t.Errorf("Delay %d was %d the first time but %d the second", i, delay, again)
+		}
+	}
+}
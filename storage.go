@@ -0,0 +1,187 @@
+package main
+
+import (
+	"database/sql"
+	"strconv"
+	"strings"
+	"sync"
+)
+
+// kinds of storage invariant violations
+const (
+	ViolationSlotCount          = "slot_count"          // a listing has a different number of slots owed to users than items in our echests
+	ViolationOrphanedWithdrawal = "orphaned_withdrawal" // a slot is locked for withdrawal but there is no pending withdrawal for it
+	ViolationSharedWithdrawal   = "shared_withdrawal"   // more than one slot is locked for the same pending withdrawal, so one item would pay off several slots
+	ViolationWrongItemWithdrawn = "wrong_item"          // a slot is locked for a withdrawal of an item from some other listing
+	ViolationTooManySlots       = "too_many_slots"      // a user holds more slots than their max_slots
+)
+
+type StorageViolation struct {
+	Kind           string `json:"kind"`
+	ListingID      int64  `json:"listing_id,omitempty"`
+	OtherListingID int64  `json:"other_listing_id,omitempty"` // for wrong_item, the listing the item is actually in (0 if it isn't in inventory)
+	UserID         int64  `json:"user_id,omitempty"`
+	ItemID         int64  `json:"item_id,omitempty"`
+	SlotIndex      int    `json:"slot_index,omitempty"`
+	Expected       int    `json:"expected"`
+	Actual         int    `json:"actual"`
+}
+
+func (v StorageViolation) String() string {
+	switch v.Kind {
+	case ViolationSlotCount:
+		return "listing " + strconv.FormatInt(v.ListingID, 10) + " has " + strconv.Itoa(v.Expected) + " slots owed to users but " + strconv.Itoa(v.Actual) + " items in echests"
+	case ViolationOrphanedWithdrawal:
+		return "slot #" + strconv.Itoa(v.SlotIndex) + " of user " + strconv.FormatInt(v.UserID, 10) + " is locked for withdrawal but has no pending withdrawal"
+	case ViolationSharedWithdrawal:
+		return strconv.Itoa(v.Actual) + " slots are locked for the withdrawal of item " + strconv.FormatInt(v.ItemID, 10)
+	case ViolationWrongItemWithdrawn:
+		return "slot #" + strconv.Itoa(v.SlotIndex) + " of user " + strconv.FormatInt(v.UserID, 10) + " is in listing " + strconv.FormatInt(v.ListingID, 10) + " but is withdrawing item " + strconv.FormatInt(v.ItemID, 10) + " from listing " + strconv.FormatInt(v.OtherListingID, 10)
+	case ViolationTooManySlots:
+		return "user " + strconv.FormatInt(v.UserID, 10) + " holds " + strconv.Itoa(v.Actual) + " slots but only has " + strconv.Itoa(v.Expected)
+	}
+	return v.Kind
+}
+
+// returned by verifyStorage when anything doesn't add up, with every single thing that doesn't add up
+type StorageViolationsError struct {
+	Violations []StorageViolation
+}
+
+func (e *StorageViolationsError) Error() string {
+	strs := make([]string, len(e.Violations))
+	for i, v := range e.Violations {
+		strs[i] = v.String()
+	}
+	return "Storage invariants violated: " + strings.Join(strs, "; ")
+}
+
+// always sanity check after modifying inventory or slots
+// returns a *StorageViolationsError if anything is off, which rolls back the transaction like any other error
+func verifyStorage(sql *sql.Tx) error {
+	violations, err := checkStorageInvariants(sql)
+	if err != nil {
+		return err
+	}
+	if len(violations) > 0 {
+		return &StorageViolationsError{violations}
+	}
+	return nil
+}
+
+// same checks as verifyStorage, but just reports what it finds instead of treating it as an error
+func checkStorageInvariants(sql *sql.Tx) ([]StorageViolation, error) {
+	violations := make([]StorageViolation, 0)
+	collect := func(kind string, query string, scan func(row func(dest ...interface{}) error, v *StorageViolation) error) error {
+		rows, err := sql.Query(query)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			v := StorageViolation{Kind: kind}
+			err = scan(rows.Scan, &v)
+			if err != nil {
+				return err
+			}
+			violations = append(violations, v)
+		}
+		return rows.Err()
+	}
+
+	err := collect(ViolationSlotCount, `
+			SELECT debts.listing_id, debts.cnt, storage.cnt FROM
+				(SELECT listings.listing_id, COUNT(slots.listing_id)     AS cnt FROM listings LEFT OUTER JOIN slots     ON slots.listing_id = listings.listing_id     GROUP BY listings.listing_id)
+			debts INNER JOIN
+				(SELECT listings.listing_id, COUNT(inventory.listing_id) AS cnt FROM listings LEFT OUTER JOIN inventory ON inventory.listing_id = listings.listing_id GROUP BY listings.listing_id)
+			storage ON debts.listing_id = storage.listing_id WHERE debts.cnt != storage.cnt;
+			`, func(row func(dest ...interface{}) error, v *StorageViolation) error {
+		return row(&v.ListingID, &v.Expected, &v.Actual)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = collect(ViolationOrphanedWithdrawal, `
+			SELECT slots.user_id, slots.slot_index, slots.listing_id FROM slots
+			LEFT OUTER JOIN pending_withdrawals ON pending_withdrawals.withdrawal_code = slots.withdrawal_code
+			WHERE slots.locked == 2 AND pending_withdrawals.withdrawal_code IS NULL;
+			`, func(row func(dest ...interface{}) error, v *StorageViolation) error {
+		v.Expected = 1
+		return row(&v.UserID, &v.SlotIndex, &v.ListingID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	// reported by item and never by withdrawal code, since the code is as good as the item to anyone who reads this
+	err = collect(ViolationSharedWithdrawal, `
+			SELECT pending_withdrawals.item_id, COUNT(*) FROM slots
+			INNER JOIN pending_withdrawals ON pending_withdrawals.withdrawal_code = slots.withdrawal_code
+			GROUP BY slots.withdrawal_code HAVING COUNT(*) > 1;
+			`, func(row func(dest ...interface{}) error, v *StorageViolation) error {
+		v.Expected = 1
+		return row(&v.ItemID, &v.Actual)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = collect(ViolationWrongItemWithdrawn, `
+			SELECT slots.user_id, slots.slot_index, slots.listing_id, pending_withdrawals.item_id, COALESCE(inventory.listing_id, 0) FROM slots
+			INNER JOIN pending_withdrawals ON pending_withdrawals.withdrawal_code = slots.withdrawal_code
+			LEFT OUTER JOIN inventory ON inventory.item_id = pending_withdrawals.item_id
+			WHERE slots.locked == 2 AND (inventory.listing_id IS NULL OR inventory.listing_id != slots.listing_id);
+			`, func(row func(dest ...interface{}) error, v *StorageViolation) error {
+		return row(&v.UserID, &v.SlotIndex, &v.ListingID, &v.ItemID, &v.OtherListingID)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	err = collect(ViolationTooManySlots, `
+			SELECT users.user_id, users.max_slots, COUNT(slots.user_id) FROM users
+			INNER JOIN slots ON slots.user_id = users.user_id
+			GROUP BY users.user_id HAVING COUNT(slots.user_id) > users.max_slots;
+			`, func(row func(dest ...interface{}) error, v *StorageViolation) error {
+		return row(&v.UserID, &v.Expected, &v.Actual)
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	return violations, nil
+}
+
+type StorageHealth struct {
+	OK         bool               `json:"ok"`
+	Violations []StorageViolation `json:"violations"`
+}
+
+// the storage check job. the invariant check reads every slot and every item, which is too much to do for every /readyz from anyone
+// so readiness uses whatever the last run of this found. returns how many violations there are
+func checkStorage() (int64, error) {
+	var health StorageHealth
+	err := RunReadSQL(func(sql *sql.Tx) error {
+		var err error
+		health.Violations, err = checkStorageInvariants(sql)
+		return err
+	})
+	if err != nil {
+		return 0, err
+	}
+	health.OK = len(health.Violations) == 0
+	storageCheckLock.Lock()
+	lastStorageCheck = &health
+	storageCheckLock.Unlock()
+	return int64(len(health.Violations)), nil
+}
+
+var storageCheckLock sync.Mutex
+var lastStorageCheck *StorageHealth // nil until the first check
+
+func cachedStorageHealth() *StorageHealth {
+	storageCheckLock.Lock()
+	defer storageCheckLock.Unlock()
+	return lastStorageCheck
+}
@@ -0,0 +1,106 @@
+package main
+
+import (
+	"database/sql"
+	"testing"
+)
+
+func TestStorageViolations(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := RunSQL(func(sql *sql.Tx) error {
+			// user 2 gets an extra gapple slot with no item behind it, over their max of 1 slot
+			_, err := sql.Exec("UPDATE users SET max_slots = 1 WHERE user_id = 2")
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id) VALUES (?, ?, ?)", 2, 0, 1)
+			if err != nil {
+				return err
+			}
+			// and a slot that thinks it's being withdrawn, but the pending withdrawal is gone
+			_, err = sql.Exec("PRAGMA defer_foreign_keys = ON; INSERT INTO slots (user_id, slot_index, listing_id, locked, withdrawal_code) VALUES (?, ?, ?, ?, ?)", 1, 0, 2, 2, 1234)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (?, ?, ?, ?)", 8, 2, testBotUUID, 6)
+			if err != nil {
+				return err
+			}
+
+			err = verifyStorage(sql)
+			violations, ok := err.(*StorageViolationsError)
+			if !ok {
+				t.Errorf("Expected storage violations, got %v", err)
+				return err
+			}
+			kinds := make(map[string]StorageViolation)
+			for _, v := range violations.Violations {
+				kinds[v.Kind] = v
+			}
+			if v, ok := kinds[ViolationSlotCount]; !ok || v.ListingID != 1 || v.Expected != 1 || v.Actual != 0 {
+				t.Errorf("Wrong slot count violation %v", v)
+			}
+			if v, ok := kinds[ViolationOrphanedWithdrawal]; !ok || v.UserID != 1 || v.SlotIndex != 0 {
+				t.Errorf("Wrong orphaned withdrawal violation %v", v)
+			}
+			if v, ok := kinds[ViolationTooManySlots]; !ok || v.UserID != 2 || v.Expected != 1 || v.Actual != 2 {
+				t.Errorf("Wrong too many slots violation %v", v)
+			}
+			if len(violations.Violations) != 3 {
+				t.Errorf("Expected exactly 3 violations, got %s", violations)
+			}
+			return err // roll all of this back
+		})
+		if err == nil {
+			t.Errorf("Storage violations didn't roll back the transaction")
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			return verifyStorage(sql)
+		})
+		if err != nil {
+			t.Error(err)
+		}
+	})
+}
+
+func TestWithdrawalViolations(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := RunSQL(func(sql *sql.Tx) error {
+			// user 2 withdraws their totems properly, then user 1's crystal slot gets locked for the same withdrawal
+			_, err := sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (55, 7, ?)", unixNow()+60)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("UPDATE slots SET locked = 2, withdrawal_code = 55, sale_price = NULL, for_sale_since = NULL WHERE (user_id = 2 AND slot_index = 3) OR (user_id = 1 AND slot_index = 2)")
+			if err != nil {
+				return err
+			}
+
+			err = verifyStorage(sql)
+			violations, ok := err.(*StorageViolationsError)
+			if !ok {
+				t.Errorf("Expected storage violations, got %v", err)
+				return err
+			}
+			kinds := make(map[string]StorageViolation)
+			for _, v := range violations.Violations {
+				kinds[v.Kind] = v
+			}
+			if v, ok := kinds[ViolationSharedWithdrawal]; !ok || v.ItemID != 7 || v.Actual != 2 {
+				t.Errorf("Wrong shared withdrawal violation %v", v)
+			}
+			if v, ok := kinds[ViolationWrongItemWithdrawn]; !ok || v.UserID != 1 || v.SlotIndex != 2 || v.ListingID != 3 || v.ItemID != 7 || v.OtherListingID != 2 {
+				t.Errorf("Wrong item withdrawn violation %v", v)
+			}
+			if len(violations.Violations) != 2 {
+				t.Errorf("Expected exactly 2 violations, got %s", violations)
+			}
+			return err
+		})
+		if err == nil {
+			t.Errorf("Storage violations didn't roll back the transaction")
+		}
+	})
+}
@@ -0,0 +1,407 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"errors"
+	"net/http"
+	"strconv"
+	"strings"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+// you have to be in the discord (and have one of the required roles, if there are any) to log in, but that used to only be checked at login
+// now the membership check job re-checks everyone every membership_check_hours, and discord tells us the moment someone leaves, is banned, or has their roles changed
+// anyone who fails is suspended: they can still log in and see what they have, but can't trade or withdraw until they're back
+// admins can suspend people by hand too, and only an admin can lift one of those
+
+const (
+	SuspensionDiscord = "discord" // not in the discord or missing a role, lifted on its own once that's fixed
+	SuspensionAdmin   = "admin"   // done by hand, only lifted by hand
+)
+
+// why they're suspended, these go in DMs and on the site after "suspended because"
+const (
+	ReasonNotInGuild  = "you aren't in the 2b2tq discord server"
+	ReasonLeftGuild   = "you left or were kicked from the 2b2tq discord server"
+	ReasonBanned      = "you were banned from the 2b2tq discord server"
+	ReasonMissingRole = "you don't have any of the roles needed to trade in the 2b2tq discord server"
+)
+
+type Suspension struct {
+	Source      string
+	Reason      string
+	SuspendedAt int64
+}
+
+// nil if they aren't suspended
+func getSuspension(sql *sql.Tx, user_id int64) (*Suspension, error) {
+	s := &Suspension{}
+	err := sql.QueryRow("SELECT source, reason, suspended_at FROM user_suspensions WHERE user_id = ?", user_id).Scan(&s.Source, &s.Reason, &s.SuspendedAt)
+	if err == ErrNoRows {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// can only be called within the context of a sql transaction, like checkListingTradable
+func checkNotSuspended(sql *sql.Tx, user_id int64) error {
+	s, err := getSuspension(sql, user_id)
+	if err != nil {
+		return err
+	}
+	if s != nil {
+		return errors.New("Your account is suspended: " + s.Reason)
+	}
+	return nil
+}
+
+// returns whether they weren't suspended before, so the caller knows to DM them
+// an admin suspension is never replaced by a discord one, but a discord one becomes an admin one if an admin suspends them too
+func suspendUser(sql *sql.Tx, user_id int64, source string, reason string) (bool, error) {
+	existing, err := getSuspension(sql, user_id)
+	if err != nil {
+		return false, err
+	}
+	if existing != nil {
+		if existing.Source == SuspensionAdmin && source == SuspensionDiscord {
+			return false, nil
+		}
+		_, err = sql.Exec("UPDATE user_suspensions SET source = ?, reason = ? WHERE user_id = ?", source, reason, user_id)
+		return false, err
+	}
+	_, err = sql.Exec("INSERT INTO user_suspensions (user_id, source, reason, suspended_at) VALUES (?, ?, ?, ?)", user_id, source, reason, unixNow())
+	if err != nil {
+		return false, err
+	}
+	return true, pullOrders(sql, user_id)
+}
+
+// source "" lifts either kind. returns whether there was one to lift
+// their slots didn't age while they were suspended (see checkSlotExpiries), so they get that time back on every one of them
+func unsuspendUser(sql *sql.Tx, user_id int64, source string) (bool, error) {
+	existing, err := getSuspension(sql, user_id)
+	if err != nil {
+		return false, err
+	}
+	if existing == nil || (source != "" && existing.Source != source) {
+		return false, nil
+	}
+	_, err = sql.Exec("DELETE FROM user_suspensions WHERE user_id = ?", user_id)
+	if err != nil {
+		return false, err
+	}
+	suspended := unixNow() - existing.SuspendedAt
+	if suspended > 0 {
+		_, err = sql.Exec("UPDATE slots SET expiry_time = expiry_time + ? WHERE user_id = ?", suspended, user_id)
+		if err != nil {
+			return false, err
+		}
+	}
+	return true, nil
+}
+
+// takes everything a newly suspended user has on the order book off it, and expires their withdrawals, so nothing of theirs trades or leaves while they're suspended
+// their slots are left alone while they're suspended, they don't expire and don't get force sold, since they can't renew or withdraw them
+func pullOrders(sql *sql.Tx, user_id int64) error {
+	var refund int64
+	err := sql.QueryRow("SELECT COALESCE(SUM(price * quantity), 0) FROM listing_buy_orders WHERE user_id = ?", user_id).Scan(&refund)
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("UPDATE users SET balance = balance + ? WHERE user_id = ?", refund, user_id)
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("DELETE FROM listing_buy_orders WHERE user_id = ?", user_id)
+	if err != nil {
+		return err
+	}
+	_, err = sql.Exec("UPDATE slots SET sale_price = NULL, for_sale_since = NULL WHERE user_id = ? AND locked = 0", user_id)
+	if err != nil {
+		return err
+	}
+	rows, err := sql.Query("SELECT withdrawal_code FROM slots WHERE user_id = ? AND locked = 2 AND withdrawal_code IS NOT NULL", user_id)
+	if err != nil {
+		return err
+	}
+	codes := make([]int64, 0)
+	for rows.Next() {
+		var code int64
+		err = rows.Scan(&code)
+		if err != nil {
+			rows.Close()
+			return err
+		}
+		codes = append(codes, code)
+	}
+	rows.Close()
+	if err = rows.Err(); err != nil {
+		return err
+	}
+	for _, code := range codes {
+		err = expireWithdrawal(sql, code)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func requiredRoles() []string {
+	result := make([]string, 0)
+	for _, role := range strings.Split(config.RequiredRoleIDs, ",") {
+		role = strings.TrimSpace(role)
+		if role != "" {
+			result = append(result, role)
+		}
+	}
+	return result
+}
+
+// why someone with these roles isn't allowed to trade, "" if they are
+func missingRoleReason(roles []string) string {
+	required := requiredRoles()
+	if len(required) == 0 {
+		return ""
+	}
+	for _, role := range roles {
+		for _, r := range required {
+			if role == r {
+				return ""
+			}
+		}
+	}
+	return ReasonMissingRole
+}
+
+// asks discord whether they're allowed in. "" means they are, otherwise it's why not
+// this is a network call, so never call it inside a transaction
+func verifyMembership(user_id int64) (string, error) {
+	if discord == nil {
+		return "", errors.New("Discord not connected!")
+	}
+	roles, member, err := discord.GuildMemberRoles(config.GuildID, user_id)
+	if err != nil {
+		return "", err
+	}
+	if !member {
+		return ReasonNotInGuild, nil
+	}
+	return missingRoleReason(roles), nil
+}
+
+// records the result of a membership check: reason "" lifts a discord suspension, anything else suspends them for it
+// people who have never logged in don't have a users row, and are ignored
+func applyMembership(ctx context.Context, user_id int64, reason string) error {
+	var suspended, lifted bool
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		result, err := sql.Exec("UPDATE users SET membership_checked_at = ? WHERE user_id = ?", unixNow(), user_id)
+		if err != nil {
+			return err
+		}
+		n, err := result.RowsAffected()
+		if err != nil || n == 0 {
+			return err
+		}
+		if reason == "" {
+			lifted, err = unsuspendUser(sql, user_id, SuspensionDiscord)
+			return err
+		}
+		suspended, err = suspendUser(sql, user_id, SuspensionDiscord, reason)
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	logger := logFor(ctx, discordLog).With("user", user_id)
+	if suspended {
+		logger.Info("Suspended user", "reason", reason)
+		go DMuser(user_id, "Your 2b2tq account is suspended because "+reason+". Your orders have been cancelled and you can't trade or withdraw until that's fixed.")
+	}
+	if lifted {
+		logger.Info("Lifted suspension")
+		go DMuser(user_id, "Your 2b2tq account is no longer suspended, you can trade and withdraw again.")
+	}
+	return nil
+}
+
+// the membership check job. checks at most JobBatchSize people who haven't been checked in membership_check_hours, oldest first
+// one person failing to check (discord hiccups) is logged and they're tried again next run, but if every one fails that's the job failing
+func recheckMemberships() (int64, error) {
+	if discord == nil {
+		return 0, errors.New("Discord not connected!")
+	}
+	var user_ids []int64
+	err := RunReadSQL(func(sql *sql.Tx) error {
+		rows, err := sql.Query("SELECT user_id FROM users WHERE membership_checked_at <= ? ORDER BY membership_checked_at ASC LIMIT ?", unixNow()-config.MembershipCheckHours*60*60, JobBatchSize)
+		if err != nil {
+			return err
+		}
+		defer rows.Close()
+		for rows.Next() {
+			var user_id int64
+			err = rows.Scan(&user_id)
+			if err != nil {
+				return err
+			}
+			user_ids = append(user_ids, user_id)
+		}
+		return rows.Err()
+	})
+	if err != nil {
+		return 0, err
+	}
+	var checked int64
+	var lastErr error
+	for _, user_id := range user_ids {
+		reason, err := verifyMembership(user_id)
+		if err == nil {
+			err = applyMembership(ctx, user_id, reason)
+		}
+		if err != nil {
+			discordLog.Warn("Unable to check guild membership", "user", user_id, "err", err)
+			lastErr = err
+			continue
+		}
+		checked++
+	}
+	if checked == 0 && lastErr != nil {
+		return 0, lastErr
+	}
+	return checked, nil
+}
+
+// discord gateway events, so someone who's banned is suspended straight away and not at their next check
+// these need the server members intent turned on for the bot in the discord developer portal
+
+func onGuildMemberRemove(s *discordgo.Session, m *discordgo.GuildMemberRemove) {
+	if m.Member != nil && m.User != nil {
+		guildMemberChanged(m.GuildID, m.User.ID, ReasonLeftGuild)
+	}
+}
+
+func onGuildBanAdd(s *discordgo.Session, b *discordgo.GuildBanAdd) {
+	if b.User != nil {
+		guildMemberChanged(b.GuildID, b.User.ID, ReasonBanned)
+	}
+}
+
+// joining, or getting or losing a role
+func onGuildMemberUpdate(s *discordgo.Session, m *discordgo.GuildMemberUpdate) {
+	if m.Member != nil && m.User != nil {
+		guildMemberChanged(m.GuildID, m.User.ID, missingRoleReason(m.Roles))
+	}
+}
+
+func onGuildMemberAdd(s *discordgo.Session, m *discordgo.GuildMemberAdd) {
+	if m.Member != nil && m.User != nil {
+		guildMemberChanged(m.GuildID, m.User.ID, missingRoleReason(m.Roles))
+	}
+}
+
+func guildMemberChanged(guild_id string, discord_id string, reason string) {
+	if guild_id != config.GuildID {
+		return
+	}
+	user_id, err := strconv.ParseInt(discord_id, 10, 64)
+	if err != nil || user_id <= 0 {
+		discordLog.Warn("Guild member event with a bad user id", "id", discord_id)
+		return
+	}
+	err = applyMembership(ctx, user_id, reason)
+	if err != nil {
+		discordLog.Error("Unable to apply guild member event", "user", user_id, "reason", reason, "err", err)
+	}
+}
+
+func adminSuspendUser(ctx context.Context, admin_id int64, user_id int64, reason string) error {
+	var suspended bool
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		var exists int
+		err := sql.QueryRow("SELECT COUNT(*) FROM users WHERE user_id = ?", user_id).Scan(&exists)
+		if err != nil {
+			return err
+		}
+		if exists == 0 {
+			return errors.New("No such user")
+		}
+		existing, err := getSuspension(sql, user_id)
+		if err != nil {
+			return err
+		}
+		if existing != nil && existing.Source == SuspensionAdmin {
+			return errors.New("They're already suspended by an admin")
+		}
+		suspended, err = suspendUser(sql, user_id, SuspensionAdmin, reason)
+		if err != nil {
+			return err
+		}
+		return writeAdminLog(sql, admin_id, "suspend", user_id, "suspended", reason)
+	})
+	if err != nil {
+		return err
+	}
+	if suspended {
+		go DMuser(user_id, "An admin suspended your 2b2tq account. Your orders have been cancelled and you can't trade or withdraw. Reason: "+reason)
+	}
+	return nil
+}
+
+// lifts either kind. if it was a discord one and they're still out of the discord, the next check puts it back
+func adminUnsuspendUser(ctx context.Context, admin_id int64, user_id int64, reason string) error {
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		lifted, err := unsuspendUser(sql, user_id, "")
+		if err != nil {
+			return err
+		}
+		if !lifted {
+			return errors.New("They aren't suspended")
+		}
+		return writeAdminLog(sql, admin_id, "unsuspend", user_id, "lifted suspension", reason)
+	})
+	if err != nil {
+		return err
+	}
+	go DMuser(user_id, "An admin lifted the suspension on your 2b2tq account, you can trade and withdraw again. Reason: "+reason)
+	return nil
+}
+
+func handleAdminSuspendUser(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		return adminSuspendUser(r.Context(), admin.UserID, user_id, reason)
+	})
+}
+
+func handleAdminUnsuspendUser(w http.ResponseWriter, r *http.Request) {
+	adminAction(w, r, func(admin *User, user_id int64, reason string) error {
+		return adminUnsuspendUser(r.Context(), admin.UserID, user_id, reason)
+	})
+}
+
+type SuspendedUser struct {
+	UserID int64
+	Suspension
+}
+
+func getSuspendedUsers(sql *sql.Tx) ([]SuspendedUser, error) {
+	rows, err := sql.Query("SELECT user_id, source, reason, suspended_at FROM user_suspensions ORDER BY suspended_at DESC")
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]SuspendedUser, 0)
+	for rows.Next() {
+		var s SuspendedUser
+		err = rows.Scan(&s.UserID, &s.Source, &s.Reason, &s.SuspendedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, s)
+	}
+	return result, rows.Err()
+}
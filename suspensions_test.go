@@ -0,0 +1,280 @@
+package main
+
+import (
+	"database/sql"
+	"net/http"
+	"net/url"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/bwmarrin/discordgo"
+)
+
+func isSuspended(t *testing.T, user_id int64) *Suspension {
+	var s *Suspension
+	err := RunSQL(func(sql *sql.Tx) error {
+		var err error
+		s, err = getSuspension(sql, user_id)
+		return err
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return s
+}
+
+func TestSuspensionPullsOrders(t *testing.T) {
+	WithTestingDatabase(func() {
+		createSomeExampleUsers(t)
+		err := RunSQL(func(sql *sql.Tx) error {
+			err := createBuyOrder(sql, 2, 2, 10, 3)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (99, 7, ?)", unixNow()+60)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("UPDATE slots SET locked = 2, withdrawal_code = 99 WHERE user_id = 2 AND slot_index = 3")
+			if err != nil {
+				return err
+			}
+			for _, user_id := range []int64{1, 2} {
+				suspended, err := suspendUser(sql, user_id, SuspensionAdmin, "testing")
+				if err != nil {
+					return err
+				}
+				if !suspended {
+					t.Error("They weren't suspended before")
+				}
+			}
+			return verifyStorage(sql)
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM listing_buy_orders") != 0 || countRows(t, "SELECT COUNT(*) FROM slots WHERE sale_price IS NOT NULL") != 0 {
+			t.Error("Suspending should take their orders off the book")
+		}
+		if balanceOf(t, 2) != 100 {
+			t.Error("Buy order should have been refunded, balance is", balanceOf(t, 2))
+		}
+		if countRows(t, "SELECT COUNT(*) FROM pending_withdrawals") != 0 || countRows(t, "SELECT COUNT(*) FROM slots WHERE locked != 0") != 0 {
+			t.Error("Suspending should expire their withdrawals")
+		}
+
+		err = RunSQL(func(sql *sql.Tx) error {
+			return createSellOrder(sql, 1, 2, 5)
+		})
+		if err == nil || !strings.Contains(err.Error(), "suspended: testing") {
+			t.Error("Suspended user shouldn't be able to sell", err)
+		}
+		err = RunSQL(func(sql *sql.Tx) error {
+			return createBuyOrder(sql, 2, 2, 10, 1)
+		})
+		if err == nil {
+			t.Error("Suspended user shouldn't be able to buy")
+		}
+		_, err = createWithdrawal(ctx, 2, 3)
+		if err == nil || !strings.Contains(err.Error(), "suspended") {
+			t.Error("Suspended user shouldn't be able to withdraw", err)
+		}
+	})
+}
+
+func TestMembershipRecheck(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		client := site.login(t, 1)
+		site.login(t, 2)
+		if err := adminAdjustBalance(ctx, 42, 1, 50, "testing"); err != nil {
+			t.Fatal(err)
+		}
+		site.act(t, client, "/trade/2/buy", url.Values{"price": {"10"}, "quantity": {"2"}})
+
+		checked, err := recheckMemberships()
+		if err != nil || checked != 0 {
+			t.Error("They were checked when they logged in", checked, err)
+		}
+
+		site.discord.lock.Lock()
+		delete(site.discord.members, 1)
+		site.discord.lock.Unlock()
+		site.clock.Advance(time.Duration(config.MembershipCheckHours)*time.Hour + time.Second)
+		checked, err = recheckMemberships()
+		if err != nil || checked != 2 {
+			t.Fatal("Both should have been rechecked", checked, err)
+		}
+		if s := isSuspended(t, 1); s == nil || s.Source != SuspensionDiscord || s.Reason != ReasonNotInGuild {
+			t.Fatal("Someone who left should be suspended", s)
+		}
+		if isSuspended(t, 2) != nil {
+			t.Error("Someone still in the discord shouldn't be")
+		}
+		site.discord.waitForDM(t, 1, "suspended because "+ReasonNotInGuild)
+		if balanceOf(t, 1) != 50 || countRows(t, "SELECT COUNT(*) FROM listing_buy_orders") != 0 {
+			t.Error("Their buy order should have been cancelled and refunded")
+		}
+		status, body := site.post(t, client, "/trade/2/buy", url.Values{"price": {"10"}, "quantity": {"1"}})
+		if status != http.StatusBadRequest || !strings.Contains(body, "suspended") {
+			t.Error("Suspended user was able to place an order", status, body)
+		}
+
+		site.discord.lock.Lock()
+		site.discord.members[1] = true
+		site.discord.lock.Unlock()
+		site.clock.Advance(time.Duration(config.MembershipCheckHours)*time.Hour + time.Second)
+		_, err = recheckMemberships()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if isSuspended(t, 1) != nil {
+			t.Error("Suspension should be lifted once they're back")
+		}
+		site.discord.waitForDM(t, 1, "no longer suspended")
+	})
+}
+
+func TestRequiredRoles(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		saved := config.RequiredRoleIDs
+		config.RequiredRoleIDs = "111, 222"
+		defer func() {
+			config.RequiredRoleIDs = saved
+		}()
+		site.discord.members[1] = true
+		status, body := site.get(t, site.client(t), "/auth/discord/callback?user=1")
+		if status == http.StatusFound || !strings.Contains(body, "roles needed to trade") {
+			t.Error("Member without a required role was able to log in", status, body)
+		}
+		site.discord.roles[1] = []string{"999", "222"}
+		site.login(t, 1)
+
+		onGuildMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: &discordgo.Member{GuildID: config.GuildID, User: &discordgo.User{ID: "1"}, Roles: []string{"999"}}})
+		if s := isSuspended(t, 1); s == nil || s.Reason != ReasonMissingRole {
+			t.Error("Losing the role should suspend them", s)
+		}
+		onGuildMemberUpdate(nil, &discordgo.GuildMemberUpdate{Member: &discordgo.Member{GuildID: config.GuildID, User: &discordgo.User{ID: "1"}, Roles: []string{"111"}}})
+		if isSuspended(t, 1) != nil {
+			t.Error("Getting the role back should lift it")
+		}
+		site.discord.waitForDM(t, 1, "no longer suspended")
+	})
+}
+
+func TestGuildEvents(t *testing.T) {
+	withTestSite(t, func(site *testSite) {
+		site.login(t, 1)
+		onGuildBanAdd(nil, &discordgo.GuildBanAdd{GuildID: "1234", User: &discordgo.User{ID: "1"}})
+		if isSuspended(t, 1) != nil {
+			t.Error("Bans from other guilds don't count")
+		}
+		onGuildMemberRemove(nil, &discordgo.GuildMemberRemove{Member: &discordgo.Member{GuildID: config.GuildID, User: &discordgo.User{ID: "1"}}})
+		onGuildBanAdd(nil, &discordgo.GuildBanAdd{GuildID: config.GuildID, User: &discordgo.User{ID: "1"}})
+		if s := isSuspended(t, 1); s == nil || s.Reason != ReasonBanned {
+			t.Error("A ban should suspend them", s)
+		}
+		onGuildBanAdd(nil, &discordgo.GuildBanAdd{GuildID: config.GuildID, User: &discordgo.User{ID: "5"}})
+		if countRows(t, "SELECT COUNT(*) FROM user_suspensions") != 1 {
+			t.Error("Someone who never logged in has nothing to suspend")
+		}
+
+		if adminSuspendUser(ctx, 42, 2, "no reason") == nil {
+			t.Error("Can't suspend someone who doesn't exist")
+		}
+		site.login(t, 2)
+		if adminSuspendUser(ctx, 42, 2, "") == nil {
+			t.Error("Admins need a reason")
+		}
+		if err := adminSuspendUser(ctx, 42, 2, "scamming"); err != nil {
+			t.Fatal(err)
+		}
+		onGuildMemberAdd(nil, &discordgo.GuildMemberAdd{Member: &discordgo.Member{GuildID: config.GuildID, User: &discordgo.User{ID: "2"}}})
+		if s := isSuspended(t, 2); s == nil || s.Source != SuspensionAdmin {
+			t.Error("Only an admin can lift an admin suspension", s)
+		}
+		if err := adminUnsuspendUser(ctx, 42, 2, "appealed"); err != nil {
+			t.Fatal(err)
+		}
+		if isSuspended(t, 2) != nil || countRows(t, "SELECT COUNT(*) FROM admin_audit_log WHERE user_id = 2 AND action IN ('suspend', 'unsuspend')") != 2 {
+			t.Error("Admin should have lifted it and both should be audited")
+		}
+		site.discord.waitForDM(t, 1, "suspended because")
+		site.discord.waitForDM(t, 2, "An admin suspended")
+		site.discord.waitForDM(t, 2, "Reason: appealed")
+	})
+}
+
+func TestSuspendedSlotsWait(t *testing.T) {
+	WithTestingDatabase(func() {
+		fake := &fakeClock{now: time.Now()}
+		clock = fake
+		defer func() {
+			clock = realClock{}
+		}()
+		createSomeExampleUsers(t)
+		err := RunSQL(func(sql *sql.Tx) error {
+			_, err := suspendUser(sql, 1, SuspensionAdmin, "testing")
+			if err != nil {
+				return err
+			}
+			// user 1's slot was already waiting to be force sold, user 2's is about to expire like user 1's other one
+			_, err = sql.Exec("INSERT INTO slots (user_id, slot_index, listing_id, expiry_time) VALUES (1, 4, 2, ?); INSERT INTO inventory (item_id, listing_id, bot_uuid, slot_number) VALUES (8, 2, ?, 6)", unixNow()+60, testBotUUID)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("UPDATE slots SET locked = 1, expiry_time = ? WHERE user_id = 1 AND slot_index = 2", unixNow()-1)
+			if err != nil {
+				return err
+			}
+			_, err = sql.Exec("UPDATE slots SET expiry_time = ? WHERE user_id = 2", unixNow()+60)
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		fake.Advance(time.Hour)
+		_, err = checkSlotExpiries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 2 AND locked = 1") != 1 {
+			t.Error("Someone who isn't suspended should have their slot expire")
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND slot_index = 4 AND locked = 0") != 1 {
+			t.Error("Suspended user's slot shouldn't expire")
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND slot_index = 2 AND sale_price IS NULL") != 1 {
+			t.Error("Suspended user's slot shouldn't be force sold")
+		}
+
+		_, err = createPendingDeposit(ctx, 1, 2)
+		if err == nil || !strings.Contains(err.Error(), "suspended") {
+			t.Error("Suspended user shouldn't be able to deposit", err)
+		}
+
+		var before int64
+		err = RunSQL(func(sql *sql.Tx) error {
+			err := sql.QueryRow("SELECT expiry_time FROM slots WHERE user_id = 1 AND slot_index = 4").Scan(&before)
+			if err != nil {
+				return err
+			}
+			_, err = unsuspendUser(sql, 1, "")
+			return err
+		})
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND slot_index = 4 AND expiry_time = ?", before+3600) != 1 {
+			t.Error("Lifting the suspension should give back the hour it lasted")
+		}
+		_, err = checkSlotExpiries()
+		if err != nil {
+			t.Fatal(err)
+		}
+		if countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND locked = 0") != 1 || countRows(t, "SELECT COUNT(*) FROM slots WHERE user_id = 1 AND slot_index = 2 AND sale_price = 0") != 1 {
+			t.Error("Once they're back the slot still has time left, and the one being force sold goes on sale")
+		}
+	})
+}
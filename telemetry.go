@@ -0,0 +1,292 @@
+package main
+
+import (
+	"database/sql"
+	"fmt"
+	"net/http"
+	"strconv"
+	"time"
+)
+
+// a bot sends a status packet several times a second, that's way too much to keep
+// so every so often we save a snapshot into bot_status_history, and throw away the old ones
+const BotStatusSampleInterval = 10 * time.Second
+const BotStatusRetentionSeconds = 7 * 24 * 60 * 60
+
+// health is in half hearts, 20 is full
+const BotLowHealth = 10
+const BotHealthDropAlert = 6 // losing this much in one status packet is a big hit, like a crystal or a fall
+
+// how long a connected bot can go without a status update before we tell the admins
+const BotStaleAlertAfter = 30 * time.Second
+
+type BotStatusSample struct {
+	SampledAt      int64
+	X              float64
+	Y              float64
+	Z              float64
+	Health         float32
+	FoodLevel      int
+	Saturation     float32
+	Dimension      int
+	CurrentGoal    string
+	CurrentProcess string
+	CalcFailed     bool
+}
+
+type BotAlert struct {
+	BotUUID   string
+	Server    string
+	Kind      string // "health", "dimension", "stale" or "recovered"
+	Message   string
+	CreatedAt int64
+}
+
+type AdminBotPageTemplate struct {
+	Profile *User
+	BotUUID string
+	Hours   int
+	Online  *BotStatus // nil if it isn't connected right now
+	Alerts  []BotAlert
+	Samples []BotStatusSample
+	Rules   SafetyRules
+	Actions []SafetyActionLog
+}
+
+func dimensionName(dimension int) string {
+	switch dimension {
+	case -1:
+		return "the nether"
+	case 0:
+		return "the overworld"
+	case 1:
+		return "the end"
+	}
+	return "dimension " + strconv.Itoa(dimension)
+}
+
+// what changed between two status packets from the same bot that an admin should hear about
+// previous is nil for the first status packet on a connection
+func statusAlerts(previous *BotStatus, current *BotStatus) []BotAlert {
+	alerts := make([]BotAlert, 0)
+	if previous == nil {
+		return alerts
+	}
+	alert := func(kind string, message string) {
+		alerts = append(alerts, BotAlert{
+			BotUUID: current.BotUUID,
+			Server:  current.ServerIP,
+			Kind:    kind,
+			Message: message,
+		})
+	}
+	if previous.Health-current.Health >= BotHealthDropAlert {
+		alert("health", fmt.Sprintf("Bot %s took %.0f damage at once, health is now %.0f", current.BotUUID, previous.Health-current.Health, current.Health))
+	} else if previous.Health >= BotLowHealth && current.Health < BotLowHealth {
+		alert("health", fmt.Sprintf("Bot %s is low on health, %.0f", current.BotUUID, current.Health))
+	}
+	if previous.Dimension != current.Dimension {
+		alert("dimension", fmt.Sprintf("Bot %s went from %s to %s", current.BotUUID, dimensionName(previous.Dimension), dimensionName(current.Dimension)))
+	}
+	return alerts
+}
+
+// called on every status packet, right after latestStatus is replaced
+// wasStale is whether the watchdog had told the admins this bot went quiet
+func (bot *Bot) recordTelemetry(previous *BotStatus, current *BotStatus, wasStale bool) {
+	alerts := statusAlerts(previous, current)
+	if wasStale {
+		alerts = append(alerts, BotAlert{
+			BotUUID: current.BotUUID,
+			Server:  current.ServerIP,
+			Kind:    "recovered",
+			Message: "Bot " + current.BotUUID + " is sending status updates again",
+		})
+	}
+	for _, alert := range alerts {
+		raiseBotAlert(alert)
+	}
+	// always sample when something happened, so the timeline shows the status that caused the alert
+	if len(alerts) == 0 && current.timeReceivedUnixNano-bot.lastSampledUnixNano < int64(BotStatusSampleInterval) {
+		return
+	}
+	bot.lastSampledUnixNano = current.timeReceivedUnixNano
+	err := RunSQL(func(sql *sql.Tx) error {
+		return sampleBotStatus(sql, current)
+	})
+	if err != nil {
+		botLog.Error("Unable to save bot status", "bot", current.BotUUID, "err", err)
+	}
+}
+
+// can only be called within the context of a sql transaction
+func sampleBotStatus(sql *sql.Tx, status *BotStatus) error {
+	_, err := sql.Exec(`INSERT INTO bot_status_history (bot_uuid, server, sampled_at, x, y, z, health, food_level, saturation, dimension, current_goal, current_process, calc_failed)
+		VALUES (?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?, ?)`,
+		status.BotUUID, status.ServerIP, status.timeReceivedUnixNano/int64(time.Second), status.X, status.Y, status.Z, status.Health, status.FoodLevel, status.Saturation, status.Dimension, status.CurrentGoal, status.CurrentProcess, status.CalcFailedLastTick)
+	return err
+}
+
+func raiseBotAlert(alert BotAlert) {
+	botLog.Warn("Bot alert", "bot", alert.BotUUID, "kind", alert.Kind, "message", alert.Message)
+	err := RunSQL(func(sql *sql.Tx) error {
+		_, err := sql.Exec("INSERT INTO bot_alerts (bot_uuid, server, kind, message) VALUES (?, ?, ?, ?)", alert.BotUUID, alert.Server, alert.Kind, alert.Message)
+		return err
+	})
+	if err != nil {
+		botLog.Error("Unable to save bot alert", "err", err)
+	}
+	go DMadmins(alert.Message) // don't hold up the bot's packet loop on discord
+}
+
+// the bot watchdog job: checks for bots that are still connected but have gone quiet, returns how many it raised alerts for
+func botWatchdog() (int64, error) {
+	alerts := findStaleBots(time.Now())
+	for _, alert := range alerts {
+		raiseBotAlert(alert)
+	}
+	return int64(len(alerts)), nil
+}
+
+func findStaleBots(now time.Time) []BotAlert {
+	botsLock.Lock()
+	defer botsLock.Unlock()
+	alerts := make([]BotAlert, 0)
+	for _, bot := range bots {
+		if bot.latestStatus == nil || bot.staleAlerted {
+			continue
+		}
+		age := time.Duration(now.UnixNano() - bot.latestStatus.timeReceivedUnixNano)
+		if age < BotStaleAlertAfter {
+			continue
+		}
+		bot.staleAlerted = true
+		alerts = append(alerts, BotAlert{
+			BotUUID: bot.latestStatus.BotUUID,
+			Server:  bot.latestStatus.ServerIP,
+			Kind:    "stale",
+			Message: fmt.Sprintf("Bot %s on %s hasn't sent a status update in %s", bot.latestStatus.BotUUID, bot.latestStatus.ServerIP, age.Round(time.Second)),
+		})
+	}
+	return alerts
+}
+
+// the bot status history cleanup job, returns how many rows it deleted
+func botStatusHistoryCleanup() (int64, error) {
+	var deleted int64
+	err := RunSQL(func(sql *sql.Tx) error {
+		var err error
+		deleted, err = deleteOldBotStatusHistory(sql, unixNow()-BotStatusRetentionSeconds)
+		return err
+	})
+	return deleted, err
+}
+
+// can only be called within the context of a sql transaction
+func deleteOldBotStatusHistory(sql *sql.Tx, before int64) (int64, error) {
+	var deleted int64
+	for _, query := range []string{
+		"DELETE FROM bot_status_history WHERE sampled_at < ?",
+		"DELETE FROM bot_alerts WHERE created_at < ?",
+		"DELETE FROM bot_safety_actions WHERE created_at < ?",
+	} {
+		result, err := sql.Exec(query, before)
+		if err != nil {
+			return deleted, err
+		}
+		n, err := result.RowsAffected()
+		if err != nil {
+			return deleted, err
+		}
+		deleted += n
+	}
+	return deleted, nil
+}
+
+// can only be called within the context of a sql transaction
+// botUUID "" means alerts from every bot
+func getBotAlerts(sql *sql.Tx, botUUID string, since int64) ([]BotAlert, error) {
+	rows, err := sql.Query("SELECT bot_uuid, server, kind, message, created_at FROM bot_alerts WHERE (? = '' OR bot_uuid = ?) AND created_at >= ? ORDER BY created_at DESC, rowid DESC LIMIT 100", botUUID, botUUID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]BotAlert, 0)
+	for rows.Next() {
+		var alert BotAlert
+		err = rows.Scan(&alert.BotUUID, &alert.Server, &alert.Kind, &alert.Message, &alert.CreatedAt)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, alert)
+	}
+	return result, rows.Err()
+}
+
+// can only be called within the context of a sql transaction
+func getBotTimeline(sql *sql.Tx, botUUID string, since int64) ([]BotStatusSample, error) {
+	rows, err := sql.Query("SELECT sampled_at, x, y, z, health, food_level, saturation, dimension, current_goal, current_process, calc_failed FROM bot_status_history WHERE bot_uuid = ? AND sampled_at >= ? ORDER BY sampled_at DESC LIMIT 1000", botUUID, since)
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+	result := make([]BotStatusSample, 0)
+	for rows.Next() {
+		var sample BotStatusSample
+		err = rows.Scan(&sample.SampledAt, &sample.X, &sample.Y, &sample.Z, &sample.Health, &sample.FoodLevel, &sample.Saturation, &sample.Dimension, &sample.CurrentGoal, &sample.CurrentProcess, &sample.CalcFailed)
+		if err != nil {
+			return nil, err
+		}
+		result = append(result, sample)
+	}
+	return result, rows.Err()
+}
+
+func handleAdminBotPage(w http.ResponseWriter, r *http.Request) {
+	admin := getAdmin(r)
+	if admin == nil {
+		http.Error(w, "admins only", http.StatusForbidden)
+		return
+	}
+	hours, err := strconv.Atoi(r.URL.Query().Get("hours"))
+	if err != nil || hours <= 0 {
+		hours = 24
+	}
+	data := &AdminBotPageTemplate{
+		Profile: admin,
+		BotUUID: r.URL.Query().Get(":uuid"),
+		Hours:   hours,
+	}
+	for _, status := range GetBotStatuses() {
+		if status.BotUUID == data.BotUUID {
+			status := status
+			data.Online = &status
+		}
+	}
+	since := time.Now().Unix() - int64(hours)*60*60
+	err = RunReadSQLContext(r.Context(), func(sql *sql.Tx) error {
+		var err error
+		data.Alerts, err = getBotAlerts(sql, data.BotUUID, since)
+		if err != nil {
+			return err
+		}
+		data.Samples, err = getBotTimeline(sql, data.BotUUID, since)
+		if err != nil {
+			return err
+		}
+		data.Rules, err = loadSafetyRules(sql, data.BotUUID)
+		if err != nil {
+			return err
+		}
+		data.Actions, err = getSafetyActions(sql, data.BotUUID, since)
+		return err
+	})
+	if err != nil {
+		http.Error(w, "Unable to load bot timeline. "+err.Error(), http.StatusInternalServerError)
+		return
+	}
+	err = templates.ExecuteTemplate(w, "admin_bot.html", data)
+	if err != nil {
+		http.Error(w, "Unable to render the bot timeline template. "+err.Error(), http.StatusInternalServerError)
+	}
+}
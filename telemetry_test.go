@@ -0,0 +1,91 @@
+package main
+
+import (
+	"database/sql"
+	"io/ioutil"
+	"testing"
+	"time"
+)
+
+func TestStatusAlerts(t *testing.T) {
+	previous := &BotStatus{BotUUID: "bot", Health: 20, Dimension: 0}
+	if len(statusAlerts(nil, previous)) != 0 {
+		t.Errorf("First status of a connection raised an alert")
+	}
+	if len(statusAlerts(previous, &BotStatus{BotUUID: "bot", Health: 18})) != 0 {
+		t.Errorf("Losing a heart raised an alert")
+	}
+	alerts := statusAlerts(previous, &BotStatus{BotUUID: "bot", Health: 12, Dimension: -1})
+	if len(alerts) != 2 || alerts[0].Kind != "health" || alerts[1].Kind != "dimension" {
+		t.Errorf("Expected a health and a dimension alert, got %v", alerts)
+	}
+	alerts = statusAlerts(&BotStatus{Health: 11}, &BotStatus{Health: 9})
+	if len(alerts) != 1 || alerts[0].Kind != "health" {
+		t.Errorf("Going below low health didn't raise an alert %v", alerts)
+	}
+}
+
+func TestStaleBots(t *testing.T) {
+	now := time.Now()
+	fresh := &Bot{latestStatus: &BotStatus{BotUUID: "fresh", timeReceivedUnixNano: now.UnixNano()}}
+	stale := &Bot{latestStatus: &BotStatus{BotUUID: "stale", timeReceivedUnixNano: now.Add(-time.Minute).UnixNano()}}
+	botsLock.Lock()
+	bots = []*Bot{fresh, stale, {}}
+	botsLock.Unlock()
+	defer func() {
+		botsLock.Lock()
+		bots = nil
+		botsLock.Unlock()
+	}()
+	alerts := findStaleBots(now)
+	if len(alerts) != 1 || alerts[0].BotUUID != "stale" {
+		t.Errorf("Expected only the stale bot to be alerted, got %v", alerts)
+	}
+	if len(findStaleBots(now)) != 0 {
+		t.Errorf("Stale bot was alerted twice")
+	}
+}
+
+func TestBotStatusHistory(t *testing.T) {
+	WithTestingSingleQuery(t, func(sql *sql.Tx) error {
+		now := time.Now().Unix()
+		for _, age := range []int64{BotStatusRetentionSeconds + 60, 60, 0} {
+			err := sampleBotStatus(sql, &BotStatus{BotUUID: "bot", ServerIP: "2b2t.org", timeReceivedUnixNano: (now - age) * int64(time.Second), Health: 20})
+			if err != nil {
+				return err
+			}
+		}
+		samples, err := getBotTimeline(sql, "bot", 0)
+		if err != nil {
+			return err
+		}
+		if len(samples) != 3 || samples[0].SampledAt != now {
+			t.Errorf("Timeline isn't newest first %v", samples)
+		}
+		_, err = deleteOldBotStatusHistory(sql, now-BotStatusRetentionSeconds)
+		if err != nil {
+			return err
+		}
+		samples, err = getBotTimeline(sql, "bot", 0)
+		if err != nil {
+			return err
+		}
+		if len(samples) != 2 {
+			t.Errorf("Retention didn't delete the old sample %v", samples)
+		}
+		return nil
+	})
+}
+
+func TestAdminBotTemplateRenders(t *testing.T) {
+	err := templates.ExecuteTemplate(ioutil.Discard, "admin_bot.html", &AdminBotPageTemplate{
+		Profile: &User{UserID: 42},
+		BotUUID: "bot",
+		Online:  &BotStatus{BotUUID: "bot"},
+		Alerts:  []BotAlert{{BotUUID: "bot", Kind: "stale"}},
+		Samples: []BotStatusSample{{SampledAt: 1}},
+	})
+	if err != nil {
+		t.Error(err)
+	}
+}
@@ -1,49 +1,66 @@
 package main
 
 import (
+	"context"
 	"database/sql"
 	"errors"
-	"log"
-	"math/rand"
 	"strconv"
-	"time"
 )
 
-const TimeToCompleteWithdrawalSeconds = 15 * 60
-
-func pendingWithdrawalCleanup() {
-	ticker := time.NewTicker(time.Second * 10)
-	for range ticker.C {
-		err := RunSQL(func(sql *sql.Tx) error {
-			row := sql.QueryRow("SELECT withdrawal_code FROM pending_withdrawals WHERE expiry_time < strftime('%s', 'now') LIMIT 1")
+// the pending withdrawal cleanup job, returns how many it expired. at most JobBatchSize per run
+func cleanupPendingWithdrawals() (int64, error) {
+	now := unixNow()
+	var expired int64
+	err := RunSQL(func(sql *sql.Tx) error {
+		rows, err := sql.Query("SELECT withdrawal_code FROM pending_withdrawals WHERE expiry_time < ? LIMIT ?", now, JobBatchSize)
+		if err != nil {
+			return err
+		}
+		codes := make([]int64, 0)
+		for rows.Next() {
 			var withdrawal_code int64
-			err := row.Scan(&withdrawal_code)
+			err = rows.Scan(&withdrawal_code)
 			if err != nil {
-				if err == ErrNoRows {
-					return nil
-				}
+				rows.Close()
 				return err
 			}
-			_, err = sql.Exec(`UPDATE slots SET withdrawal_code = NULL, locked = 0 WHERE withdrawal_code = ?;
-				               DELETE FROM pending_withdrawals WHERE withdrawal_code = ?`, withdrawal_code, withdrawal_code)
+			codes = append(codes, withdrawal_code)
+		}
+		rows.Close()
+		if err = rows.Err(); err != nil {
 			return err
-		})
-		if err != nil {
-			log.Println("Error while cleaning up unfulfilled pending deposits")
-			log.Println(err)
 		}
-	}
+		for _, withdrawal_code := range codes {
+			err = expireWithdrawal(sql, withdrawal_code)
+			if err != nil {
+				return err
+			}
+		}
+		expired = int64(len(codes))
+		// an audit normally forgets these as soon as the item is gone, this is for bots that never audit again
+		_, err = sql.Exec("DELETE FROM withdrawal_drops WHERE confirmed_at < ? - 86400", now)
+		return err
+	})
+	return expired, err
 }
 
-// when a bot receives a message like "2b2tq.org withdrawal #abcd1234" through ANY means (/w or normal chat)
-// it will call this function
-// oh also there should be a public API thing like /withdraw?code=abcd1234 that just hex decodes then calls this
+// give the slot back to its owner and forget about the withdrawal
+func expireWithdrawal(sql *sql.Tx, withdrawal_code int64) error {
+	_, err := sql.Exec(`UPDATE slots SET withdrawal_code = NULL, locked = 0 WHERE withdrawal_code = ?;
+		               DELETE FROM pending_withdrawals WHERE withdrawal_code = ?`, withdrawal_code, withdrawal_code)
+	return err
+}
+
+// when a bot receives a message like "2b2tq.org withdrawal #7K2M-Q9XD-4HBW" through ANY means (/w or normal chat)
+// it will call this function, with the code already through parseWithdrawalCode
+// oh also there should be a public API thing like /withdraw?code=7K2M-Q9XD-4HBW that just parses it then calls this
 // that way you can have an easy button on the site to do it
 // this is the final step in completing a withdrawal (first you get the code and bot XYZ, then you go there and message it the code to make it actually drop)
 func botReceivesWithdrawalCode(code int64) {
+	logger := ordersLog.With("corr", withdrawalCorrelation(code))
 	err := RunSQL(func(sql *sql.Tx) error {
 		// quad table join like a sir *nae nae*
-		row := sql.QueryRow("SELECT slots.user_id, slots.slot_index, pending_withdrawals.item_id, inventory.bot_uuid, inventory.slot_number, listings.item_name, listings.server FROM slots INNER JOIN pending_withdrawals ON pending_withdrawals.withdrawal_code = slots.withdrawal_code INNER JOIN inventory ON inventory.item_id = pending_withdrawals.item_id INNER JOIN listings ON listings.listing_id = inventory.item_id WHERE slots.withdrawal_code = ?", code)
+		row := sql.QueryRow("SELECT slots.user_id, slots.slot_index, pending_withdrawals.item_id, inventory.bot_uuid, inventory.slot_number, listings.item_name, listings.server FROM slots INNER JOIN pending_withdrawals ON pending_withdrawals.withdrawal_code = slots.withdrawal_code INNER JOIN inventory ON inventory.item_id = pending_withdrawals.item_id INNER JOIN listings ON listings.listing_id = inventory.listing_id WHERE slots.withdrawal_code = ?", code)
 		var user_id int64
 		var slot_index int // the slot index that is being withdrawn from (slot on the website)
 		var item_id uint32
@@ -57,6 +74,12 @@ func botReceivesWithdrawalCode(code int64) {
 			return err
 		}
 
+		// the bot only drops it once it sees it's gone from inventory, so until then an audit would find it where it shouldn't be
+		_, err = sql.Exec("INSERT OR REPLACE INTO withdrawal_drops (item_id, listing_id, bot_uuid, confirmed_at) SELECT item_id, listing_id, bot_uuid, ? FROM inventory WHERE item_id = ?", unixNow(), item_id)
+		if err != nil {
+			return err
+		}
+
 		_, err = sql.Exec(`DELETE FROM slots               WHERE withdrawal_code = ?;
 			               DELETE FROM pending_withdrawals WHERE withdrawal_code = ?;
 			               DELETE FROM inventory           WHERE item_id         = ?;`, code, code, item_id)
@@ -70,30 +93,35 @@ func botReceivesWithdrawalCode(code int64) {
 			return err
 		}
 
-		notificationMessage := "Withdrawal code `" + strconv.FormatInt(code, 10) + "` confirmed!\n"
+		logger.Info("Withdrawal confirmed, item will be dropped", "user", user_id, "item", depositIDToName(item_id), "bot", bot_uuid, "slot", slot_number)
+		notificationMessage := "Withdrawal code `" + formatWithdrawalCode(code) + "` confirmed!\n"
 		notificationMessage += "The shulker of `" + item_name + "` on `" + server + "` will be dropped, and has been removed from slot `#" + strconv.Itoa(slot_index) + "` of your exchange account.\n"
 		notificationMessage += "The item name will be `" + depositIDToName(item_id) + "`.\n\n"
 		notificationMessage += "UUID of the bot that has this item in its ender chest is `" + bot_uuid + "`.\n"
+		var status *BotStatus
 		bot := getByUUIDAndServer(bot_uuid, server)
-		if bot == nil || bot.latestStatus == nil || bot.latestStatus.Dimension != 0 || !bot.hasReceivedStatusUpdateInTheLastFiveSeconds() {
+		if bot != nil {
+			status = bot.status()
+		}
+		if !status.isFresh() || status.Dimension != 0 {
 			notificationMessage += "This bot is not currently online and connected to the exchange controller, which is strange because you should not have been able to place this withdrawal in the first place.\n"
 			notificationMessage += "It will drop the item soon as it regains connection.\n"
 		} else {
-			status := bot.latestStatus
 			notificationMessage += "This bot is at (" + strconv.Itoa(int(status.X)) + "," + strconv.Itoa(int(status.Y)) + "," + strconv.Itoa(int(status.Z)) + ") and will drop your item immediately.\n"
 		}
-		go DMuser(user_id, notificationMessage)
+		go DMuserCorr(user_id, withdrawalCorrelation(code), notificationMessage)
 		return nil
 	})
 	if err != nil {
-		log.Println("Unable to complete withdrawal", err)
+		logger.Warn("Unable to complete withdrawal", "err", err)
 	}
 }
 
-func createWithdrawal(user_id int64, slot_index int) (int64, error) {
+func createWithdrawal(ctx context.Context, user_id int64, slot_index int) (int64, error) {
 	var withdrawal_code int64
-	err := RunSQL(func(sql *sql.Tx) error {
-		row := sql.QueryRow("SELECT slots.listing_id, slots.locked, listings.server FROM slots INNER JOIN listings ON listings.listing_id = slots.listing_id WHERE slots.user_id = ? AND slots.slot_index = ? AND slots.locked = 0 AND slots.expiry_time > strftime('%s','now')", user_id, slot_index)
+	err := RunSQLContext(ctx, func(sql *sql.Tx) error {
+		// slots in a retired listing never get force sold, so they stay withdrawable after they expire
+		row := sql.QueryRow("SELECT slots.listing_id, slots.locked, listings.server FROM slots INNER JOIN listings ON listings.listing_id = slots.listing_id WHERE slots.user_id = ? AND slots.slot_index = ? AND slots.locked = 0 AND (slots.expiry_time > ? OR slots.listing_id IN (SELECT listing_id FROM listing_retirements))", user_id, slot_index, unixNow())
 		var listing_id int64
 		var locked int64
 		var server string
@@ -104,24 +132,39 @@ func createWithdrawal(user_id int64, slot_index int) (int64, error) {
 		if locked == 1 {
 			return errors.New("cannot withdraw locked meme")
 		}
+		err = checkNotSuspended(sql, user_id)
+		if err != nil {
+			return err
+		}
+		err = checkNotFrozen(sql, listing_id)
+		if err != nil {
+			return err
+		}
+		err = checkServerEnabled(sql, server)
+		if err != nil {
+			return err
+		}
 		currentlyConnected := getConnectedToServer(server)
 		uuids := make(map[string]bool)
 		for _, bot := range currentlyConnected {
-			if !bot.hasReceivedStatusUpdateInTheLastFiveSeconds() {
+			status := bot.status()
+			if !status.isFresh() {
 				continue
 			}
-			if bot.latestStatus.Dimension != 0 {
+			if status.Dimension != 0 {
 				continue
 			}
-			uuids[bot.latestStatus.BotUUID] = true
+			uuids[status.BotUUID] = true
 		}
 		item_id, err := getMeAWithdrawalOption(sql, listing_id, uuids)
 		if err != nil {
 			return err
 		}
-		r := rand.New(rand.NewSource(time.Now().UnixNano()))
-		withdrawal_code = r.Int63()
-		_, err = sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (?, ?, strftime('%s','now') + ?)", withdrawal_code, item_id, TimeToCompleteWithdrawalSeconds)
+		withdrawal_code, err = newWithdrawalCode(sql)
+		if err != nil {
+			return err
+		}
+		_, err = sql.Exec("INSERT INTO pending_withdrawals (withdrawal_code, item_id, expiry_time) VALUES (?, ?, ?)", withdrawal_code, item_id, unixNow()+config.WithdrawalTimeoutSeconds)
 		if err != nil {
 			return err
 		}
@@ -131,6 +174,9 @@ func createWithdrawal(user_id int64, slot_index int) (int64, error) {
 		}
 		return nil
 	})
+	if err == nil {
+		logFor(ctx, ordersLog).Info("Created withdrawal", "corr", withdrawalCorrelation(withdrawal_code), "user", user_id, "slot", slot_index)
+	}
 	return withdrawal_code, err
 }
 